@@ -0,0 +1,267 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+import "gopkg.in/yaml.v3"
+
+// how long an admin request waits for runTunnels to take it
+const adminTimeout = 5 * time.Second
+
+// largest tunnel definition the admin API reads
+const adminMaxBody = 1 << 20
+
+// adminRequests hands runTunnels the work of the admin API, to be done on
+// its goroutine, where the tunnels and their config are managed.
+var adminRequests = make(chan func(*tunnelSupervisor))
+
+// adminServer changes the tunnels of the config file while they run:
+// GET /tunnels lists their settings, GET, PUT and DELETE /tunnels/<name>
+// read, add or replace, and remove one.
+type adminServer struct {
+	token  []byte
+	config *tunnelConfig
+	// write the changes back to the config file
+	persist bool
+}
+
+// newAdminServer sets up the admin API for the tunnels of config. Requests
+// have to bear the token in the file at tokenFile.
+func newAdminServer(tokenFile string, config *tunnelConfig, persist bool) (*adminServer, error) {
+	if config == nil {
+		return nil, errors.New("-admin manages the tunnels of -config, which is not given")
+	}
+	if tokenFile == "" {
+		return nil, errors.New("-admin requires -admin-token-file")
+	}
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read admin token: %w", err)
+	}
+	token = []byte(strings.TrimSpace(string(token)))
+	if len(token) == 0 {
+		return nil, fmt.Errorf("admin token file %s is empty", tokenFile)
+	}
+	return &adminServer{token: token, config: config, persist: persist}, nil
+}
+
+// serve serves the admin API on addr for as long as the process runs.
+func (a *adminServer) serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(listener, a); err != nil {
+			log.Errorf("admin server stopped: %s", err)
+		}
+	}()
+	log.Infof("serving the admin API on http://%s/tunnels", listener.Addr())
+	return nil
+}
+
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="tcptunnel"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path == "/tunnels" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.do(w, func(*tunnelSupervisor) (int, interface{}) {
+			return http.StatusOK, a.config.file.Tunnels
+		})
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/tunnels/")
+	if name == r.URL.Path || name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		a.do(w, func(*tunnelSupervisor) (int, interface{}) {
+			if i := a.config.file.index(name); i >= 0 {
+				return http.StatusOK, a.config.file.Tunnels[i]
+			}
+			return http.StatusNotFound, "no tunnel " + name
+		})
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(r.Body, adminMaxBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// JSON being YAML, values come out as they would from the file
+		var settings map[string]interface{}
+		if err = yaml.Unmarshal(body, &settings); err != nil || settings == nil {
+			http.Error(w, "expected an object of settings", http.StatusBadRequest)
+			return
+		}
+		settings["name"] = name
+		a.do(w, func(s *tunnelSupervisor) (int, interface{}) {
+			file := a.config.file.clone()
+			status := http.StatusOK
+			if i := file.index(name); i >= 0 {
+				file.Tunnels[i] = settings
+			} else {
+				file.Tunnels = append(file.Tunnels, settings)
+				status = http.StatusCreated
+			}
+			if status, reason := a.change(s, file); reason != "" {
+				return status, reason
+			}
+			log.Infof("tunnel %s put through the admin API", name)
+			return status, settings
+		})
+	case http.MethodDelete:
+		a.do(w, func(s *tunnelSupervisor) (int, interface{}) {
+			file := a.config.file.clone()
+			i := file.index(name)
+			if i < 0 {
+				return http.StatusNotFound, "no tunnel " + name
+			}
+			file.Tunnels = append(file.Tunnels[:i], file.Tunnels[i+1:]...)
+			if status, reason := a.change(s, file); reason != "" {
+				return status, reason
+			}
+			log.Infof("tunnel %s deleted through the admin API", name)
+			return http.StatusNoContent, nil
+		})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// do runs handle on the goroutine of runTunnels and answers with the status
+// and the value, in JSON, it returns. A string value is an error message.
+func (a *adminServer) do(w http.ResponseWriter, handle func(*tunnelSupervisor) (int, interface{})) {
+	var status int
+	var value interface{}
+	done := make(chan struct{})
+	select {
+	case adminRequests <- func(s *tunnelSupervisor) {
+		status, value = handle(s)
+		close(done)
+	}:
+	case <-time.After(adminTimeout):
+		http.Error(w, "tunnels not running", http.StatusServiceUnavailable)
+		return
+	}
+	<-done
+
+	if reason, ok := value.(string); ok {
+		http.Error(w, reason, status)
+		return
+	}
+	if value == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// change puts file in place of the config, reloading the tunnels as SIGHUP
+// would. Returns the status and the reason when file is not taken.
+func (a *adminServer) change(s *tunnelSupervisor, file *configFile) (int, string) {
+	tunnels, err := file.definitions(flag.CommandLine)
+	if err == nil {
+		err = checkComplete(tunnels)
+	}
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	if a.persist {
+		if err = a.config.save(file); err != nil {
+			log.Errorf("could not write the config file: %s", err)
+			return http.StatusInternalServerError, "could not write the config file"
+		}
+	}
+	a.config.file = file
+	s.reload(tunnels)
+	return 0, ""
+}
+
+// index returns the position of the tunnel named name, or -1.
+func (config *configFile) index(name string) int {
+	for i, settings := range config.Tunnels {
+		if n, _ := tunnelName(i, settings); n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// clone copies config so tunnels can be put in and taken out of the copy.
+// The settings of each tunnel are shared, they are replaced, not changed.
+func (config *configFile) clone() *configFile {
+	return &configFile{
+		Defaults: config.Defaults,
+		Tunnels:  append([]map[string]interface{}(nil), config.Tunnels...),
+	}
+}
+
+// save writes file to the path of the config, replacing it at once so a
+// reload never reads half of it. Comments in the file are lost.
+func (c *tunnelConfig) save(file *configFile) error {
+	data, err := yaml.Marshal(file)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(c.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), "."+filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
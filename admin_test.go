@@ -0,0 +1,124 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminServer(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tunnels.yaml")
+	initial := "tunnels:\n  - name: a\n    listen: 127.0.0.1:0\n    target: 127.0.0.1:9\n"
+	if err := os.WriteFile(path, []byte(initial), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := &tunnelConfig{path: path}
+	tunnels, err := config.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := newAdminServer(tokenFile, config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- runTunnels(tunnels, signals, config.load)
+	}()
+	defer func() {
+		signals <- os.Interrupt
+		<-stopped
+	}()
+
+	tests := []struct {
+		method, path, token, body string
+		status                    int
+		// in the answer
+		answer string
+		// the tunnels in the config file afterwards
+		saved []string
+	}{
+		{"GET", "/tunnels", "", "", http.StatusUnauthorized, "", []string{"a"}},
+		{"GET", "/tunnels", "wrong", "", http.StatusUnauthorized, "", []string{"a"}},
+		{"GET", "/tunnels", "s3cret", "", http.StatusOK, `"name":"a"`, []string{"a"}},
+		{"POST", "/tunnels", "s3cret", "", http.StatusMethodNotAllowed, "", []string{"a"}},
+		{"GET", "/tunnels/a", "s3cret", "", http.StatusOK, `"target":"127.0.0.1:9"`, []string{"a"}},
+		{"GET", "/tunnels/b", "s3cret", "", http.StatusNotFound, "no tunnel b", []string{"a"}},
+		{"GET", "/tunnels/a/b", "s3cret", "", http.StatusNotFound, "", []string{"a"}},
+		{"PUT", "/tunnels/b", "s3cret", `{"listen": "127.0.0.1:0", "target": "127.0.0.1:10"}`,
+			http.StatusCreated, `"name":"b"`, []string{"a", "b"}},
+		{"PUT", "/tunnels/b", "s3cret", "listen: 127.0.0.1:0\ntarget: 127.0.0.1:11\n",
+			http.StatusOK, `"target":"127.0.0.1:11"`, []string{"a", "b"}},
+		{"PUT", "/tunnels/c", "s3cret", `{"listen": "127.0.0.1:0"}`,
+			http.StatusBadRequest, "listen and target are required", []string{"a", "b"}},
+		{"PUT", "/tunnels/c", "s3cret", `{"listen": "127.0.0.1:0", "tagret": "127.0.0.1:10"}`,
+			http.StatusBadRequest, `unknown setting "tagret"`, []string{"a", "b"}},
+		{"PUT", "/tunnels/c", "s3cret", `[1, 2]`, http.StatusBadRequest, "expected an object", []string{"a", "b"}},
+		{"DELETE", "/tunnels/a", "s3cret", "", http.StatusNoContent, "", []string{"b"}},
+		{"DELETE", "/tunnels/a", "s3cret", "", http.StatusNotFound, "no tunnel a", []string{"b"}},
+		{"DELETE", "/tunnels/b", "s3cret", "", http.StatusBadRequest, "no tunnels defined", []string{"b"}},
+		{"PATCH", "/tunnels/b", "s3cret", "", http.StatusMethodNotAllowed, "", []string{"b"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.answer) {
+			t.Errorf("%s %s: %d %q, expected %d with %q", tt.method, tt.path, w.Code, w.Body, tt.status, tt.answer)
+		}
+
+		saved, err := readConfig(path)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		var names []string
+		for i, settings := range saved.Tunnels {
+			name, _ := tunnelName(i, settings)
+			names = append(names, name)
+		}
+		if strings.Join(names, ",") != strings.Join(tt.saved, ",") {
+			t.Errorf("%s %s: saved %q, expected %q", tt.method, tt.path, names, tt.saved)
+		}
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0o640 {
+		t.Errorf("config file mode changed to %v", info.Mode().Perm())
+	}
+
+	// the tunnels run as changed
+	names := make(chan string)
+	adminRequests <- func(s *tunnelSupervisor) {
+		running, _ := runningNames(s)
+		names <- running
+	}
+	if running := <-names; running != "b" {
+		t.Errorf("running %q, expected \"b\"", running)
+	}
+}
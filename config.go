@@ -0,0 +1,226 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import "gopkg.in/yaml.v3"
+
+// configFile is the layout of a -config file. Tunnel settings use the flag
+// names as keys, e.g.
+//
+//	defaults:
+//	  proxy: socks5://127.0.0.1:1080/
+//	  timeout: 5
+//	tunnels:
+//	  - name: ssh
+//	    listen: :2222
+//	    target: 10.0.0.2:22
+//	  - listen: :8080
+//	    target: 10.0.0.3:80
+//	    proxy: ""
+type configFile struct {
+	// settings of every tunnel, unless it overrides them
+	Defaults map[string]interface{}   `yaml:"defaults"`
+	Tunnels  []map[string]interface{} `yaml:"tunnels"`
+}
+
+// tunnelDefinition is a tunnel to run, along with where its settings came from.
+type tunnelDefinition struct {
+	name    string
+	options *options
+	flags   *flag.FlagSet
+	// "flag" or "config" for each setting that isn't left at its default
+	origins map[string]string
+}
+
+// commandLineTunnel is the single tunnel configured by the command line flags.
+func commandLineTunnel() *tunnelDefinition {
+	t := &tunnelDefinition{options: &cliOptions, flags: flag.CommandLine, origins: make(map[string]string)}
+	flag.Visit(func(f *flag.Flag) {
+		t.origins[f.Name] = "flag"
+	})
+	return t
+}
+
+// readConfig parses the config file at path.
+func readConfig(path string) (*configFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config configFile
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// tunnelName is the name of the tunnel with settings at index i of the
+// file: the one it is given, or else its position counting from 1.
+func tunnelName(i int, settings map[string]interface{}) (string, error) {
+	value, ok := settings["name"]
+	if !ok {
+		return strconv.Itoa(i + 1), nil
+	}
+	if name, ok := value.(string); ok && name != "" {
+		return name, nil
+	}
+	return "", fmt.Errorf("tunnel %d: invalid name", i+1)
+}
+
+// definitions returns the tunnels of config, on top of the settings given
+// by the flags of base.
+func (config *configFile) definitions(base *flag.FlagSet) ([]*tunnelDefinition, error) {
+	if len(config.Tunnels) == 0 {
+		return nil, errors.New("no tunnels defined")
+	}
+
+	tunnels := make([]*tunnelDefinition, 0, len(config.Tunnels))
+	for i, settings := range config.Tunnels {
+		name, err := tunnelName(i, settings)
+		if err != nil {
+			return nil, err
+		}
+
+		t := &tunnelDefinition{
+			name:    name,
+			options: &options{},
+			flags:   flag.NewFlagSet(name, flag.ContinueOnError),
+			origins: make(map[string]string),
+		}
+		t.options.register(t.flags)
+		base.Visit(func(f *flag.Flag) {
+			if t.flags.Lookup(f.Name) != nil && t.flags.Set(f.Name, f.Value.String()) == nil {
+				t.origins[f.Name] = "flag"
+			}
+		})
+		if err = t.apply(config.Defaults); err != nil {
+			return nil, fmt.Errorf("defaults: %w", err)
+		}
+		if err = t.apply(settings); err != nil {
+			return nil, fmt.Errorf("tunnel %s: %w", name, err)
+		}
+		tunnels = append(tunnels, t)
+	}
+	return tunnels, nil
+}
+
+// tunnelConfig is the config file the tunnels run from, as last read or
+// changed through the admin API. Once they run, only runTunnels uses it.
+type tunnelConfig struct {
+	path string
+	file *configFile
+}
+
+// load reads the file again and returns its tunnels, on top of the command
+// line flags, checking that every one of them is complete.
+func (c *tunnelConfig) load() ([]*tunnelDefinition, error) {
+	file, err := readConfig(c.path)
+	var tunnels []*tunnelDefinition
+	if err == nil {
+		tunnels, err = file.definitions(flag.CommandLine)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load %s: %w", c.path, err)
+	}
+	if err = checkComplete(tunnels); err != nil {
+		return nil, err
+	}
+	c.file = file
+	return tunnels, nil
+}
+
+// checkComplete tells the first of tunnels missing what it needs to run.
+func checkComplete(tunnels []*tunnelDefinition) error {
+	for _, t := range tunnels {
+		if !t.options.complete() {
+			return fmt.Errorf("tunnel %s: listen and target are required", t.name)
+		}
+	}
+	return nil
+}
+
+// apply sets the flags named by the keys of settings.
+func (t *tunnelDefinition) apply(settings map[string]interface{}) error {
+	// in a stable order, so the same error shows up every time
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == "name" {
+			continue
+		}
+		if t.flags.Lookup(key) == nil {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		value, err := configValue(settings[key])
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if err = t.flags.Set(key, value); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		t.origins[key] = "config"
+	}
+	return nil
+}
+
+// configValue turns a YAML value into what the flag would be given on the
+// command line. Lists are joined with commas, as for -proxy.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			if _, ok := item.([]interface{}); ok {
+				return "", errors.New("nested lists are not supported")
+			}
+			part, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// complete reports whether the tunnel has what it needs to run.
+func (o *options) complete() bool {
+	return o.listenAddr != "" && (o.targetAddr != "" || o.sniTarget != "" || o.headerTarget || o.proxyServer != "" || o.transparentListen)
+}
@@ -0,0 +1,225 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+import "gopkg.in/yaml.v3"
+
+func TestConfigValue(t *testing.T) {
+	tests := []struct {
+		yaml  string
+		value string
+		ok    bool
+	}{
+		{"~", "", true},
+		{"socks5://gw:1080", "socks5://gw:1080", true},
+		{`""`, "", true},
+		{"true", "true", true},
+		{"5", "5", true},
+		{"0.5", "0.5", true},
+		{"[a:1, b:2]", "a:1,b:2", true},
+		{"[a:1, 5, true]", "a:1,5,true", true},
+		{"[]", "", true},
+		{"[[a:1]]", "", false},
+		{"{a: 1}", "", false},
+	}
+	for _, tt := range tests {
+		var v interface{}
+		if err := yaml.Unmarshal([]byte(tt.yaml), &v); err != nil {
+			t.Fatal(err)
+		}
+		value, err := configValue(v)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s as %q, expected an error", tt.yaml, value)
+			}
+			continue
+		}
+		if err != nil || value != tt.value {
+			t.Errorf("%s as %q, %v, expected %q", tt.yaml, value, err, tt.value)
+		}
+	}
+}
+
+func TestConfigDefinitions(t *testing.T) {
+	// the value of a flag of a tunnel, and where it came from: "" when left at its default
+	type setting struct {
+		tunnel, flag, value, origin string
+	}
+	tests := []struct {
+		name   string
+		config string
+		// flags given on the command line
+		flags map[string]string
+		// names of the tunnels, nil for an error
+		tunnels  []string
+		settings []setting
+	}{
+		{"names", `
+tunnels:
+  - name: ssh
+    listen: :2222
+    target: 10.0.0.2:22
+  - listen: :8080
+    target: 10.0.0.3:80
+`, nil, []string{"ssh", "2"}, []setting{
+			{"ssh", "listen", ":2222", "config"},
+			{"2", "target", "10.0.0.3:80", "config"},
+			{"2", "proxy", "", ""},
+		}},
+		{"defaults", `
+defaults:
+  proxy: socks5://127.0.0.1:1080/
+  timeout: 5
+tunnels:
+  - name: a
+    listen: :1
+    target: b:1
+  - name: b
+    listen: :2
+    target: b:2
+    proxy: ""
+`, nil, []string{"a", "b"}, []setting{
+			{"a", "proxy", "socks5://127.0.0.1:1080/", "config"},
+			{"a", "timeout", "5", "config"},
+			{"b", "proxy", "", "config"},
+			{"b", "timeout", "5", "config"},
+		}},
+		{"command line under the file", `
+defaults:
+  timeout: 5
+tunnels:
+  - name: a
+    listen: :1
+    target: b:1
+`, map[string]string{"timeout": "7", "max-conns": "3"}, []string{"a"}, []setting{
+			{"a", "timeout", "5", "config"},
+			{"a", "max-conns", "3", "flag"},
+		}},
+		{"list", `
+tunnels:
+  - listen: :1
+    target: [b:1, c:1]
+`, nil, []string{"1"}, []setting{{"1", "target", "b:1,c:1", "config"}}},
+		{"no tunnels", "defaults:\n  timeout: 5\n", nil, nil, nil},
+		{"unknown setting", "tunnels:\n  - listen: :1\n    tagret: b:1\n", nil, nil, nil},
+		{"unknown default", "defaults:\n  tagret: b:1\ntunnels:\n  - listen: :1\n", nil, nil, nil},
+		{"invalid name", "tunnels:\n  - name: 5\n    listen: :1\n", nil, nil, nil},
+		{"invalid value", "tunnels:\n  - listen: :1\n    timeout: soon\n", nil, nil, nil},
+		{"nested list", "tunnels:\n  - listen: :1\n    target: [[b:1]]\n", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		var config configFile
+		if err := yaml.Unmarshal([]byte(tt.config), &config); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		base := flag.NewFlagSet("base", flag.ContinueOnError)
+		(&options{}).register(base)
+		for name, value := range tt.flags {
+			if err := base.Set(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tunnels, err := config.definitions(base)
+		if tt.tunnels == nil {
+			if err == nil {
+				t.Errorf("%s: got %d tunnels, expected an error", tt.name, len(tunnels))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		byName := make(map[string]*tunnelDefinition)
+		var names []string
+		for _, def := range tunnels {
+			names = append(names, def.name)
+			byName[def.name] = def
+		}
+		if strings.Join(names, ",") != strings.Join(tt.tunnels, ",") {
+			t.Errorf("%s: tunnels %q, expected %q", tt.name, names, tt.tunnels)
+			continue
+		}
+		for _, s := range tt.settings {
+			def := byName[s.tunnel]
+			if value := def.flags.Lookup(s.flag).Value.String(); value != s.value {
+				t.Errorf("%s: tunnel %s has %s=%q, expected %q", tt.name, s.tunnel, s.flag, value, s.value)
+			}
+			if origin := def.origins[s.flag]; origin != s.origin {
+				t.Errorf("%s: tunnel %s has %s from %q, expected %q", tt.name, s.tunnel, s.flag, origin, s.origin)
+			}
+		}
+	}
+}
+
+func TestTunnelConfigLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnels.yaml")
+	config := &tunnelConfig{path: path}
+	tests := []struct {
+		name   string
+		config string
+		// names of the tunnels loaded, nil for an error
+		tunnels []string
+	}{
+		{"valid", "tunnels:\n  - name: a\n    listen: :1\n    target: b:1\n", []string{"a"}},
+		{"replaced", "tunnels:\n  - name: a\n    listen: :1\n    target: b:1\n  - name: c\n    listen: :2\n    target: b:2\n", []string{"a", "c"}},
+		{"unknown key", "tunnels:\n  - name: a\n    listen: :1\n    target: b:1\nextra: 1\n", nil},
+		{"incomplete", "tunnels:\n  - name: a\n    listen: :1\n", nil},
+		{"not YAML", "tunnels: [", nil},
+		{"removed", "", nil},
+	}
+	var loaded *configFile
+	for _, tt := range tests {
+		if tt.name == "removed" {
+			os.Remove(path)
+		} else if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		tunnels, err := config.load()
+		if tt.tunnels == nil {
+			if err == nil {
+				t.Errorf("%s: loaded %d tunnels, expected an error", tt.name, len(tunnels))
+			}
+			// the config in use stays
+			if config.file != loaded {
+				t.Errorf("%s: config replaced by one failing to load", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var names []string
+		for _, def := range tunnels {
+			names = append(names, def.name)
+		}
+		if strings.Join(names, ",") != strings.Join(tt.tunnels, ",") {
+			t.Errorf("%s: tunnels %q, expected %q", tt.name, names, tt.tunnels)
+		}
+		if config.file == nil || len(config.file.Tunnels) != len(tt.tunnels) {
+			t.Errorf("%s: config file not kept", tt.name)
+		}
+		loaded = config.file
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+import "tcptunnel/tunnel"
+
+// redactedFlags lists flags whose values may carry credentials, along with
+// how to redact them.
+var redactedFlags = map[string]func(string) string{
+	"proxy":       tunnel.RedactProxyList,
+	"listen":      redactURLs,
+	"target":      redactURLs,
+	"pac":         redactURLs,
+	"proxy-rules": redactProxyRules,
+	"dns":         redactURLs,
+	"usage-post":  redactURLs,
+}
+
+// environment lists the variables read besides the flags, and whether their
+// values are secret.
+var environment = []struct {
+	name   string
+	secret bool
+}{
+	{"TCPTUNNEL_PROXY_USER", false},
+	{"TCPTUNNEL_PROXY_PASS", true},
+	{"SSLKEYLOGFILE", false},
+	{"SSH_AUTH_SOCK", false},
+	{"CONSUL_HTTP_ADDR", false},
+	{"CONSUL_HTTP_TOKEN", true},
+	{"KUBECONFIG", false},
+	{"KUBERNETES_SERVICE_HOST", false},
+	{"KUBERNETES_SERVICE_PORT", false},
+}
+
+// flags defaulting to an environment variable
+var flagEnvironment = map[string]string{
+	"ssl-keylog": "SSLKEYLOGFILE",
+}
+
+// redactURLs redacts the passwords, query values and relay tokens of the
+// URLs in a comma separated list, leaving anything else as it is.
+func redactURLs(list string) string {
+	items := strings.Split(list, ",")
+	for i, item := range items {
+		if !strings.Contains(item, "://") {
+			continue
+		}
+		u, err := url.Parse(strings.TrimSpace(item))
+		if err != nil {
+			items[i] = "<invalid>"
+			continue
+		}
+		if u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "xxxxx")
+			} else {
+				// a user without a password is often a token
+				u.User = url.User("xxxxx")
+			}
+		}
+		if u.RawQuery != "" {
+			query := u.Query()
+			for key := range query {
+				query.Set(key, "xxxxx")
+			}
+			u.RawQuery = query.Encode()
+		}
+		if tunnel.IsRelayURL(item) && u.Path != "" {
+			u.Path = "/xxxxx"
+		}
+		items[i] = u.String()
+	}
+	return strings.Join(items, ",")
+}
+
+// redactProxyRules redacts the proxy URLs of -proxy-rules.
+func redactProxyRules(list string) string {
+	rules := strings.Split(list, ",")
+	for i, rule := range rules {
+		if match, proxy, ok := strings.Cut(rule, "="); ok {
+			rules[i] = match + "=" + redactURLs(proxy)
+		}
+	}
+	return strings.Join(rules, ",")
+}
+
+// tunnelFlags holds the flags configuring a single tunnel, as opposed to the
+// global ones.
+var tunnelFlags = func() *flag.FlagSet {
+	fs := flag.NewFlagSet("tunnel", flag.ContinueOnError)
+	(&options{}).register(fs)
+	return fs
+}()
+
+// printGlobalConfig writes the settings shared by all tunnels and the
+// environment variables in effect, marking where each one comes from.
+func printGlobalConfig(w io.Writer) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	fmt.Fprintln(w, "# global")
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "dry-run" || f.Name == "help" || tunnelFlags.Lookup(f.Name) != nil {
+			return
+		}
+		origin := "default"
+		if set[f.Name] {
+			origin = "flag"
+		}
+		fmt.Fprintf(w, "%s = %q # %s\n", f.Name, f.Value.String(), origin)
+	})
+	for _, env := range environment {
+		value, ok := os.LookupEnv(env.name)
+		if !ok {
+			continue
+		}
+		if env.secret && value != "" {
+			value = "xxxxx"
+		}
+		fmt.Fprintf(w, "$%s = %q # env\n", env.name, value)
+	}
+}
+
+// printEffectiveConfig writes every setting the tunnel would run with, marking
+// where each one comes from, followed by the resulting port mappings.
+func printEffectiveConfig(w io.Writer, t *tunnelDefinition) error {
+	t.flags.VisitAll(func(f *flag.Flag) {
+		if tunnelFlags.Lookup(f.Name) == nil {
+			return
+		}
+		value := f.Value.String()
+		if redact, ok := redactedFlags[f.Name]; ok && value != "" {
+			value = redact(value)
+		}
+		origin, ok := t.origins[f.Name]
+		if !ok {
+			origin = "default"
+			if env := flagEnvironment[f.Name]; env != "" && value != "" && value == os.Getenv(env) {
+				origin = "env $" + env
+			}
+		}
+		fmt.Fprintf(w, "%s = %q # %s\n", f.Name, value, origin)
+	})
+
+	o := t.options
+	if tunnel.IsRelayURL(o.listenAddr) || o.sniTarget != "" || o.headerTarget {
+		return nil
+	}
+	target := o.targetAddr
+	if tunnel.IsRelayURL(target) {
+		target = "relay"
+	}
+	mappings, err := tunnel.ExpandPortMapping(o.listenAddr, target)
+	if err != nil {
+		return configError(fmt.Errorf("invalid port mapping: %w", err))
+	}
+	fmt.Fprintln(w)
+	for _, m := range mappings {
+		fmt.Fprintf(w, "# %s -> %s\n", m.Listen, m.Target)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"tcptunnel/tunnel"
+)
+
+// Exit codes, so supervisors and scripts can tell failure modes apart.
+const (
+	// stopped on signal after all connections drained
+	exitOK = 0
+	// unexpected error while running
+	exitRuntime = 1
+	// invalid flags or configuration (same as the flag package uses)
+	exitConfig = 2
+	// a listening socket could not be opened
+	exitBind = 3
+	// something required to start serving could not be set up
+	exitPreflight = 4
+	// stopped on signal, but connections had to be cut forcefully
+	exitDrainTimeout = 5
+)
+
+var exitCodes = map[tunnel.Class]int{
+	tunnel.ClassRuntime:   exitRuntime,
+	tunnel.ClassConfig:    exitConfig,
+	tunnel.ClassBind:      exitBind,
+	tunnel.ClassPreflight: exitPreflight,
+	tunnel.ClassDrain:     exitDrainTimeout,
+}
+
+func configError(err error) error {
+	return &tunnel.Error{Class: tunnel.ClassConfig, Err: err}
+}
+
+func bindError(err error) error {
+	return &tunnel.Error{Class: tunnel.ClassBind, Err: err}
+}
+
+func runtimeError(err error) error {
+	return &tunnel.Error{Class: tunnel.ClassRuntime, Err: err}
+}
+
+// exit logs a final summary of err and exits with the matching code.
+func exit(err error) {
+	if err == nil {
+		log.WithField("exit_code", exitOK).Infof("exiting")
+		os.Exit(exitOK)
+	}
+
+	class := tunnel.ClassRuntime
+	var e *tunnel.Error
+	if errors.As(err, &e) {
+		class = e.Class
+	}
+	code, ok := exitCodes[class]
+	if !ok {
+		code = exitRuntime
+	}
+	log.WithFields(logrus.Fields{
+		"exit_code": code,
+		"class":     class,
+	}).Errorf("exiting on error: %s", err)
+	os.Exit(code)
+}
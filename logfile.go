@@ -0,0 +1,157 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import "github.com/sirupsen/logrus"
+
+// rotated log files are named after the log file, suffixed with this
+const logBackupLayout = "2006-01-02T15-04-05.000"
+
+var (
+	logFormat     string
+	logFile       string
+	logMaxSize    sizeValue = 100e6
+	logMaxAge     time.Duration
+	logMaxBackups int
+)
+
+// setupLogging applies -log-format, -log-file and -log-output to log.
+func setupLogging() error {
+	switch logFormat {
+	case "text":
+	case "json":
+		log.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q (text or json)", logFormat)
+	}
+	if logFile != "" && logOutput != "stderr" {
+		return fmt.Errorf("-log-file can't be combined with -log-output %s", logOutput)
+	}
+	if logFile != "" {
+		file, err := openLogFile(logFile, int64(logMaxSize), logMaxAge, logMaxBackups)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(file)
+	}
+	return setupLogOutput()
+}
+
+// rotatingFile is a log file that is moved aside and started over once it
+// grows beyond maxSize bytes or has been written to for longer than maxAge,
+// keeping the newest backups of the files moved aside.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	backups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openLogFile(path string, maxSize int64, maxAge time.Duration, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	full := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	old := f.maxAge > 0 && time.Since(f.opened) >= f.maxAge
+	if full || old {
+		if err := f.rotate(); err != nil {
+			// keep logging to the file we have rather than losing the entry
+			fmt.Fprintf(os.Stderr, "could not rotate log file %s: %s\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the log file aside, starts a new one and prunes the backups.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	backup := f.path + "." + time.Now().Format(logBackupLayout)
+	renameErr := os.Rename(f.path, backup)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	if f.backups > 0 {
+		f.prune()
+	}
+	return nil
+}
+
+// prune removes the oldest backups beyond the ones to keep.
+func (f *rotatingFile) prune() {
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, f.path+".")
+		if _, err := time.Parse(logBackupLayout, suffix); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// the timestamps sort chronologically
+	sort.Strings(backups)
+	for len(backups) > f.backups {
+		if err := os.Remove(backups[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "could not remove old log file %s: %s\n", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import "github.com/sirupsen/logrus"
+
+const (
+	defaultSyslogPort = "514"
+	journaldSocket    = "/run/systemd/journal/socket"
+	// facility the syslog messages are sent with
+	syslogDaemon = 3
+	// private enterprise number of the example SD-ID in RFC 5424
+	syslogEnterprise = 32473
+)
+
+var logOutput string
+
+// setupLogOutput sends the log to -log-output instead of stderr.
+func setupLogOutput() error {
+	var hook logrus.Hook
+	var err error
+	switch {
+	case logOutput == "stderr":
+		return nil
+	case logOutput == "journald":
+		hook, err = newJournaldHook(journaldSocket)
+	case strings.HasPrefix(logOutput, "syslog://"), strings.HasPrefix(logOutput, "syslog+tcp://"):
+		hook, err = newSyslogHook(logOutput)
+	default:
+		return fmt.Errorf("unknown log output %q (stderr, syslog://<host>[:<port>], syslog+tcp://<host>[:<port>] or journald)", logOutput)
+	}
+	if err != nil {
+		return err
+	}
+	log.AddHook(hook)
+	log.SetOutput(io.Discard)
+	return nil
+}
+
+// syslogSeverity maps the logrus levels to syslog severities.
+func syslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// sortedFields returns the keys of fields in order, so messages are stable.
+func sortedFields(fields logrus.Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// syslogHook sends log entries to a syslog server as RFC 5424 messages, over
+// UDP or, for syslog+tcp://, over TCP with octet counting framing.
+type syslogHook struct {
+	network  string
+	addr     string
+	hostname string
+	app      string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newSyslogHook(rawURL string) (*syslogHook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultSyslogPort)
+	}
+	h := &syslogHook{network: "udp", addr: addr, app: filepath.Base(os.Args[0])}
+	if u.Scheme == "syslog+tcp" {
+		h.network = "tcp"
+	}
+	if h.hostname, err = os.Hostname(); err != nil {
+		h.hostname = "-"
+	}
+	if h.conn, err = net.Dial(h.network, h.addr); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	msg := h.format(entry)
+	if h.network == "tcp" {
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn == nil {
+		conn, err := net.Dial(h.network, h.addr)
+		if err != nil {
+			return err
+		}
+		h.conn = conn
+	}
+	if _, err := h.conn.Write(msg); err != nil {
+		// dialed again for the next entry
+		h.conn.Close()
+		h.conn = nil
+		return err
+	}
+	return nil
+}
+
+// format renders entry as an RFC 5424 message, its fields as structured data.
+func (h *syslogHook) format(entry *logrus.Entry) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - ",
+		syslogDaemon*8+syslogSeverity(entry.Level),
+		entry.Time.Format(time.RFC3339Nano), h.hostname, h.app, os.Getpid())
+	if len(entry.Data) == 0 {
+		b.WriteString("-")
+	} else {
+		fmt.Fprintf(&b, "[fields@%d", syslogEnterprise)
+		for _, key := range sortedFields(entry.Data) {
+			value := fmt.Sprint(entry.Data[key])
+			value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+			fmt.Fprintf(&b, ` %s="%s"`, syslogParamName(key), value)
+		}
+		b.WriteString("]")
+	}
+	b.WriteString(" ")
+	b.WriteString(entry.Message)
+	return b.Bytes()
+}
+
+// syslogParamName replaces the characters RFC 5424 doesn't allow in names
+// of structured data parameters.
+func syslogParamName(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// journaldHook sends log entries to journald over its native protocol, the
+// fields of an entry becoming journal fields.
+type journaldHook struct {
+	conn net.Conn
+	app  string
+}
+
+func newJournaldHook(socket string) (*journaldHook, error) {
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, err
+	}
+	return &journaldHook{conn: conn, app: filepath.Base(os.Args[0])}, nil
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	var b bytes.Buffer
+	journaldField(&b, "MESSAGE", entry.Message)
+	journaldField(&b, "PRIORITY", fmt.Sprint(syslogSeverity(entry.Level)))
+	journaldField(&b, "SYSLOG_IDENTIFIER", h.app)
+	for _, key := range sortedFields(entry.Data) {
+		journaldField(&b, journaldFieldName(key), fmt.Sprint(entry.Data[key]))
+	}
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+// journaldField appends a field, in the binary form when value spans lines.
+func journaldField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteString("=")
+		b.WriteString(value)
+		b.WriteString("\n")
+		return
+	}
+	b.WriteString("\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteString("\n")
+}
+
+// journaldFieldName turns key into a valid journal field name: upper case
+// letters, digits and underscores, not starting with an underscore.
+func journaldFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "F_" + name
+	}
+	return name
+}
@@ -15,36 +15,343 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
-import "github.com/sirupsen/logrus"
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"tcptunnel/tunnel"
+)
 
 var (
+	showHelp   bool
+	dryRun     bool
+	debugLog   bool
+	configPath string
+	// serves the metrics of all the tunnels when set
+	metricsAddr string
+	// serves the snapshot of the running tunnels on /stats of metricsAddr too
+	metricsStats bool
+	// StatsD server the metrics are sent to when set
+	statsdAddr     string
+	statsdInterval time.Duration
+	// serves the admin API changing the tunnels of the config file when set
+	adminAddr      string
+	adminTokenFile string
+	adminPersist   bool
+	// the tunnel configured on the command line, and the defaults of the
+	// ones defined in a config file
+	cliOptions options
+)
+
+// options holds the flags configuring a single tunnel.
+type options struct {
 	listenAddr        string
 	targetAddr        string
 	proxyAddr         string
+	proxyRules        string
+	portFile          string
+	printPort         bool
+	listenNetns       string
+	dialNetns         string
+	ftpMode           bool
+	fragRecordSize    int
+	fragSegmentSize   int
+	fragDelay         time.Duration
+	agentAddr         string
+	agentCapacity     int
+	dnsListen         string
+	dnsResolver       string
+	firewall          string
+	usageFile         string
+	usageFormat       string
+	usagePost         string
+	usageInterval     time.Duration
+	usageKey          string
+	accessLog         string
+	socksBind         bool
+	proxyCA           string
+	proxySNI          string
+	sslKeyLog         string
+	proxyCooldown     time.Duration
+	onOpenHook        string
+	onCloseHook       string
+	onBindHook        string
+	hookConcurrency   int
+	hookTimeout       time.Duration
+	acceptRate        rateValue
+	identityMaxConns  int
+	identityRate      rateValue
+	identityLimits    identityLimitsValue
+	acceptBurst       int
+	backlog           int
+	listenBPF         string
+	acceptFilter      string
+	acceptQueue       int
+	acceptOverflow    string
+	closeOnShutdown   string
+	closeOnLimit      string
+	closeOnDeny       string
+	sniTarget         string
+	headerTarget      bool
+	headerAllow       string
+	sniAllow          string
 	dialTimeout       int
+	fallbackDelay     time.Duration
+	dnsCache          bool
+	resolveOnce       bool
+	dns               string
+	maxConns          int
+	maxConnsWait      time.Duration
+	maxConnsReserved  int
+	maxConnsPriority  string
+	maxConnsPerIP     int
+	banAfter          int
+	banWindow         time.Duration
+	banFor            time.Duration
+	banAdmin          string
+	banState          string
+	maxConnsPerIPWait time.Duration
+	maxSession        time.Duration
+	maxBytes          sizeValue
+	rateLimit         bandwidthValue
+	rateLimitPerConn  bandwidthValue
+	allow             string
+	deny              string
+	geoDB             string
+	geoAllow          string
+	geoBlock          string
+	geoAllowASN       string
+	geoBlockASN       string
+	geoReload         time.Duration
+	proxyResolve      string
 	keepAliveInterval int
-	showHelp          bool
-	debugLog          bool
-)
+	keepAliveIdle     time.Duration
+	keepAliveProbes   time.Duration
+	keepAliveCount    int
+	mss               int
+	transparent       bool
+	stallRead         time.Duration
+	stallWrite        time.Duration
+	udpTimeout        time.Duration
+	unixMode          string
+	tlsCert           string
+	tlsKey            string
+	tlsMinVersion     string
+	tlsClientCA       string
+	tlsReload         time.Duration
+	tlsTicketRotate   time.Duration
+	tlsTicketKeys     string
+	targetTLS         bool
+	targetCA          string
+	targetCert        string
+	targetKey         string
+	targetSNI         string
+	frontDomain       string
+	targetInsecure    bool
+	tlsFingerprint    string
+	sshKey            string
+	sshKnownHosts     string
+	pac               string
+	proxyCredFile     string
+	proxyProbe        time.Duration
+	proxyProbeTarget  string
+	proxyServer       string
+	transparentListen bool
+	proxyProtocolOut  string
+	proxyProtocolIn   bool
+	proxyTrusted      string
+	peerKeyIn         string
+	peerKeyOut        string
+	peerEncrypt       bool
+	peerCompress      string
+	peerObfuscate     time.Duration
+	balance           string
+	ejectAfter        int
+	ejectFor          time.Duration
+	healthInterval    time.Duration
+	healthTimeout     time.Duration
+	healthThreshold   int
+	healthSend        string
+	healthExpect      string
+	proxyServerAuth   string
+	proxyServerAllow  string
+}
 
 // Create a new instance of the logger. You can have any number of instances.
 var log = logrus.New()
 
 func init() {
+	tunnel.SetLogger(log)
 	flag.BoolVar(&showHelp, "help", false, "show usage")
 	flag.BoolVar(&debugLog, "debug", false, "more verbose logging")
-	flag.StringVar(&listenAddr, "listen", "", "listening address (<host>:<port>)")
-	flag.StringVar(&targetAddr, "target", "", "remote target (<host>:<port>)")
-	flag.StringVar(&proxyAddr, "proxy", "", "proxy address (<proto>://[user[:password]@]<host>:<port>/)")
-	flag.IntVar(&dialTimeout, "timeout", 10, "dial timeout")
-	flag.IntVar(&keepAliveInterval, "keepalive", 30, "keep-alive interval")
+	flag.BoolVar(&dryRun, "dry-run", false, "print the effective configuration and exit")
+	flag.StringVar(&logFormat, "log-format", "text", "log format, text or json")
+	flag.StringVar(&logFile, "log-file", "", "append the log to this file instead of writing it to stderr")
+	flag.StringVar(&logOutput, "log-output", "stderr", "where the log goes: stderr, syslog://<host>[:<port>] (UDP), syslog+tcp://<host>[:<port>] as RFC 5424 messages, or journald")
+	flag.Var(&logMaxSize, "log-max-size", "rotate -log-file once it would grow beyond this size, with a unit as in 100M (0 disables it)")
+	flag.DurationVar(&logMaxAge, "log-max-age", 0, "rotate -log-file once it has been written to for this long (0 disables it)")
+	flag.IntVar(&logMaxBackups, "log-backups", 5, "rotated log files to keep (0 keeps all of them)")
+	flag.StringVar(&configPath, "config", "", "YAML file defining tunnels, flags given on the command line are their defaults")
+	flag.StringVar(&metricsAddr, "metrics", "", "serve Prometheus metrics of all tunnels on this address under /metrics, labeled with the tunnel name or listening address")
+	flag.BoolVar(&metricsStats, "metrics-stats", false, "serve a snapshot of the running tunnels and their connections, client addresses included, under /stats of -metrics")
+	flag.StringVar(&statsdAddr, "statsd", "", "send the connection and byte metrics of all tunnels to this StatsD server (<host>:<port>), with DogStatsD tags")
+	flag.DurationVar(&statsdInterval, "statsd-interval", tunnel.DefaultStatsDInterval, "how often the metrics are sent to -statsd")
+	flag.StringVar(&adminAddr, "admin", "", "serve an HTTP API adding, changing and removing the tunnels of -config on this address")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "file with the bearer token requests to -admin have to carry")
+	flag.BoolVar(&adminPersist, "admin-persist", false, "write the changes made through -admin back to the -config file")
+	cliOptions.register(flag.CommandLine)
+}
+
+// register defines the flags of a tunnel on fs.
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.listenAddr, "listen", "", "listening address (<host>:<port>, <host>:<first>-<last>, relay://<host>:<port>/<token>, udp://<host>:<port>, unix://<path>, ws[s]://<host>:<port>/<path> or mux://<host>:<port>)")
+	fs.StringVar(&o.targetAddr, "target", "", "remote target (<host>:<port>, relay://<host>:<port>/<token>, udp://<host>:<port>, unix://<path>, ws[s]://<host>:<port>/<path> or mux://<host>:<port>) or a comma separated list of <host>:<port>[=<weight>] to balance across, consul://<service> for its passing instances or k8s://<namespace>/<service>:<port> for its ready endpoints, with a listening port range also <host>:<first>-<last> or a template using %port and %index")
+	fs.StringVar(&o.proxyAddr, "proxy", "", "proxy address (<proto>://[user[:password]@]<host>:<port>/), a comma separated list fails over in order")
+	fs.StringVar(&o.proxyCredFile, "proxy-cred-file", "", "file with user:password for proxies whose URL has no credentials (overrides $TCPTUNNEL_PROXY_USER and $TCPTUNNEL_PROXY_PASS)")
+	fs.StringVar(&o.proxyProtocolOut, "proxy-protocol-out", "", "send the client's address to the target in a PROXY protocol header (v1 or v2)")
+	fs.StringVar(&o.balance, "balance", tunnel.BalanceRoundRobin, "how connections are distributed across a target list: round-robin, least-conn, random or weighted")
+	fs.IntVar(&o.ejectAfter, "eject-after", 3, "consecutive failed connections to a target of a list to stop using it for -eject-for (0 disables)")
+	fs.DurationVar(&o.ejectFor, "eject-for", 30*time.Second, "how long a target of a list is not used after failing")
+	fs.DurationVar(&o.healthInterval, "health-interval", 0, "how often to check the health of the targets in a list (disabled by default)")
+	fs.DurationVar(&o.healthTimeout, "health-timeout", 2*time.Second, "how long a health check may take")
+	fs.IntVar(&o.healthThreshold, "health-threshold", 2, "consecutive failed (passed) health checks to stop (resume) using a target")
+	fs.StringVar(&o.healthSend, "health-send", "", "payload sent in health checks, with escapes such as \\r\\n")
+	fs.StringVar(&o.healthExpect, "health-expect", "", "payload a health check has to read back to pass, instead of just connecting")
+	fs.BoolVar(&o.proxyProtocolIn, "proxy-protocol-in", false, "take the client's address from the PROXY protocol header (v1 or v2) a load balancer sends first")
+	fs.StringVar(&o.proxyTrusted, "proxy-protocol-trusted", "", "comma separated CIDRs of the load balancers allowed to connect with -proxy-protocol-in")
+	fs.StringVar(&o.peerKeyIn, "peer-key-in", "", "file with the secret peer instances dialing the listener have to authenticate with before anything is relayed")
+	fs.BoolVar(&o.peerEncrypt, "peer-encrypt", false, "encrypt the stream between peers with AES-GCM under keys derived from the -peer-key-in or -peer-key-out secret (used when either peer asks for it)")
+	fs.StringVar(&o.peerCompress, "peer-compress", "", "compress the stream between peers with zstd or snappy, for chatty text protocols over slow links (the dialing peer's choice wins)")
+	fs.DurationVar(&o.peerObfuscate, "peer-obfuscate", 0, "pad the encrypted frames between peers to fixed sizes and send dummy ones this often on average, at random, to make the stream harder to fingerprint (0 disables it unless the other peer asks)")
+	fs.StringVar(&o.peerKeyOut, "peer-key-out", "", "file with the secret to authenticate to the target, a peer instance with -peer-key-in, with")
+	fs.BoolVar(&o.transparentListen, "transparent", false, "accept connections redirected by iptables REDIRECT or TPROXY and tunnel them to their original destination, instead of -target (Linux only)")
+	fs.StringVar(&o.proxyServer, "proxy-server", "", "speak this proxy protocol (socks5 or http) on the listener and tunnel to the targets clients ask for, instead of -target")
+	fs.StringVar(&o.proxyServerAuth, "proxy-server-auth", "", "file with one user:password per line that clients of -proxy-server have to log in with")
+	fs.StringVar(&o.proxyServerAllow, "proxy-server-allow", "", "regular expression host:port targets requested from -proxy-server have to match (any when empty)")
+	fs.StringVar(&o.proxyRules, "proxy-rules", "", "comma separated <match>=<proxy> rules sending targets matching a CIDR, host name or *.domain through a proxy URL or direct, ahead of -proxy")
+	fs.StringVar(&o.pac, "pac", "", "proxy auto-config script (URL or file) choosing the proxy for each target, instead of -proxy")
+	fs.StringVar(&o.tlsCert, "tls-cert", "", "certificate (PEM) to terminate TLS on the listener with, the target gets plaintext")
+	fs.StringVar(&o.tlsKey, "tls-key", "", "private key (PEM) of -tls-cert")
+	fs.StringVar(&o.tlsMinVersion, "tls-min-version", "1.2", "minimum TLS version accepted with -tls-cert (1.0, 1.1, 1.2 or 1.3)")
+	fs.StringVar(&o.tlsClientCA, "tls-client-ca", "", "require client certificates signed by one of these CA certificates (PEM) with -tls-cert")
+	fs.DurationVar(&o.tlsReload, "tls-reload", time.Minute, "how often to check -tls-cert, -tls-key and -tls-client-ca for changes and reload them (0 disables, SIGHUP reloads them too)")
+	fs.DurationVar(&o.tlsTicketRotate, "tls-ticket-rotate", 0, "how often to replace the session ticket key of -tls-cert, keeping only the previous one, or to check -tls-ticket-keys for changes (0 leaves it to Go)")
+	fs.StringVar(&o.tlsTicketKeys, "tls-ticket-keys", "", "file with the session ticket keys of -tls-cert shared by several instances, one hex encoded 32 byte key per line, the first issuing tickets")
+	fs.BoolVar(&o.targetTLS, "target-tls", false, "wrap connections to the target in TLS")
+	fs.StringVar(&o.targetCA, "target-ca", "", "CA certificates (PEM) to verify the target with instead of the system ones")
+	fs.StringVar(&o.targetCert, "target-cert", "", "client certificate (PEM) to present to the target")
+	fs.StringVar(&o.targetKey, "target-key", "", "private key (PEM) of -target-cert")
+	fs.StringVar(&o.targetSNI, "target-sni", "", "server name to send to and verify for the target (defaults to its host)")
+	fs.StringVar(&o.frontDomain, "front-domain", "", "connect to wss:// targets through this CDN domain, sent as the TLS server name while the Host header names the target")
+	fs.BoolVar(&o.targetInsecure, "target-insecure", false, "don't verify the certificate of the target")
+	fs.StringVar(&o.tlsFingerprint, "tls-fingerprint", "", "browser ClientHello to send instead of Go's in TLS to the target, wss:// and https:// proxies (chrome, firefox, safari, edge, ios or random)")
+	fs.StringVar(&o.proxyCA, "proxy-ca", "", "CA certificates (PEM) to verify an https:// proxy with")
+	fs.StringVar(&o.proxySNI, "proxy-sni", "", "server name to send to and verify for an https:// proxy")
+	fs.StringVar(&o.sshKey, "ssh-key", "", "private key file to log in to ssh:// proxies with (the password in the URL and ssh-agent are tried too)")
+	fs.StringVar(&o.sshKnownHosts, "ssh-known-hosts", "", "known_hosts file to verify ssh:// proxies with (defaults to ~/.ssh/known_hosts)")
+	fs.StringVar(&o.sslKeyLog, "ssl-keylog", os.Getenv("SSLKEYLOGFILE"), "append TLS session keys to this file in NSS key log format, for debugging (defaults to $SSLKEYLOGFILE)")
+	fs.DurationVar(&o.proxyCooldown, "proxy-cooldown", 30*time.Second, "how long a failed proxy is skipped when failing over")
+	fs.DurationVar(&o.proxyProbe, "proxy-probe", 0, "how often to check the health of the proxies in a list (disabled by default)")
+	fs.StringVar(&o.proxyProbeTarget, "proxy-probe-target", "", "address (<host>:<port>) dialed through each proxy to check it, instead of just connecting to the proxy")
+	fs.StringVar(&o.portFile, "port-file", "", "write the bound listening port to this file")
+	fs.BoolVar(&o.printPort, "print-port", false, "print the bound listening port on stdout (LISTEN_PORT=<port>)")
+	fs.StringVar(&o.listenNetns, "listen-netns", "", "network namespace (name or path) to open the listener in (Linux only)")
+	fs.StringVar(&o.dialNetns, "dial-netns", "", "network namespace (name or path) to dial the target from (Linux only)")
+	fs.BoolVar(&o.ftpMode, "ftp", false, "rewrite FTP passive mode replies and forward the data connections")
+	fs.IntVar(&o.fragRecordSize, "frag-records", 0, "split the outbound TLS ClientHello into records of at most this many bytes")
+	fs.IntVar(&o.fragSegmentSize, "frag-segments", 0, "send the outbound TLS ClientHello in TCP segments of at most this many bytes")
+	fs.DurationVar(&o.fragDelay, "frag-delay", 0, "delay between the fragmented ClientHello segments")
+	fs.StringVar(&o.agentAddr, "agent-check", "", "HAProxy agent-check listening address (<host>:<port>)")
+	fs.IntVar(&o.agentCapacity, "agent-capacity", 0, "number of connections reported as full load to the agent-check (defaults to -max-conns)")
+	fs.StringVar(&o.dnsListen, "dns-listen", "", "address to accept DNS queries on (UDP and TCP), forwarded through the tunnel to -dns-resolver")
+	fs.StringVar(&o.dnsResolver, "dns-resolver", "", "resolver to forward DNS queries to (host:port, reached over TCP)")
+	fs.BoolVar(&o.socksBind, "socks-bind", false, "use SOCKS5 BIND: let the proxy accept a connection from the target for each local client")
+	fs.StringVar(&o.usageFile, "usage-report", "", "file to write per-client transfer totals to, totals are resumed from it on start")
+	fs.StringVar(&o.usageFormat, "usage-format", tunnel.UsageJSON, "format of the usage report (json or csv)")
+	fs.StringVar(&o.usagePost, "usage-post", "", "URL to POST the usage report to")
+	fs.DurationVar(&o.usageInterval, "usage-interval", time.Minute, "how often the usage report is written")
+	fs.StringVar(&o.usageKey, "usage-key", "", "file with an HMAC-SHA256 key to sign usage reports with (in <report>.sig and the X-Signature header)")
+	fs.StringVar(&o.accessLog, "access-log", "", "append a JSON line for every closed connection to this file (client, target, proxy, bytes each way, duration and close reason)")
+	fs.StringVar(&o.onOpenHook, "on-open", "", "command to run when a connection is opened (details are passed in TCPTUNNEL_* variables)")
+	fs.StringVar(&o.onCloseHook, "on-close", "", "command to run when a connection is closed (details are passed in TCPTUNNEL_* variables)")
+	fs.StringVar(&o.onBindHook, "on-bind", "", "command to run when the proxy of -socks-bind waits for the target to connect to $TCPTUNNEL_BIND_ADDR")
+	fs.IntVar(&o.hookConcurrency, "hook-concurrency", 4, "maximum number of hook commands running at the same time, the runs of further events are dropped")
+	fs.DurationVar(&o.hookTimeout, "hook-timeout", 10*time.Second, "kill hook commands running longer than this")
+	fs.Var(&o.acceptRate, "accept-rate", "maximum number of connections accepted per second, or per period as in 50/s or 3000/m (0 means unlimited)")
+	fs.IntVar(&o.acceptBurst, "accept-burst", 1, "number of connections accepted at once before -accept-rate kicks in")
+	fs.StringVar(&o.firewall, "open-firewall", "", "allow the listening ports in the firewall while running (nft, ufw, firewalld or netsh)")
+	fs.IntVar(&o.backlog, "backlog", 0, "listen backlog (0 means the OS default)")
+	fs.StringVar(&o.listenBPF, "listen-bpf", "", "file with a classic BPF program (tcpdump -ddd) to attach to the listening socket (Linux)")
+	fs.StringVar(&o.acceptFilter, "accept-filter", "", "accept filter to install on the listening socket, e.g. dataready or httpready (FreeBSD)")
+	fs.IntVar(&o.acceptQueue, "accept-queue", 0, "size of the internal queue of accepted connections waiting to be tunneled (0 disables it)")
+	fs.StringVar(&o.acceptOverflow, "accept-overflow", "", "what to do with connections when the accept queue is full (drop or reset, defaults to -close-limit)")
+	fs.StringVar(&o.closeOnShutdown, "close-shutdown", tunnel.CloseFIN, "how to close active connections when stopping (fin or rst)")
+	fs.StringVar(&o.closeOnLimit, "close-limit", tunnel.CloseFIN, "how to close connections rejected for exceeding a limit (fin or rst)")
+	fs.StringVar(&o.closeOnDeny, "close-deny", tunnel.CloseFIN, "how to close connections rejected by -allow, -deny or -sni-allow (fin or rst)")
+	fs.BoolVar(&o.headerTarget, "header-target", false, "take the target from a header the client sends first (length byte, then host:port)")
+	fs.StringVar(&o.headerAllow, "header-allow", "", "regular expression host:port targets requested with -header-target have to match")
+	fs.StringVar(&o.sniTarget, "sni-target", "", "derive the target from the TLS server name (%sni, or %1..%9 for groups captured by -sni-allow)")
+	fs.StringVar(&o.sniAllow, "sni-allow", "", "regular expression server names have to match for -sni-target")
+	fs.IntVar(&o.dialTimeout, "timeout", 10, "dial timeout")
+	fs.BoolVar(&o.dnsCache, "dns-cache", false, "cache the addresses of the target and proxies for their DNS TTL instead of resolving them on every dial")
+	fs.BoolVar(&o.resolveOnce, "resolve-once", false, "resolve the target and proxies once, keeping their addresses for good")
+	fs.IntVar(&o.maxConns, "max-conns", 0, "maximum number of connections handled at once (0 means unlimited)")
+	fs.DurationVar(&o.maxConnsWait, "max-conns-wait", 0, "how long a connection over -max-conns waits for another to finish before it is rejected (rejected right away by default)")
+	fs.IntVar(&o.maxConnsReserved, "max-conns-reserved", 0, "number of the -max-conns slots only clients in -max-conns-priority may take")
+	fs.StringVar(&o.maxConnsPriority, "max-conns-priority", "", "comma separated CIDRs of the clients allowed to take the -max-conns-reserved slots")
+	fs.IntVar(&o.banAfter, "ban-after", 0, "ban client IPs failing the TLS handshake, logging in, routing or -allow/-deny this many times within -ban-window (0 disables it)")
+	fs.DurationVar(&o.banWindow, "ban-window", 10*time.Minute, "how long the failures counted by -ban-after are remembered")
+	fs.DurationVar(&o.banFor, "ban-for", time.Hour, "how long a ban by -ban-after lasts")
+	fs.StringVar(&o.banAdmin, "ban-admin", "", "address taking list and unban <ip> commands for the bans by -ban-after, one per connection (bind it to localhost)")
+	fs.StringVar(&o.banState, "ban-state", "", "file to keep the bans by -ban-after in, so they survive a restart")
+	fs.IntVar(&o.identityMaxConns, "identity-max-conns", 0, "maximum number of sessions open at once for each proxy server user or client certificate name (0 means unlimited)")
+	fs.Var(&o.identityRate, "identity-rate", "maximum number of new sessions per second for each proxy server user or client certificate name, or per period as in 50/s (0 means unlimited)")
+	fs.Var(&o.identityLimits, "identity-limits", "comma separated <identity>=<sessions>[@<rate>] limits of single identities, in place of -identity-max-conns and -identity-rate")
+	fs.IntVar(&o.maxConnsPerIP, "max-conns-per-ip", 0, "maximum number of connections handled at once from one client IP (0 means unlimited)")
+	fs.DurationVar(&o.maxConnsPerIPWait, "max-conns-per-ip-wait", 0, "how long a connection over -max-conns-per-ip waits for another from the same IP to finish before it is rejected (rejected right away by default)")
+	fs.DurationVar(&o.maxSession, "max-session", 0, "close tunneled connections open for longer than this (0 means unlimited)")
+	fs.Var(&o.maxBytes, "max-bytes", "close tunneled connections once they have copied this many bytes in both directions together, with a unit as in 5G or 100M (0 means unlimited)")
+	fs.Var(&o.rateLimit, "rate-limit", "bandwidth shared by all connections in each direction, in bytes per second or with a unit as in 10mbit or 2MB (0 means unlimited)")
+	fs.Var(&o.rateLimitPerConn, "rate-limit-per-conn", "bandwidth of each connection in each direction, like -rate-limit (0 means unlimited)")
+	fs.StringVar(&o.allow, "allow", "", "comma separated CIDRs of the only clients allowed to connect")
+	fs.StringVar(&o.deny, "deny", "", "comma separated CIDRs of clients not allowed to connect, even when in -allow")
+	fs.StringVar(&o.geoDB, "geoip-db", "", "comma separated MaxMind DB files (country and/or ASN) for -geo-allow, -geo-block, -geo-allow-asn and -geo-block-asn")
+	fs.StringVar(&o.geoAllow, "geo-allow", "", "comma separated country codes of the only clients allowed to connect")
+	fs.StringVar(&o.geoBlock, "geo-block", "", "comma separated country codes of clients not allowed to connect")
+	fs.StringVar(&o.geoAllowASN, "geo-allow-asn", "", "comma separated AS numbers of the only clients allowed to connect")
+	fs.StringVar(&o.geoBlockASN, "geo-block-asn", "", "comma separated AS numbers of clients not allowed to connect")
+	fs.DurationVar(&o.geoReload, "geoip-reload", time.Hour, "how often to reopen the GeoIP databases when they changed (0 disables)")
+	fs.StringVar(&o.dns, "dns", "", "nameservers to resolve the target and proxies with instead of the system resolver (<host>[:<port>], tls://<host>[:<port>] or https://<host>/<path>, comma separated)")
+	fs.StringVar(&o.proxyResolve, "proxy-resolve", tunnel.ProxyResolveRemote, "where the targets of proxied connections are resolved: remote (by the proxy, as with socks5h) or local")
+	fs.DurationVar(&o.fallbackDelay, "happy-eyeballs-delay", 300*time.Millisecond, "head start of the preferred address family (usually IPv6) before the other one is dialed in parallel, for targets with both (negative to dial one after another)")
+	fs.IntVar(&o.keepAliveInterval, "keepalive", 30, "keep-alive interval")
+	fs.DurationVar(&o.keepAliveIdle, "keepalive-idle", 0, "idle time before the first keep-alive probe (TCP_KEEPIDLE, overrides -keepalive)")
+	fs.DurationVar(&o.keepAliveProbes, "keepalive-interval", 0, "time between keep-alive probes (TCP_KEEPINTVL, overrides -keepalive)")
+	fs.IntVar(&o.keepAliveCount, "keepalive-count", 0, "unanswered keep-alive probes before dropping the connection (TCP_KEEPCNT)")
+	fs.BoolVar(&o.transparent, "transparent-source", false, "dial the target from the client's address (Linux, IP_TRANSPARENT, see README for the routing it needs)")
+	fs.DurationVar(&o.stallRead, "stall-read", 0, "tear connections down when no data has been copied in either direction for this long (0 disables it)")
+	fs.DurationVar(&o.stallWrite, "stall-write", 0, "tear connections down when a write can't make progress for this long (0 disables it)")
+	fs.DurationVar(&o.udpTimeout, "udp-timeout", tunnel.DefaultUDPTimeout, "forget a client of a udp:// listener after this long without datagrams")
+	fs.StringVar(&o.unixMode, "unix-mode", "", "permissions of a unix:// listening socket, in octal (e.g. 0660, defaults to the umask)")
+	fs.IntVar(&o.mss, "mss", 0, "clamp the MSS of tunneled connections (TCP_MAXSEG, 0 keeps the OS default)")
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "relay":
+			exit(runRelay(os.Args[2:]))
+		case "selftest":
+			exit(runSelftest(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
 	log.SetLevel(logrus.InfoLevel)
@@ -52,18 +359,227 @@ func main() {
 		log.SetLevel(logrus.DebugLevel)
 	}
 
+	if err := setupLogging(); err != nil {
+		exit(configError(fmt.Errorf("could not set up logging: %w", err)))
+	}
+
 	log.Debugf("logging level set to %s", log.GetLevel())
 
-	if showHelp || targetAddr == "" || listenAddr == "" {
+	if showHelp {
+		flag.Usage()
+		return
+	}
+
+	tunnels := []*tunnelDefinition{commandLineTunnel()}
+	var config *tunnelConfig
+	if configPath != "" {
+		config = &tunnelConfig{path: configPath}
+		var err error
+		if tunnels, err = config.load(); err != nil {
+			exit(configError(err))
+		}
+	} else if !cliOptions.complete() {
 		flag.Usage()
+		os.Exit(exitConfig)
+	}
+	if dryRun {
+		printGlobalConfig(os.Stdout)
+		for _, t := range tunnels {
+			fmt.Println()
+			if t.name != "" {
+				fmt.Printf("# tunnel %s\n", t.name)
+			} else {
+				fmt.Println("# tunnel")
+			}
+			if err := printEffectiveConfig(os.Stdout, t); err != nil {
+				exit(err)
+			}
+		}
 		return
 	}
+	if metricsAddr != "" || statsdAddr != "" {
+		metrics = tunnel.NewMetrics()
+	}
+	if metricsAddr != "" {
+		if err := serveMetrics(metrics, metricsAddr, metricsStats); err != nil {
+			exit(bindError(fmt.Errorf("could not serve metrics: %w", err)))
+		}
+	}
+	if statsdAddr != "" {
+		go sendStatsD(metrics, statsdAddr, statsdInterval)
+	}
+	if adminAddr != "" {
+		admin, err := newAdminServer(adminTokenFile, config, adminPersist)
+		if err != nil {
+			exit(configError(err))
+		}
+		if err = admin.serve(adminAddr); err != nil {
+			exit(bindError(fmt.Errorf("could not serve the admin API: %w", err)))
+		}
+	}
 	signals := make(chan os.Signal, 1)
 
-	signal.Notify(signals, os.Interrupt, os.Kill)
-	client := newClient(listenAddr, targetAddr, proxyAddr, time.Duration(dialTimeout), time.Duration(keepAliveInterval), signals)
-	err := client.Run()
-	if err != nil {
-		log.Fatalf("exiting on error: %s", err)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	if statsSignal != nil {
+		signal.Notify(signals, statsSignal)
+	}
+	// SIGHUP reloads the TLS certificates, and the config file when there is one
+	signal.Notify(signals, syscall.SIGHUP)
+	var reload func() ([]*tunnelDefinition, error)
+	if config != nil {
+		reload = config.load
+	}
+	exit(runTunnels(tunnels, signals, reload))
+}
+
+// newTunnel builds the tunnel described by o, named name in its metrics.
+func (o *options) newTunnel(name string) *tunnel.Tunnel {
+	opts := []tunnel.Option{
+		tunnel.WithProxy(o.proxyAddr),
+		tunnel.WithProxyRules(o.proxyRules),
+		tunnel.WithPAC(o.pac),
+		// kept out of the flags so they don't show up in -dry-run
+		tunnel.WithProxyCredentials(os.Getenv("TCPTUNNEL_PROXY_USER"), os.Getenv("TCPTUNNEL_PROXY_PASS")),
+		tunnel.WithProxyCredentialFile(o.proxyCredFile),
+		tunnel.WithPortFile(o.portFile),
+		tunnel.WithNetns(o.listenNetns, o.dialNetns),
+		tunnel.WithFragmentation(o.fragRecordSize, o.fragSegmentSize, o.fragDelay),
+		tunnel.WithDialTimeout(time.Duration(o.dialTimeout) * time.Second),
+		tunnel.WithFallbackDelay(o.fallbackDelay),
+		tunnel.WithDNS(o.dns),
+		tunnel.WithMaxConns(o.maxConns, o.maxConnsWait),
+		tunnel.WithReservedConns(o.maxConnsReserved, o.maxConnsPriority),
+		tunnel.WithAutoBan(tunnel.AutoBan{
+			Failures: o.banAfter,
+			Window:   o.banWindow,
+			Duration: o.banFor,
+			Admin:    o.banAdmin,
+			State:    o.banState,
+		}),
+		tunnel.WithMaxConnsPerIP(o.maxConnsPerIP, o.maxConnsPerIPWait),
+		tunnel.WithIdentityLimits(tunnel.IdentityLimit{MaxConns: o.identityMaxConns, Rate: float64(o.identityRate)}, o.identityLimits),
+		tunnel.WithSessionLimits(o.maxSession, int64(o.maxBytes)),
+		tunnel.WithRateLimit(int64(o.rateLimit), int64(o.rateLimitPerConn)),
+		tunnel.WithAccessList(o.allow, o.deny),
+		tunnel.WithGeoIP(tunnel.GeoIP{
+			Databases: o.geoDB,
+			Allow:     o.geoAllow,
+			Block:     o.geoBlock,
+			AllowASN:  o.geoAllowASN,
+			BlockASN:  o.geoBlockASN,
+			Reload:    o.geoReload,
+		}),
+		tunnel.WithProxyResolve(o.proxyResolve),
+		tunnel.WithAgentCheck(o.agentAddr, o.agentCapacity),
+		tunnel.WithDNSForwarder(o.dnsListen, o.dnsResolver),
+		tunnel.WithFirewall(o.firewall),
+		tunnel.WithMetrics(metrics, name),
+		tunnel.WithUsageReport(tunnel.UsageReport{
+			Path:     o.usageFile,
+			Format:   o.usageFormat,
+			Post:     o.usagePost,
+			Interval: o.usageInterval,
+			KeyFile:  o.usageKey,
+		}),
+		tunnel.WithAccessLog(o.accessLog),
+		tunnel.WithHooks(tunnel.Hooks{
+			OnOpen:      o.onOpenHook,
+			OnClose:     o.onCloseHook,
+			OnBind:      o.onBindHook,
+			Concurrency: o.hookConcurrency,
+			Timeout:     o.hookTimeout,
+		}),
+		tunnel.WithAcceptRate(float64(o.acceptRate), o.acceptBurst),
+		tunnel.WithBacklog(o.backlog),
+		tunnel.WithListenBPF(o.listenBPF),
+		tunnel.WithAcceptFilter(o.acceptFilter),
+		tunnel.WithAcceptQueue(o.acceptQueue, o.acceptOverflow),
+		tunnel.WithClosePolicy(tunnel.ClosePolicy{
+			Shutdown: o.closeOnShutdown,
+			Limit:    o.closeOnLimit,
+			Deny:     o.closeOnDeny,
+		}),
+		tunnel.WithSNITarget(o.sniTarget, o.sniAllow),
+		tunnel.WithProxyTLS(o.proxyCA, o.proxySNI),
+		tunnel.WithTLSServer(tunnel.TLSServer{
+			CertFile:     o.tlsCert,
+			KeyFile:      o.tlsKey,
+			MinVersion:   o.tlsMinVersion,
+			ClientCA:     o.tlsClientCA,
+			Reload:       o.tlsReload,
+			TicketRotate: o.tlsTicketRotate,
+			TicketKeys:   o.tlsTicketKeys,
+		}),
+		tunnel.WithSSHAuth(o.sshKey, o.sshKnownHosts),
+		tunnel.WithKeyLog(o.sslKeyLog),
+		tunnel.WithProxyCooldown(o.proxyCooldown),
+		tunnel.WithProxyProbe(o.proxyProbe, o.proxyProbeTarget),
+		tunnel.WithProxyServer(o.proxyServer, o.proxyServerAuth),
+		tunnel.WithProxyServerAllow(o.proxyServerAllow),
+		tunnel.WithProxyProtocolOut(o.proxyProtocolOut),
+		tunnel.WithPeerKeys(o.peerKeyIn, o.peerKeyOut),
+		tunnel.WithPeerCompression(o.peerCompress),
+		tunnel.WithPeerObfuscation(o.peerObfuscate),
+		tunnel.WithTLSFingerprint(o.tlsFingerprint),
+		tunnel.WithFrontDomain(o.frontDomain),
+		tunnel.WithBalance(o.balance),
+		tunnel.WithEjection(o.ejectAfter, o.ejectFor),
+		tunnel.WithHealthCheck(tunnel.HealthCheck{
+			Interval:  o.healthInterval,
+			Timeout:   o.healthTimeout,
+			Threshold: o.healthThreshold,
+			Send:      o.healthSend,
+			Expect:    o.healthExpect,
+		}),
+		tunnel.WithKeepAlive(time.Duration(o.keepAliveInterval) * time.Second),
+		tunnel.WithKeepAliveProbes(o.keepAliveIdle, o.keepAliveProbes, o.keepAliveCount),
+		tunnel.WithMSS(o.mss),
+		tunnel.WithStallTimeouts(o.stallRead, o.stallWrite),
+		tunnel.WithUDPTimeout(o.udpTimeout),
+		tunnel.WithUnixMode(o.unixMode),
+	}
+	if name != "" {
+		// tells the tunnels of a config file apart in the log
+		opts = append(opts, tunnel.WithLogger(log.WithField("tunnel", name)))
+	}
+	if o.printPort {
+		opts = append(opts, tunnel.WithPrintPort())
+	}
+	if o.ftpMode {
+		opts = append(opts, tunnel.WithFTP())
+	}
+	if o.socksBind {
+		opts = append(opts, tunnel.WithSOCKSBind())
+	}
+	if o.headerTarget {
+		opts = append(opts, tunnel.WithHeaderTarget(o.headerAllow))
+	}
+	if o.transparentListen {
+		opts = append(opts, tunnel.WithTransparent())
+	}
+	if o.peerEncrypt {
+		opts = append(opts, tunnel.WithPeerEncryption())
+	}
+	if o.proxyProtocolIn {
+		opts = append(opts, tunnel.WithProxyProtocolIn(o.proxyTrusted))
+	}
+	if o.dnsCache {
+		opts = append(opts, tunnel.WithDNSCache())
+	}
+	if o.resolveOnce {
+		opts = append(opts, tunnel.WithResolveOnce())
+	}
+	if o.transparent {
+		opts = append(opts, tunnel.WithTransparentSource())
+	}
+	if o.targetTLS {
+		opts = append(opts, tunnel.WithTLSClient(tunnel.TLSClient{
+			CA:                 o.targetCA,
+			CertFile:           o.targetCert,
+			KeyFile:            o.targetKey,
+			ServerName:         o.targetSNI,
+			InsecureSkipVerify: o.targetInsecure,
+		}))
 	}
+	return tunnel.New(o.listenAddr, o.targetAddr, opts...)
 }
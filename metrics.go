@@ -0,0 +1,57 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+import "tcptunnel/tunnel"
+
+// metrics of all the tunnels, nil without -metrics and -statsd
+var metrics *tunnel.Metrics
+
+// serveMetrics exposes m to Prometheus on addr, under /metrics, for as long
+// as the process runs. With stats, /stats has the snapshot statsSignal logs;
+// it lists the addresses of the clients, so it is left out unless asked for.
+func serveMetrics(m *tunnel.Metrics, addr string, stats bool) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	if stats {
+		mux.HandleFunc("/stats", serveStats)
+	}
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Errorf("metrics server stopped: %s", err)
+		}
+	}()
+	log.Infof("serving metrics on http://%s/metrics", listener.Addr())
+	return nil
+}
+
+// sendStatsD emits m to the StatsD server at addr for as long as the process
+// runs.
+func sendStatsD(m *tunnel.Metrics, addr string, interval time.Duration) {
+	log.Infof("sending metrics to StatsD at %s every %s", addr, interval)
+	if err := m.SendStatsD(context.Background(), addr, interval); err != nil {
+		log.Errorf("could not send metrics to StatsD: %s", err)
+	}
+}
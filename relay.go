@@ -0,0 +1,55 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+)
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"tcptunnel/tunnel"
+)
+
+// runRelay implements the "relay" subcommand.
+func runRelay(args []string) error {
+	flags := flag.NewFlagSet("relay", flag.ExitOnError)
+	listen := flags.String("listen", "", "listening address (<host>:<port>)")
+	waitTimeout := flags.Duration("wait-timeout", tunnel.DefaultRelayWaitTimeout, "how long a peer waits to be paired")
+	debug := flags.Bool("debug", false, "more verbose logging")
+	_ = flags.Parse(args)
+
+	if *debug {
+		log.SetLevel(logrus.DebugLevel)
+	}
+	if *listen == "" {
+		flags.Usage()
+		return configError(errors.New("no listening address given"))
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return bindError(fmt.Errorf("could not start listening: %w", err))
+	}
+	log.Infof("relay listening on %s", listener.Addr())
+	if err = tunnel.NewRelayServer(*waitTimeout).Serve(listener); err != nil {
+		return runtimeError(fmt.Errorf("error accepting connection: %w", err))
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+import "tcptunnel/tunnel"
+
+// runningTunnel is a tunnel started by runTunnels.
+type runningTunnel struct {
+	def *tunnelDefinition
+	// identical settings give identical fingerprints
+	fingerprint string
+	tunnel      *tunnel.Tunnel
+	// closed once Run returned err
+	done chan struct{}
+	err  error
+	// a failure of a tunnel started with the process stops the process
+	fatal bool
+	// draining on purpose after a reload
+	removed bool
+	// the reload that started the tunnel, 0 for those started with the process
+	generation int
+}
+
+// fingerprint renders every setting of t, to tell whether a reload changes it.
+func (t *tunnelDefinition) fingerprint() string {
+	var b strings.Builder
+	t.flags.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&b, "%s=%q\n", f.Name, f.Value.String())
+	})
+	return b.String()
+}
+
+func (t *runningTunnel) describe(err error) error {
+	if t.def.name == "" {
+		return err
+	}
+	return fmt.Errorf("tunnel %s: %w", t.def.name, err)
+}
+
+type tunnelSupervisor struct {
+	running  []*runningTunnel
+	finished chan *runningTunnel
+	// reloads so far
+	generation int
+}
+
+func (s *tunnelSupervisor) start(def *tunnelDefinition, fatal bool) {
+	t := &runningTunnel{
+		def:         def,
+		fingerprint: def.fingerprint(),
+		tunnel:      def.options.newTunnel(def.name),
+		done:        make(chan struct{}),
+		fatal:       fatal,
+		generation:  s.generation,
+	}
+	go func() {
+		t.err = t.tunnel.Run(context.Background())
+		close(t.done)
+		s.finished <- t
+	}()
+	s.running = append(s.running, t)
+}
+
+func (s *tunnelSupervisor) stopAll() {
+	for _, t := range s.running {
+		t.tunnel.Close()
+	}
+}
+
+// reload drains the running tunnels whose settings aren't in tunnels anymore
+// and starts the ones that are new. Unchanged tunnels keep running along with
+// their connections; drained ones stop accepting, and their connections carry
+// on under the old settings until they finish, while the replacements take
+// the new ones.
+func (s *tunnelSupervisor) reload(tunnels []*tunnelDefinition) {
+	s.generation++
+	wanted := make(map[string][]*tunnelDefinition)
+	for _, def := range tunnels {
+		wanted[def.fingerprint()] = append(wanted[def.fingerprint()], def)
+	}
+
+	var removed int
+	for _, t := range s.running {
+		if t.removed {
+			continue
+		}
+		if defs := wanted[t.fingerprint]; len(defs) > 0 {
+			wanted[t.fingerprint] = defs[1:]
+			continue
+		}
+		log.Infof("draining tunnel %s: removed or changed", t.def.name)
+		t.removed = true
+		// returns once the listeners are closed, the replacements may listen on the same addresses
+		t.tunnel.Drain()
+		removed++
+	}
+
+	var started int
+	for _, def := range tunnels {
+		fingerprint := def.fingerprint()
+		if defs := wanted[fingerprint]; len(defs) > 0 && defs[0] == def {
+			wanted[fingerprint] = defs[1:]
+			log.Infof("starting tunnel %s", def.name)
+			s.start(def, false)
+			started++
+		}
+	}
+	log.Infof("configuration reloaded (generation %d): %d tunnels draining, %d started", s.generation, removed, started)
+}
+
+// reloadCertificates has the running tunnels read their TLS certificates again.
+func (s *tunnelSupervisor) reloadCertificates() {
+	for _, t := range s.running {
+		if err := t.tunnel.ReloadCertificates(); err != nil {
+			log.Errorf("%s", t.describe(fmt.Errorf("could not reload TLS certificate, keeping the one loaded: %w", err)))
+		}
+	}
+}
+
+func (s *tunnelSupervisor) remove(t *runningTunnel) {
+	for i, r := range s.running {
+		if r == t {
+			s.running = append(s.running[:i], s.running[i+1:]...)
+			return
+		}
+	}
+}
+
+// runTunnels runs every tunnel until SIGINT or SIGTERM arrives or one of them
+// fails, stopping the others then. It returns the error of the tunnel failing
+// first. On SIGHUP, the TLS certificates are reloaded and the tunnels returned
+// by load, if any, replace the running ones; on statsSignal, the running
+// tunnels are logged. Requests of the admin API are run in between.
+func runTunnels(tunnels []*tunnelDefinition, signals chan os.Signal, load func() ([]*tunnelDefinition, error)) error {
+	s := &tunnelSupervisor{finished: make(chan *runningTunnel)}
+	for _, def := range tunnels {
+		s.start(def, true)
+	}
+
+	var err error
+	stopping := false
+	for len(s.running) > 0 {
+		// no changes once stopping
+		admin := adminRequests
+		if stopping {
+			admin = nil
+		}
+		select {
+		case reply := <-statsRequests:
+			reply <- s.stats()
+		case request := <-admin:
+			request(s)
+		case sig := <-signals:
+			if statsSignal != nil && sig == statsSignal {
+				s.logStats()
+				continue
+			}
+			if sig == syscall.SIGHUP && !stopping {
+				s.reloadCertificates()
+				if load == nil {
+					continue
+				}
+				tunnels, loadErr := load()
+				if loadErr != nil {
+					log.Errorf("could not reload configuration, keeping the running one: %s", loadErr)
+					continue
+				}
+				s.reload(tunnels)
+				continue
+			}
+			if !stopping {
+				log.Infof("received shutdown signal from user")
+			}
+			stopping = true
+			s.stopAll()
+		case t := <-s.finished:
+			s.remove(t)
+			switch {
+			case t.removed:
+				if t.err != nil {
+					log.Warnf("removed tunnel %s stopped with error: %s", t.def.name, t.err)
+				} else {
+					log.Infof("removed tunnel %s drained", t.def.name)
+				}
+			case t.err != nil && (t.fatal || stopping):
+				if err == nil {
+					err = t.describe(t.err)
+				}
+				stopping = true
+				s.stopAll()
+			case t.err != nil:
+				log.Errorf("%s", t.describe(t.err))
+			}
+		}
+	}
+	return err
+}
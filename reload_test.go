@@ -0,0 +1,136 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"sort"
+	"strings"
+	"testing"
+)
+
+import "gopkg.in/yaml.v3"
+
+// testTunnels returns the tunnels of a config file listing them, one per
+// line as <name> <target>, all listening on a free loopback port.
+func testTunnels(t *testing.T, list string) []*tunnelDefinition {
+	t.Helper()
+	var config configFile
+	for _, line := range strings.Split(strings.TrimSpace(list), "\n") {
+		name, target, _ := strings.Cut(line, " ")
+		config.Tunnels = append(config.Tunnels, map[string]interface{}{
+			"name": name, "listen": "127.0.0.1:0", "target": target,
+		})
+	}
+	base := flag.NewFlagSet("base", flag.ContinueOnError)
+	(&options{}).register(base)
+	tunnels, err := config.definitions(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tunnels
+}
+
+// runningNames lists the tunnels s runs, and those it drains.
+func runningNames(s *tunnelSupervisor) (running, draining string) {
+	var r, d []string
+	for _, t := range s.running {
+		if t.removed {
+			d = append(d, t.def.name)
+		} else {
+			r = append(r, t.def.name)
+		}
+	}
+	sort.Strings(r)
+	sort.Strings(d)
+	return strings.Join(r, ","), strings.Join(d, ",")
+}
+
+func TestSupervisorReload(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		running       string
+		draining      string
+		newGeneration string
+	}{
+		{"unchanged", "a 127.0.0.1:9\nb 127.0.0.1:10", "a 127.0.0.1:9\nb 127.0.0.1:10", "a,b", "", ""},
+		{"changed", "a 127.0.0.1:9\nb 127.0.0.1:10", "a 127.0.0.1:11\nb 127.0.0.1:10", "a,b", "a", "a"},
+		{"removed", "a 127.0.0.1:9\nb 127.0.0.1:10", "b 127.0.0.1:10", "b", "a", ""},
+		{"added", "a 127.0.0.1:9", "a 127.0.0.1:9\nb 127.0.0.1:10", "a,b", "", "b"},
+		// the name is no setting of the tunnel, which keeps running as it was
+		{"renamed", "a 127.0.0.1:9", "c 127.0.0.1:9", "a", "", ""},
+		{"one of two identical removed", "a 127.0.0.1:9\nb 127.0.0.1:9", "b 127.0.0.1:9", "a", "b", ""},
+		{"identical one added", "a 127.0.0.1:9", "a 127.0.0.1:9\nb 127.0.0.1:9", "a,b", "", "b"},
+	}
+	for _, tt := range tests {
+		s := &tunnelSupervisor{finished: make(chan *runningTunnel)}
+		for _, def := range testTunnels(t, tt.before) {
+			s.start(def, true)
+		}
+		s.reload(testTunnels(t, tt.after))
+
+		running, draining := runningNames(s)
+		if running != tt.running || draining != tt.draining {
+			t.Errorf("%s: running %q and draining %q, expected %q and %q",
+				tt.name, running, draining, tt.running, tt.draining)
+		}
+		var started []string
+		for _, r := range s.running {
+			if r.generation == s.generation {
+				started = append(started, r.def.name)
+			}
+		}
+		sort.Strings(started)
+		if strings.Join(started, ",") != tt.newGeneration {
+			t.Errorf("%s: started %q, expected %q", tt.name, started, tt.newGeneration)
+		}
+
+		s.stopAll()
+		for len(s.running) > 0 {
+			s.remove(<-s.finished)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		a, b map[string]interface{}
+		same bool
+	}{
+		{map[string]interface{}{"listen": ":1", "target": "b:1"}, map[string]interface{}{"listen": ":1", "target": "b:1"}, true},
+		{map[string]interface{}{"name": "a", "listen": ":1", "target": "b:1"}, map[string]interface{}{"name": "c", "listen": ":1", "target": "b:1"}, true},
+		{map[string]interface{}{"listen": ":1", "target": "b:1"}, map[string]interface{}{"listen": ":1", "target": "b:2"}, false},
+		// set to its default or left at it, the tunnel is the same
+		{map[string]interface{}{"listen": ":1", "target": "b:1", "timeout": 10}, map[string]interface{}{"listen": ":1", "target": "b:1"}, true},
+		{map[string]interface{}{"listen": ":1", "target": "b:1", "timeout": 5}, map[string]interface{}{"listen": ":1", "target": "b:1"}, false},
+		{map[string]interface{}{"listen": ":1", "target": []interface{}{"b:1", "c:1"}}, map[string]interface{}{"listen": ":1", "target": "b:1,c:1"}, true},
+	}
+	for _, tt := range tests {
+		var fingerprints []string
+		for _, settings := range []map[string]interface{}{tt.a, tt.b} {
+			config := configFile{Tunnels: []map[string]interface{}{settings}}
+			tunnels, err := config.definitions(flag.NewFlagSet("base", flag.ContinueOnError))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fingerprints = append(fingerprints, tunnels[0].fingerprint())
+		}
+		if same := fingerprints[0] == fingerprints[1]; same != tt.same {
+			a, _ := yaml.Marshal(tt.a)
+			b, _ := yaml.Marshal(tt.b)
+			t.Errorf("same fingerprint of\n%s and\n%s: %v, expected %v", a, b, same, tt.same)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"tcptunnel/tunnel"
+)
+
+// runSelftest implements the "selftest" subcommand: it tunnels data to an
+// internal echo server, through the given proxies if any, and checks that
+// all of it comes back.
+func runSelftest(args []string) error {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	proxyList := flags.String("proxy", "", "proxy address (<proto>://[user[:password]@]<host>:<port>/), a comma separated list fails over in order")
+	proxyCA := flags.String("proxy-ca", "", "CA certificates (PEM) to verify an https:// proxy with")
+	proxySNI := flags.String("proxy-sni", "", "server name to send to and verify for an https:// proxy")
+	echoListen := flags.String("echo-listen", "127.0.0.1:0", "listening address of the internal echo server")
+	echoTarget := flags.String("echo-target", "", "address the tunnel dials to reach the echo server (defaults to its listening address)")
+	size := flags.Int("size", 1<<20, "number of bytes to push through the tunnel")
+	timeout := flags.Duration("timeout", 10*time.Second, "maximum duration of the test")
+	debug := flags.Bool("debug", false, "more verbose logging")
+	_ = flags.Parse(args)
+
+	log.SetLevel(logrus.WarnLevel)
+	if *debug {
+		log.SetLevel(logrus.DebugLevel)
+	}
+
+	echo, err := net.Listen("tcp", *echoListen)
+	if err != nil {
+		return bindError(fmt.Errorf("could not start echo server: %w", err))
+	}
+	defer echo.Close()
+	go serveEcho(echo)
+	if *echoTarget == "" {
+		*echoTarget = echo.Addr().String()
+	}
+
+	listening := make(chan net.Addr, 1)
+	finished := make(chan struct{}, 2)
+	t := tunnel.New("127.0.0.1:0", *echoTarget,
+		tunnel.WithProxy(*proxyList),
+		tunnel.WithProxyTLS(*proxyCA, *proxySNI),
+		tunnel.WithDialTimeout(*timeout),
+		tunnel.WithEvents(tunnel.Events{
+			OnListen: func(addrs []net.Addr) {
+				listening <- addrs[0]
+			},
+			OnDialError: func(s *tunnel.Session, err error) {
+				finished <- struct{}{}
+			},
+			OnClose: func(s *tunnel.Session) {
+				finished <- struct{}{}
+			},
+		}),
+	)
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- t.Run(context.Background())
+	}()
+
+	var addr net.Addr
+	select {
+	case addr = <-listening:
+	case err = <-runErr:
+		return err
+	}
+
+	err = pushThrough(addr.String(), *echoTarget, *size, *timeout)
+	// let the tunneled connection wind down before stopping
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+	}
+	t.Close()
+	if runErr := <-runErr; runErr != nil {
+		log.Warnf("tunnel stopped with error: %s", runErr)
+	}
+	if err != nil {
+		fmt.Printf("FAIL: %s\n", err)
+		return runtimeError(fmt.Errorf("selftest failed: %w", err))
+	}
+	return nil
+}
+
+func serveEcho(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+// pushThrough sends size random bytes through the tunnel on addr and checks
+// the echo, printing the timings.
+func pushThrough(addr string, target string, size int, timeout time.Duration) error {
+	payload := make([]byte, size)
+	if _, err := rand.Read(payload); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return fmt.Errorf("could not connect to the tunnel: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(start.Add(timeout))
+
+	// the first byte coming back proves the target has been reached
+	if _, err = conn.Write(payload[:1]); err != nil {
+		return fmt.Errorf("could not send: %w", err)
+	}
+	echoed := make([]byte, size)
+	if _, err = io.ReadFull(conn, echoed[:1]); err != nil {
+		return fmt.Errorf("no echo from %s: %w", target, err)
+	}
+	established := time.Since(start)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload[1:])
+		writeErr <- err
+	}()
+	if _, err = io.ReadFull(conn, echoed[1:]); err != nil {
+		return fmt.Errorf("echo incomplete: %w", err)
+	}
+	if err = <-writeErr; err != nil {
+		return fmt.Errorf("could not send: %w", err)
+	}
+	if !bytes.Equal(payload, echoed) {
+		return errors.New("echoed data differs from what has been sent")
+	}
+
+	transfer := time.Since(start) - established
+	throughput := float64(2*size) / transfer.Seconds() / (1 << 20)
+	fmt.Printf("PASS: reached %s in %s, %d bytes each way in %s (%.1f MiB/s)\n",
+		target, established.Round(time.Microsecond), size, transfer.Round(time.Microsecond), throughput)
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// statsRequests asks runTunnels for a snapshot of the running tunnels, as
+// lines of text.
+var statsRequests = make(chan chan []string)
+
+// stats describes the running tunnels and the connections they tunnel.
+func (s *tunnelSupervisor) stats() []string {
+	var lines []string
+	for _, t := range s.running {
+		name := t.def.name
+		if name == "" {
+			name = t.def.options.listenAddr
+		}
+		started := t.tunnel.Started()
+		if started.IsZero() {
+			continue
+		}
+		sessions := t.tunnel.Sessions()
+		var state string
+		if t.removed {
+			state = ", draining"
+		}
+		lines = append(lines, fmt.Sprintf("tunnel %s to %s (generation %d%s): up for %s, %d active connections",
+			name, t.def.options.targetAddr, t.generation, state, time.Since(started).Round(time.Second), len(sessions)))
+		for _, session := range sessions {
+			var via string
+			if session.Proxy() != "" {
+				via = " via " + session.Proxy()
+			}
+			lines = append(lines, fmt.Sprintf("  %s -> %s%s: %d bytes in, %d bytes out, open for %s",
+				session.ClientAddr(), session.Target(), via, session.BytesIn(), session.BytesOut(),
+				session.Duration().Round(time.Second)))
+		}
+	}
+	return lines
+}
+
+// logStats logs the snapshot of the running tunnels.
+func (s *tunnelSupervisor) logStats() {
+	for _, line := range s.stats() {
+		log.Info(line)
+	}
+}
+
+// serveStats answers with the snapshot runTunnels gives, for platforms
+// without statsSignal, with -metrics-stats.
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	reply := make(chan []string, 1)
+	select {
+	case statsRequests <- reply:
+	case <-time.After(5 * time.Second):
+		http.Error(w, "tunnels not running", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range <-reply {
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
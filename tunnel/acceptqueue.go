@@ -0,0 +1,75 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+)
+
+// What to do with connections arriving while the accept queue is full.
+const (
+	// close the connection gracefully (FIN)
+	OverflowDrop = "drop"
+	// abort the connection (RST)
+	OverflowReset = "reset"
+)
+
+func validOverflowPolicy(policy string) error {
+	switch policy {
+	case OverflowDrop, OverflowReset:
+		return nil
+	}
+	return fmt.Errorf("unknown accept queue overflow policy %q", policy)
+}
+
+// queueAccepts accepts connections as fast as they come into a queue of
+// c.acceptQueue entries and returns a function taking them out of it. When
+// the queue is full, new connections are dropped or reset right away.
+func (c *client) queueAccepts(listener net.Listener) func() (net.Conn, error) {
+	queue := make(chan net.Conn, c.acceptQueue)
+	errc := make(chan error, 1)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case queue <- conn:
+			default:
+				c.log.Warnf("accept queue full, applying %s to connection from %s", c.acceptOverflow, conn.RemoteAddr())
+				closeConn(conn, c.acceptOverflow == OverflowReset)
+			}
+		}
+	}()
+
+	return func() (net.Conn, error) {
+		// hand out what has been queued before reporting a listener error
+		select {
+		case conn := <-queue:
+			return conn, nil
+		default:
+		}
+		select {
+		case conn := <-queue:
+			return conn, nil
+		case err := <-errc:
+			return nil, err
+		}
+	}
+}
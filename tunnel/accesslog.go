@@ -0,0 +1,114 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessRecord is the line the access log gets for each connection.
+type accessRecord struct {
+	Time   time.Time `json:"time"`
+	Listen string    `json:"listen"`
+	Client string    `json:"client"`
+	// the user or client certificate name it logged in as
+	Identity string `json:"identity,omitempty"`
+	Target   string `json:"target"`
+	Proxy    string `json:"proxy,omitempty"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+	// seconds
+	Duration float64 `json:"duration"`
+	Reason   string  `json:"reason"`
+}
+
+// accessLog appends a JSON line for every closed connection to a file of
+// its own, away from the log.
+type accessLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openAccessLog(path string) (*accessLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLog{file: file}, nil
+}
+
+// record writes the line of s, doing nothing on a nil log.
+func (l *accessLog) record(s *Session) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(&accessRecord{
+		Time:     time.Now(),
+		Listen:   s.localAddr.String(),
+		Client:   s.clientAddr.String(),
+		Identity: s.identity,
+		Target:   s.target,
+		Proxy:    s.proxy,
+		BytesIn:  s.bytesIn.Load(),
+		BytesOut: s.bytesOut.Load(),
+		Duration: s.Duration().Seconds(),
+		Reason:   s.closeReason,
+	})
+	if err != nil {
+		log.Errorf("could not encode access log record: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err = l.file.Write(line); err != nil {
+		log.Errorf("could not write access log: %s", err)
+	}
+}
+
+func (l *accessLog) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// copyCloseReason tells why copying from the client to the target, or from
+// the target to the client when fromClient is false, ended with err.
+func copyCloseReason(err error, fromClient bool) string {
+	if errors.Is(err, errDataCap) {
+		return "byte limit"
+	}
+	if errors.Is(err, net.ErrClosed) {
+		// closed by us, for a reason given already
+		return ""
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "write" {
+		// the other side broke off
+		fromClient = !fromClient
+	}
+	if fromClient {
+		return "client closed"
+	}
+	return "target closed"
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// accessList decides by their IP address which clients may connect. A
+// client in a deny range is rejected; with allow ranges, so is every client
+// outside of them.
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newAccessList(allow, deny string) (*accessList, error) {
+	a := &accessList{}
+	var err error
+	if a.allow, err = parseCIDRs(allow); err != nil {
+		return nil, fmt.Errorf("invalid -allow: %w", err)
+	}
+	if a.deny, err = parseCIDRs(deny); err != nil {
+		return nil, fmt.Errorf("invalid -deny: %w", err)
+	}
+	return a, nil
+}
+
+// parseCIDRs parses a comma separated list of CIDRs, single addresses
+// standing for themselves.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// permits tells whether the client at addr may connect and the rule
+// deciding it.
+func (a *accessList) permits(addr net.Addr) (bool, string) {
+	ip := addrIP(addr)
+	if ip == nil {
+		return len(a.allow) == 0, "no IP address"
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false, "deny " + n.String()
+		}
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true, "allow " + n.String()
+		}
+	}
+	if len(a.allow) > 0 {
+		return false, "no allow rule"
+	}
+	return true, "no deny rule"
+}
+
+// addrIP returns the IP address of addr, nil when it has none.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// admit applies the bans, the access list and the GeoIP rules to a
+// connection from addr, closing it when denied.
+func (c *client) admit(accepted net.Conn, addr net.Addr) bool {
+	if c.access == nil && c.geo == nil && c.bans == nil {
+		return true
+	}
+	if c.banned(addr) {
+		c.log.Infof("connection from %s denied (banned)", addr)
+		closeConn(accepted, c.closing.deny == CloseRST)
+		return false
+	}
+	ok, rule := true, ""
+	if c.access != nil {
+		ok, rule = c.access.permits(addr)
+	}
+	if ok && c.geo != nil {
+		ok, rule = c.geo.permits(addr)
+	}
+	if !ok {
+		c.log.Infof("connection from %s denied (%s)", addr, rule)
+		c.failed(addr)
+		closeConn(accepted, c.closing.deny == CloseRST)
+		return false
+	}
+	c.log.Debugf("connection from %s allowed (%s)", addr, rule)
+	return true
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		list string
+		// the networks parsed, nil for an error
+		nets []string
+	}{
+		{"", []string{}},
+		{" , ", []string{}},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}},
+		{"10.1.2.3/8", []string{"10.0.0.0/8"}},
+		{"192.0.2.7, 2001:db8::/32", []string{"192.0.2.7/32", "2001:db8::/32"}},
+		{"::ffff:192.0.2.7", []string{"192.0.2.7/32"}},
+		{"2001:db8::1", []string{"2001:db8::1/128"}},
+		{"10.0.0.0/8,example.com", nil},
+		{"10.0.0.0/33", nil},
+	}
+	for _, tt := range tests {
+		nets, err := parseCIDRs(tt.list)
+		if tt.nets == nil {
+			if err == nil {
+				t.Errorf("parseCIDRs(%q) = %v, expected an error", tt.list, nets)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCIDRs(%q): %v", tt.list, err)
+			continue
+		}
+		if len(nets) != len(tt.nets) {
+			t.Errorf("parseCIDRs(%q) = %v, expected %v", tt.list, nets, tt.nets)
+			continue
+		}
+		for i, n := range nets {
+			if n.String() != tt.nets[i] {
+				t.Errorf("parseCIDRs(%q) = %v, expected %v", tt.list, nets, tt.nets)
+				break
+			}
+		}
+	}
+}
+
+func TestAccessListPermits(t *testing.T) {
+	tcp := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+	tests := []struct {
+		allow, deny string
+		addr        net.Addr
+		ok          bool
+		rule        string
+	}{
+		{"", "", tcp("192.0.2.1"), true, "no deny rule"},
+		{"", "192.0.2.0/24", tcp("192.0.2.1"), false, "deny 192.0.2.0/24"},
+		{"", "192.0.2.0/24", tcp("198.51.100.1"), true, "no deny rule"},
+		{"10.0.0.0/8", "", tcp("10.1.2.3"), true, "allow 10.0.0.0/8"},
+		{"10.0.0.0/8", "", tcp("192.0.2.1"), false, "no allow rule"},
+		// deny wins over allow
+		{"10.0.0.0/8", "10.0.0.5", tcp("10.0.0.5"), false, "deny 10.0.0.5/32"},
+		{"10.0.0.0/8", "10.0.0.5", tcp("10.0.0.6"), true, "allow 10.0.0.0/8"},
+		{"2001:db8::/32", "", tcp("2001:db8::1"), true, "allow 2001:db8::/32"},
+		{"10.0.0.0/8", "", tcp("::ffff:10.0.0.1"), true, "allow 10.0.0.0/8"},
+		{"", "", &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}, true, "no deny rule"},
+		{"", "192.0.2.0/24", &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}, false, "deny 192.0.2.0/24"},
+		// addresses without IP, as of unix sockets, pass only without allow rules
+		{"", "192.0.2.0/24", &net.UnixAddr{Name: "/run/a.sock", Net: "unix"}, true, "no IP address"},
+		{"10.0.0.0/8", "", &net.UnixAddr{Name: "/run/a.sock", Net: "unix"}, false, "no IP address"},
+	}
+	for _, tt := range tests {
+		a, err := newAccessList(tt.allow, tt.deny)
+		if err != nil {
+			t.Errorf("allow %q, deny %q: %v", tt.allow, tt.deny, err)
+			continue
+		}
+		ok, rule := a.permits(tt.addr)
+		if ok != tt.ok || rule != tt.rule {
+			t.Errorf("allow %q, deny %q: %v permitted %v (%s), expected %v (%s)",
+				tt.allow, tt.deny, tt.addr, ok, rule, tt.ok, tt.rule)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+)
+
+// agentReply builds a HAProxy agent-check reply. The percentage is the weight
+// HAProxy should apply, so it shrinks as the tunnel fills up to its capacity.
+func (c *client) agentReply() string {
+	select {
+	case <-c.done:
+		return "drain stopped\n"
+	default:
+	}
+
+	if c.agentCapacity <= 0 {
+		return "up ready 100%\n"
+	}
+	load := c.active.Load() * 100 / int64(c.agentCapacity)
+	if load > 100 {
+		load = 100
+	}
+	return fmt.Sprintf("up ready %d%%\n", 100-load)
+}
+
+// serveAgent answers every connection with the current agent-check reply and
+// closes it, which is all HAProxy's agent protocol expects.
+func (c *client) serveAgent(listener net.Listener) {
+	defer c.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				c.log.Errorf("error accepting agent-check connection: %s", err)
+			}
+			return
+		}
+		reply := c.agentReply()
+		c.log.Debugf("agent-check from %s: %q", conn.RemoteAddr(), reply)
+		if _, err = conn.Write([]byte(reply)); err != nil {
+			c.log.Debugf("failed to answer agent-check: %s", err)
+		}
+		conn.Close()
+	}
+}
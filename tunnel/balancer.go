@@ -0,0 +1,415 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+// Strategies distributing connections across the targets of a list.
+const (
+	// each target in turn
+	BalanceRoundRobin = "round-robin"
+	// the target with the fewest open connections
+	BalanceLeastConn = "least-conn"
+	// any target, at random
+	BalanceRandom = "random"
+	// each target in turn, as often as its weight says
+	BalanceWeighted = "weighted"
+)
+
+func validBalanceStrategy(strategy string) error {
+	switch strategy {
+	case BalanceRoundRobin, BalanceLeastConn, BalanceRandom, BalanceWeighted:
+		return nil
+	}
+	return fmt.Errorf("unknown load balancing strategy %q", strategy)
+}
+
+// isTargetList reports whether target names several targets to balance across.
+func isTargetList(target string) bool {
+	return strings.Contains(target, ",")
+}
+
+// backend is one of the targets connections are balanced across.
+type backend struct {
+	address string
+	weight  int
+	// connections open to it
+	active atomic.Int64
+	// failing its health checks
+	down atomic.Bool
+	// consecutive checks contradicting down, only touched by the checks
+	streak int
+	// consecutive connections that failed
+	failures atomic.Int64
+	// until when (UnixNano) it gets no connections after failing
+	ejectedUntil atomic.Int64
+	// the running total of smooth weighted round-robin, guarded by the balancer
+	current int
+}
+
+// release tells the backend a connection to it has been closed.
+func (b *backend) release() {
+	b.active.Add(-1)
+}
+
+// parseTargetList parses a comma separated list of <host>:<port> targets,
+// each optionally followed by =<weight>.
+func parseTargetList(list string) ([]*backend, error) {
+	var backends []*backend
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		b := &backend{address: entry, weight: 1}
+		if address, weight, ok := strings.Cut(entry, "="); ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight %q of target %s", weight, address)
+			}
+			b.address, b.weight = address, w
+		}
+		if err := plainHostPort(b.address); err != nil {
+			return nil, fmt.Errorf("target %q of a list has to be <host>:<port>", b.address)
+		}
+		backends = append(backends, b)
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("empty target list")
+	}
+	return backends, nil
+}
+
+// balancer picks the target of each new connection from a list.
+type balancer struct {
+	strategy string
+	backends []*backend
+	log      logrus.FieldLogger
+	// consecutive failures a backend is ejected after, never when zero
+	ejectAfter int
+	ejectFor   time.Duration
+
+	mu   sync.Mutex
+	next int
+	rand *rand.Rand
+}
+
+// plainHostPort checks that address is a bare <host>:<port>, without the
+// scheme or path of a udp://, unix://, ws:// or mux:// target. Targets a
+// client picks must pass it, so it can't reach anything else but TCP hosts.
+func plainHostPort(address string) error {
+	if strings.Contains(address, "://") || strings.Contains(address, "/") {
+		return fmt.Errorf("%q is not <host>:<port>", address)
+	}
+	_, _, err := net.SplitHostPort(address)
+	return err
+}
+
+func newBalancer(strategy string, backends []*backend, log logrus.FieldLogger) (*balancer, error) {
+	if strategy != BalanceWeighted {
+		for _, b := range backends {
+			if b.weight != 1 {
+				return nil, fmt.Errorf("target weights need the %s strategy", BalanceWeighted)
+			}
+		}
+	}
+	return &balancer{
+		strategy: strategy,
+		backends: backends,
+		log:      log,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// update replaces the backends by those given, keeping the state of the ones
+// still in, and tells whether anything changed.
+func (l *balancer) update(backends []*backend) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	known := make(map[string]*backend, len(l.backends))
+	for _, b := range l.backends {
+		known[b.address] = b
+	}
+	changed := len(backends) != len(l.backends)
+	updated := make([]*backend, 0, len(backends))
+	for _, b := range backends {
+		if k, ok := known[b.address]; ok {
+			changed = changed || k.weight != b.weight
+			k.weight = b.weight
+			b = k
+		} else {
+			changed = true
+		}
+		updated = append(updated, b)
+	}
+	l.backends = updated
+	return changed
+}
+
+// all returns the backends as they are now.
+func (l *balancer) all() []*backend {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.backends
+}
+
+// pick returns the backend for a new connection, counting the connection as
+// open to it until released, or nil when every backend is down. Ejected
+// backends are skipped, unless every backend up has been ejected.
+func (l *balancer) pick() *backend {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	up := make([]*backend, 0, len(l.backends))
+	var ejected []*backend
+	for _, b := range l.backends {
+		switch {
+		case b.down.Load():
+		case b.ejectedUntil.Load() > now:
+			ejected = append(ejected, b)
+		default:
+			up = append(up, b)
+		}
+	}
+	if len(up) == 0 {
+		up = ejected
+	}
+	if len(up) == 0 {
+		return nil
+	}
+
+	var picked *backend
+	switch l.strategy {
+	case BalanceLeastConn:
+		// ties go round-robin, so idle targets share the load
+		for i := range up {
+			b := up[(l.next+i)%len(up)]
+			if picked == nil || b.active.Load() < picked.active.Load() {
+				picked = b
+			}
+		}
+		l.next++
+	case BalanceRandom:
+		picked = up[l.rand.Intn(len(up))]
+	case BalanceWeighted:
+		// smooth weighted round-robin, spreading heavy targets out
+		total := 0
+		for _, b := range up {
+			b.current += b.weight
+			total += b.weight
+			if picked == nil || b.current > picked.current {
+				picked = b
+			}
+		}
+		picked.current -= total
+	default:
+		picked = up[l.next%len(up)]
+		l.next++
+	}
+	picked.active.Add(1)
+	return picked
+}
+
+// report counts the outcome of a connection to b, err being nil when it
+// succeeded. Failing again after the cooldown ejects b right away.
+func (l *balancer) report(b *backend, err error) {
+	if err == nil {
+		b.failures.Store(0)
+		return
+	}
+	failures := b.failures.Add(1)
+	if l.ejectAfter == 0 || failures < int64(l.ejectAfter) {
+		return
+	}
+	l.log.Warnf("target %s failed %d times in a row, not using it for %s: %s", b.address, failures, l.ejectFor, err)
+	b.ejectedUntil.Store(time.Now().Add(l.ejectFor).UnixNano())
+}
+
+// routeBalanced picks the target of an accepted connection from the list,
+// closing the connection when there is none to pick.
+func (c *client) routeBalanced(accepted net.Conn, s *Session) bool {
+	if s.backend = c.balancer.pick(); s.backend == nil {
+		c.log.Warnf("no healthy target for connection from %s", accepted.RemoteAddr())
+		accepted.Close()
+		return false
+	}
+	s.target = s.backend.address
+	return true
+}
+
+// maxHealthCheckResponse is how much of the response is searched for the
+// expected payload.
+const maxHealthCheckResponse = 64 * 1024
+
+type healthCheckConfig struct {
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+	send      string
+	expect    string
+}
+
+// unescape interprets the Go escapes in the payloads. Quotes may be given
+// escaped or not.
+func (h *healthCheckConfig) unescape() error {
+	for _, payload := range []*string{&h.send, &h.expect} {
+		unquoted, err := strconv.Unquote(quotePayload(*payload))
+		if err != nil {
+			return fmt.Errorf("invalid payload %q", *payload)
+		}
+		*payload = unquoted
+	}
+	return nil
+}
+
+// quotePayload wraps payload in quotes for strconv.Unquote, escaping the
+// quotes in it that aren't escaped already.
+func quotePayload(payload string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(payload); i++ {
+		switch payload[i] {
+		case '\\':
+			// the escaped character, whatever it is, stays as it is
+			b.WriteByte('\\')
+			if i+1 < len(payload) {
+				i++
+				b.WriteByte(payload[i])
+			}
+		case '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(payload[i])
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// check checks the backends every interval until done is closed. A backend
+// failing the threshold of checks in a row is down until it passes as many.
+func (l *balancer) check(dialer proxy.Dialer, h healthCheckConfig, done <-chan struct{}) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range l.all() {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				l.checkBackend(dialer, b, h)
+			}(b)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (l *balancer) checkBackend(dialer proxy.Dialer, b *backend, h healthCheckConfig) {
+	err := healthCheck(dialer, b.address, h)
+	if (err != nil) == b.down.Load() {
+		b.streak = 0
+		return
+	}
+	if b.streak++; b.streak < h.threshold {
+		return
+	}
+	b.streak = 0
+	if err != nil {
+		l.log.Warnf("target %s failed health check, not using it: %s", b.address, err)
+		b.down.Store(true)
+	} else {
+		l.log.Infof("target %s passed health check, using it again", b.address)
+		b.down.Store(false)
+	}
+}
+
+// healthCheck connects to addr and, with a payload to send or expect,
+// exchanges it within the timeout.
+func healthCheck(dialer proxy.Dialer, addr string, h healthCheckConfig) error {
+	deadline := time.Now().Add(h.timeout)
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	dialed := make(chan dialResult, 1)
+	go func() {
+		conn, err := dialer.Dial("tcp", addr)
+		dialed <- dialResult{conn, err}
+	}()
+	var conn net.Conn
+	select {
+	case r := <-dialed:
+		if r.err != nil {
+			return r.err
+		}
+		conn = r.conn
+	case <-time.After(h.timeout):
+		go func() {
+			if r := <-dialed; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return errors.New("timed out connecting")
+	}
+	defer conn.Close()
+
+	if h.send == "" && h.expect == "" {
+		return nil
+	}
+	_ = conn.SetDeadline(deadline)
+	if _, err := conn.Write([]byte(h.send)); err != nil {
+		return err
+	}
+	if h.expect == "" {
+		return nil
+	}
+	var received []byte
+	buf := make([]byte, 4096)
+	for !bytes.Contains(received, []byte(h.expect)) {
+		if len(received) >= maxHealthCheckResponse {
+			return fmt.Errorf("expected %q within %d bytes", h.expect, maxHealthCheckResponse)
+		}
+		n, err := conn.Read(buf)
+		received = append(received, buf[:n]...)
+		if err != nil && !bytes.Contains(received, []byte(h.expect)) {
+			return fmt.Errorf("expected %q: %w", h.expect, err)
+		}
+	}
+	return nil
+}
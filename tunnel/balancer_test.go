@@ -0,0 +1,43 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import "testing"
+
+func TestHealthCheckUnescape(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+		ok      bool
+	}{
+		{`PING\r\n`, "PING\r\n", true},
+		{`say "hi"`, `say "hi"`, true},
+		{`say \"hi\"`, `say "hi"`, true},
+		{`mixed "a\" b`, `mixed "a" b`, true},
+		{`\x00\x01`, "\x00\x01", true},
+		{`back\\slash`, `back\slash`, true},
+		{`trailing\`, "", false},
+		{`\q`, "", false},
+	}
+	for _, tt := range tests {
+		h := healthCheckConfig{send: tt.payload}
+		err := h.unescape()
+		if tt.ok && (err != nil || h.send != tt.want) {
+			t.Errorf("unescape(%q) = %q, %v, expected %q", tt.payload, h.send, err, tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("unescape(%q) = %q, expected an error", tt.payload, h.send)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a ban admin client may take to send its command
+const banAdminTimeout = 5 * time.Second
+
+// how often changed bans are written to the state file
+const banCheckpointInterval = 10 * time.Second
+
+// banConfig tells when clients failing checks get banned.
+type banConfig struct {
+	// failures within window that get a client IP banned, never when zero
+	failures int
+	window   time.Duration
+	// how long a ban lasts
+	duration time.Duration
+	// where list and unban commands are taken, nowhere when empty
+	admin string
+	// file the bans are kept in across restarts, none when empty
+	state string
+}
+
+// banList tracks the failures of client IPs and bans those with too many.
+type banList struct {
+	banConfig
+	mu sync.Mutex
+	// when each IP failed within the window, oldest first
+	failed map[string][]time.Time
+	// when the ban of each IP ends
+	banned map[string]time.Time
+	// last time stale entries have been dropped
+	swept time.Time
+	// bans changed since the state file was written
+	dirty bool
+}
+
+func newBanList(cfg banConfig) *banList {
+	return &banList{
+		banConfig: cfg,
+		failed:    make(map[string][]time.Time),
+		banned:    make(map[string]time.Time),
+		swept:     time.Now(),
+	}
+}
+
+// fail records a failure of ip, banning it when that makes too many. It
+// reports whether ip just got banned.
+func (l *banList) fail(ip string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	if until, ok := l.banned[ip]; ok && now.Before(until) {
+		return false
+	}
+
+	failed := l.failed[ip]
+	for len(failed) > 0 && now.Sub(failed[0]) > l.window {
+		failed = failed[1:]
+	}
+	failed = append(failed, now)
+	if len(failed) < l.failures {
+		l.failed[ip] = failed
+		return false
+	}
+	delete(l.failed, ip)
+	l.banned[ip] = now.Add(l.duration)
+	l.dirty = true
+	return true
+}
+
+// sweep drops the failures that left the window and the bans that ended,
+// at most once per window.
+func (l *banList) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.window {
+		return
+	}
+	l.swept = now
+	for ip, failed := range l.failed {
+		if now.Sub(failed[len(failed)-1]) > l.window {
+			delete(l.failed, ip)
+		}
+	}
+	for ip, until := range l.banned {
+		if !now.Before(until) {
+			delete(l.banned, ip)
+		}
+	}
+}
+
+// isBanned reports whether ip is banned.
+func (l *banList) isBanned(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.banned[ip]
+	if ok && !time.Now().Before(until) {
+		delete(l.banned, ip)
+		return false
+	}
+	return ok
+}
+
+// unban lifts the ban of ip, reporting whether there was one.
+func (l *banList) unban(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.banned[ip]
+	delete(l.banned, ip)
+	delete(l.failed, ip)
+	l.dirty = l.dirty || ok
+	return ok && time.Now().Before(until)
+}
+
+// banState is the layout of the state file: when the ban of each IP ends.
+type banState struct {
+	Banned map[string]time.Time `json:"banned"`
+}
+
+// load restores the bans in force from the state file, if there is one.
+func (l *banList) load() error {
+	data, err := os.ReadFile(l.state)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state banState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid ban state in %s: %w", l.state, err)
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, until := range state.Banned {
+		if net.ParseIP(ip) != nil && now.Before(until) {
+			l.banned[ip] = until
+		}
+	}
+	return nil
+}
+
+// save writes the bans in force to the state file if they changed since it
+// was last written. The file is replaced in one go, so a crash leaves either
+// the old bans or the new ones.
+func (l *banList) save() error {
+	now := time.Now()
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+	state := banState{Banned: make(map[string]time.Time, len(l.banned))}
+	for ip, until := range l.banned {
+		if now.Before(until) {
+			state.Banned[ip] = until
+		}
+	}
+	l.dirty = false
+	l.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = writeFileAtomic(l.state, data)
+	}
+	if err != nil {
+		l.mu.Lock()
+		l.dirty = true
+		l.mu.Unlock()
+	}
+	return err
+}
+
+// checkpointBans writes changed bans to the state file every
+// banCheckpointInterval, and once more when done is closed.
+func (c *client) checkpointBans() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(banCheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			if err := c.bans.save(); err != nil {
+				c.log.Errorf("could not save bans: %s", err)
+			}
+			return
+		}
+		if err := c.bans.save(); err != nil {
+			c.log.Errorf("could not save bans: %s", err)
+		}
+	}
+}
+
+// list describes the bans in force, one line per IP with when it ends.
+func (l *banList) list() []string {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines := make([]string, 0, len(l.banned))
+	for ip, until := range l.banned {
+		if now.Before(until) {
+			lines = append(lines, fmt.Sprintf("%s %s", ip, until.UTC().Format(time.RFC3339)))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// failed records that the client at addr failed a check, such as the TLS
+// handshake, logging in or the access list, banning it once it failed too
+// often.
+func (c *client) failed(addr net.Addr) {
+	ip := addrIP(addr)
+	if c.bans == nil || ip == nil {
+		return
+	}
+	if c.bans.fail(ip.String()) {
+		c.log.Warnf("banning %s for %s: failed %d times within %s",
+			ip, c.bans.duration, c.bans.failures, c.bans.window)
+	}
+}
+
+// banned reports whether the client at addr is banned.
+func (c *client) banned(addr net.Addr) bool {
+	ip := addrIP(addr)
+	return c.bans != nil && ip != nil && c.bans.isBanned(ip.String())
+}
+
+// serveBanAdmin takes one command per connection: "list" answers with the
+// bans in force, "unban <ip>" lifts one.
+func (c *client) serveBanAdmin(listener net.Listener) {
+	defer c.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				c.log.Errorf("error accepting ban admin connection: %s", err)
+			}
+			return
+		}
+		_ = conn.SetDeadline(time.Now().Add(banAdminTimeout))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		reply := c.banAdminReply(strings.Fields(line))
+		c.log.Debugf("ban admin command from %s: %q", conn.RemoteAddr(), strings.TrimSpace(line))
+		if _, err = conn.Write([]byte(reply)); err != nil {
+			c.log.Debugf("failed to answer ban admin command: %s", err)
+		}
+		conn.Close()
+	}
+}
+
+func (c *client) banAdminReply(command []string) string {
+	switch {
+	case len(command) == 1 && command[0] == "list":
+		var b strings.Builder
+		for _, line := range c.bans.list() {
+			b.WriteString(line + "\n")
+		}
+		return b.String()
+	case len(command) == 2 && command[0] == "unban":
+		ip := net.ParseIP(command[1])
+		if ip == nil {
+			return "invalid IP\n"
+		}
+		if !c.bans.unban(ip.String()) {
+			return "not banned\n"
+		}
+		c.log.Infof("unbanned %s on request", ip)
+		return "unbanned\n"
+	}
+	return "unknown command, expected list or unban <ip>\n"
+}
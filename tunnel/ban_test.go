@@ -0,0 +1,135 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	const window = 100 * time.Millisecond
+	type step struct {
+		// fail, wait, unban or banned
+		op string
+		ip string
+		// what fail, unban or banned returns
+		ok bool
+	}
+	fail := func(ip string, banned bool) step { return step{"fail", ip, banned} }
+	wait := step{op: "wait"}
+	tests := []struct {
+		name     string
+		failures int
+		duration time.Duration
+		steps    []step
+	}{
+		{"banned at the last failure", 3, time.Hour, []step{
+			fail("192.0.2.1", false), fail("192.0.2.1", false), {"banned", "192.0.2.1", false},
+			fail("192.0.2.1", true), {"banned", "192.0.2.1", true},
+			// failing again doesn't ban anew
+			fail("192.0.2.1", false),
+		}},
+		{"each IP counted apart", 2, time.Hour, []step{
+			fail("192.0.2.1", false), fail("192.0.2.2", false), {"banned", "192.0.2.1", false},
+			fail("192.0.2.2", true), {"banned", "192.0.2.1", false}, {"banned", "192.0.2.2", true},
+		}},
+		{"failures leave the window", 2, time.Hour, []step{
+			fail("192.0.2.1", false), wait, fail("192.0.2.1", false), fail("192.0.2.1", true),
+		}},
+		{"ban ends", 1, window / 2, []step{
+			fail("192.0.2.1", true), {"banned", "192.0.2.1", true}, wait, {"banned", "192.0.2.1", false},
+			{"unban", "192.0.2.1", false},
+		}},
+		{"unban", 1, time.Hour, []step{
+			{"unban", "192.0.2.1", false}, fail("192.0.2.1", true), {"unban", "192.0.2.1", true},
+			{"banned", "192.0.2.1", false}, fail("192.0.2.1", true),
+		}},
+	}
+	for _, tt := range tests {
+		l := newBanList(banConfig{failures: tt.failures, window: window, duration: tt.duration})
+		for i, s := range tt.steps {
+			var ok bool
+			switch s.op {
+			case "wait":
+				time.Sleep(window + window/2)
+				continue
+			case "fail":
+				ok = l.fail(s.ip)
+			case "unban":
+				ok = l.unban(s.ip)
+			case "banned":
+				ok = l.isBanned(s.ip)
+			}
+			if ok != s.ok {
+				t.Errorf("%s: step %d, %s %s = %v, expected %v", tt.name, i, s.op, s.ip, ok, s.ok)
+			}
+		}
+	}
+}
+
+func TestBanListState(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "bans.json")
+	cfg := banConfig{failures: 1, window: time.Minute, duration: time.Hour, state: state}
+
+	l := newBanList(cfg)
+	if err := l.load(); err != nil {
+		t.Fatalf("load without a state file: %v", err)
+	}
+	l.fail("192.0.2.1")
+	l.fail("2001:db8::1")
+	if err := l.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newBanList(cfg)
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		if !restored.isBanned(ip) {
+			t.Errorf("ban of %s not restored", ip)
+		}
+	}
+	if got, expected := strings.Join(restored.list(), "\n"), strings.Join(l.list(), "\n"); got != expected {
+		t.Errorf("restored bans %q, expected %q", got, expected)
+	}
+}
+
+func TestBanAdminReply(t *testing.T) {
+	c := newClient(clientConfig{}, make(chan struct{}), make(chan struct{}), make(chan struct{}))
+	c.bans = newBanList(banConfig{failures: 1, window: time.Minute, duration: time.Hour})
+	c.bans.fail("192.0.2.1")
+
+	tests := []struct {
+		command string
+		reply   string
+	}{
+		{"list", "192.0.2.1 "},
+		{"unban 192.0.2.2", "not banned\n"},
+		{"unban example.com", "invalid IP\n"},
+		{"unban 192.0.2.1", "unbanned\n"},
+		{"unban 192.0.2.1", "not banned\n"},
+		{"list", ""},
+		{"ban 192.0.2.1", "unknown command"},
+	}
+	for _, tt := range tests {
+		reply := c.banAdminReply(strings.Fields(tt.command))
+		if !strings.HasPrefix(reply, tt.reply) || (tt.reply == "" && reply != "") {
+			t.Errorf("%q answered with %q, expected %q", tt.command, reply, tt.reply)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+import "github.com/sirupsen/logrus"
+
+// certReloader serves the certificate and client CA of the TLS listeners,
+// re-reading their files when they change so connections accepted from then
+// on get the new ones. Established connections keep what they were accepted
+// with.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	// client CA file, none when empty
+	clientCA string
+	// configuration the client CA is added to for each handshake
+	base *tls.Config
+	log  logrus.FieldLogger
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// of certFile, keyFile and clientCA when they were last read
+	modTimes [3]time.Time
+}
+
+func newCertReloader(t tlsServerConfig, base *tls.Config, log logrus.FieldLogger) (*certReloader, error) {
+	r := &certReloader{
+		certFile: t.certFile,
+		keyFile:  t.keyFile,
+		clientCA: t.clientCA,
+		base:     base,
+		log:      log,
+	}
+	if err := r.load(true); err != nil {
+		return nil, err
+	}
+	base.GetCertificate = r.getCertificate
+	if r.clientCA != "" {
+		base.GetConfigForClient = r.configForClient
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return r, nil
+}
+
+// load reads the files again if force is set or any of them changed since
+// they were last read, keeping the ones read before when they can't be.
+func (r *certReloader) load(force bool) error {
+	var modTimes [3]time.Time
+	for i, file := range []string{r.certFile, r.keyFile, r.clientCA} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	r.mu.RLock()
+	changed := modTimes != r.modTimes
+	r.mu.RUnlock()
+	if !force && !changed {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if r.clientCA != "" {
+		if clientCAs, err = loadCertPool(r.clientCA); err != nil {
+			return fmt.Errorf("could not load client CA: %w", err)
+		}
+	}
+
+	r.mu.Lock()
+	reloaded := r.cert != nil
+	r.cert, r.clientCAs, r.modTimes = &cert, clientCAs, modTimes
+	r.mu.Unlock()
+	if reloaded {
+		r.log.Infof("reloaded TLS certificate %s", r.certFile)
+	}
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// configForClient returns the base configuration with the current client CA.
+// It is cloned for every handshake so the session ticket keys set on the base
+// since then are used.
+func (r *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	config := r.base.Clone()
+	config.GetConfigForClient = nil
+	r.mu.RLock()
+	config.ClientCAs = r.clientCAs
+	r.mu.RUnlock()
+	return config, nil
+}
+
+// watch checks the files for changes every interval until done is closed.
+func (r *certReloader) watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.load(false); err != nil {
+				r.log.Warnf("could not reload TLS certificate, keeping the one loaded: %s", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,1477 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+// Copyright 2017 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+	"golang.org/x/time/rate"
+)
+
+// clientConfig holds the user supplied settings of a client.
+type clientConfig struct {
+	listenAddress   string
+	targetAddress   string
+	proxyAddress    string
+	portFile        string
+	printPort       bool
+	listenNetns     string
+	dialNetns       string
+	ftp             bool
+	fragment        fragmentConfig
+	agentAddress    string
+	agentCapacity   int
+	dnsListen       string
+	dnsResolver     string
+	firewall        string
+	usage           usageConfig
+	hooks           hookConfig
+	events          Events
+	acceptRate      float64
+	acceptBurst     int
+	backlog         int
+	acceptQueue     int
+	acceptOverflow  string
+	closing         closePolicy
+	sniTarget       string
+	headerTarget    bool
+	headerAllow     string
+	sniAllow        string
+	socksBind       bool
+	proxyCA         string
+	proxySNI        string
+	sslKeyLog       string
+	proxyCooldown   time.Duration
+	keepAlivePeriod time.Duration
+	keepAlive       keepAliveConfig
+	mss             int
+	transparent     bool
+	stall           stallConfig
+	listenBPF       string
+	acceptFilter    string
+	dialTimeout     time.Duration
+	udpTimeout      time.Duration
+	// octal permissions of unix:// listening sockets, left to the umask when empty
+	unixMode  string
+	tlsServer tlsServerConfig
+	tlsClient tlsClientConfig
+	ssh       sshConfig
+	// PAC script (URL or file) picking the proxy per target
+	pac string
+	// how often the proxies of a list are probed, never when zero
+	proxyProbeInterval time.Duration
+	// dialed through the proxies to probe them instead of connecting to them
+	proxyProbeTarget string
+	// head start of the preferred address family, racing disabled when negative
+	fallbackDelay time.Duration
+	// cache the addresses names resolve to for their TTL, or for good
+	cacheLookups bool
+	resolveOnce  bool
+	// comma separated CIDRs of the clients let in and of those kept out
+	allow string
+	deny  string
+	// connections handled at once, unlimited when zero
+	maxConns int
+	// how long a connection over the limit waits for a slot, rejected right away when zero
+	maxConnsWait time.Duration
+	// slots of maxConns only clients in the comma separated priority CIDRs may take, none when zero
+	maxConnsReserved int
+	maxConnsPriority string
+	// connections handled at once from one client IP, unlimited when zero
+	maxConnsPerIP int
+	// limits of the sessions of each identity, and of single ones
+	identityLimit     IdentityLimit
+	identityOverrides map[string]IdentityLimit
+	// how long a connection over the per IP limit waits for a slot, rejected right away when zero
+	maxConnsPerIPWait time.Duration
+	// how long a tunneled connection may stay open and how many bytes it may copy, unlimited when zero
+	maxSession time.Duration
+	maxBytes   int64
+	// bytes per second copied in each direction, by all connections and by each, unlimited when zero
+	rateLimit        int64
+	rateLimitPerConn int64
+	// countries and autonomous systems of the clients let in and kept out
+	geoIP geoConfig
+	// when clients failing checks get banned
+	ban banConfig
+	// nameservers (plain, tls:// or https://) to look names up with instead of the system resolver
+	dns string
+	// where the targets of proxied connections are resolved
+	proxyResolve string
+	// how connections are distributed across a list of targets
+	balance string
+	// how the targets of a list are checked, not at all when the interval is zero
+	healthCheck healthCheckConfig
+	// consecutive failures a target of a list is ejected after, never when zero
+	ejectAfter int
+	// how long an ejected target gets no connections
+	ejectFor time.Duration
+	// comma separated <match>=<proxy> rules choosing the proxy by target, none when empty
+	proxyRules string
+	// PROXY protocol version to announce the client to the target with, none when empty
+	proxyProtocolOut string
+	// take the client's address from a PROXY protocol header on accepted connections
+	proxyProtocolIn bool
+	// comma separated CIDRs of the load balancers whose PROXY protocol headers are believed
+	proxyProtocolTrusted string
+	// files with the secret peers dialing the listener and the peer the target is authenticate with, none when empty
+	peerKeyInFile  string
+	peerKeyOutFile string
+	// seal the stream between the peers, whichever side asks for it
+	peerEncrypt bool
+	// compress the stream between the peers with this, not at all when neither side asks for it
+	peerCompress string
+	// browser whose ClientHello TLS to the target and to proxies mimics, Go's when empty
+	tlsFingerprint string
+	// host wss:// targets are reached through, named in TLS instead of theirs
+	frontDomain string
+	// mean time between the dummy frames of the obfuscated stream between the peers, not obfuscated when zero
+	peerObfuscate time.Duration
+	// accept connections redirected by iptables, dialing their original destination
+	transparentListen bool
+	// protocol the listener speaks as a proxy, not one when empty
+	proxyServer string
+	// users clients of the proxy server log in as, anyone may use it when empty
+	proxyServerAuth string
+	// pattern the targets asked of the proxy server have to match, any when empty
+	proxyServerAllow string
+	// credentials for proxies whose URL has none, the file taking precedence
+	proxyCredFile string
+	proxyUser     string
+	proxyPassword string
+	// Prometheus metrics of the tunnel, nil when not in use
+	metrics *tunnelMetrics
+	// file every closed connection gets a JSON line in, none when empty
+	accessLogPath string
+	// dials the target or the first proxy instead of a net.Dialer when set
+	baseDialer proxy.Dialer
+	log        logrus.FieldLogger
+}
+
+type client struct {
+	clientConfig
+	dialer   proxy.Dialer
+	proxyURL *url.URL
+	// credentials for proxies whose URL has none, nil when not in use
+	proxyCredentials *url.Userinfo
+	// the proxy list to probe, nil when not in use
+	proxyProbes *failoverDialer
+	// users of the proxy server, nil when no login is needed
+	proxyServerUsers proxyUsers
+	// one entry per connection being handled, nil when unlimited
+	connSlots chan struct{}
+	// one entry per connection from a client outside of priorityNets, nil when no slots are reserved
+	ordinarySlots chan struct{}
+	priorityNets  []*net.IPNet
+	// bandwidth shared by all connections from clients and from targets, nil when unlimited
+	bandwidthIn  *rate.Limiter
+	bandwidthOut *rate.Limiter
+	// sessions of each client identity, nil when unlimited
+	identityLimits *identityLimits
+	// connection slots of each client IP, nil when unlimited
+	ipSlots   map[string]*ipSlots
+	ipSlotsMu sync.Mutex
+	// secrets of the peer handshakes on accepted and dialed connections, nil when not in use
+	peerKeyIn  []byte
+	peerKeyOut []byte
+	// clients banned for failing checks, nil when not banning
+	bans *banList
+	// decides which clients may connect, nil to let anyone in
+	access *accessList
+	// decides which clients may connect by where they are, nil to let anyone in
+	geo *geoFilter
+	// picks the target of each connection from the list, nil for a single target
+	balancer *balancer
+	// keeps the targets of the balancer in sync with a registry, nil for a fixed list
+	targetSource targetSource
+	// serves the certificate of the TLS listeners, nil when not terminating TLS
+	certs atomic.Pointer[certReloader]
+	// replaces the session ticket keys of the TLS listeners, nil when crypto/tls does
+	tickets atomic.Pointer[ticketKeys]
+	// load balancers allowed to send a PROXY protocol header
+	proxyProtocolNets []*net.IPNet
+	// terminates TLS after the PROXY protocol header, nil when the listener does it
+	tlsAfterProxyHeader *tls.Config
+	// ports of the TCP listeners, to tell redirected connections from those made to the listener
+	listenPorts map[int]bool
+	// derives targets from the requested server name, nil when not in use
+	sniRouter *sniRouter
+	// takes targets from a header sent by the client, nil when not in use
+	headerRouter *headerRouter
+	// the targets clients of the proxy server may ask for, nil for any
+	proxyServerTargets *regexp.Regexp
+	// receives TLS session keys in NSS key log format, nil when not in use
+	keyLog io.Writer
+	// wraps connections to the target in TLS, nil when not in use
+	targetTLS *tls.Config
+	// carriers to mux:// targets
+	mux *muxDialer
+	// filters packets of the listening sockets, nil when not in use
+	bpfProgram []bpfInstruction
+	// per-client transfer totals, nil when not in use
+	usageLedger *usageLedger
+	// records of the closed connections, nil when not in use
+	accessLog *accessLog
+	// a slot for each hook command running
+	hookSem chan struct{}
+	// hook runs have been dropped since one last got a slot
+	hooksBehind atomic.Bool
+	// throttles the accept loop, nil when unlimited
+	acceptLimiter *rate.Limiter
+	wg            sync.WaitGroup
+	// accept loops and the connection handlers they started, waited for when draining
+	serving sync.WaitGroup
+	conns   sync.WaitGroup
+	active  atomic.Int64
+	// the connections being tunneled, for Tunnel.Sessions
+	sessions   map[*Session]struct{}
+	sessionsMu sync.Mutex
+	started    time.Time
+	// recovered panics
+	panics  atomic.Int64
+	errChan chan error
+	// closed to ask Run to stop
+	stop <-chan struct{}
+	// closed to ask Run to stop accepting and return once the connections finished
+	drain <-chan struct{}
+	// closed once the listeners are closed for draining, and once they are closed at all
+	draining chan struct{}
+	unbound  chan struct{}
+	done     chan struct{}
+}
+
+func newClient(cfg clientConfig, stop, drain <-chan struct{}, unbound chan struct{}) *client {
+	if cfg.log == nil {
+		cfg.log = log
+	}
+	if cfg.hooks.concurrency < 1 {
+		cfg.hooks.concurrency = 1
+	}
+	var acceptLimiter *rate.Limiter
+	if cfg.acceptRate > 0 {
+		if cfg.acceptBurst < 1 {
+			cfg.acceptBurst = 1
+		}
+		acceptLimiter = rate.NewLimiter(rate.Limit(cfg.acceptRate), cfg.acceptBurst)
+	}
+	return &client{
+		clientConfig:  cfg,
+		acceptLimiter: acceptLimiter,
+		wg:            sync.WaitGroup{},
+		hookSem:       make(chan struct{}, cfg.hooks.concurrency),
+		sessions:      make(map[*Session]struct{}),
+		started:       time.Now(),
+		errChan:       make(chan error, 1),
+		stop:          stop,
+		drain:         drain,
+		draining:      make(chan struct{}),
+		unbound:       unbound,
+		done:          make(chan struct{}),
+	}
+}
+
+func (c *client) connCopy(dst, src net.Conn, s *Session, written *atomic.Int64, copyDone chan struct{}) {
+	defer c.wg.Done()
+	defer s.copies.Done()
+	defer func() {
+		copyDone <- struct{}{}
+	}()
+	defer c.recoverPanic(s, dst, src)
+	if c.stall.isSet() {
+		err := c.stallCopy(dst, src, s, written)
+		s.setCloseReason(copyCloseReason(err, written == &s.bytesIn))
+		if err != nil && !errors.Is(err, errDataCap) {
+			c.log.Errorf("failed to copy connection from %s to %s: %s",
+				src.RemoteAddr(), dst.RemoteAddr(), err)
+		}
+		return
+	}
+	// counted as it goes, so Tunnel.Sessions shows the progress
+	_, err := io.Copy(&countingWriter{Writer: dst, written: written}, src)
+	s.setCloseReason(copyCloseReason(err, written == &s.bytesIn))
+	if err != nil && written == &s.bytesOut && !errors.Is(err, net.ErrClosed) {
+		// the target broke off the stream, held against it when balancing
+		s.targetErr = err
+	}
+	if err != nil {
+		opErr, ok := err.(*net.OpError)
+		switch {
+		case ok && opErr.Op == "readfrom":
+			return
+		case ok && opErr.Op == "read":
+			return
+		case ok && opErr.Op == "writeto":
+			return
+		case errors.Is(err, net.ErrClosed):
+			// the other direction finished and closed the connections
+			return
+		case errors.Is(err, errDataCap):
+			// logged once by handleConn
+			return
+		default:
+		}
+		c.log.Errorf("failed to copy connection from %s to %s: %s",
+			src.RemoteAddr(), dst.RemoteAddr(), err)
+	}
+}
+
+func (c *client) run() error {
+	// Drain waits for this, even when failing before listening
+	defer func() {
+		select {
+		case <-c.unbound:
+		default:
+			close(c.unbound)
+		}
+	}()
+	var proxyURLs []*url.URL
+	var err error
+	if c.proxyAddress != "" {
+		proxyURLs, err = parseProxyList(c.proxyAddress)
+		if err != nil {
+			return configError(fmt.Errorf("could not parse proxy URL: %w", err))
+		}
+	}
+	if c.proxyCredentials, err = c.loadProxyCredentials(); err != nil {
+		return preflightError(fmt.Errorf("could not load proxy credentials: %w", err))
+	}
+	if len(proxyURLs) > 0 {
+		// BIND is always requested from the most preferred proxy
+		c.proxyURL = c.withProxyCredentials(proxyURLs[0])
+	}
+	if c.pac != "" && len(proxyURLs) > 0 {
+		return configError(errors.New("-pac and -proxy can't be combined"))
+	}
+	var proxyRules []proxyRule
+	if c.proxyRules != "" {
+		if c.pac != "" {
+			return configError(errors.New("-pac and -proxy-rules can't be combined"))
+		}
+		if proxyRules, err = parseProxyRules(c.proxyRules); err != nil {
+			return configError(err)
+		}
+	}
+	proxied := len(proxyURLs) > 0 || c.pac != "" || len(proxyRules) > 0
+	if c.socksBind && (c.proxyURL == nil || c.proxyURL.Scheme != "socks5") {
+		return configError(errors.New("SOCKS BIND requires a socks5:// proxy"))
+	}
+	if c.transparent {
+		if err = checkTransparent(); err != nil {
+			return configError(err)
+		}
+		if proxied || c.socksBind || IsRelayURL(c.targetAddress) {
+			return configError(errors.New("the client's address can only be kept when dialing the target directly"))
+		}
+	}
+	if isUDPURL(c.targetAddress) && (proxied || c.socksBind || c.transparent) {
+		return configError(errors.New("a udp:// target can only be reached directly"))
+	}
+	if isUnixURL(c.targetAddress) && (proxied || c.socksBind || c.transparent) {
+		return configError(errors.New("a unix:// target can only be reached directly"))
+	}
+	if err = checkSocketOptions(c.keepAlive, c.mss); err != nil {
+		return configError(err)
+	}
+	if err = c.closing.validate(); err != nil {
+		return configError(err)
+	}
+	if c.acceptOverflow == "" {
+		c.acceptOverflow = OverflowDrop
+		if c.closing.limit == CloseRST {
+			c.acceptOverflow = OverflowReset
+		}
+	}
+	if c.acceptQueue > 0 {
+		if err = validOverflowPolicy(c.acceptOverflow); err != nil {
+			return configError(err)
+		}
+	}
+
+	if c.firewall != "" {
+		if err = validFirewallBackend(c.firewall); err != nil {
+			return configError(err)
+		}
+	}
+	if c.dnsListen != "" && c.dnsResolver == "" {
+		return configError(errors.New("-dns-listen requires -dns-resolver"))
+	}
+	if c.headerTarget {
+		if c.sniTarget != "" {
+			return configError(errors.New("-header-target and -sni-target can't be combined"))
+		}
+		if c.headerRouter, err = newHeaderRouter(c.headerAllow); err != nil {
+			return configError(err)
+		}
+	}
+	if c.proxyProtocolOut != "" {
+		if err = validProxyProtocol(c.proxyProtocolOut); err != nil {
+			return configError(err)
+		}
+		if isUDPURL(c.targetAddress) || c.socksBind {
+			return configError(errors.New("PROXY protocol can't be sent to udp:// targets or over SOCKS BIND"))
+		}
+	}
+	if c.proxyProtocolIn && (isUDPURL(c.listenAddress) || isWebSocketURL(c.listenAddress) || isMuxURL(c.listenAddress) || c.socksBind) {
+		return configError(errors.New("PROXY protocol can't be accepted on udp://, WebSocket or mux:// listeners or with SOCKS BIND"))
+	}
+	if c.proxyProtocolIn {
+		if c.proxyProtocolNets, err = parseCIDRs(c.proxyProtocolTrusted); err != nil {
+			return configError(fmt.Errorf("invalid trusted load balancers: %w", err))
+		}
+		if len(c.proxyProtocolNets) == 0 {
+			return configError(errors.New("accepting the PROXY protocol needs the CIDRs of the load balancers to trust"))
+		}
+	}
+	if c.peerKeyInFile != "" {
+		if isUDPURL(c.listenAddress) || c.socksBind {
+			return configError(errors.New("peers can't authenticate on udp:// listeners or with SOCKS BIND"))
+		}
+		if c.peerKeyIn, err = readPeerKey(c.peerKeyInFile); err != nil {
+			return preflightError(fmt.Errorf("could not read peer key: %w", err))
+		}
+	}
+	if (c.peerEncrypt || c.peerCompress != "" || c.peerObfuscate > 0) && c.peerKeyInFile == "" && c.peerKeyOutFile == "" {
+		return configError(errors.New("encrypting, compressing or obfuscating the stream between peers needs a peer key"))
+	}
+	if err = validCompression(c.peerCompress); err != nil {
+		return configError(err)
+	}
+	if c.peerKeyOutFile != "" {
+		if isUDPURL(c.targetAddress) || c.socksBind {
+			return configError(errors.New("peers can't be authenticated to over udp:// or SOCKS BIND"))
+		}
+		if c.peerKeyOut, err = readPeerKey(c.peerKeyOutFile); err != nil {
+			return preflightError(fmt.Errorf("could not read peer key: %w", err))
+		}
+	}
+	if c.transparentListen {
+		if err = checkTransparentListen(); err != nil {
+			return configError(err)
+		}
+		if c.targetAddress != "" || c.sniTarget != "" || c.headerTarget || c.proxyServer != "" {
+			return configError(errors.New("-transparent takes the target from the redirected connections, it can't be combined with -target, -sni-target, -header-target or -proxy-server"))
+		}
+		if IsRelayURL(c.listenAddress) || isUDPURL(c.listenAddress) || isUnixURL(c.listenAddress) || isWebSocketURL(c.listenAddress) || isMuxURL(c.listenAddress) {
+			return configError(errors.New("-transparent needs a TCP listener"))
+		}
+	}
+	if c.proxyServer != "" {
+		if err = validProxyServer(c.proxyServer); err != nil {
+			return configError(err)
+		}
+		if c.targetAddress != "" || c.sniTarget != "" || c.headerTarget {
+			return configError(errors.New("a proxy server takes the target from its clients, it can't be combined with -target, -sni-target or -header-target"))
+		}
+		if c.transparent || c.ftp || c.socksBind || isUDPURL(c.listenAddress) {
+			return configError(errors.New("a proxy server can't be combined with the client's address, FTP, SOCKS BIND or udp:// listeners"))
+		}
+		if c.proxyServerAuth != "" {
+			if c.proxyServerUsers, err = loadProxyUsers(c.proxyServerAuth); err != nil {
+				return preflightError(fmt.Errorf("could not load proxy server users: %w", err))
+			}
+		}
+		if c.proxyServerAllow != "" {
+			if c.proxyServerTargets, err = regexp.Compile("^(?:" + c.proxyServerAllow + ")$"); err != nil {
+				return configError(fmt.Errorf("invalid proxy server target pattern: %w", err))
+			}
+		}
+	}
+	if c.sniTarget != "" {
+		if c.sniRouter, err = newSNIRouter(c.sniAllow, c.sniTarget); err != nil {
+			return configError(err)
+		}
+	}
+
+	if c.maxConns > 0 {
+		c.connSlots = make(chan struct{}, c.maxConns)
+		// the agent-check reports the load against the limit unless told otherwise
+		if c.agentCapacity == 0 {
+			c.agentCapacity = c.maxConns
+		}
+	}
+	if c.maxConnsReserved > 0 {
+		if c.maxConnsReserved >= c.maxConns {
+			return configError(errors.New("the reserved connections have to be fewer than -max-conns"))
+		}
+		if c.priorityNets, err = parseCIDRs(c.maxConnsPriority); err != nil {
+			return configError(fmt.Errorf("invalid -max-conns-priority: %w", err))
+		}
+		if len(c.priorityNets) == 0 {
+			return configError(errors.New("reserved connections need the CIDRs of the clients allowed to use them"))
+		}
+		c.ordinarySlots = make(chan struct{}, c.maxConns-c.maxConnsReserved)
+	}
+	c.bandwidthIn = newBandwidthLimiter(c.rateLimit)
+	c.bandwidthOut = newBandwidthLimiter(c.rateLimit)
+	if c.maxConnsPerIP > 0 {
+		c.ipSlots = make(map[string]*ipSlots)
+	}
+	if c.identityLimits = newIdentityLimits(c.identityLimit, c.identityOverrides); c.identityLimits != nil {
+		if c.proxyServerAuth == "" && c.tlsServer.clientCA == "" {
+			return configError(errors.New("identity limits need clients logging in to the proxy server or presenting certificates"))
+		}
+	}
+	if c.ban.failures > 0 {
+		c.bans = newBanList(c.ban)
+		if c.ban.state != "" {
+			if err = c.bans.load(); err != nil {
+				return preflightError(fmt.Errorf("could not restore bans: %w", err))
+			}
+		}
+	} else if c.ban.admin != "" || c.ban.state != "" {
+		return configError(errors.New("the ban admin listener and state file need a number of failures to ban after"))
+	}
+	if c.allow != "" || c.deny != "" {
+		if c.access, err = newAccessList(c.allow, c.deny); err != nil {
+			return configError(err)
+		}
+	}
+	if c.geoIP.enabled() {
+		if c.geo, err = newGeoFilter(c.geoIP, c.log); err != nil {
+			return configError(err)
+		}
+		if err = c.geo.open(); err != nil {
+			return preflightError(err)
+		}
+		defer c.geo.close()
+	}
+	if c.cacheLookups && c.resolveOnce {
+		return configError(errors.New("-dns-cache can't be combined with -resolve-once"))
+	}
+	if (c.dns != "" || c.cacheLookups || c.resolveOnce) && c.dialNetns != "" {
+		return configError(errors.New("-dns, -dns-cache and -resolve-once can't be combined with -dial-netns"))
+	}
+	if err = validProxyResolve(c.proxyResolve); err != nil {
+		return configError(err)
+	}
+	if c.proxyResolve == ProxyResolveLocal && c.pac != "" {
+		return configError(errors.New("a PAC script picks the proxy by the target's name, it can't be combined with -proxy-resolve local"))
+	}
+	if isTargetList(c.targetAddress) || isConsulURL(c.targetAddress) || isK8sURL(c.targetAddress) {
+		if err = validBalanceStrategy(c.balance); err != nil {
+			return configError(err)
+		}
+		if _, first, last, err := parsePortRange(c.listenAddress); err == nil && first != last {
+			return configError(errors.New("a target list can't be combined with a listening port range"))
+		}
+		if c.socksBind || c.ftp {
+			return configError(errors.New("a target list can't be combined with SOCKS BIND or FTP"))
+		}
+		var backends []*backend
+		if isConsulURL(c.targetAddress) {
+			if c.targetSource, err = newConsulSource(c.targetAddress); err != nil {
+				return configError(err)
+			}
+		} else if isK8sURL(c.targetAddress) {
+			source, err := newK8sSource(c.targetAddress)
+			if err != nil {
+				return configError(err)
+			}
+			if err = source.loadCredentials(); err != nil {
+				return preflightError(fmt.Errorf("could not set up Kubernetes access: %w", err))
+			}
+			c.targetSource = source
+		} else if backends, err = parseTargetList(c.targetAddress); err != nil {
+			return configError(fmt.Errorf("invalid target: %w", err))
+		}
+		if c.balancer, err = newBalancer(c.balance, backends, c.log); err != nil {
+			return configError(err)
+		}
+		// the targets registered already are known before serving
+		if c.targetSource != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), c.dialTimeout)
+			err = c.syncTargets(ctx, c.targetSource)
+			cancel()
+			if err != nil {
+				return preflightError(fmt.Errorf("could not get the targets of %s: %w", c.targetSource, err))
+			}
+		}
+		c.balancer.ejectAfter, c.balancer.ejectFor = c.ejectAfter, c.ejectFor
+		if err = c.healthCheck.unescape(); err != nil {
+			return configError(fmt.Errorf("invalid health check: %w", err))
+		}
+	} else if c.healthCheck.interval > 0 {
+		return configError(errors.New("health checks need a list of targets"))
+	}
+
+	// a relay target is reached by asking the relay for a peer listening under the token
+	target := c.targetAddress
+	var relayToken string
+	if IsRelayURL(c.targetAddress) {
+		if target, relayToken, err = parseRelayURL(c.targetAddress); err != nil {
+			return configError(fmt.Errorf("invalid target: %w", err))
+		}
+	}
+
+	if c.sslKeyLog != "" {
+		keyLog, err := os.OpenFile(c.sslKeyLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return preflightError(fmt.Errorf("could not open TLS key log: %w", err))
+		}
+		defer keyLog.Close()
+		c.log.Warnf("writing TLS session keys to %s, traffic can be decrypted with them", c.sslKeyLog)
+		c.keyLog = keyLog
+	}
+
+	var tlsConfig *tls.Config
+	if c.tlsServer.enabled() {
+		if isUDPURL(c.listenAddress) || c.sniTarget != "" {
+			return configError(errors.New("TLS can only be terminated on TCP listeners not routing by server name"))
+		}
+		if tlsConfig, err = c.newTLSServerConfig(); err != nil {
+			return err
+		}
+	}
+
+	if err = validTLSFingerprint(c.tlsFingerprint); err != nil {
+		return configError(err)
+	}
+	if strings.HasPrefix(c.listenAddress, "wss://") && tlsConfig == nil {
+		return configError(errors.New("a wss:// listener needs a TLS certificate"))
+	}
+	if isWebSocketURL(c.targetAddress) {
+		if c.socksBind || c.transparent || c.ftp {
+			return configError(errors.New("a WebSocket target can't be combined with SOCKS BIND, the client's address or FTP"))
+		}
+		// wss:// is verified like -target-tls does unless configured otherwise
+		if strings.HasPrefix(c.targetAddress, "wss://") {
+			c.tlsClient.enabled = true
+		}
+	}
+	if c.frontDomain != "" {
+		if !strings.HasPrefix(c.targetAddress, "wss://") {
+			return configError(errors.New("-front-domain needs a wss:// target"))
+		}
+		if c.tlsClient.serverName != "" {
+			return configError(errors.New("-front-domain sets the server name, it can't be combined with -target-sni"))
+		}
+	}
+	if isMuxURL(c.targetAddress) && (c.socksBind || c.transparent || c.ftp) {
+		return configError(errors.New("a mux:// target can't be combined with SOCKS BIND, the client's address or FTP"))
+	}
+	c.mux = newMuxDialer(c)
+	if c.tlsClient.enabled {
+		if isUDPURL(c.targetAddress) || c.ftp || c.socksBind {
+			return configError(errors.New("TLS to the target can't be combined with udp:// targets, FTP or SOCKS BIND"))
+		}
+		if c.targetTLS, err = c.newTLSClientConfig(); err != nil {
+			return err
+		}
+	}
+
+	if c.metrics != nil && c.metrics.tunnel == "" {
+		c.metrics.tunnel = c.listenAddress
+	}
+	if c.accessLogPath != "" {
+		if c.accessLog, err = openAccessLog(c.accessLogPath); err != nil {
+			return preflightError(fmt.Errorf("could not open access log: %w", err))
+		}
+		defer c.accessLog.close()
+	}
+	if c.usage.enabled() {
+		if c.usageLedger, err = newUsageLedger(c.usage); err != nil {
+			return preflightError(fmt.Errorf("could not set up usage reports: %w", err))
+		}
+	}
+
+	if c.listenBPF != "" {
+		if c.bpfProgram, err = loadBPF(c.listenBPF); err != nil {
+			return preflightError(fmt.Errorf("could not load BPF listen filter: %w", err))
+		}
+	}
+
+	// default should be direct
+	var dialer proxy.Dialer = &net.Dialer{
+		Timeout:   c.dialTimeout,
+		KeepAlive: c.keepAlivePeriod,
+		Control:   mssControl(c.mss),
+		// races IPv4 against IPv6 when the name has both (RFC 6555), but not within -dial-netns
+		FallbackDelay: netnsFallbackDelay(c.dialNetns, c.fallbackDelay),
+	}
+	if c.baseDialer != nil {
+		dialer = c.baseDialer
+	}
+	resolver, err := newResolver(c.dns, c.cacheLookups, c.resolveOnce)
+	if err != nil {
+		return configError(fmt.Errorf("invalid -dns: %w", err))
+	}
+	if c.dns != "" || c.cacheLookups || c.resolveOnce {
+		dialer = &resolvingDialer{resolver: resolver, dialer: dialer, fallbackDelay: netnsFallbackDelay(c.dialNetns, c.fallbackDelay)}
+	}
+	dialer = &tunedDialer{c: c, dialer: dialer}
+	direct := dialer
+
+	// if proxies have been defined, chain direct with proxy (proxy -> direct),
+	// failing over to the next proxy when one doesn't work
+	if len(proxyURLs) == 1 {
+		if dialer, err = c.proxyDialer(proxyURLs[0], dialer); err != nil {
+			return preflightError(fmt.Errorf("could not construct proxy: %w", err))
+		}
+	} else if len(proxyURLs) > 1 {
+		failover := &failoverDialer{cooldown: c.proxyCooldown, log: c.log}
+		for _, proxyURL := range proxyURLs {
+			proxyDialer, err := c.proxyDialer(proxyURL, dialer)
+			if err != nil {
+				return preflightError(fmt.Errorf("could not construct proxy: %w", err))
+			}
+			failover.proxies = append(failover.proxies, &failoverProxy{
+				name:    redactedURL(proxyURL),
+				dialer:  proxyDialer,
+				address: proxyHostPort(proxyURL),
+				forward: dialer,
+			})
+		}
+		if c.proxyProbeInterval > 0 {
+			c.proxyProbes = failover
+		}
+		dialer = failover
+	} else if c.pac != "" {
+		script, err := loadPAC(c.pac, c.dialTimeout)
+		if err != nil {
+			return preflightError(fmt.Errorf("could not load PAC script: %w", err))
+		}
+		pac := &pacDialer{
+			direct:   dialer,
+			newProxy: c.proxyDialer,
+			cooldown: c.proxyCooldown,
+			log:      c.log,
+		}
+		if pac.script, err = newPACScript(script, c.dialTimeout); err != nil {
+			return preflightError(err)
+		}
+		dialer = pac
+	}
+	// the rules take precedence over the proxies above, which the rest goes through
+	if len(proxyRules) > 0 {
+		rules := &ruleDialer{rules: proxyRules, fallback: dialer}
+		for _, rule := range proxyRules {
+			ruleDialer := direct
+			if rule.proxy != nil {
+				if ruleDialer, err = c.proxyDialer(rule.proxy, direct); err != nil {
+					return preflightError(fmt.Errorf("could not construct proxy: %w", err))
+				}
+			}
+			rules.dialers = append(rules.dialers, ruleDialer)
+		}
+		dialer = rules
+	}
+	// the proxies are handed addresses instead of the target's name
+	if proxied && c.proxyResolve == ProxyResolveLocal {
+		dialer = &resolvingDialer{resolver: resolver, dialer: dialer, fallbackDelay: netnsFallbackDelay(c.dialNetns, c.fallbackDelay)}
+	}
+
+	// dialing has to be performed from within the namespace which should be bridged to
+	if c.dialNetns != "" {
+		dialer = &netnsDialer{netns: c.dialNetns, dialer: dialer}
+	}
+	if relayToken != "" {
+		dialer = &relayDialer{dialer: dialer, token: relayToken}
+	}
+
+	// a port range listens on every port of it, each one with its own target
+	mappings := []PortMapping{{Listen: c.listenAddress, Target: target}}
+	if !IsRelayURL(c.listenAddress) && !isUDPURL(c.listenAddress) && !isUnixURL(c.listenAddress) && !isWebSocketURL(c.listenAddress) && !isMuxURL(c.listenAddress) {
+		if mappings, err = ExpandPortMapping(c.listenAddress, target); err != nil {
+			return configError(fmt.Errorf("invalid port mapping: %w", err))
+		}
+	}
+
+	var listeners []net.Listener
+	closeListeners := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	for _, m := range mappings {
+		listener, err := c.listen(m.Listen)
+		if err != nil {
+			closeListeners()
+			return err
+		}
+		// the PROXY protocol header comes ahead of the TLS handshake
+		switch {
+		case tlsConfig != nil && c.proxyProtocolIn:
+			c.tlsAfterProxyHeader = tlsConfig
+		case tlsConfig != nil && isWebSocketURL(m.Listen):
+			listener = newHandshakingListener(c, listener, tlsConfig)
+		case tlsConfig != nil:
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+		if isWebSocketURL(m.Listen) {
+			u, _, _ := parseWebSocketURL(m.Listen)
+			listener = newWebSocketListener(listener, u.Path)
+		}
+		if isMuxURL(m.Listen) {
+			listener = newMuxListener(listener, c.log, c.peerConfig(c.peerKeyIn))
+		}
+		listeners = append(listeners, listener)
+		if len(mappings) > 1 {
+			c.log.Debugf("Listening port opened on %s, forwarding to %s", listener.Addr(), m.Target)
+		}
+	}
+	if len(mappings) > 1 {
+		c.log.Infof("Listening ports opened on %s (%d ports)", c.listenAddress, len(mappings))
+	} else {
+		c.log.Infof("Listening port opened on %s", listeners[0].Addr())
+	}
+
+	// the listen address may ask for an ephemeral port, so report what we actually got
+	if err = c.reportPort(listeners[0].Addr()); err != nil {
+		closeListeners()
+		return preflightError(fmt.Errorf("could not report listening port: %w", err))
+	}
+
+	closeFirewall := func() {}
+	if c.firewall != "" {
+		if closeFirewall, err = c.openFirewallPorts(listeners); err != nil {
+			closeListeners()
+			return preflightError(fmt.Errorf("could not open firewall: %w", err))
+		}
+	}
+	defer closeFirewall()
+
+	var agentListener net.Listener
+	if c.agentAddress != "" {
+		if agentListener, err = net.Listen("tcp", c.agentAddress); err != nil {
+			closeListeners()
+			return bindError(fmt.Errorf("could not start agent-check listener: %w", err))
+		}
+		c.log.Infof("agent-check listener opened on %s", agentListener.Addr())
+		c.wg.Add(1)
+		go c.serveAgent(agentListener)
+	}
+
+	var banAdminListener net.Listener
+	if c.ban.admin != "" {
+		if banAdminListener, err = net.Listen("tcp", c.ban.admin); err != nil {
+			closeListeners()
+			if agentListener != nil {
+				agentListener.Close()
+			}
+			return bindError(fmt.Errorf("could not start ban admin listener: %w", err))
+		}
+		c.log.Infof("ban admin listener opened on %s", banAdminListener.Addr())
+		c.wg.Add(1)
+		go c.serveBanAdmin(banAdminListener)
+	}
+
+	c.dialer = dialer
+	closeDNS := func() {}
+	if c.dnsListen != "" {
+		if closeDNS, err = c.startDNS(); err != nil {
+			closeListeners()
+			if agentListener != nil {
+				agentListener.Close()
+			}
+			if banAdminListener != nil {
+				banAdminListener.Close()
+			}
+			return bindError(fmt.Errorf("could not start DNS forwarder: %w", err))
+		}
+	}
+
+	if c.usageLedger != nil {
+		c.wg.Add(1)
+		go c.reportUsage()
+	}
+	if c.bans != nil && c.ban.state != "" {
+		c.wg.Add(1)
+		go c.checkpointBans()
+	}
+	if c.proxyProbes != nil {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.proxyProbes.probe(c.proxyProbeTarget, c.proxyProbeInterval, c.done)
+		}()
+	}
+	if certs := c.certs.Load(); certs != nil && c.tlsServer.reload > 0 {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			certs.watch(c.tlsServer.reload, c.done)
+		}()
+	}
+	if tickets := c.tickets.Load(); tickets != nil && c.tlsServer.ticketRotate > 0 {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			tickets.run(c.tlsServer.ticketRotate, c.done)
+		}()
+	}
+	if c.geo != nil && c.geoIP.reload > 0 {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.geo.reload(c.geoIP.reload, c.done)
+		}()
+	}
+	if c.targetSource != nil {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.watchTargets(c.targetSource)
+		}()
+	}
+	if c.balancer != nil && c.healthCheck.interval > 0 {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.balancer.check(c.dialer, c.healthCheck, c.done)
+		}()
+	}
+
+	addrs := make([]net.Addr, 0, len(listeners))
+	c.listenPorts = make(map[int]bool)
+	for _, listener := range listeners {
+		if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok {
+			c.listenPorts[tcpAddr.Port] = true
+		}
+	}
+	for i, listener := range listeners {
+		addrs = append(addrs, listener.Addr())
+		c.serving.Add(1)
+		go func(listener net.Listener, target string) {
+			defer c.serving.Done()
+			c.superviseServe(listener, target)
+		}(listener, mappings[i].Target)
+	}
+	c.events.listen(addrs)
+
+	unbind := func() {
+		for _, listener := range listeners {
+			if err := listener.Close(); err != nil {
+				c.log.Errorf("failed to close listener: %s", err)
+			}
+		}
+		if agentListener != nil {
+			agentListener.Close()
+		}
+		if banAdminListener != nil {
+			banAdminListener.Close()
+		}
+		closeDNS()
+		close(c.unbound)
+	}
+
+	// wait...
+	select {
+	// Wait for a stop request
+	case <-c.stop:
+		c.log.Infof("stopping on request")
+	// Wait for a listener error
+	case <-c.done:
+	// Wait for a drain request, then for the connections to finish
+	case <-c.drain:
+		c.log.Infof("draining %s: no new connections, waiting for %d to finish", c.listenAddress, len(c.activeSessions()))
+		close(c.draining)
+		unbind()
+		conns := make(chan struct{})
+		go func() {
+			// no connection gets added once the accept loops are gone
+			c.serving.Wait()
+			c.conns.Wait()
+			close(conns)
+		}()
+		select {
+		case <-conns:
+		case <-c.stop:
+		case <-c.done:
+		}
+	}
+
+	// Signal all running goroutines to stop.
+	c.shutdown()
+
+	c.log.Infof("stopping proxy client: %s", c.listenAddress)
+	select {
+	case <-c.unbound:
+	default:
+		unbind()
+	}
+
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		c.wg.Wait()
+	}()
+
+	drained := true
+	select {
+	case <-ch:
+	case <-time.After(time.Duration(10) * time.Second):
+		c.log.Warnf("some goroutines will be stopped forcefully")
+		drained = false
+	}
+	c.mux.closeAll()
+	if c.usageLedger != nil {
+		if err = c.usageLedger.report(); err != nil {
+			c.log.Errorf("could not write final usage report: %s", err)
+		}
+	}
+
+	select {
+	case err = <-c.errChan:
+		return err
+	default:
+	}
+	if !drained {
+		return drainError(errors.New("connections did not drain in time"))
+	}
+	return nil
+}
+
+// listen opens a listener on addr, which may also be a relay, UDP, unix,
+// WebSocket or mux URL.
+func (c *client) listen(addr string) (net.Listener, error) {
+	if isUDPURL(addr) {
+		return c.listenUDP(addr)
+	}
+	if isUnixURL(addr) {
+		return c.listenUnix(addr)
+	}
+	if isMuxURL(addr) {
+		// the carriers are accepted on top once TLS is set up
+		addr = strings.TrimPrefix(addr, muxScheme)
+	}
+	if isWebSocketURL(addr) {
+		// the WebSocket listener is put on top once TLS is set up
+		_, hostPort, err := parseWebSocketURL(addr)
+		if err != nil {
+			return nil, configError(fmt.Errorf("invalid listening address: %w", err))
+		}
+		addr = hostPort
+	}
+	if IsRelayURL(addr) {
+		listener, err := newRelayListener(addr, func(network, addr string) (conn net.Conn, err error) {
+			dialer := &net.Dialer{FallbackDelay: netnsFallbackDelay(c.listenNetns, 0)}
+			err = inNetns(c.listenNetns, func() error {
+				conn, err = dialer.Dial(network, addr)
+				return err
+			})
+			return conn, err
+		}, c.log)
+		if err != nil {
+			return nil, configError(fmt.Errorf("invalid listening address: %w", err))
+		}
+		return listener, nil
+	}
+
+	// the listening socket keeps belonging to the namespace it has been created in
+	var listener net.Listener
+	err := inNetns(c.listenNetns, func() (err error) {
+		config := c.listenConfig()
+		if c.transparentListen {
+			config.Control = transparentListenControl(c.mss, c.log)
+		}
+		listener, err = config.Listen(context.Background(), "tcp", addr)
+		return err
+	})
+	if err != nil {
+		return nil, bindError(fmt.Errorf("could not start listening: %w", err))
+	}
+	if c.backlog > 0 {
+		if err = setBacklog(listener.(*net.TCPListener), c.backlog); err != nil {
+			listener.Close()
+			return nil, bindError(err)
+		}
+	}
+	if c.bpfProgram != nil {
+		if err = attachBPF(listener.(*net.TCPListener), c.bpfProgram); err != nil {
+			listener.Close()
+			return nil, bindError(err)
+		}
+	}
+	if c.acceptFilter != "" {
+		if err = setAcceptFilter(listener.(*net.TCPListener), c.acceptFilter); err != nil {
+			listener.Close()
+			return nil, bindError(err)
+		}
+	}
+	return listener, nil
+}
+
+// proxyDialer returns a dialer connecting through the proxy described by proxyURL.
+func (c *client) proxyDialer(proxyURL *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	proxyURL = c.withProxyCredentials(proxyURL)
+	switch proxyURL.Scheme {
+	case "https":
+		tlsConfig, err := newHTTPSProxyConfig(proxyURL, c.proxyCA, c.proxySNI)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.KeyLogWriter = c.keyLog
+		return &httpConnectDialer{
+			proxyURL:    proxyURL,
+			forward:     forward,
+			tlsConfig:   tlsConfig,
+			fingerprint: c.tlsFingerprint,
+			timeout:     c.dialTimeout,
+		}, nil
+	case "http":
+		return &httpConnectDialer{
+			proxyURL: proxyURL,
+			forward:  forward,
+			timeout:  c.dialTimeout,
+		}, nil
+	case "ssh":
+		return newSSHDialer(proxyURL, forward, c.ssh, c.dialTimeout, c.log)
+	default:
+		dialer, err := proxy.FromURL(proxyURL, forward)
+		if err != nil {
+			return nil, err
+		}
+		return &socksDialer{Dialer: dialer}, nil
+	}
+}
+
+func (c *client) serve(accept func() (net.Conn, error), target string) error {
+	// accept loop
+	for {
+		// connections exceeding the rate wait in the accept queue or listen backlog
+		if c.acceptLimiter != nil {
+			select {
+			case <-time.After(c.acceptLimiter.Reserve().Delay()):
+			case <-c.done:
+				return nil
+			}
+		}
+
+		accepted, err := accept()
+		if err != nil {
+			select {
+			case <-c.done:
+				// the listener has been closed on purpose
+				return nil
+			case <-c.draining:
+				return nil
+			default:
+			}
+			select {
+			case c.errChan <- runtimeError(fmt.Errorf("error accepting connection: %w", err)):
+			default:
+				// another listener failed already
+			}
+			c.shutdown()
+			return err
+		}
+		c.log.Infof("accepted connection from %s on %s", accepted.RemoteAddr(), accepted.LocalAddr())
+		if !c.admit(accepted, accepted.RemoteAddr()) {
+			continue
+		}
+		// anyone else could claim to be any client
+		if c.proxyProtocolIn && !c.trustedProxyHeader(accepted) {
+			continue
+		}
+		// released once the connection (and its tunnel) has been handled
+		releaseSlot, ok := c.acquireSlot(accepted)
+		if !ok {
+			continue
+		}
+		if err = c.tuneConn(accepted); err != nil {
+			c.log.Warnf("connection from %s: %s", accepted.RemoteAddr(), err)
+		}
+		s := newSession(accepted, target)
+		c.events.accept(s)
+		c.metrics.accept()
+
+		// the proxy accepts the connection to tunnel instead of us dialing one
+		if c.socksBind {
+			c.wg.Add(1)
+			c.conns.Add(1)
+			go c.handleBind(accepted, s, releaseSlot)
+			continue
+		}
+
+		c.wg.Add(1)
+		c.conns.Add(1)
+		go c.handleAccepted(accepted, s, releaseSlot)
+	}
+}
+
+// handleAccepted dials the target for an accepted connection and tunnels it,
+// calling releaseSlot once done.
+func (c *client) handleAccepted(accepted net.Conn, s *Session, releaseSlot func()) {
+	defer c.wg.Done()
+	defer c.conns.Done()
+	defer releaseSlot()
+	defer c.recoverPanic(s, accepted)
+	// the target as configured, before routing may have set one a client asked for
+	configured := s.target
+
+	// a load balancer in front tells who the client is before anything else
+	if c.proxyProtocolIn {
+		var ok bool
+		if accepted, ok = c.acceptProxyHeader(accepted, s); !ok {
+			return
+		}
+		if !c.admit(accepted, s.clientAddr) {
+			return
+		}
+		if c.tlsAfterProxyHeader != nil {
+			accepted = tls.Server(accepted, c.tlsAfterProxyHeader)
+		}
+	}
+	// waits here rather than in the accept loop, holding up only this client
+	releaseIPSlot, ok := c.acquireIPSlot(accepted, s.clientAddr)
+	if !ok {
+		return
+	}
+	defer releaseIPSlot()
+	if tlsConn, ok := accepted.(*tls.Conn); ok {
+		if err := c.handshakeTLS(tlsConn); err != nil {
+			c.log.Warnf("TLS handshake with %s failed: %s", accepted.RemoteAddr(), err)
+			c.failed(s.clientAddr)
+			accepted.Close()
+			return
+		}
+		s.identity = certificateIdentity(tlsConn)
+	}
+	// peers over mux:// have authenticated their carrier already
+	if c.peerKeyIn != nil && !isMuxURL(c.listenAddress) {
+		peer, err := peerAccept(accepted, c.peerConfig(c.peerKeyIn))
+		if err != nil {
+			c.log.Warnf("peer %s failed to authenticate: %s", accepted.RemoteAddr(), err)
+			c.failed(s.clientAddr)
+			accepted.Close()
+			return
+		}
+		accepted = peer
+	}
+
+	// the target may depend on what the client sends first
+	if c.sniRouter != nil {
+		var ok bool
+		if accepted, ok = c.routeSNI(accepted, s); !ok {
+			return
+		}
+	}
+	if c.headerRouter != nil && !c.routeHeader(accepted, s) {
+		return
+	}
+	if c.transparentListen && !c.routeOriginalDst(accepted, s) {
+		return
+	}
+	if c.proxyServer != "" {
+		var ok bool
+		if accepted, ok = c.routeProxyRequest(accepted, s); !ok {
+			return
+		}
+	}
+	// the identity is known once the client has logged in
+	releaseIdentity, ok := c.acquireIdentity(accepted, s)
+	if !ok {
+		return
+	}
+	defer releaseIdentity()
+	if c.balancer != nil {
+		if !c.routeBalanced(accepted, s) {
+			return
+		}
+		defer s.backend.release()
+	}
+
+	// when accepted, dial remote
+	var dialed net.Conn
+	var err error
+	// only the configured target picks the network, a routed one is always TCP
+	switch {
+	case isUDPURL(configured):
+		dialed, err = c.dialUDP(s.target)
+	case isUnixURL(configured):
+		dialed, err = c.dialer.Dial("unix", unixPath(s.target))
+	case isWebSocketURL(configured):
+		dialed, err = c.dialWebSocket(s.target)
+	case isMuxURL(configured):
+		dialed, err = c.mux.Dial(s.target)
+	case c.transparent:
+		dialed, err = c.dialTransparent(s)
+	default:
+		dialed, err = c.dialer.Dial("tcp", s.target)
+	}
+	if err == nil {
+		s.proxy = c.dialedProxy(dialed)
+	}
+	// the header comes before anything else, TLS included
+	if err == nil && c.proxyProtocolOut != "" {
+		if err = c.sendProxyHeader(dialed, s); err != nil {
+			dialed.Close()
+		}
+	}
+	// WebSockets and carriers are built on wrapped connections already
+	if err == nil && !isWebSocketURL(configured) && !isMuxURL(configured) {
+		dialed, err = c.wrapDialed(dialed, s.target)
+	}
+	if err == nil && c.peerKeyOut != nil && !isMuxURL(configured) {
+		var peer net.Conn
+		if peer, err = peerDial(dialed, c.peerConfig(c.peerKeyOut)); err != nil {
+			dialed.Close()
+		}
+		dialed = peer
+	}
+	if c.proxyServer != "" {
+		if replyErr := c.replyProxyRequest(accepted, dialed, err); replyErr != nil && err == nil {
+			c.log.Warnf("could not answer proxy request from %s: %s", accepted.RemoteAddr(), replyErr)
+			closeConn(dialed, false)
+			accepted.Close()
+			return
+		}
+	}
+	if err != nil {
+		c.log.Errorf("error dialing remote target: %s", err)
+		if s.backend != nil {
+			c.balancer.report(s.backend, err)
+		}
+		c.dialFailed(s, err)
+		accepted.Close()
+		return
+	}
+
+	if c.ftp {
+		dialed = c.newFTPControlConn(accepted, dialed, s)
+	}
+
+	c.wg.Add(1)
+	// tunnel the connection
+	c.handleConn(accepted, dialed, s)
+}
+
+// wrapDialed applies ClientHello fragmentation and TLS to a connection
+// dialed to addr.
+func (c *client) wrapDialed(conn net.Conn, addr string) (net.Conn, error) {
+	if c.fragment.enabled() {
+		conn = newFragmentConn(conn, c.fragment)
+	}
+	if c.targetTLS != nil {
+		return c.originateTLS(conn, addr)
+	}
+	return conn, nil
+}
+
+// dialFailed reports that the target of s could not be reached.
+func (c *client) dialFailed(s *Session, err error) {
+	s.setCloseReason("dial failed")
+	c.events.dialError(s, err)
+	c.metrics.dialError(s)
+	c.accessLog.record(s)
+}
+
+func (c *client) handleConn(accepted net.Conn, remote net.Conn, s *Session) {
+	defer c.wg.Done()
+	defer c.recoverPanic(s, accepted, remote)
+	c.active.Add(1)
+	defer c.active.Add(-1)
+	// set before Tunnel.Sessions can see the session
+	s.established = time.Now()
+	c.track(s)
+	defer c.untrack(s)
+
+	c.log.Infof("tunneling connection from %s to %s", accepted.RemoteAddr(), remote.RemoteAddr())
+	c.events.establish(s)
+	c.metrics.establish(s)
+	c.runHook(hookOpen, s)
+
+	ch := make(chan struct{})
+	c.wg.Add(1)
+	go c.duplexCopy(accepted, remote, s, ch)
+	var maxSession <-chan time.Time
+	if c.maxSession > 0 {
+		timer := time.NewTimer(c.maxSession)
+		defer timer.Stop()
+		maxSession = timer.C
+	}
+	reset := false
+	select {
+	case <-c.done:
+		reset = c.closing.shutdown == CloseRST
+		s.setCloseReason("shutdown")
+	case <-ch:
+	case <-maxSession:
+		s.setCloseReason("time limit")
+		c.log.Infof("closing connection from %s to %s: open for %s, the maximum",
+			accepted.RemoteAddr(), remote.RemoteAddr(), c.maxSession)
+	}
+
+	closeConn(accepted, reset)
+	closeConn(remote, reset)
+	// wait for both directions to stop, so the byte counts are final
+	s.copies.Wait()
+	if c.maxBytes > 0 && s.bytesIn.Load()+s.bytesOut.Load() >= c.maxBytes {
+		c.log.Infof("closed connection from %s to %s: %d bytes copied, the maximum",
+			accepted.RemoteAddr(), remote.RemoteAddr(), c.maxBytes)
+	}
+	if s.backend != nil {
+		c.balancer.report(s.backend, s.targetErr)
+	}
+	c.events.close(s)
+	c.metrics.close(s)
+	c.accessLog.record(s)
+	if c.usageLedger != nil {
+		c.usageLedger.record(s)
+	}
+	c.runHook(hookClose, s)
+}
+
+func (c *client) shutdown() {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	close(c.done)
+}
+
+func (c *client) duplexCopy(conn, rConn net.Conn, s *Session, ch chan struct{}) {
+	defer c.wg.Done()
+
+	// close ch, clientConn waits until it will be closed.
+	defer close(ch)
+	copyDone := make(chan struct{}, 2)
+
+	if c.maxBytes > 0 {
+		used := new(atomic.Int64)
+		conn = &cappedConn{Conn: conn, used: used, max: c.maxBytes}
+		rConn = &cappedConn{Conn: rConn, used: used, max: c.maxBytes}
+	}
+	conn, rConn = c.metrics.meter(conn, rConn, s)
+	if c.rateLimit > 0 || c.rateLimitPerConn > 0 {
+		// each direction is held to its share of the uplink and its own limit
+		conn = c.throttle(conn, ch, c.bandwidthIn, newBandwidthLimiter(c.rateLimitPerConn))
+		rConn = c.throttle(rConn, ch, c.bandwidthOut, newBandwidthLimiter(c.rateLimitPerConn))
+	}
+	c.wg.Add(2)
+	s.copies.Add(2)
+	go c.connCopy(rConn, conn, s, &s.bytesIn, copyDone)
+	go c.connCopy(conn, rConn, s, &s.bytesOut, copyDone)
+	// rConn and conn will be closed by handleConn. There is nothing to do here.
+	<-copyDone
+}
@@ -0,0 +1,338 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms of the stream between peers.
+const (
+	CompressZstd   = "zstd"
+	CompressSnappy = "snappy"
+)
+
+// window of the zstd streams, bounding the memory each connection takes
+const zstdWindowSize = 1 << 20
+
+func validCompression(algorithm string) error {
+	switch algorithm {
+	case "", CompressZstd, CompressSnappy:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q, expected %s or %s", algorithm, CompressZstd, CompressSnappy)
+}
+
+// compressFeature is the peer handshake feature asking for algorithm.
+func compressFeature(algorithm string) peerFeatures {
+	switch algorithm {
+	case CompressZstd:
+		return peerCompressZstd
+	case CompressSnappy:
+		return peerCompressSnappy
+	}
+	return 0
+}
+
+// flushWriter compresses what is written to it, flushing it to the
+// connection right away, so interactive traffic isn't held back.
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// The compressed stream is sent in frames: a type, the length of the
+// payload and that of the data it carries, each of the latter two in 16
+// bits, followed by the payload. Data that looks incompressible goes out
+// raw, sparing the compressor; the compressed frames together make up the
+// stream of the compressor.
+const (
+	compressFrameRaw = iota
+	compressFrameCompressed
+
+	compressHeaderLen = 5
+)
+
+// decompressed bytes handed from readLoop to Read at once, and the most data
+// a frame carries
+const decompressChunk = 32 * 1024
+
+// bytes of a frame whose entropy tells whether it's worth compressing
+const compressSample = 4096
+
+// bits per byte above which data is taken for compressed or encrypted
+// already
+const incompressibleEntropy = 7.5
+
+var errCompressedFrame = errors.New("invalid compressed frame")
+
+// incompressible guesses from the entropy of its first bytes whether b
+// would shrink when compressed.
+func incompressible(b []byte) bool {
+	if len(b) > compressSample {
+		b = b[:compressSample]
+	}
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var entropy float64
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(b))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy > incompressibleEntropy
+}
+
+// frameSource hands the decoder the payload of the compressed frame being
+// read, and nothing past it.
+type frameSource struct {
+	conn      io.Reader
+	remaining int
+}
+
+func (s *frameSource) Read(b []byte) (int, error) {
+	if s.remaining == 0 {
+		return 0, errCompressedFrame
+	}
+	if len(b) > s.remaining {
+		b = b[:s.remaining]
+	}
+	n, err := s.conn.Read(b)
+	s.remaining -= n
+	return n, err
+}
+
+// compressedConn compresses what is written to it and decompresses what is
+// read. The decoders can't pick up again after a read of the connection
+// failed, so they run in readLoop without a read deadline, and Read applies
+// the deadline itself; a read timing out loses nothing then.
+type compressedConn struct {
+	net.Conn
+	wmu sync.Mutex
+	w   flushWriter
+	// what w compressed from the frame being written
+	compressed bytes.Buffer
+	frame      []byte
+
+	r      io.Reader
+	source frameSource
+	closer func()
+
+	// decompressed data, closed once readLoop stops at readErr
+	chunks  chan []byte
+	readErr error
+	pending []byte
+
+	readDeadline chanDeadline
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newCompressedConn(conn net.Conn, features peerFeatures) (net.Conn, error) {
+	c := &compressedConn{
+		Conn:   conn,
+		source: frameSource{conn: conn},
+		closer: func() {},
+		chunks: make(chan []byte),
+		done:   make(chan struct{}),
+	}
+	switch {
+	case features&peerCompressZstd != 0:
+		w, err := zstd.NewWriter(&c.compressed, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdWindowSize))
+		if err != nil {
+			return nil, err
+		}
+		r, err := zstd.NewReader(&c.source, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdWindowSize))
+		if err != nil {
+			return nil, err
+		}
+		c.w, c.r, c.closer = w, r, r.Close
+	case features&peerCompressSnappy != 0:
+		c.w = s2.NewWriter(&c.compressed, s2.WriterSnappyCompat(), s2.WriterConcurrency(1))
+		c.r = snappy.NewReader(&c.source)
+	default:
+		return conn, nil
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// readLoop decompresses the stream into chunks until it fails or the
+// connection is closed.
+func (c *compressedConn) readLoop() {
+	defer close(c.chunks)
+	defer c.closer()
+	// Read is done with a chunk before it takes the next one, so two buffers
+	// taking turns are enough
+	bufs := [2][]byte{make([]byte, decompressChunk), make([]byte, decompressChunk)}
+	header := make([]byte, compressHeaderLen)
+	for i := 0; ; i ^= 1 {
+		chunk, err := c.readFrame(header, bufs[i])
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		select {
+		case c.chunks <- chunk:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// readFrame reads the next frame into buf, returning the data it carries.
+func (c *compressedConn) readFrame(header, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(header[1:3]))
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length == 0 || length > len(buf) {
+		return nil, errCompressedFrame
+	}
+	buf = buf[:length]
+	switch header[0] {
+	case compressFrameRaw:
+		if size != length {
+			return nil, errCompressedFrame
+		}
+		if _, err := io.ReadFull(c.Conn, buf); err != nil {
+			return nil, err
+		}
+	case compressFrameCompressed:
+		c.source.remaining = size
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		// the decoder has to take all of the frame, or the next would be misread
+		if c.source.remaining != 0 {
+			return nil, errCompressedFrame
+		}
+	default:
+		return nil, fmt.Errorf("unknown compressed frame type %d", header[0])
+	}
+	return buf, nil
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var written int
+	for len(b) > 0 {
+		n := len(b)
+		if n > decompressChunk {
+			n = decompressChunk
+		}
+		if err := c.writeFrame(b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// writeFrame sends data in a frame, compressed unless it looks like it
+// wouldn't get any smaller.
+func (c *compressedConn) writeFrame(data []byte) error {
+	kind, payload := byte(compressFrameRaw), data
+	if !incompressible(data) {
+		c.compressed.Reset()
+		if _, err := c.w.Write(data); err != nil {
+			return err
+		}
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		kind, payload = compressFrameCompressed, c.compressed.Bytes()
+		if len(payload) > math.MaxUint16 {
+			return errCompressedFrame
+		}
+	}
+	c.frame = append(c.frame[:0], kind, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(c.frame[1:3], uint16(len(payload)))
+	binary.BigEndian.PutUint16(c.frame[3:5], uint16(len(data)))
+	// in one write, so the header doesn't go out in a segment of its own
+	c.frame = append(c.frame, payload...)
+	_, err := c.Conn.Write(c.frame)
+	return err
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		timeout, deadlineSet, stop, err := c.readDeadline.wait()
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case chunk, ok := <-c.chunks:
+			stop()
+			if !ok {
+				if c.readErr == nil {
+					return 0, net.ErrClosed
+				}
+				return 0, c.readErr
+			}
+			c.pending = chunk
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-deadlineSet:
+			stop()
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *compressedConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *compressedConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *compressedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	// readLoop closes the decoder once the closed connection stops it
+	return c.Conn.Close()
+}
+
+// NetConn is the connection the compressed stream is sent over.
+func (c *compressedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	consulScheme = "consul://"
+	// how long Consul holds a query waiting for the service to change
+	consulWait = 5 * time.Minute
+)
+
+func isConsulURL(addr string) bool {
+	return strings.HasPrefix(addr, consulScheme)
+}
+
+// consulSource keeps the targets in sync with the passing instances of a
+// Consul service, through blocking queries to the agent named by
+// $CONSUL_HTTP_ADDR (127.0.0.1:8500 by default).
+type consulSource struct {
+	service string
+	// of the health endpoint, the tag, dc and the like given in the target
+	query  url.Values
+	agent  string
+	token  string
+	client *http.Client
+	// of the last response, 0 to not wait for a change
+	index uint64
+}
+
+// newConsulSource parses consul://<service>[?tag=<tag>&dc=<datacenter>].
+func newConsulSource(target string) (*consulSource, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return nil, fmt.Errorf("invalid Consul target %q, use consul://<service>", target)
+	}
+	agent := os.Getenv("CONSUL_HTTP_ADDR")
+	if agent == "" {
+		agent = "127.0.0.1:8500"
+	}
+	if !strings.Contains(agent, "://") {
+		agent = "http://" + agent
+	}
+	query := u.Query()
+	query.Set("passing", "1")
+	return &consulSource{
+		service: u.Host,
+		query:   query,
+		agent:   strings.TrimSuffix(agent, "/"),
+		token:   os.Getenv("CONSUL_HTTP_TOKEN"),
+		client:  &http.Client{Timeout: consulWait + 30*time.Second},
+	}, nil
+}
+
+func (s *consulSource) String() string {
+	return "Consul service " + s.service
+}
+
+type consulInstance struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+func (s *consulSource) fetch(ctx context.Context) ([]*backend, error) {
+	query := url.Values{}
+	for k, v := range s.query {
+		query[k] = v
+	}
+	if s.index > 0 {
+		query.Set("index", strconv.FormatUint(s.index, 10))
+		query.Set("wait", consulWait.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		s.agent+"/v1/health/service/"+url.PathEscape(s.service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Consul answered %s", resp.Status)
+	}
+	var instances []consulInstance
+	if err = json.NewDecoder(resp.Body).Decode(&instances); err != nil {
+		return nil, err
+	}
+
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, errors.New("Consul answered without an index")
+	}
+	// an index going backwards starts over, as Consul recommends
+	if index < s.index {
+		index = 0
+	}
+	s.index = index
+
+	backends := make([]*backend, 0, len(instances))
+	for _, instance := range instances {
+		address := instance.Service.Address
+		if address == "" {
+			address = instance.Node.Address
+		}
+		b := &backend{address: net.JoinHostPort(address, strconv.Itoa(instance.Service.Port)), weight: 1}
+		if instance.Service.Weights.Passing > 0 {
+			b.weight = instance.Service.Weights.Passing
+		}
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
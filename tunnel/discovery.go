@@ -0,0 +1,69 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"context"
+	"time"
+)
+
+// how long to wait before asking a registry again after it failed
+const discoveryRetryDelay = 5 * time.Second
+
+// targetSource tells the targets registered for a service.
+type targetSource interface {
+	// fetch returns the targets, waiting for them to change since the last
+	// fetch when the source can
+	fetch(ctx context.Context) ([]*backend, error)
+	String() string
+}
+
+// syncTargets updates the targets of the balancer from the source once.
+func (c *client) syncTargets(ctx context.Context, source targetSource) error {
+	backends, err := source.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if c.balancer.update(backends) {
+		c.log.Infof("%s has %d targets", source, len(backends))
+	}
+	return nil
+}
+
+// watchTargets keeps the targets of the balancer in sync with the source
+// until the tunnel is closed.
+func (c *client) watchTargets(source targetSource) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.done
+		cancel()
+	}()
+	for {
+		err := c.syncTargets(ctx, source)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			continue
+		}
+		c.log.Warnf("could not get the targets of %s: %s", source, err)
+		select {
+		case <-time.After(discoveryRetryDelay):
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// how long a query forwarded from UDP may take to be answered
+	dnsQueryTimeout  = 5 * time.Second
+	dnsMaxMessageLen = 65535
+)
+
+// startDNS opens UDP and TCP listeners on c.dnsListen forwarding queries to
+// c.dnsResolver through the dialer, so they don't leak outside the tunnel.
+// Proxies generally don't carry UDP, so queries received over UDP are sent
+// over TCP (RFC 7766). It returns a function closing the listeners.
+func (c *client) startDNS() (func(), error) {
+	var tcpListener net.Listener
+	var udpConn net.PacketConn
+	err := inNetns(c.listenNetns, func() (err error) {
+		if tcpListener, err = net.Listen("tcp", c.dnsListen); err != nil {
+			return err
+		}
+		// both on the same port, even if an ephemeral one has been asked for
+		if udpConn, err = net.ListenPacket("udp", tcpListener.Addr().String()); err != nil {
+			tcpListener.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.log.Infof("forwarding DNS queries on %s to %s", tcpListener.Addr(), c.dnsResolver)
+
+	c.wg.Add(2)
+	go c.serveDNSTCP(tcpListener)
+	go c.serveDNSUDP(udpConn)
+	return func() {
+		tcpListener.Close()
+		udpConn.Close()
+	}, nil
+}
+
+func (c *client) serveDNSTCP(listener net.Listener) {
+	defer c.wg.Done()
+	for {
+		accepted, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				c.log.Errorf("error accepting DNS connection: %s", err)
+			}
+			return
+		}
+		// DNS over TCP is just another stream to tunnel
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			s := newSession(accepted, c.dnsResolver)
+			c.events.accept(s)
+			c.metrics.accept()
+			dialed, err := c.dialer.Dial("tcp", c.dnsResolver)
+			if err != nil {
+				c.log.Errorf("error dialing DNS resolver: %s", err)
+				c.dialFailed(s, err)
+				accepted.Close()
+				return
+			}
+			c.wg.Add(1)
+			c.handleConn(accepted, dialed, s)
+		}()
+	}
+}
+
+func (c *client) serveDNSUDP(conn net.PacketConn) {
+	defer c.wg.Done()
+	buf := make([]byte, dnsMaxMessageLen)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				c.log.Errorf("error receiving DNS query: %s", err)
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			response, err := c.forwardDNSQuery(query)
+			if err != nil {
+				c.log.Warnf("could not forward DNS query from %s: %s", addr, err)
+				return
+			}
+			if _, err = conn.WriteTo(response, addr); err != nil {
+				c.log.Debugf("could not send DNS response to %s: %s", addr, err)
+			}
+		}()
+	}
+}
+
+// forwardDNSQuery sends query to the resolver over TCP and returns the response.
+func (c *client) forwardDNSQuery(query []byte) ([]byte, error) {
+	conn, err := c.dialer.Dial("tcp", c.dnsResolver)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing DNS resolver: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	if _, err = conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	length := make([]byte, 2)
+	if _, err = io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+// Class tells what kind of failure an Error is, so callers can react to
+// (or exit with codes for) the different failure modes.
+type Class string
+
+const (
+	// invalid configuration
+	ClassConfig Class = "config"
+	// a listening socket could not be opened
+	ClassBind Class = "bind"
+	// something required to start serving could not be set up
+	ClassPreflight Class = "preflight"
+	// stopped, but connections had to be cut forcefully
+	ClassDrain Class = "drain"
+	// unexpected error while running
+	ClassRuntime Class = "runtime"
+)
+
+// Error is returned by Run, classifying the error it wraps.
+type Error struct {
+	Class Class
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func configError(err error) error {
+	return &Error{Class: ClassConfig, Err: err}
+}
+
+func bindError(err error) error {
+	return &Error{Class: ClassBind, Err: err}
+}
+
+func preflightError(err error) error {
+	return &Error{Class: ClassPreflight, Err: err}
+}
+
+func drainError(err error) error {
+	return &Error{Class: ClassDrain, Err: err}
+}
+
+func runtimeError(err error) error {
+	return &Error{Class: ClassRuntime, Err: err}
+}
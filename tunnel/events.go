@@ -0,0 +1,72 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import "net"
+
+// Events holds callbacks observing the life cycle of connections, for
+// accounting and policy hooks. Every callback is optional and is called
+// synchronously on the connection's goroutine (the accept loop for
+// OnAccept), so it must not block.
+type Events struct {
+	// the listeners are open and connections are about to be accepted
+	OnListen func(addrs []net.Addr)
+	// a connection has been accepted, the target isn't dialed yet
+	OnAccept func(s *Session)
+	// the target could not be reached, the accepted connection gets closed
+	OnDialError func(s *Session, err error)
+	// the SOCKS proxy waits for the target to connect to s.BindAddr()
+	OnBind func(s *Session)
+	// the connection to the target is established and tunneling starts
+	OnEstablished func(s *Session)
+	// both connections are closed, byte counts are final
+	OnClose func(s *Session)
+}
+
+func (e *Events) listen(addrs []net.Addr) {
+	if e.OnListen != nil {
+		e.OnListen(addrs)
+	}
+}
+
+func (e *Events) accept(s *Session) {
+	if e.OnAccept != nil {
+		e.OnAccept(s)
+	}
+}
+
+func (e *Events) dialError(s *Session, err error) {
+	if e.OnDialError != nil {
+		e.OnDialError(s, err)
+	}
+}
+
+func (e *Events) bind(s *Session) {
+	if e.OnBind != nil {
+		e.OnBind(s)
+	}
+}
+
+func (e *Events) establish(s *Session) {
+	if e.OnEstablished != nil {
+		e.OnEstablished(s)
+	}
+}
+
+func (e *Events) close(s *Session) {
+	if e.OnClose != nil {
+		e.OnClose(s)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+// parseProxyList parses a comma separated list of proxy URLs, in order of preference.
+func parseProxyList(list string) ([]*url.URL, error) {
+	var urls []*url.URL
+	for _, rawURL := range strings.Split(list, ",") {
+		rawURL = strings.TrimSpace(rawURL)
+		if rawURL == "" {
+			continue
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// failoverProxy is a proxy dialer along with what we remember about its health.
+type failoverProxy struct {
+	name   string
+	dialer proxy.Dialer
+	// address of the proxy itself and the dialer reaching it, to probe it with
+	address   string
+	forward   proxy.Dialer
+	mu        sync.Mutex
+	deadUntil time.Time
+}
+
+func (p *failoverProxy) alive(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return now.After(p.deadUntil)
+}
+
+func (p *failoverProxy) markDead(until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadUntil = until
+}
+
+func (p *failoverProxy) markAlive() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadUntil = time.Time{}
+}
+
+// dialed tags conn as dialed through p, unless that's a direct connection.
+func (p *failoverProxy) dialed(conn net.Conn) net.Conn {
+	if p.name == "DIRECT" {
+		return conn
+	}
+	return &viaProxyConn{Conn: conn, proxy: p.name}
+}
+
+// viaProxyConn is a connection dialed through one proxy of several, which
+// the access log tells.
+type viaProxyConn struct {
+	net.Conn
+	proxy string
+}
+
+func (p *viaProxyConn) NetConn() net.Conn {
+	return p.Conn
+}
+
+// dialedProxy returns the proxy conn has been dialed through, empty when it
+// has been dialed directly.
+func (c *client) dialedProxy(conn net.Conn) string {
+	for {
+		if p, ok := conn.(*viaProxyConn); ok {
+			return p.proxy
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	// a single proxy is dialed through without failing over
+	if c.proxyURL != nil && c.pac == "" {
+		return redactedURL(c.proxyURL)
+	}
+	return ""
+}
+
+// targetError is a failure a working proxy reported about the target, such
+// as a refused connection, which says nothing about the proxy itself.
+type targetError struct {
+	err error
+}
+
+func (e *targetError) Error() string {
+	return e.err.Error()
+}
+
+func (e *targetError) Unwrap() error {
+	return e.err
+}
+
+// socksDialer tells the failures a SOCKS5 proxy replies with apart from
+// those reaching or talking to the proxy.
+type socksDialer struct {
+	proxy.Dialer
+}
+
+func (d *socksDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	var opErr *net.OpError
+	if err != nil && errors.As(err, &opErr) && opErr.Err != nil {
+		// the reply codes are only in the message; a general failure is the proxy's own
+		if msg := opErr.Err.Error(); strings.HasPrefix(msg, "unknown error ") && !strings.Contains(msg, "general SOCKS server failure") {
+			return nil, &targetError{err: err}
+		}
+	}
+	return conn, err
+}
+
+// failoverDialer dials through the first proxy that works. A proxy which
+// can't be reached or fails the handshake is skipped for the cooldown
+// period, unless every proxy has failed; failures reaching the target
+// through a working proxy are returned right away.
+type failoverDialer struct {
+	proxies  []*failoverProxy
+	cooldown time.Duration
+	log      logrus.FieldLogger
+}
+
+func (d *failoverDialer) Dial(network, addr string) (net.Conn, error) {
+	now := time.Now()
+	var candidates, dead []*failoverProxy
+	for _, p := range d.proxies {
+		if p.alive(now) {
+			candidates = append(candidates, p)
+		} else {
+			dead = append(dead, p)
+		}
+	}
+	// rather retry a dead proxy than fail right away
+	candidates = append(candidates, dead...)
+
+	err := errors.New("no proxy configured")
+	for _, p := range candidates {
+		var conn net.Conn
+		if conn, err = p.dialer.Dial(network, addr); err == nil {
+			p.markAlive()
+			return p.dialed(conn), nil
+		}
+		var targetErr *targetError
+		if errors.As(err, &targetErr) {
+			p.markAlive()
+			return nil, err
+		}
+		d.log.Warnf("dialing through proxy %s failed, trying next one: %s", p.name, err)
+		p.markDead(time.Now().Add(d.cooldown))
+	}
+	return nil, err
+}
+
+// defaultProxyPorts are the ports of proxies whose URL has none.
+var defaultProxyPorts = map[string]string{
+	"http":    "80",
+	"https":   "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
+	"ssh":     "22",
+}
+
+// proxyHostPort returns the address of the proxy at proxyURL.
+func proxyHostPort(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), defaultProxyPorts[proxyURL.Scheme])
+}
+
+// probe checks the proxies every interval until done is closed, by dialing
+// target through them or, without a target, by connecting to them. A proxy
+// failing the probe is skipped for the cooldown as if a dial had failed, one
+// passing it again is preferred again right away.
+func (d *failoverDialer) probe(target string, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, p := range d.proxies {
+			wg.Add(1)
+			go func(p *failoverProxy) {
+				defer wg.Done()
+				d.probeProxy(p, target)
+			}(p)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (d *failoverDialer) probeProxy(p *failoverProxy, target string) {
+	var conn net.Conn
+	var err error
+	if target != "" {
+		conn, err = p.dialer.Dial("tcp", target)
+	} else {
+		conn, err = p.forward.Dial("tcp", p.address)
+	}
+	wasAlive := p.alive(time.Now())
+	var targetErr *targetError
+	if errors.As(err, &targetErr) {
+		// the proxy works, the probe target doesn't
+		d.log.Debugf("proxy %s could not reach the probe target: %s", p.name, err)
+		p.markAlive()
+		return
+	}
+	if err != nil {
+		if wasAlive {
+			d.log.Warnf("proxy %s failed health probe: %s", p.name, err)
+		}
+		p.markDead(time.Now().Add(d.cooldown))
+		return
+	}
+	conn.Close()
+	if !wasAlive {
+		d.log.Infof("proxy %s passed health probe, using it again", p.name)
+	}
+	p.markAlive()
+}
+
+// RedactProxyList returns the proxy list without the passwords in it.
+func RedactProxyList(list string) string {
+	urls, err := parseProxyList(list)
+	if err != nil {
+		return "<invalid>"
+	}
+	redacted := make([]string, 0, len(urls))
+	for _, u := range urls {
+		redacted = append(redacted, redactedURL(u))
+	}
+	return strings.Join(redacted, ",")
+}
+
+// redactedURL returns u as string without its password.
+func redactedURL(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	if _, ok := u.User.Password(); !ok {
+		return u.String()
+	}
+	redacted := *u
+	redacted.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return redacted.String()
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+import (
+	utls "github.com/refraction-networking/utls"
+)
+
+// ClientHello fingerprints TLS to the target and to proxies can mimic. The
+// Go one is used when none is set.
+var tlsFingerprints = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"safari":  utls.HelloSafari_Auto,
+	"edge":    utls.HelloEdge_Auto,
+	"ios":     utls.HelloIOS_Auto,
+	"random":  utls.HelloRandomizedNoALPN,
+}
+
+func validTLSFingerprint(name string) error {
+	if _, ok := tlsFingerprints[name]; ok || name == "" {
+		return nil
+	}
+	names := make([]string, 0, len(tlsFingerprints))
+	for name := range tlsFingerprints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown TLS fingerprint %q (%s)", name, strings.Join(names, ", "))
+}
+
+// mimicTLS wraps conn in TLS as config says, but with the ClientHello of
+// the browser fingerprint names instead of Go's.
+func mimicTLS(conn net.Conn, config *tls.Config, fingerprint string) (net.Conn, error) {
+	uconfig := &utls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		RootCAs:            config.RootCAs,
+		KeyLogWriter:       config.KeyLogWriter,
+	}
+	for _, cert := range config.Certificates {
+		uconfig.Certificates = append(uconfig.Certificates, utls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  cert.PrivateKey,
+			OCSPStaple:  cert.OCSPStaple,
+			Leaf:        cert.Leaf,
+		})
+	}
+
+	id := tlsFingerprints[fingerprint]
+	uconn := utls.UClient(conn, uconfig, id)
+	if id != utls.HelloRandomizedNoALPN {
+		spec, err := utls.UTLSIdToSpec(id)
+		if err != nil {
+			return nil, err
+		}
+		// browsers offer h2, which the tunneled stream (a WebSocket one
+		// included) doesn't speak
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = []string{"http/1.1"}
+			}
+		}
+		uconn = utls.UClient(conn, uconfig, utls.HelloCustom)
+		if err = uconn.ApplyPreset(&spec); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := uconn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return uconn, nil
+}
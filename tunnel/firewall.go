@@ -0,0 +1,141 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// firewall backends opening the listening ports
+const (
+	firewallNft       = "nft"
+	firewallUfw       = "ufw"
+	firewallFirewalld = "firewalld"
+	firewallNetsh     = "netsh"
+)
+
+// comment/name identifying the rules we created
+const firewallRuleName = "tcptunnel"
+
+var nftHandleRegexp = regexp.MustCompile(`# handle (\d+)`)
+
+func validFirewallBackend(backend string) error {
+	switch backend {
+	case firewallNft, firewallUfw, firewallFirewalld, firewallNetsh:
+		return nil
+	}
+	return fmt.Errorf("unknown firewall backend %q (nft, ufw, firewalld or netsh)", backend)
+}
+
+// openFirewall creates an allow rule for incoming connections to port and
+// returns a function removing it again.
+func openFirewall(backend string, port int) (func() error, error) {
+	p := strconv.Itoa(port)
+	switch backend {
+	case firewallNft:
+		// a rule in a table of our own wouldn't override a drop in the main
+		// filter table, so it goes into the latter
+		out, err := runFirewall("nft", "--echo", "--handle", "insert", "rule", "inet", "filter", "input",
+			"tcp", "dport", p, "accept", "comment", strconv.Quote(firewallRuleName))
+		if err != nil {
+			return nil, err
+		}
+		m := nftHandleRegexp.FindSubmatch(out)
+		if m == nil {
+			return nil, fmt.Errorf("no rule handle in nft output %q", out)
+		}
+		handle := string(m[1])
+		return func() error {
+			_, err := runFirewall("nft", "delete", "rule", "inet", "filter", "input", "handle", handle)
+			return err
+		}, nil
+	case firewallUfw:
+		if _, err := runFirewall("ufw", "allow", p+"/tcp", "comment", firewallRuleName); err != nil {
+			return nil, err
+		}
+		return func() error {
+			_, err := runFirewall("ufw", "delete", "allow", p+"/tcp")
+			return err
+		}, nil
+	case firewallFirewalld:
+		// runtime only, nothing survives a firewalld restart
+		if _, err := runFirewall("firewall-cmd", "--add-port="+p+"/tcp"); err != nil {
+			return nil, err
+		}
+		return func() error {
+			_, err := runFirewall("firewall-cmd", "--remove-port="+p+"/tcp")
+			return err
+		}, nil
+	case firewallNetsh:
+		name := "name=" + firewallRuleName + " " + p
+		if _, err := runFirewall("netsh", "advfirewall", "firewall", "add", "rule", name,
+			"dir=in", "action=allow", "protocol=TCP", "localport="+p); err != nil {
+			return nil, err
+		}
+		return func() error {
+			_, err := runFirewall("netsh", "advfirewall", "firewall", "delete", "rule", name,
+				"protocol=TCP", "localport="+p)
+			return err
+		}, nil
+	}
+	return nil, validFirewallBackend(backend)
+}
+
+func runFirewall(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+// openFirewallPorts opens the firewall for every TCP listener and returns a
+// function closing what has been opened.
+func (c *client) openFirewallPorts(listeners []net.Listener) (func(), error) {
+	var closers []func() error
+	closeAll := func() {
+		for _, closeRule := range closers {
+			if err := closeRule(); err != nil {
+				c.log.Errorf("could not remove firewall rule: %s", err)
+			}
+		}
+	}
+	for _, listener := range listeners {
+		addr, ok := listener.Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		closeRule, err := openFirewall(c.firewall, addr.Port)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		c.log.Infof("opened port %d in %s", addr.Port, c.firewall)
+		closers = append(closers, closeRule)
+	}
+	return closeAll, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	tlsRecordHeaderLen     = 5
+	tlsRecordTypeHandshake = 0x16
+)
+
+// fragmentConfig controls how the first TLS record sent to the target (the
+// ClientHello) gets fragmented, which defeats naive SNI based filtering.
+type fragmentConfig struct {
+	// maximum payload size of each TLS record the ClientHello is split into
+	recordSize int
+	// maximum size of each write (and hence TCP segment) carrying the records
+	segmentSize int
+	// pause between consecutive segments
+	delay time.Duration
+}
+
+func (f fragmentConfig) enabled() bool {
+	return f.recordSize > 0 || f.segmentSize > 0
+}
+
+// fragmentConn buffers the first TLS record written to it and sends it
+// fragmented, passing everything afterwards through untouched.
+type fragmentConn struct {
+	net.Conn
+	config fragmentConfig
+	buf    []byte
+	done   bool
+}
+
+func (f *fragmentConn) NetConn() net.Conn {
+	return f.Conn
+}
+
+func newFragmentConn(conn net.Conn, config fragmentConfig) net.Conn {
+	if tcpConn, ok := underlyingConn(conn).(*net.TCPConn); ok {
+		// make sure every write leaves as a segment of its own
+		_ = tcpConn.SetNoDelay(true)
+	}
+	return &fragmentConn{Conn: conn, config: config}
+}
+
+func (f *fragmentConn) Write(p []byte) (int, error) {
+	if f.done {
+		return f.Conn.Write(p)
+	}
+
+	f.buf = append(f.buf, p...)
+	if len(f.buf) < tlsRecordHeaderLen {
+		return len(p), nil
+	}
+	if f.buf[0] != tlsRecordTypeHandshake {
+		// not TLS, nothing to do
+		return len(p), f.flush(f.buf)
+	}
+	recordLen := int(f.buf[3])<<8 | int(f.buf[4])
+	if len(f.buf) < tlsRecordHeaderLen+recordLen {
+		return len(p), nil
+	}
+
+	hello := f.buf[tlsRecordHeaderLen : tlsRecordHeaderLen+recordLen]
+	rest := f.buf[tlsRecordHeaderLen+recordLen:]
+
+	out := f.buf[:tlsRecordHeaderLen+recordLen]
+	if f.config.recordSize > 0 {
+		out = fragmentRecord(f.buf[:3], hello, f.config.recordSize)
+	}
+	if err := f.writeSegments(out); err != nil {
+		return 0, err
+	}
+	return len(p), f.flush(rest)
+}
+
+// flush writes b as is and stops buffering.
+func (f *fragmentConn) flush(b []byte) error {
+	f.done = true
+	f.buf = nil
+	if len(b) == 0 {
+		return nil
+	}
+	_, err := f.Conn.Write(b)
+	return err
+}
+
+func (f *fragmentConn) writeSegments(b []byte) error {
+	size := f.config.segmentSize
+	if size <= 0 {
+		size = len(b)
+	}
+	for len(b) > 0 {
+		n := size
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := f.Conn.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+		if len(b) > 0 && f.config.delay > 0 {
+			time.Sleep(f.config.delay)
+		}
+	}
+	return nil
+}
+
+// fragmentRecord splits payload into consecutive TLS records of at most size
+// bytes each, all sharing the type and version found in header.
+func fragmentRecord(header []byte, payload []byte, size int) []byte {
+	out := make([]byte, 0, len(payload)+(len(payload)/size+1)*tlsRecordHeaderLen)
+	for len(payload) > 0 {
+		n := size
+		if n > len(payload) {
+			n = len(payload)
+		}
+		out = append(out, header[0], header[1], header[2], byte(n>>8), byte(n))
+		out = append(out, payload[:n]...)
+		payload = payload[n:]
+	}
+	return out
+}
@@ -0,0 +1,259 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// how long an announced passive data port waits for the FTP client
+const ftpDataTimeout = 30 * time.Second
+
+var (
+	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+	ftpPasvRegexp = regexp.MustCompile(`(\d{1,3}),(\d{1,3}),(\d{1,3}),(\d{1,3}),(\d{1,3}),(\d{1,3})`)
+	// 229 Entering Extended Passive Mode (|||port|)
+	ftpEpsvRegexp = regexp.MustCompile(`\((.)(.)(.)(\d{1,5})(.)\)`)
+)
+
+// ftpControlConn wraps the connection to an FTP server and rewrites its passive
+// mode replies, so the client connects to data ports opened by the tunnel instead
+// of the (unreachable) ones announced by the server.
+type ftpControlConn struct {
+	net.Conn
+	c       *client
+	localIP net.IP
+	// the only address the data connections are accepted from, any when nil
+	clientIP net.IP
+	reader   *bufio.Reader
+	pending  []byte
+	readErr  error
+	dataHost string
+}
+
+func (f *ftpControlConn) NetConn() net.Conn {
+	return f.Conn
+}
+
+func (c *client) newFTPControlConn(accepted net.Conn, dialed net.Conn, s *Session) net.Conn {
+	// data connections are dialed to the same host as the control connection,
+	// the address included in the reply is often a private one behind NAT.
+	host, _, err := net.SplitHostPort(s.target)
+	if err != nil {
+		host = s.target
+	}
+	var localIP net.IP
+	if tcpAddr, ok := accepted.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP
+	}
+	return &ftpControlConn{
+		Conn:     dialed,
+		c:        c,
+		localIP:  localIP,
+		clientIP: addrIP(s.clientAddr),
+		reader:   bufio.NewReader(dialed),
+		dataHost: host,
+	}
+}
+
+func (f *ftpControlConn) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.readErr != nil {
+			return 0, f.readErr
+		}
+		line, err := f.reader.ReadSlice('\n')
+		f.readErr = err
+		if err == bufio.ErrBufferFull {
+			// not a reply we care about, pass it through as is
+			f.readErr = nil
+		} else if err == nil {
+			line = f.rewrite(line)
+		}
+		f.pending = append(f.pending[:0], line...)
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func (f *ftpControlConn) rewrite(line []byte) []byte {
+	switch {
+	case bytes.HasPrefix(line, []byte("227 ")):
+		return f.rewritePasv(line)
+	case bytes.HasPrefix(line, []byte("229 ")):
+		return f.rewriteEpsv(line)
+	}
+	return line
+}
+
+func (f *ftpControlConn) rewritePasv(line []byte) []byte {
+	m := ftpPasvRegexp.FindSubmatchIndex(line)
+	if m == nil {
+		f.c.log.Warnf("could not parse FTP passive mode reply: %q", line)
+		return line
+	}
+	p1, _ := strconv.Atoi(string(line[m[10]:m[11]]))
+	p2, _ := strconv.Atoi(string(line[m[12]:m[13]]))
+	if p1 > 255 || p2 > 255 {
+		f.c.log.Warnf("invalid port in FTP passive mode reply: %q", line)
+		return line
+	}
+
+	ip4 := f.localIP.To4()
+	if ip4 == nil {
+		f.c.log.Warnf("can't announce non-IPv4 address %s in FTP passive mode reply", f.localIP)
+		return line
+	}
+
+	port, err := f.c.ftpDataForward(f.localIP, f.clientIP, net.JoinHostPort(f.dataHost, strconv.Itoa(p1<<8|p2)))
+	if err != nil {
+		f.c.log.Errorf("could not forward FTP data connection: %s", err)
+		return line
+	}
+
+	announced := fmt.Sprintf("%d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+	return spliceBytes(line, m[0], m[1], announced)
+}
+
+func (f *ftpControlConn) rewriteEpsv(line []byte) []byte {
+	m := ftpEpsvRegexp.FindSubmatchIndex(line)
+	if m == nil {
+		f.c.log.Warnf("could not parse FTP extended passive mode reply: %q", line)
+		return line
+	}
+	// all delimiters must be the same character
+	delim := line[m[2]:m[3]]
+	for _, i := range []int{4, 6, 10} {
+		if !bytes.Equal(line[m[i]:m[i+1]], delim) {
+			f.c.log.Warnf("could not parse FTP extended passive mode reply: %q", line)
+			return line
+		}
+	}
+	remotePort, err := strconv.Atoi(string(line[m[8]:m[9]]))
+	if err != nil || remotePort > 65535 {
+		f.c.log.Warnf("invalid port in FTP extended passive mode reply: %q", line)
+		return line
+	}
+
+	port, err := f.c.ftpDataForward(f.localIP, f.clientIP, net.JoinHostPort(f.dataHost, strconv.Itoa(remotePort)))
+	if err != nil {
+		f.c.log.Errorf("could not forward FTP data connection: %s", err)
+		return line
+	}
+	return spliceBytes(line, m[8], m[9], strconv.Itoa(port))
+}
+
+// spliceBytes returns a copy of b with b[start:end] replaced by s.
+func spliceBytes(b []byte, start, end int, s string) []byte {
+	out := make([]byte, 0, len(b)-(end-start)+len(s))
+	out = append(out, b[:start]...)
+	out = append(out, s...)
+	return append(out, b[end:]...)
+}
+
+// ftpDataForward opens a one-shot listener on localIP and tunnels the first
+// connection it accepts from clientIP to remoteAddr, admitting it like those
+// accepted by the tunnel. It returns the port it listens on.
+func (c *client) ftpDataForward(localIP, clientIP net.IP, remoteAddr string) (int, error) {
+	var listener net.Listener
+	err := inNetns(c.listenNetns, func() (err error) {
+		listener, err = c.listenConfig().Listen(context.Background(), "tcp", net.JoinHostPort(localIP.String(), "0"))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.log.Debugf("forwarding FTP data connections from %s to %s", listener.Addr(), remoteAddr)
+
+	// called while the control connection is handled, so draining waits for this too
+	c.wg.Add(1)
+	c.conns.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.conns.Done()
+		defer listener.Close()
+
+		// give up on the port when the client doesn't show up or we are stopping
+		timer := time.NewTimer(ftpDataTimeout)
+		defer timer.Stop()
+		acceptDone := make(chan struct{})
+		defer close(acceptDone)
+		go func() {
+			select {
+			case <-timer.C:
+			case <-c.done:
+			case <-acceptDone:
+				return
+			}
+			listener.Close()
+		}()
+
+		accepted, err := c.acceptFTPData(listener, clientIP)
+		if err != nil {
+			c.log.Debugf("no FTP data connection on %s: %s", listener.Addr(), err)
+			return
+		}
+		if !c.admit(accepted, accepted.RemoteAddr()) {
+			return
+		}
+		// the control connection holds a slot of the client's IP already,
+		// waiting for another could hold up the transfer until it times out
+		releaseSlot, ok := c.acquireSlot(accepted)
+		if !ok {
+			return
+		}
+		defer releaseSlot()
+		s := newSession(accepted, remoteAddr)
+		s.routed = true
+		c.events.accept(s)
+		c.metrics.accept()
+
+		dialed, err := c.dialer.Dial("tcp", remoteAddr)
+		if err != nil {
+			c.log.Errorf("error dialing FTP data connection: %s", err)
+			c.dialFailed(s, err)
+			accepted.Close()
+			return
+		}
+
+		c.wg.Add(1)
+		c.handleConn(accepted, dialed, s)
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// acceptFTPData accepts the first connection from clientIP, or from anyone
+// when it is nil, closing those from other hosts.
+func (c *client) acceptFTPData(listener net.Listener, clientIP net.IP) (net.Conn, error) {
+	for {
+		accepted, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if clientIP == nil || clientIP.Equal(addrIP(accepted.RemoteAddr())) {
+			return accepted, nil
+		}
+		c.log.Warnf("FTP data connection from %s denied (not the client %s)", accepted.RemoteAddr(), clientIP)
+		closeConn(accepted, c.closing.deny == CloseRST)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFTPControlConnRewrite(t *testing.T) {
+	quote := regexp.QuoteMeta
+	long := "220-" + strings.Repeat("x", 5000) + "\r\n"
+	tests := []struct {
+		localIP string
+		reply   string
+		// what the client reads, as a regexp; a port the tunnel listens on
+		// is captured
+		expected string
+	}{
+		{"127.0.0.1", "220 Welcome\r\n", quote("220 Welcome\r\n")},
+		{"127.0.0.1", "227 Entering Passive Mode (10,0,0,5,195,80).\r\n",
+			`^227 Entering Passive Mode \(127,0,0,1,(\d+,\d+)\)\.\r\n$`},
+		{"127.0.0.1", "227 =10,0,0,5,4,1\r\n", `^227 =127,0,0,1,(\d+,\d+)\r\n$`},
+		{"127.0.0.1", "227 Entering Passive Mode (10,0,0,5,300,80).\r\n",
+			quote("227 Entering Passive Mode (10,0,0,5,300,80).\r\n")},
+		{"127.0.0.1", "227 Entering Passive Mode.\r\n", quote("227 Entering Passive Mode.\r\n")},
+		// there's no IPv6 address in a PASV reply
+		{"::1", "227 Entering Passive Mode (10,0,0,5,195,80).\r\n",
+			quote("227 Entering Passive Mode (10,0,0,5,195,80).\r\n")},
+		{"127.0.0.1", "229 Entering Extended Passive Mode (|||50000|)\r\n",
+			`^229 Entering Extended Passive Mode \(\|\|\|(\d+)\|\)\r\n$`},
+		{"::1", "229 Entering Extended Passive Mode (|||50000|)\r\n",
+			`^229 Entering Extended Passive Mode \(\|\|\|(\d+)\|\)\r\n$`},
+		{"127.0.0.1", "229 (!!!50000!)\r\n", `^229 \(!!!(\d+)!\)\r\n$`},
+		{"127.0.0.1", "229 (|!|50000|)\r\n", quote("229 (|!|50000|)\r\n")},
+		{"127.0.0.1", "229 (|||70000|)\r\n", quote("229 (|||70000|)\r\n")},
+		{"127.0.0.1", "150 Opening (10,0,0,5,195,80)\r\n", quote("150 Opening (10,0,0,5,195,80)\r\n")},
+		// longer than the read buffer, passed through as is
+		{"127.0.0.1", long, quote(long)},
+		// the last line may have no line end
+		{"127.0.0.1", "220 Welcome\r\n221 Bye", quote("220 Welcome\r\n221 Bye")},
+	}
+	c := newClient(clientConfig{}, make(chan struct{}), make(chan struct{}), make(chan struct{}))
+	defer c.wg.Wait()
+	defer c.shutdown()
+	for _, tt := range tests {
+		conn, server := net.Pipe()
+		go func(reply string) {
+			_, _ = io.WriteString(server, reply)
+			server.Close()
+		}(tt.reply)
+		f := &ftpControlConn{
+			Conn:     conn,
+			c:        c,
+			localIP:  net.ParseIP(tt.localIP),
+			reader:   bufio.NewReader(conn),
+			dataHost: "192.0.2.1",
+		}
+		read, err := io.ReadAll(f)
+		conn.Close()
+		if err != nil {
+			t.Errorf("%q: %v", tt.reply, err)
+			continue
+		}
+		m := regexp.MustCompile(tt.expected).FindStringSubmatch(string(read))
+		if m == nil {
+			t.Errorf("%q read as %q, expected %q", tt.reply, read, tt.expected)
+			continue
+		}
+		if len(m) < 2 {
+			continue
+		}
+		// the announced port is one the tunnel listens on
+		port := m[1]
+		if p1, p2, ok := strings.Cut(port, ","); ok {
+			high, _ := strconv.Atoi(p1)
+			low, _ := strconv.Atoi(p2)
+			port = strconv.Itoa(high<<8 | low)
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(tt.localIP, port))
+		if err == nil {
+			listener.Close()
+			t.Errorf("%q read as %q, nothing listening on port %s", tt.reply, read, port)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/sirupsen/logrus"
+)
+
+// geoFilter decides by the country and autonomous system of their address
+// which clients may connect, looking them up in MaxMind DB files such as
+// GeoLite2-Country and GeoLite2-ASN. A client of a blocked country or AS is
+// rejected; with allowed ones, so is every client of none of them.
+type geoFilter struct {
+	paths    []string
+	allow    map[string]bool
+	block    map[string]bool
+	allowASN map[uint]bool
+	blockASN map[uint]bool
+	log      logrus.FieldLogger
+
+	mu      sync.RWMutex
+	readers []*maxminddb.Reader
+	// modification times of the files when they were opened
+	modTimes []time.Time
+}
+
+// geoRecord holds what is needed of the records of either database.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+type geoConfig struct {
+	databases string
+	allow     string
+	block     string
+	allowASN  string
+	blockASN  string
+	// how often the databases are checked for updates, never when zero
+	reload time.Duration
+}
+
+func (g geoConfig) enabled() bool {
+	return g.allow != "" || g.block != "" || g.allowASN != "" || g.blockASN != ""
+}
+
+func newGeoFilter(config geoConfig, log logrus.FieldLogger) (*geoFilter, error) {
+	f := &geoFilter{log: log}
+	for _, path := range strings.Split(config.databases, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			f.paths = append(f.paths, path)
+		}
+	}
+	if len(f.paths) == 0 {
+		return nil, errors.New("GeoIP rules need a database")
+	}
+	f.allow = countrySet(config.allow)
+	f.block = countrySet(config.block)
+	var err error
+	if f.allowASN, err = asnSet(config.allowASN); err != nil {
+		return nil, err
+	}
+	if f.blockASN, err = asnSet(config.blockASN); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func countrySet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, country := range strings.Split(list, ",") {
+		if country = strings.TrimSpace(country); country != "" {
+			set[strings.ToUpper(country)] = true
+		}
+	}
+	return set
+}
+
+func asnSet(list string) (map[uint]bool, error) {
+	set := make(map[uint]bool)
+	for _, asn := range strings.Split(list, ",") {
+		asn = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(asn)), "AS")
+		if asn == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(asn, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AS number %q", asn)
+		}
+		set[uint(n)] = true
+	}
+	return set, nil
+}
+
+// open (re)opens the databases whose files changed since they were opened.
+func (f *geoFilter) open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.readers == nil {
+		f.readers = make([]*maxminddb.Reader, len(f.paths))
+		f.modTimes = make([]time.Time, len(f.paths))
+	}
+	for i, path := range f.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if f.readers[i] != nil && info.ModTime().Equal(f.modTimes[i]) {
+			continue
+		}
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			return fmt.Errorf("could not open GeoIP database %s: %w", path, err)
+		}
+		if f.readers[i] != nil {
+			f.readers[i].Close()
+			f.log.Infof("reloaded GeoIP database %s", path)
+		}
+		f.readers[i], f.modTimes[i] = reader, info.ModTime()
+	}
+	return nil
+}
+
+// reload checks the databases for updates every interval until done is
+// closed, keeping the ones open before when an update can't be opened.
+func (f *geoFilter) reload(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.open(); err != nil {
+				f.log.Warnf("could not reload GeoIP databases: %s", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (f *geoFilter) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, reader := range f.readers {
+		if reader != nil {
+			reader.Close()
+		}
+	}
+}
+
+// permits tells whether the client at addr may connect and the rule
+// deciding it.
+func (f *geoFilter) permits(addr net.Addr) (bool, string) {
+	ip := addrIP(addr)
+	if ip == nil {
+		return len(f.allow) == 0 && len(f.allowASN) == 0, "no IP address"
+	}
+	var record geoRecord
+	f.mu.RLock()
+	for _, reader := range f.readers {
+		if err := reader.Lookup(ip, &record); err != nil {
+			f.log.Debugf("could not look %s up: %s", ip, err)
+		}
+	}
+	f.mu.RUnlock()
+
+	country := record.Country.ISOCode
+	switch {
+	case country != "" && f.block[country]:
+		return false, "country " + country + " blocked"
+	case record.ASN != 0 && f.blockASN[record.ASN]:
+		return false, fmt.Sprintf("AS%d blocked", record.ASN)
+	case country != "" && f.allow[country]:
+		return true, "country " + country + " allowed"
+	case record.ASN != 0 && f.allowASN[record.ASN]:
+		return true, fmt.Sprintf("AS%d allowed", record.ASN)
+	case len(f.allow) > 0 || len(f.allowASN) > 0:
+		return false, "country and AS not allowed"
+	}
+	return true, "country and AS not blocked"
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// how long a client may take to send the target header
+const headerTargetTimeout = 10 * time.Second
+
+// headerRouter lets cooperating clients name their target in a header sent
+// before any payload: one byte holding the length, followed by "host:port".
+type headerRouter struct {
+	// the requested host:port has to match this completely
+	allow *regexp.Regexp
+}
+
+func newHeaderRouter(allow string) (*headerRouter, error) {
+	if allow == "" {
+		return nil, errors.New("taking the target from a header requires an allowlist pattern")
+	}
+	re, err := regexp.Compile("^(?:" + allow + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid target allowlist pattern: %w", err)
+	}
+	return &headerRouter{allow: re}, nil
+}
+
+func readTargetHeader(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+	if length[0] == 0 {
+		return "", errors.New("empty target header")
+	}
+	target := make([]byte, length[0])
+	if _, err := io.ReadFull(r, target); err != nil {
+		return "", err
+	}
+	// checked before the allowlist, which mustn't be all that keeps clients off unix:// and the like
+	if err := plainHostPort(string(target)); err != nil {
+		return "", fmt.Errorf("invalid target %q in header: %w", target, err)
+	}
+	return string(target), nil
+}
+
+// routeHeader reads the target header from accepted and sets the session
+// target from it. The connection is closed when that fails or the target
+// isn't allowed.
+func (c *client) routeHeader(accepted net.Conn, s *Session) bool {
+	timeout := c.dialTimeout
+	if timeout <= 0 {
+		timeout = headerTargetTimeout
+	}
+	_ = accepted.SetReadDeadline(time.Now().Add(timeout))
+	target, err := readTargetHeader(accepted)
+	_ = accepted.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.log.Warnf("could not read target header from %s: %s", accepted.RemoteAddr(), err)
+		c.failed(s.clientAddr)
+		accepted.Close()
+		return false
+	}
+	if !c.headerRouter.allow.MatchString(strings.ToLower(target)) {
+		c.log.Warnf("target %q requested by %s is not allowed", target, accepted.RemoteAddr())
+		c.failed(s.clientAddr)
+		closeConn(accepted, c.closing.deny == CloseRST)
+		return false
+	}
+
+	c.log.Debugf("routing %s to requested target %s", accepted.RemoteAddr(), target)
+	s.target = target
+	s.routed = true
+	return true
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+const (
+	hookOpen  = "open"
+	hookClose = "close"
+	hookBind  = "bind"
+)
+
+// hookConfig holds the commands run on connection events.
+type hookConfig struct {
+	onOpen      string
+	onClose     string
+	onBind      string
+	concurrency int
+	timeout     time.Duration
+}
+
+func (h hookConfig) command(event string) string {
+	switch event {
+	case hookOpen:
+		return h.onOpen
+	case hookClose:
+		return h.onClose
+	case hookBind:
+		return h.onBind
+	}
+	return ""
+}
+
+// hookEnv describes the session to a hook command.
+func hookEnv(event string, s *Session) []string {
+	env := []string{
+		"TCPTUNNEL_EVENT=" + event,
+		"TCPTUNNEL_CLIENT=" + s.clientAddr.String(),
+		"TCPTUNNEL_LISTEN=" + s.localAddr.String(),
+		"TCPTUNNEL_TARGET=" + s.target,
+	}
+	if host, _, err := net.SplitHostPort(s.clientAddr.String()); err == nil {
+		env = append(env, "TCPTUNNEL_CLIENT_IP="+host)
+	}
+	if s.bindAddr != "" {
+		env = append(env, "TCPTUNNEL_BIND_ADDR="+s.bindAddr)
+	}
+	if event == hookClose {
+		env = append(env,
+			"TCPTUNNEL_BYTES_IN="+strconv.FormatInt(s.bytesIn.Load(), 10),
+			"TCPTUNNEL_BYTES_OUT="+strconv.FormatInt(s.bytesOut.Load(), 10),
+			"TCPTUNNEL_DURATION="+strconv.FormatFloat(s.Duration().Seconds(), 'f', 3, 64),
+		)
+	}
+	return env
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
+
+// runHook runs the command configured for event in the background. At most
+// hooks.concurrency commands run at the same time; while that many do, the
+// runs of further events are dropped and counted, rather than piling up
+// goroutines waiting for a slot.
+func (c *client) runHook(event string, s *Session) {
+	command := c.hooks.command(event)
+	if command == "" {
+		return
+	}
+	select {
+	case c.hookSem <- struct{}{}:
+		if c.hooksBehind.Swap(false) {
+			c.log.Infof("hook commands caught up")
+		}
+	default:
+		c.metrics.hookDropped(event)
+		if !c.hooksBehind.Swap(true) {
+			c.log.Warnf("dropping %s hook for %s: %d hook commands running already", event, s.clientAddr, c.hooks.concurrency)
+		} else {
+			c.log.Debugf("dropping %s hook for %s", event, s.clientAddr)
+		}
+		return
+	}
+	env := hookEnv(event, s)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer func() { <-c.hookSem }()
+
+		ctx := context.Background()
+		if c.hooks.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.hooks.timeout)
+			defer cancel()
+		}
+
+		cmd := shellCommand(ctx, command)
+		cmd.Env = append(os.Environ(), env...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			c.log.Errorf("%s hook for %s failed: %s: %s", event, s.clientAddr, err, output)
+			return
+		}
+		c.log.Debugf("%s hook for %s finished: %s", event, s.clientAddr, output)
+	}()
+}
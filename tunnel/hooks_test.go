@@ -0,0 +1,45 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestHooksDroppedWhenBusy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook command uses sleep")
+	}
+	cfg := clientConfig{hooks: hookConfig{onOpen: "sleep 0.2", concurrency: 1, timeout: time.Second}}
+	c := newClient(cfg, make(chan struct{}), make(chan struct{}), make(chan struct{}))
+	s := &Session{clientAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, localAddr: &net.TCPAddr{}}
+
+	c.runHook(hookOpen, s)
+	if c.hooksBehind.Load() {
+		t.Fatal("first hook run dropped")
+	}
+	c.runHook(hookOpen, s)
+	if !c.hooksBehind.Load() {
+		t.Fatal("hook run with every slot taken wasn't dropped")
+	}
+	c.wg.Wait()
+	c.runHook(hookOpen, s)
+	if c.hooksBehind.Load() {
+		t.Fatal("hook run after the others finished dropped")
+	}
+	c.wg.Wait()
+}
@@ -0,0 +1,219 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+import "golang.org/x/net/proxy"
+
+// httpConnectDialer tunnels connections through an HTTP proxy using CONNECT.
+// Credentials in the URL are only sent once the proxy asks for them, with
+// Negotiate or NTLM when it offers those and as Basic auth otherwise. When tlsConfig is set, the
+// connection to the proxy itself is TLS (https://), otherwise it is plain (http://).
+type httpConnectDialer struct {
+	proxyURL  *url.URL
+	forward   proxy.Dialer
+	tlsConfig *tls.Config
+	// browser ClientHello to send to the proxy, Go's when empty
+	fingerprint string
+	timeout     time.Duration
+}
+
+// newHTTPSProxyConfig builds the TLS configuration used to talk to an https:// proxy.
+func newHTTPSProxyConfig(proxyURL *url.URL, caFile string, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: proxyURL.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	if serverName != "" {
+		config.ServerName = serverName
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func (d *httpConnectDialer) proxyAddress() string {
+	if d.proxyURL.Port() != "" {
+		return d.proxyURL.Host
+	}
+	if d.tlsConfig != nil {
+		return net.JoinHostPort(d.proxyURL.Hostname(), "443")
+	}
+	return net.JoinHostPort(d.proxyURL.Hostname(), "80")
+}
+
+// maxAuthRounds limits the CONNECT requests sent while authenticating.
+const maxAuthRounds = 4
+
+// dialProxy opens a connection to the proxy, with the deadline of the
+// handshake set.
+func (d *httpConnectDialer) dialProxy(network string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, d.proxyAddress())
+	if err != nil {
+		return nil, err
+	}
+
+	if d.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(d.timeout))
+	}
+	if d.tlsConfig != nil && d.fingerprint != "" {
+		tlsConn, err := mimicTLS(conn, d.tlsConfig, d.fingerprint)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy failed: %w", err)
+		}
+		conn = tlsConn
+	} else if d.tlsConfig != nil {
+		tlsConn := tls.Client(conn, d.tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy failed: %w", err)
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.dialProxy(network)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+
+	// nothing is sent before the proxy says which schemes it takes, so the
+	// password doesn't go out as Basic auth to one expecting NTLM
+	authorization := ""
+	var auth proxyAuthenticator
+	var scheme string
+	defer func() {
+		if auth != nil {
+			auth.close()
+		}
+	}()
+
+	for round := 0; ; round++ {
+		resp, err := d.connect(conn, reader, addr, authorization)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				conn.Close()
+				return nil, &targetError{err: fmt.Errorf("proxy refused CONNECT: %s", resp.Status)}
+			}
+			break
+		}
+
+		// the handshake continues on the same connection
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		var challenge []byte
+		if auth == nil {
+			scheme = pickProxyAuth(resp)
+			if scheme == "" || round >= maxAuthRounds {
+				conn.Close()
+				return nil, errors.New("proxy authentication required")
+			}
+			if scheme == authBasic {
+				auth, err = newBasicAuthenticator(d.proxyURL)
+			} else {
+				auth, err = newProxyAuthenticator(scheme, d.proxyURL)
+			}
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("could not authenticate with proxy: %w", err)
+			}
+		} else if challenge = proxyChallenge(resp, scheme); challenge == nil || round >= maxAuthRounds {
+			conn.Close()
+			return nil, fmt.Errorf("proxy rejected %s authentication", scheme)
+		}
+		token, err := auth.step(challenge)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s authentication with proxy failed: %w", scheme, err)
+		}
+		authorization = scheme + " " + base64.StdEncoding.EncodeToString(token)
+
+		if resp.Close {
+			// a proxy may hang up before the handshake has started, but not within it
+			conn.Close()
+			if challenge != nil {
+				return nil, fmt.Errorf("proxy closed the connection during %s authentication", scheme)
+			}
+			if conn, err = d.dialProxy(network); err != nil {
+				return nil, err
+			}
+			reader = bufio.NewReader(conn)
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// the target may have started talking already
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// connect sends a CONNECT request for addr, with the given Proxy-Authorization.
+func (d *httpConnectDialer) connect(conn net.Conn, reader *bufio.Reader, addr, authorization string) (*http.Response, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(reader, req)
+}
+
+// bufferedConn reads data still buffered from the handshake before reading the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) NetConn() net.Conn {
+	return b.Conn
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
@@ -0,0 +1,227 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import "golang.org/x/net/proxy"
+
+func TestPickProxyAuth(t *testing.T) {
+	tests := []struct {
+		offered []string
+		scheme  string
+	}{
+		{nil, ""},
+		{[]string{`Basic realm="proxy"`}, authBasic},
+		{[]string{`Basic realm="proxy"`, "NTLM"}, authNTLM},
+		{[]string{"NTLM", "Negotiate", `Basic realm="proxy"`}, authNegotiate},
+		{[]string{"ntlm"}, authNTLM},
+		{[]string{`Digest realm="proxy"`}, ""},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{"Proxy-Authenticate": tt.offered}}
+		if scheme := pickProxyAuth(resp); scheme != tt.scheme {
+			t.Errorf("pickProxyAuth(%q) = %q, expected %q", tt.offered, scheme, tt.scheme)
+		}
+	}
+}
+
+func TestProxyChallenge(t *testing.T) {
+	tests := []struct {
+		offered   []string
+		scheme    string
+		challenge string
+	}{
+		{[]string{"NTLM"}, authNTLM, ""},
+		{[]string{"NTLM dG9rZW4="}, authNTLM, "token"},
+		{[]string{"Negotiate dG9rZW4=", "NTLM b3RoZXI="}, authNTLM, "other"},
+		{[]string{"ntlm dG9rZW4="}, authNTLM, "token"},
+		{[]string{"NTLM !!"}, authNTLM, ""},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{"Proxy-Authenticate": tt.offered}}
+		if challenge := proxyChallenge(resp, tt.scheme); string(challenge) != tt.challenge {
+			t.Errorf("proxyChallenge(%q, %s) = %q, expected %q", tt.offered, tt.scheme, challenge, tt.challenge)
+		}
+	}
+}
+
+func TestProxyCredentials(t *testing.T) {
+	tests := []struct {
+		user                       *url.Userinfo
+		domain, username, password string
+	}{
+		{nil, "", "", ""},
+		{url.User("alice"), "", "alice", ""},
+		{url.UserPassword(`CORP\alice`, "secret"), "CORP", "alice", "secret"},
+		{url.UserPassword("alice@corp.example", "secret"), "", "alice@corp.example", "secret"},
+	}
+	for _, tt := range tests {
+		domain, username, password := proxyCredentials(tt.user)
+		if domain != tt.domain || username != tt.username || password != tt.password {
+			t.Errorf("proxyCredentials(%v) = %q, %q, %q, expected %q, %q, %q",
+				tt.user, domain, username, password, tt.domain, tt.username, tt.password)
+		}
+	}
+}
+
+// fakeHTTPProxy answers the CONNECT requests it gets, on whichever
+// connection, with the responses in turn, hanging up after those with
+// "Connection: close". It records the Proxy-Authorization of each request.
+type fakeHTTPProxy struct {
+	listener  net.Listener
+	responses []string
+	mu        sync.Mutex
+	auths     []string
+}
+
+func newFakeHTTPProxy(t *testing.T, responses []string) *fakeHTTPProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeHTTPProxy{listener: listener, responses: responses}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeHTTPProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.auths = append(p.auths, req.Header.Get("Proxy-Authorization"))
+		if len(p.responses) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		resp := p.responses[0]
+		p.responses = p.responses[1:]
+		p.mu.Unlock()
+		if _, err = io.WriteString(conn, resp); err != nil || strings.Contains(resp, "Connection: close") {
+			return
+		}
+	}
+}
+
+func (p *fakeHTTPProxy) authorizations() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.auths...)
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	const (
+		ok            = "HTTP/1.1 200 Connection established\r\n\r\n"
+		basicRequired = "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nContent-Length: 0\r\n\r\n"
+	)
+	tests := []struct {
+		name      string
+		user      *url.Userinfo
+		responses []string
+		// Proxy-Authorization sent with each request, by prefix
+		auths []string
+		// error message, by prefix, empty for none
+		err string
+		// reported as a failure reaching the target
+		target bool
+		// read first from the tunnel
+		data string
+	}{
+		{"no authentication", nil, []string{ok}, []string{""}, "", false, ""},
+		{"target talks first", nil, []string{"HTTP/1.1 200 OK\r\n\r\nhello"}, []string{""}, "", false, "hello"},
+		{"refused", nil, []string{"HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"}, []string{""},
+			"proxy refused CONNECT: 502", true, ""},
+		{"basic", url.UserPassword("user", "pass"), []string{basicRequired, ok},
+			[]string{"", "Basic dXNlcjpwYXNz"}, "", false, ""},
+		{"basic after reconnecting", url.UserPassword("user", "pass"),
+			[]string{strings.Replace(basicRequired, "\r\n\r\n", "\r\nConnection: close\r\n\r\n", 1), ok},
+			[]string{"", "Basic dXNlcjpwYXNz"}, "", false, ""},
+		{"basic rejected", url.UserPassword("user", "pass"), []string{basicRequired, basicRequired},
+			[]string{"", "Basic dXNlcjpwYXNz"}, "proxy rejected Basic authentication", false, ""},
+		{"basic without credentials", nil, []string{basicRequired}, []string{""},
+			"could not authenticate with proxy", false, ""},
+		{"no scheme offered", url.UserPassword("user", "pass"),
+			[]string{"HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"}, []string{""},
+			"proxy authentication required", false, ""},
+		{"NTLM preferred", url.UserPassword(`CORP\user`, "pass"),
+			[]string{"HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nProxy-Authenticate: NTLM\r\nContent-Length: 0\r\n\r\n",
+				"HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nContent-Length: 0\r\n\r\n"},
+			[]string{"", "NTLM TlRMTVNTUAAB"}, "proxy rejected NTLM authentication", false, ""},
+	}
+	for _, tt := range tests {
+		p := newFakeHTTPProxy(t, tt.responses)
+		d := &httpConnectDialer{
+			proxyURL: &url.URL{Scheme: "http", Host: p.listener.Addr().String(), User: tt.user},
+			forward:  proxy.Direct,
+			timeout:  5 * time.Second,
+		}
+		conn, err := d.Dial("tcp", "192.0.2.1:80")
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)):
+			t.Errorf("%s: dial failed with %v, expected %q", tt.name, err, tt.err)
+		}
+		var targetErr *targetError
+		if err != nil && errors.As(err, &targetErr) != tt.target {
+			t.Errorf("%s: target error %v, expected %v", tt.name, !tt.target, tt.target)
+		}
+		if conn != nil {
+			if tt.data != "" {
+				buf := make([]byte, len(tt.data))
+				if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != tt.data {
+					t.Errorf("%s: read %q (%v), expected %q", tt.name, buf, err, tt.data)
+				}
+			}
+			conn.Close()
+		}
+
+		auths := p.authorizations()
+		if len(auths) != len(tt.auths) {
+			t.Errorf("%s: sent %q, expected %q", tt.name, auths, tt.auths)
+		} else {
+			for i := range auths {
+				if !strings.HasPrefix(auths[i], tt.auths[i]) || (tt.auths[i] == "" && auths[i] != "") {
+					t.Errorf("%s: sent %q, expected %q", tt.name, auths, tt.auths)
+					break
+				}
+			}
+		}
+		p.listener.Close()
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// httpProxyConn is a connection of a client of the HTTP proxy server, along
+// with what it has sent beyond its request already.
+type httpProxyConn struct {
+	bufferedConn
+	// the head of the request, rewritten for the target; nil for CONNECT
+	forward []byte
+}
+
+// httpServe reads the request of a client of the HTTP proxy server and
+// returns the target it asks for. CONNECT requests are tunneled as they are;
+// others must name an http:// URL and are forwarded to its host with the
+// request line rewritten and the connection closed after the response.
+func (c *client) httpServe(conn net.Conn, s *Session) (*httpProxyConn, string, error) {
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	if c.proxyServerUsers != nil && !c.httpLogin(req, s) {
+		httpProxyError(conn, http.StatusProxyAuthRequired)
+		return nil, "", errors.New("HTTP proxy authentication failed")
+	}
+
+	client := &httpProxyConn{bufferedConn: bufferedConn{Conn: conn, reader: reader}}
+	if req.Method == http.MethodConnect {
+		target := req.Host
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "443")
+		}
+		return client, target, nil
+	}
+
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		httpProxyError(conn, http.StatusBadRequest)
+		return nil, "", fmt.Errorf("can't proxy request for %q", req.RequestURI)
+	}
+	target := req.URL.Host
+	if req.URL.Port() == "" {
+		target = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+
+	// the body follows the head unchanged
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s %s\r\n", req.Method, req.URL.RequestURI(), req.Proto)
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Header.Set("Connection", "close")
+	req.Header.Set("Host", req.Host)
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+	_ = req.Header.Write(&head)
+	head.WriteString("\r\n")
+	client.forward = head.Bytes()
+	return client, target, nil
+}
+
+// httpLogin checks the Basic credentials of req, taking the user as the
+// identity of s.
+func (c *client) httpLogin(req *http.Request, s *Session) bool {
+	scheme, credentials, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	user, password, _ := strings.Cut(string(decoded), ":")
+	if !c.proxyServerUsers.valid(user, password) {
+		return false
+	}
+	s.identity = user
+	return true
+}
+
+// httpProxyError answers the client with an empty response of status.
+func httpProxyError(conn net.Conn, status int) {
+	header := ""
+	if status == http.StatusProxyAuthRequired {
+		header = "Proxy-Authenticate: Basic realm=\"tcptunnel\"\r\n"
+	}
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status), header)
+}
+
+// httpReply tells the client whether its target was dialed (err is nil),
+// sending the request on to the target unless it was a CONNECT.
+func httpReply(client *httpProxyConn, dialed net.Conn, err error) error {
+	if err != nil {
+		status := http.StatusBadGateway
+		var netErr net.Error
+		if errors.Is(err, errIdentityLimit) {
+			status = http.StatusTooManyRequests
+		} else if errors.Is(err, errTargetNotAllowed) {
+			status = http.StatusForbidden
+		} else if errors.As(err, &netErr) && netErr.Timeout() {
+			status = http.StatusGatewayTimeout
+		}
+		httpProxyError(client, status)
+		return nil
+	}
+	if client.forward != nil {
+		_, err = dialed.Write(client.forward)
+		return err
+	}
+	_, err = client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return err
+}
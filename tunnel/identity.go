@@ -0,0 +1,136 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+)
+
+import "golang.org/x/time/rate"
+
+// IdentityLimit caps the sessions of one client identity: a user of the
+// proxy server or the name in a client certificate.
+type IdentityLimit struct {
+	// sessions open at once, unlimited when zero
+	MaxConns int
+	// new sessions per second, unlimited when zero
+	Rate float64
+}
+
+func (l IdentityLimit) unlimited() bool {
+	return l.MaxConns <= 0 && l.Rate <= 0
+}
+
+var errIdentityLimit = errors.New("identity over its limit")
+
+// identityLimits applies the IdentityLimit of each identity.
+type identityLimits struct {
+	defaults IdentityLimit
+	// limits of single identities, in place of the defaults
+	overrides map[string]IdentityLimit
+	mu        sync.Mutex
+	// identities stay once seen, there are only as many as the users and certificates
+	states map[string]*identityState
+}
+
+type identityState struct {
+	active  int
+	limiter *rate.Limiter
+}
+
+func newIdentityLimits(defaults IdentityLimit, overrides map[string]IdentityLimit) *identityLimits {
+	if defaults.unlimited() && len(overrides) == 0 {
+		return nil
+	}
+	return &identityLimits{defaults: defaults, overrides: overrides, states: make(map[string]*identityState)}
+}
+
+// acquire counts a new session of identity, returning the func ending it,
+// or the reason it is over the limit.
+func (l *identityLimits) acquire(identity string) (func(), string) {
+	limit, ok := l.overrides[identity]
+	if !ok {
+		limit = l.defaults
+	}
+	if limit.unlimited() {
+		return func() {}, ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state := l.states[identity]
+	if state == nil {
+		state = &identityState{}
+		if limit.Rate > 0 {
+			state.limiter = rate.NewLimiter(rate.Limit(limit.Rate), int(math.Max(1, math.Ceil(limit.Rate))))
+		}
+		l.states[identity] = state
+	}
+	if limit.MaxConns > 0 && state.active >= limit.MaxConns {
+		return nil, fmt.Sprintf("%d sessions open for %q, the maximum", limit.MaxConns, identity)
+	}
+	if state.limiter != nil && !state.limiter.Allow() {
+		return nil, fmt.Sprintf("new sessions for %q over %g/s", identity, limit.Rate)
+	}
+	state.active++
+	return func() {
+		l.mu.Lock()
+		state.active--
+		l.mu.Unlock()
+	}, ""
+}
+
+// certificateIdentity is the identity of the client certificate presented
+// on conn: its common name, or else its first DNS name or email address.
+func certificateIdentity(conn *tls.Conn) string {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	cert := certs[0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// acquireIdentity counts the session s against the limits of its identity,
+// returning the func ending it. A session over the limit is refused, the
+// client of the proxy server being told so first.
+func (c *client) acquireIdentity(accepted net.Conn, s *Session) (func(), bool) {
+	if c.identityLimits == nil || s.identity == "" {
+		return func() {}, true
+	}
+	release, reason := c.identityLimits.acquire(s.identity)
+	if release != nil {
+		return release, true
+	}
+	if c.proxyServer != "" {
+		_ = c.replyProxyRequest(accepted, nil, errIdentityLimit)
+	}
+	s.setCloseReason("identity limit")
+	c.rejectOverLimit(accepted, reason)
+	return nil, false
+}
@@ -0,0 +1,443 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import "gopkg.in/yaml.v3"
+
+const (
+	k8sScheme = "k8s://"
+	// where a pod finds the credentials of its service account
+	k8sServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+func isK8sURL(addr string) bool {
+	return strings.HasPrefix(addr, k8sScheme)
+}
+
+// k8sSource keeps the targets in sync with the ready endpoints of a
+// Kubernetes service, watching its EndpointSlices with the credentials of
+// the pod's service account or else of $KUBECONFIG (~/.kube/config).
+type k8sSource struct {
+	namespace string
+	service   string
+	// name or number of the port of the endpoints
+	port string
+
+	server string
+	client *http.Client
+	// the bearer token or the file it is read from on every request, as
+	// service account tokens get rotated
+	token     string
+	tokenFile string
+
+	// addresses of the ready endpoints of each EndpointSlice
+	slices          map[string][]string
+	resourceVersion string
+	watch           io.ReadCloser
+	events          *json.Decoder
+}
+
+// newK8sSource parses k8s://[<namespace>/]<service>:<port>.
+func newK8sSource(target string) (*k8sSource, error) {
+	invalid := fmt.Errorf("invalid Kubernetes target %q, use k8s://<namespace>/<service>:<port>", target)
+	rest := strings.TrimPrefix(target, k8sScheme)
+	namespace, service, ok := strings.Cut(rest, "/")
+	if !ok {
+		namespace, service = "", rest
+	}
+	service, port, ok := strings.Cut(service, ":")
+	if !ok || service == "" || port == "" || strings.Contains(port, "/") {
+		return nil, invalid
+	}
+	return &k8sSource{namespace: namespace, service: service, port: port, slices: make(map[string][]string)}, nil
+}
+
+// loadCredentials sets up the API client, in the cluster if running in one,
+// taking the namespace from there when the target has none.
+func (s *k8sSource) loadCredentials() error {
+	var namespace string
+	var err error
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		namespace, err = s.inCluster()
+	} else {
+		namespace, err = s.fromKubeconfig()
+	}
+	if err != nil {
+		return err
+	}
+	if s.namespace == "" {
+		s.namespace = namespace
+	}
+	if s.namespace == "" {
+		s.namespace = "default"
+	}
+	return nil
+}
+
+// inCluster sets up the API client with the pod's service account, returning
+// the pod's namespace.
+func (s *k8sSource) inCluster() (string, error) {
+	s.server = "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	s.tokenFile = filepath.Join(k8sServiceAccount, "token")
+	pool, err := loadCertPool(filepath.Join(k8sServiceAccount, "ca.crt"))
+	if err != nil {
+		return "", fmt.Errorf("could not load the cluster's CA: %w", err)
+	}
+	s.client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	namespace, _ := os.ReadFile(filepath.Join(k8sServiceAccount, "namespace"))
+	return strings.TrimSpace(string(namespace)), nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string
+		Cluster struct {
+			Server                   string
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		}
+	}
+	Contexts []struct {
+		Name    string
+		Context struct {
+			Cluster   string
+			User      string
+			Namespace string
+		}
+	}
+	Users []struct {
+		Name string
+		User struct {
+			Token                 string
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Exec                  interface{}
+			AuthProvider          interface{} `yaml:"auth-provider"`
+		}
+	}
+}
+
+// fromKubeconfig sets up the API client with the current context of the
+// kubeconfig, returning the context's namespace.
+func (s *k8sSource) fromKubeconfig() (string, error) {
+	path := os.Getenv("KUBECONFIG")
+	if i := strings.IndexRune(path, filepath.ListSeparator); i >= 0 {
+		path = path[:i]
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, ".kube", "config")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("not in a cluster and no kubeconfig: %w", err)
+	}
+	defer f.Close()
+	var config kubeconfig
+	if err = yaml.NewDecoder(f).Decode(&config); err != nil {
+		return "", fmt.Errorf("invalid kubeconfig %s: %w", path, err)
+	}
+	// files named in it are relative to it
+	relative := func(file string) string {
+		if file == "" || filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(filepath.Dir(path), file)
+	}
+
+	contextIndex := -1
+	for i := range config.Contexts {
+		if config.Contexts[i].Name == config.CurrentContext {
+			contextIndex = i
+		}
+	}
+	if contextIndex < 0 {
+		return "", fmt.Errorf("no current context in kubeconfig %s", path)
+	}
+	kubeContext := config.Contexts[contextIndex].Context
+
+	tlsConfig := &tls.Config{}
+	clusterFound := false
+	for _, cluster := range config.Clusters {
+		if cluster.Name != kubeContext.Cluster {
+			continue
+		}
+		clusterFound = true
+		s.server = strings.TrimSuffix(cluster.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = cluster.Cluster.InsecureSkipTLSVerify
+		ca, err := kubeconfigData(cluster.Cluster.CertificateAuthorityData, relative(cluster.Cluster.CertificateAuthority))
+		if err != nil {
+			return "", fmt.Errorf("could not load the cluster's CA: %w", err)
+		}
+		if ca != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return "", errors.New("no certificates found in the cluster's CA")
+			}
+		}
+	}
+	if !clusterFound || s.server == "" {
+		return "", fmt.Errorf("no server for context %s in kubeconfig %s", config.CurrentContext, path)
+	}
+
+	for _, user := range config.Users {
+		if user.Name != kubeContext.User {
+			continue
+		}
+		if user.User.Exec != nil || user.User.AuthProvider != nil {
+			return "", fmt.Errorf("user %s of kubeconfig %s logs in through a plugin, which isn't supported", user.Name, path)
+		}
+		s.token = user.User.Token
+		s.tokenFile = relative(user.User.TokenFile)
+		cert, err := kubeconfigData(user.User.ClientCertificateData, relative(user.User.ClientCertificate))
+		if err != nil {
+			return "", fmt.Errorf("could not load the client certificate: %w", err)
+		}
+		key, err := kubeconfigData(user.User.ClientKeyData, relative(user.User.ClientKey))
+		if err != nil {
+			return "", fmt.Errorf("could not load the client key: %w", err)
+		}
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return "", fmt.Errorf("invalid client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+	s.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return kubeContext.Namespace, nil
+}
+
+// kubeconfigData returns the base64 encoded data or else the contents of
+// file, nil when neither is given.
+func kubeconfigData(data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
+
+func (s *k8sSource) String() string {
+	return "Kubernetes service " + s.namespace + "/" + s.service
+}
+
+// endpointSlice holds what is needed of a discovery.k8s.io/v1 EndpointSlice.
+type endpointSlice struct {
+	Metadata struct {
+		Name            string
+		ResourceVersion string
+	}
+	Endpoints []struct {
+		Addresses  []string
+		Conditions struct {
+			Ready *bool
+		}
+	}
+	Ports []struct {
+		Name *string
+		Port *int
+	}
+}
+
+// addresses returns the <host>:<port> of the ready endpoints in the slice.
+func (s *k8sSource) addresses(slice *endpointSlice) []string {
+	port := 0
+	for _, p := range slice.Ports {
+		number := 0
+		if p.Port != nil {
+			number = *p.Port
+		}
+		if (p.Name != nil && *p.Name == s.port) || strconv.Itoa(number) == s.port {
+			port = number
+		}
+	}
+	if port == 0 {
+		return nil
+	}
+	var addresses []string
+	for _, endpoint := range slice.Endpoints {
+		if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+			continue
+		}
+		for _, address := range endpoint.Addresses {
+			addresses = append(addresses, net.JoinHostPort(address, strconv.Itoa(port)))
+		}
+	}
+	return addresses
+}
+
+func (s *k8sSource) backends() []*backend {
+	var addresses []string
+	for _, slice := range s.slices {
+		addresses = append(addresses, slice...)
+	}
+	// the same order every time, so the balancer keeps its turn
+	sort.Strings(addresses)
+	backends := make([]*backend, 0, len(addresses))
+	for _, address := range addresses {
+		backends = append(backends, &backend{address: address, weight: 1})
+	}
+	return backends
+}
+
+func (s *k8sSource) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	query.Set("labelSelector", "kubernetes.io/service-name="+s.service)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		s.server+"/apis/discovery.k8s.io/v1/namespaces/"+url.PathEscape(s.namespace)+"/endpointslices?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	token := s.token
+	if s.tokenFile != "" {
+		t, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(t))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Kubernetes API answered %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// fetch lists the EndpointSlices the first time, then watches them until
+// the targets change, listing them again whenever a watch ends.
+func (s *k8sSource) fetch(ctx context.Context) ([]*backend, error) {
+	for {
+		if s.resourceVersion == "" {
+			if err := s.list(ctx); err != nil {
+				return nil, err
+			}
+			return s.backends(), nil
+		}
+		if s.events == nil {
+			resp, err := s.get(ctx, url.Values{
+				"watch":               {"1"},
+				"resourceVersion":     {s.resourceVersion},
+				"allowWatchBookmarks": {"true"},
+			})
+			if err != nil {
+				s.resourceVersion = ""
+				return nil, err
+			}
+			s.watch, s.events = resp.Body, json.NewDecoder(resp.Body)
+		}
+		changed, err := s.next()
+		if err != nil {
+			s.watch.Close()
+			s.watch, s.events, s.resourceVersion = nil, nil, ""
+			// the API server ends watches now and then
+			if errors.Is(err, io.EOF) && ctx.Err() == nil {
+				continue
+			}
+			return nil, err
+		}
+		if changed {
+			return s.backends(), nil
+		}
+	}
+}
+
+func (s *k8sSource) list(ctx context.Context) error {
+	resp, err := s.get(ctx, url.Values{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata struct {
+			ResourceVersion string
+		}
+		Items []endpointSlice
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+	s.slices = make(map[string][]string, len(list.Items))
+	for i := range list.Items {
+		s.slices[list.Items[i].Metadata.Name] = s.addresses(&list.Items[i])
+	}
+	s.resourceVersion = list.Metadata.ResourceVersion
+	return nil
+}
+
+// next applies the next watch event, telling whether it changed the slices.
+func (s *k8sSource) next() (bool, error) {
+	var event struct {
+		Type   string
+		Object json.RawMessage
+	}
+	if err := s.events.Decode(&event); err != nil {
+		return false, err
+	}
+	if event.Type == "ERROR" {
+		// most likely the resource version is too old, listing starts over
+		return false, fmt.Errorf("watch failed: %s", event.Object)
+	}
+	var slice endpointSlice
+	if err := json.Unmarshal(event.Object, &slice); err != nil {
+		return false, err
+	}
+	s.resourceVersion = slice.Metadata.ResourceVersion
+	switch event.Type {
+	case "ADDED", "MODIFIED":
+		s.slices[slice.Metadata.Name] = s.addresses(&slice)
+		return true, nil
+	case "DELETED":
+		delete(s.slices, slice.Metadata.Name)
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// acquireSlot takes one of the c.maxConns connection slots for accepted,
+// waiting up to c.maxConnsWait for one to be freed. Clients outside of the
+// priority ranges also need one of the slots left when the reserved ones are
+// taken out. The returned func frees the slot; a connection finding none is
+// rejected as the close policy says for limits.
+func (c *client) acquireSlot(accepted net.Conn) (func(), bool) {
+	if c.connSlots == nil {
+		return func() {}, true
+	}
+	if c.ordinarySlots == nil || c.priorityClient(accepted.RemoteAddr()) {
+		if !c.takeSlot(c.connSlots, c.maxConnsWait) {
+			c.rejectOverLimit(accepted, fmt.Sprintf("%d connections open, the maximum", cap(c.connSlots)))
+			return nil, false
+		}
+		return func() { <-c.connSlots }, true
+	}
+
+	start := time.Now()
+	if !c.takeSlot(c.ordinarySlots, c.maxConnsWait) {
+		c.rejectOverLimit(accepted, fmt.Sprintf("%d connections open, the maximum with %d reserved", cap(c.ordinarySlots), c.maxConnsReserved))
+		return nil, false
+	}
+	// priority clients may hold more than the reserved slots, leaving fewer
+	if !c.takeSlot(c.connSlots, c.maxConnsWait-time.Since(start)) {
+		<-c.ordinarySlots
+		c.rejectOverLimit(accepted, fmt.Sprintf("%d connections open, the maximum", cap(c.connSlots)))
+		return nil, false
+	}
+	return func() {
+		<-c.connSlots
+		<-c.ordinarySlots
+	}, true
+}
+
+// priorityClient tells whether the client at addr may use the reserved
+// connection slots.
+func (c *client) priorityClient(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.priorityNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipSlots holds the connection slots of one client IP.
+type ipSlots struct {
+	slots chan struct{}
+	// connections holding or waiting for a slot, the entry goes at zero
+	users int
+}
+
+// acquireIPSlot takes one of the c.maxConnsPerIP slots of the client at addr,
+// waiting up to c.maxConnsPerIPWait for one to be freed. The returned func
+// frees the slot; a connection finding none is rejected like in acquireSlot.
+func (c *client) acquireIPSlot(accepted net.Conn, addr net.Addr) (func(), bool) {
+	ip := addrIP(addr)
+	if c.ipSlots == nil || ip == nil {
+		return func() {}, true
+	}
+	key := ip.String()
+
+	c.ipSlotsMu.Lock()
+	e := c.ipSlots[key]
+	if e == nil {
+		e = &ipSlots{slots: make(chan struct{}, c.maxConnsPerIP)}
+		c.ipSlots[key] = e
+	}
+	e.users++
+	c.ipSlotsMu.Unlock()
+	leave := func() {
+		c.ipSlotsMu.Lock()
+		if e.users--; e.users == 0 {
+			delete(c.ipSlots, key)
+		}
+		c.ipSlotsMu.Unlock()
+	}
+
+	if !c.takeSlot(e.slots, c.maxConnsPerIPWait) {
+		leave()
+		c.rejectOverLimit(accepted, fmt.Sprintf("%d connections open from %s, the maximum", c.maxConnsPerIP, key))
+		return nil, false
+	}
+	return func() {
+		<-e.slots
+		leave()
+	}, true
+}
+
+// takeSlot takes one of slots, waiting up to wait for one to be freed.
+func (c *client) takeSlot(slots chan struct{}, wait time.Duration) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-c.done:
+	}
+	return false
+}
+
+// rejectOverLimit closes accepted, which found no free slot, as the close
+// policy says for limits.
+func (c *client) rejectOverLimit(accepted net.Conn, reason string) {
+	select {
+	case <-c.done:
+		// shutting down, no need to tell
+		accepted.Close()
+		return
+	default:
+	}
+	c.log.Warnf("%s, applying %s to connection from %s", reason, c.closing.limit, accepted.RemoteAddr())
+	closeConn(accepted, c.closing.limit == CloseRST)
+}
+
+// errDataCap ends the copy loops of a connection that has used up c.maxBytes.
+var errDataCap = errors.New("data cap reached")
+
+// cappedConn is a net.Conn whose reads stop once used, shared by both
+// directions of the connection, reaches max.
+type cappedConn struct {
+	net.Conn
+	used *atomic.Int64
+	max  int64
+}
+
+func (cc *cappedConn) Read(p []byte) (int, error) {
+	left := cc.max - cc.used.Load()
+	if left <= 0 {
+		return 0, errDataCap
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := cc.Conn.Read(p)
+	cc.used.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+)
+
+// How connections turned down by the tunnel are closed.
+const (
+	// gracefully, with a FIN
+	CloseFIN = "fin"
+	// abortively, with a RST (SO_LINGER 0), leaving no socket in TIME_WAIT
+	CloseRST = "rst"
+)
+
+// closePolicy tells how connections are closed in each situation the tunnel
+// closes them on its own.
+type closePolicy struct {
+	// active connections cut when stopping
+	shutdown string
+	// connections rejected for exceeding a limit
+	limit string
+	// connections rejected by an access rule
+	deny string
+}
+
+func (p closePolicy) validate() error {
+	for _, how := range []string{p.shutdown, p.limit, p.deny} {
+		switch how {
+		case "", CloseFIN, CloseRST:
+		default:
+			return fmt.Errorf("unknown close behavior %q (fin or rst)", how)
+		}
+	}
+	return nil
+}
+
+// closeConn closes conn, aborting it with a RST instead of a FIN when reset is set.
+func closeConn(conn net.Conn, reset bool) {
+	if reset {
+		if tcpConn, ok := underlyingConn(conn).(*net.TCPConn); ok {
+			_ = tcpConn.SetLinger(0)
+		}
+	}
+	conn.Close()
+}
+
+// underlyingConn unwraps conn down to the connection it is built on.
+func underlyingConn(conn net.Conn) net.Conn {
+	for {
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = wrapper.NetConn()
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// bpfInstruction is a classic BPF instruction, as printed by "tcpdump -ddd".
+type bpfInstruction struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+// loadBPF reads a classic BPF program in the decimal format of "tcpdump -ddd":
+// the number of instructions on the first line, then one "code jt jf k"
+// instruction per line. Empty lines and lines starting with # are ignored.
+func loadBPF(path string) ([]bpfInstruction, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseBPF(f)
+}
+
+func parseBPF(r io.Reader) ([]bpfInstruction, error) {
+	var program []bpfInstruction
+	count := -1
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if count < 0 {
+			n, err := strconv.ParseUint(text, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid instruction count %q", line, text)
+			}
+			count = int(n)
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expected \"code jt jf k\", got %q", line, text)
+		}
+		var values [4]uint64
+		for i, bits := range []int{16, 8, 8, 32} {
+			v, err := strconv.ParseUint(fields[i], 10, bits)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value %q", line, fields[i])
+			}
+			values[i] = v
+		}
+		program = append(program, bpfInstruction{
+			code: uint16(values[0]),
+			jt:   uint8(values[1]),
+			jf:   uint8(values[2]),
+			k:    uint32(values[3]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(program) == 0 {
+		return nil, fmt.Errorf("empty BPF program")
+	}
+	if len(program) != count {
+		return nil, fmt.Errorf("BPF program has %d instructions, %d announced", len(program), count)
+	}
+	return program, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+import "golang.org/x/sys/unix"
+
+func attachBPF(listener *net.TCPListener, program []bpfInstruction) error {
+	return errors.New("BPF listen filters are only supported on Linux")
+}
+
+// setAcceptFilter installs an accept filter (e.g. "dataready" or "httpready",
+// optionally followed by ":argument") on the listening socket, holding back
+// connections in the kernel until the filter is satisfied.
+func setAcceptFilter(listener *net.TCPListener, filter string) error {
+	name, arg, _ := strings.Cut(filter, ":")
+	// struct accept_filter_arg
+	var afa [256]byte
+	if len(name) >= 16 || len(arg) >= len(afa)-16 {
+		return fmt.Errorf("accept filter %q too long", filter)
+	}
+	copy(afa[:16], name)
+	copy(afa[16:], arg)
+
+	raw, err := listener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_ACCEPTFILTER, string(afa[:]))
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("could not set accept filter %q (is the accf_%s module loaded?): %w", name, name, sockErr)
+	}
+	return nil
+}
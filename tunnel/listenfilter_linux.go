@@ -0,0 +1,55 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+import "golang.org/x/sys/unix"
+
+// attachBPF makes the kernel run program on the packets of the listening
+// socket, the connections it accepts inherit it. Packets the program
+// returns 0 for are dropped before they reach the accept loop.
+func attachBPF(listener *net.TCPListener, program []bpfInstruction) error {
+	filter := make([]unix.SockFilter, len(program))
+	for i, ins := range program {
+		filter[i] = unix.SockFilter{Code: ins.code, Jt: ins.jt, Jf: ins.jf, K: ins.k}
+	}
+	raw, err := listener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+			Len:    uint16(len(filter)),
+			Filter: &filter[0],
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("could not attach BPF filter: %w", sockErr)
+	}
+	return nil
+}
+
+func setAcceptFilter(listener *net.TCPListener, filter string) error {
+	return errors.New("accept filters are only supported on FreeBSD")
+}
@@ -0,0 +1,30 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !freebsd
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+)
+
+func attachBPF(listener *net.TCPListener, program []bpfInstruction) error {
+	return errors.New("BPF listen filters are only supported on Linux")
+}
+
+func setAcceptFilter(listener *net.TCPListener, filter string) error {
+	return errors.New("accept filters are only supported on FreeBSD")
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"net"
+	"net/http"
+)
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics collects the Prometheus metrics of any number of tunnels, told
+// apart by their tunnel label.
+type Metrics struct {
+	registry     *prometheus.Registry
+	active       *prometheus.GaugeVec
+	accepted     *prometheus.CounterVec
+	dialed       *prometheus.CounterVec
+	dialErrors   *prometheus.CounterVec
+	bytesIn      *prometheus.CounterVec
+	bytesOut     *prometheus.CounterVec
+	dialDuration *prometheus.HistogramVec
+	connDuration *prometheus.HistogramVec
+	hooksDropped *prometheus.CounterVec
+}
+
+// NewMetrics creates the metrics, along with the ones of the Go runtime and
+// the process.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tcptunnel_active_connections",
+			Help: "Connections being tunneled.",
+		}, []string{"tunnel"}),
+		accepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcptunnel_accepted_connections_total",
+			Help: "Connections accepted, whether or not they got tunneled.",
+		}, []string{"tunnel"}),
+		dialed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcptunnel_dialed_connections_total",
+			Help: "Connections established to the target.",
+		}, []string{"tunnel", "target"}),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcptunnel_dial_errors_total",
+			Help: "Targets that could not be reached.",
+		}, []string{"tunnel", "target"}),
+		bytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcptunnel_bytes_in_total",
+			Help: "Bytes sent from clients to the target.",
+		}, []string{"tunnel", "target"}),
+		bytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcptunnel_bytes_out_total",
+			Help: "Bytes sent from the target to clients.",
+		}, []string{"tunnel", "target"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tcptunnel_dial_duration_seconds",
+			Help:    "Time from accepting a connection to establishing the one to the target.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, []string{"tunnel"}),
+		connDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tcptunnel_connection_duration_seconds",
+			Help:    "Time tunneled connections have been open for.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 4, 10),
+		}, []string{"tunnel"}),
+		hooksDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcptunnel_hooks_dropped_total",
+			Help: "Hook commands not run because as many as allowed were running.",
+		}, []string{"tunnel", "event"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.active, m.accepted, m.dialed, m.dialErrors,
+		m.bytesIn, m.bytesOut, m.dialDuration, m.connDuration, m.hooksDropped,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// tunnelMetrics records the metrics of a single tunnel. Every method does
+// nothing on a nil one, so callers don't have to check whether metrics are
+// in use.
+type tunnelMetrics struct {
+	*Metrics
+	tunnel string
+}
+
+func (m *tunnelMetrics) accept() {
+	if m != nil {
+		m.accepted.WithLabelValues(m.tunnel).Inc()
+	}
+}
+
+func (m *tunnelMetrics) dialError(s *Session) {
+	if m != nil {
+		m.dialErrors.WithLabelValues(m.tunnel, targetLabel(s)).Inc()
+	}
+}
+
+func (m *tunnelMetrics) establish(s *Session) {
+	if m != nil {
+		m.active.WithLabelValues(m.tunnel).Inc()
+		m.dialed.WithLabelValues(m.tunnel, targetLabel(s)).Inc()
+		m.dialDuration.WithLabelValues(m.tunnel).Observe(s.DialDuration().Seconds())
+	}
+}
+
+func (m *tunnelMetrics) close(s *Session) {
+	if m != nil {
+		m.active.WithLabelValues(m.tunnel).Dec()
+		m.connDuration.WithLabelValues(m.tunnel).Observe(s.Duration().Seconds())
+	}
+}
+
+func (m *tunnelMetrics) hookDropped(event string) {
+	if m != nil {
+		m.hooksDropped.WithLabelValues(m.tunnel, event).Inc()
+	}
+}
+
+// targetLabel is the target label of s: the target or backend as
+// configured, or "dynamic" for one the client picked, which could be any.
+func targetLabel(s *Session) string {
+	if s.routed {
+		return "dynamic"
+	}
+	return s.target
+}
+
+// meter counts the bytes read from conn as sent in and the ones read from
+// rConn as sent out as they go by, rather than when the connection closes,
+// so long-lived ones show up too.
+func (m *tunnelMetrics) meter(conn, rConn net.Conn, s *Session) (net.Conn, net.Conn) {
+	if m == nil {
+		return conn, rConn
+	}
+	return &meteredConn{Conn: conn, counter: m.bytesIn.WithLabelValues(m.tunnel, targetLabel(s))},
+		&meteredConn{Conn: rConn, counter: m.bytesOut.WithLabelValues(m.tunnel, targetLabel(s))}
+}
+
+type meteredConn struct {
+	net.Conn
+	counter prometheus.Counter
+}
+
+func (m *meteredConn) Read(b []byte) (int, error) {
+	n, err := m.Conn.Read(b)
+	if n > 0 {
+		m.counter.Add(float64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,311 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/hashicorp/yamux"
+	"github.com/sirupsen/logrus"
+)
+
+// Multiplexing: a mux:// target carries all tunneled connections as yamux
+// streams over a single carrier connection to a peer instance, which
+// listens on a mux:// address and tunnels every stream like an accepted
+// connection. A broken carrier is dialed again for the next connection.
+const (
+	muxScheme = "mux://"
+
+	// pause before redialing a carrier that could not be established
+	muxRedialDelay = time.Second
+)
+
+func isMuxURL(addr string) bool {
+	return strings.HasPrefix(addr, muxScheme)
+}
+
+func newMuxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	// broken carriers are reported by the tunnel itself
+	config.LogOutput = io.Discard
+	return config
+}
+
+// muxDialer opens streams over carriers to mux:// targets, one carrier per
+// target address.
+type muxDialer struct {
+	c        *client
+	mu       sync.Mutex
+	sessions map[string]*yamux.Session
+	// carriers being dialed, which those needing one at the same time wait for
+	dialing map[string]*muxDial
+	// last time dialing the carrier failed, per target address
+	failed map[string]time.Time
+}
+
+// muxDial is a carrier being dialed.
+type muxDial struct {
+	done    chan struct{}
+	session *yamux.Session
+	err     error
+}
+
+func newMuxDialer(c *client) *muxDialer {
+	return &muxDialer{
+		c:        c,
+		sessions: make(map[string]*yamux.Session),
+		dialing:  make(map[string]*muxDial),
+		failed:   make(map[string]time.Time),
+	}
+}
+
+// session returns the carrier to addr, dialing it if there is none or the
+// previous one broke. Only one carrier to an address is dialed at a time,
+// without holding up those to other addresses.
+func (d *muxDialer) session(addr string) (*yamux.Session, error) {
+	d.mu.Lock()
+	if s, ok := d.sessions[addr]; ok && !s.IsClosed() {
+		d.mu.Unlock()
+		return s, nil
+	}
+	if call, ok := d.dialing[addr]; ok {
+		d.mu.Unlock()
+		<-call.done
+		return call.session, call.err
+	}
+	call := &muxDial{done: make(chan struct{})}
+	d.dialing[addr] = call
+	wait := muxRedialDelay - time.Since(d.failed[addr])
+	d.mu.Unlock()
+
+	call.session, call.err = d.dial(addr, wait)
+
+	d.mu.Lock()
+	delete(d.dialing, addr)
+	if call.err != nil {
+		d.failed[addr] = time.Now()
+	} else {
+		d.sessions[addr] = call.session
+	}
+	d.mu.Unlock()
+	close(call.done)
+	return call.session, call.err
+}
+
+// dial establishes a carrier to addr after waiting for wait.
+func (d *muxDialer) dial(addr string, wait time.Duration) (*yamux.Session, error) {
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-d.c.done:
+			timer.Stop()
+			return nil, errors.New("shutting down")
+		}
+	}
+
+	conn, err := d.c.dialer.Dial("tcp", addr)
+	if err == nil {
+		conn, err = d.c.wrapDialed(conn, addr)
+	}
+	if err == nil && d.c.peerKeyOut != nil {
+		var peer net.Conn
+		if peer, err = peerDial(conn, d.c.peerConfig(d.c.peerKeyOut)); err != nil {
+			conn.Close()
+		}
+		conn = peer
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, err := yamux.Client(conn, newMuxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.c.log.Infof("multiplexing connections to %s over %s", addr, conn.LocalAddr())
+	go func() {
+		<-s.CloseChan()
+		select {
+		case <-d.c.done:
+		default:
+			d.c.log.Warnf("carrier connection to %s closed, dialing again for the next connection", addr)
+		}
+	}()
+	return s, nil
+}
+
+// Dial opens a new stream to a mux:// target.
+func (d *muxDialer) Dial(target string) (net.Conn, error) {
+	addr := strings.TrimPrefix(target, muxScheme)
+	s, err := d.session(addr)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := s.Open()
+	if err != nil && s.IsClosed() {
+		// the carrier broke since it has been handed out, try a fresh one
+		if s, err = d.session(addr); err != nil {
+			return nil, err
+		}
+		stream, err = s.Open()
+	}
+	return stream, err
+}
+
+// closeAll closes every carrier, along with the streams over them.
+func (d *muxDialer) closeAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for addr, s := range d.sessions {
+		s.Close()
+		delete(d.sessions, addr)
+	}
+}
+
+// muxListener accepts the streams of the carriers connecting to listener.
+type muxListener struct {
+	listener net.Listener
+	log      logrus.FieldLogger
+	// how carriers authenticate, nil when they needn't
+	peer     *peerConfig
+	accepted chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	sessions map[*yamux.Session]struct{}
+	err      error
+}
+
+func newMuxListener(listener net.Listener, log logrus.FieldLogger, peer *peerConfig) *muxListener {
+	l := &muxListener{
+		listener: listener,
+		log:      log,
+		peer:     peer,
+		accepted: make(chan net.Conn),
+		done:     make(chan struct{}),
+		sessions: make(map[*yamux.Session]struct{}),
+	}
+	go l.acceptCarriers()
+	return l
+}
+
+func (l *muxListener) acceptCarriers() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.err = err
+			l.Close()
+			return
+		}
+		if l.peer != nil {
+			// authenticating takes a round trip, which mustn't hold up other carriers
+			go l.authenticateCarrier(conn)
+			continue
+		}
+		l.startCarrier(conn)
+	}
+}
+
+func (l *muxListener) authenticateCarrier(conn net.Conn) {
+	peer, err := peerAccept(conn, l.peer)
+	if err != nil {
+		l.log.Warnf("carrier from %s failed to authenticate: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	l.startCarrier(peer)
+}
+
+func (l *muxListener) startCarrier(conn net.Conn) {
+	s, err := yamux.Server(conn, newMuxConfig())
+	if err != nil {
+		l.log.Warnf("could not set up carrier from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	l.mu.Lock()
+	select {
+	case <-l.done:
+		// closed while the carrier authenticated
+		l.mu.Unlock()
+		s.Close()
+		return
+	default:
+	}
+	l.sessions[s] = struct{}{}
+	l.mu.Unlock()
+	l.log.Infof("carrier connection from %s", conn.RemoteAddr())
+	go l.acceptStreams(s)
+}
+
+func (l *muxListener) acceptStreams(s *yamux.Session) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.sessions, s)
+		l.mu.Unlock()
+		s.Close()
+	}()
+	for {
+		stream, err := s.Accept()
+		if err != nil {
+			l.log.Debugf("carrier connection from %s closed: %s", s.RemoteAddr(), err)
+			return
+		}
+		select {
+		case l.accepted <- stream:
+		case <-l.done:
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting carriers and closes the running ones.
+func (l *muxListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.listener.Close()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for s := range l.sessions {
+			s.Close()
+		}
+	})
+	return nil
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
@@ -0,0 +1,174 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// nameserver answers packed DNS queries.
+type nameserver interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// parseNameserver parses a -dns nameserver: <host>[:<port>] for plain DNS,
+// tls://<host>[:<port>] for DNS over TLS or an https:// URL for DNS over
+// HTTPS.
+func parseNameserver(server string) (nameserver, error) {
+	switch {
+	case strings.HasPrefix(server, "https://"):
+		u, err := url.Parse(server)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid DNS over HTTPS URL %q", server)
+		}
+		return &httpsNameserver{url: u.String(), client: &http.Client{Timeout: lookupTimeout}}, nil
+	case strings.HasPrefix(server, "tls://"):
+		address := withDefaultPort(strings.TrimPrefix(server, "tls://"), "853")
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS over TLS server %q", server)
+		}
+		return &tlsNameserver{address: address, config: &tls.Config{ServerName: host}}, nil
+	case strings.Contains(server, "://"):
+		return nil, fmt.Errorf("unsupported DNS server %q", server)
+	}
+	address := withDefaultPort(server, "53")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid DNS server %q", server)
+	}
+	return &plainNameserver{address: address}, nil
+}
+
+// withDefaultPort adds port to a host given without one.
+func withDefaultPort(address, port string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), port)
+}
+
+// plainNameserver speaks DNS over UDP, retrying over TCP when the response
+// is truncated.
+type plainNameserver struct {
+	address string
+}
+
+func (n *plainNameserver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", n.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 65535)
+	size, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	// the TC bit of the header
+	if size > 2 && response[2]&0x02 == 0 {
+		return response[:size], nil
+	}
+
+	tcpConn, err := d.DialContext(ctx, "tcp", n.address)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+	return exchangeFramed(ctx, tcpConn, query)
+}
+
+// tlsNameserver speaks DNS over TLS (RFC 7858).
+type tlsNameserver struct {
+	address string
+	config  *tls.Config
+}
+
+func (n *tlsNameserver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	d := tls.Dialer{Config: n.config}
+	conn, err := d.DialContext(ctx, "tcp", n.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeFramed(ctx, conn, query)
+}
+
+// exchangeFramed sends query on a stream connection and reads the response,
+// both framed with their length.
+func exchangeFramed(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// httpsNameserver speaks DNS over HTTPS (RFC 8484).
+type httpsNameserver struct {
+	url    string
+	client *http.Client
+}
+
+func (n *httpsNameserver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS server answered %s", resp.Status)
+	}
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 65536))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) == 0 {
+		return nil, errors.New("empty DNS over HTTPS response")
+	}
+	return response, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+import (
+	"golang.org/x/net/proxy"
+	"golang.org/x/sys/unix"
+)
+
+// netnsPath maps a bare namespace name (as created by "ip netns add") to its
+// path, while leaving paths untouched.
+func netnsPath(netns string) string {
+	if strings.ContainsRune(netns, os.PathSeparator) {
+		return netns
+	}
+	return filepath.Join("/var/run/netns", netns)
+}
+
+// inNetns runs fn on a locked OS thread switched into the given network
+// namespace. Sockets created by fn stay in that namespace afterwards.
+// An empty netns runs fn in the current namespace.
+func inNetns(netns string, fn func() error) error {
+	if netns == "" {
+		return fn()
+	}
+
+	target, err := os.Open(netnsPath(netns))
+	if err != nil {
+		return fmt.Errorf("could not open network namespace: %w", err)
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+
+	origin, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("could not open current network namespace: %w", err)
+	}
+	defer origin.Close()
+
+	if err = unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("could not enter network namespace %s: %w", netns, err)
+	}
+
+	fnErr := fn()
+
+	// if we can't switch back, keep the thread locked so it dies with the goroutine
+	// instead of being reused by the scheduler in the wrong namespace.
+	if err = unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+		log.Errorf("could not restore network namespace: %s", err)
+		return fnErr
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+// netnsFallbackDelay is the fallback delay of dials within netns. Only the
+// goroutine that entered the namespace runs on its thread, while racing IPv4
+// against IPv6 dials from goroutines of their own, which would create their
+// sockets in the namespace of the process. Within a namespace, the addresses
+// are dialed one after another on the calling goroutine instead.
+func netnsFallbackDelay(netns string, delay time.Duration) time.Duration {
+	if netns != "" {
+		return -1
+	}
+	return delay
+}
+
+// netnsDialer performs every dial from within a network namespace. Only the
+// calling goroutine is in it, so the dialer has to dial the addresses of a
+// name one after another there (see netnsFallbackDelay) rather than race
+// them on other goroutines. Note that name resolution may still be carried
+// out by other threads, in the namespace of the process.
+type netnsDialer struct {
+	netns  string
+	dialer proxy.Dialer
+}
+
+func (d *netnsDialer) Dial(network, addr string) (conn net.Conn, err error) {
+	err = inNetns(d.netns, func() error {
+		conn, err = d.dialer.Dial(network, addr)
+		return err
+	})
+	return conn, err
+}
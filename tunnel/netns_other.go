@@ -0,0 +1,47 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+import "golang.org/x/net/proxy"
+
+var errNetnsUnsupported = errors.New("network namespaces are only supported on Linux")
+
+func inNetns(netns string, fn func() error) error {
+	if netns == "" {
+		return fn()
+	}
+	return errNetnsUnsupported
+}
+
+func netnsFallbackDelay(netns string, delay time.Duration) time.Duration {
+	return delay
+}
+
+type netnsDialer struct {
+	netns  string
+	dialer proxy.Dialer
+}
+
+func (d *netnsDialer) Dial(network, addr string) (net.Conn, error) {
+	return nil, errNetnsUnsupported
+}
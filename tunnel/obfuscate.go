@@ -0,0 +1,84 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// Obfuscation: the data of a sealed frame is preceded by its length and
+// padded to one of a few sizes, so frame lengths don't give the traffic
+// away. Frames without data are sent at random intervals in between and
+// dropped by the peer.
+
+// sizes padded frames come in, the largest of them maxPeerFrame
+var peerFrameSizes = []int{512, 2048, 8192, maxPeerFrame}
+
+// mean time between dummy frames on the side that didn't ask for obfuscating
+const defaultPeerChaff = time.Second
+
+// padFrame prefixes data with its length and pads it to the next frame size.
+func padFrame(data []byte) []byte {
+	size := peerFrameSizes[len(peerFrameSizes)-1]
+	for _, s := range peerFrameSizes {
+		if len(data)+2 <= s {
+			size = s
+			break
+		}
+	}
+	frame := make([]byte, size)
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+	return frame
+}
+
+// unpadFrame returns the data of a padded frame.
+func unpadFrame(frame []byte) ([]byte, error) {
+	if len(frame) < 2 {
+		return nil, errors.New("peer frame too short")
+	}
+	n := int(binary.BigEndian.Uint16(frame))
+	if n > len(frame)-2 {
+		return nil, errors.New("peer frame has a bad length")
+	}
+	return frame[2 : 2+n], nil
+}
+
+// obfuscate pads the frames of p from now on and sends a dummy frame every
+// chaff on average, until p is closed.
+func (p *sealedConn) obfuscate(chaff time.Duration) {
+	p.padded = true
+	go func() {
+		for {
+			// anywhere between half and one and a half times chaff
+			timer := time.NewTimer(chaff/2 + time.Duration(rand.Int63n(int64(chaff))))
+			select {
+			case <-p.closed:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			p.wmu.Lock()
+			err := p.writeFrame(peerFrameData, nil)
+			p.wmu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
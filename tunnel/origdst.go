@@ -0,0 +1,60 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"net"
+	"strconv"
+)
+
+// routeOriginalDst sets the session target to the destination accepted had
+// before iptables redirected it to the listener. The connection is closed
+// when that can't be told, or when it was made to the listener itself,
+// which would tunnel it to itself over and over.
+func (c *client) routeOriginalDst(accepted net.Conn, s *Session) bool {
+	dst, err := originalDst(accepted)
+	if err != nil {
+		c.log.Warnf("could not get original destination of %s: %s", accepted.RemoteAddr(), err)
+		accepted.Close()
+		return false
+	}
+	if c.listenPorts[dst.Port] && isLocalIP(dst.IP) {
+		c.log.Warnf("connection from %s has been made to the listener itself instead of being redirected to it", accepted.RemoteAddr())
+		closeConn(accepted, c.closing.deny == CloseRST)
+		return false
+	}
+
+	c.log.Debugf("routing %s to original destination %s", accepted.RemoteAddr(), dst)
+	s.target = net.JoinHostPort(dst.IP.String(), strconv.Itoa(dst.Port))
+	s.routed = true
+	return true
+}
+
+// isLocalIP reports whether ip is an address of this host.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
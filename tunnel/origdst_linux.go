@@ -0,0 +1,101 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+import (
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+func checkTransparentListen() error {
+	return nil
+}
+
+// originalDst returns the destination conn had before being redirected:
+// the one iptables REDIRECT rewrote, as told by SO_ORIGINAL_DST, or else
+// its local address, which TPROXY leaves untouched.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := underlyingConn(conn).(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	local := tcpConn.LocalAddr().(*net.TCPAddr)
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// the sockaddr_in is returned in the space of an ipv6_mreq
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if err == nil {
+				m := mreq.Multiaddr
+				dst = &net.TCPAddr{IP: net.IPv4(m[4], m[5], m[6], m[7]), Port: int(m[2])<<8 | int(m[3])}
+			}
+			return
+		}
+		// IP6T_SO_ORIGINAL_DST has the same value, the sockaddr_in6 is
+		// returned in the space of an ip6_mtuinfo
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+		if err == nil {
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			dst = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(port[0])<<8 | int(port[1])}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dst == nil {
+		return local, nil
+	}
+	return dst, nil
+}
+
+// transparentListenControl returns a Control function for net.ListenConfig
+// setting IP_TRANSPARENT, which accepting connections redirected by TPROXY
+// needs, also clamping the MSS if asked to. Without CAP_NET_ADMIN a warning
+// is logged, connections redirected by REDIRECT are accepted still.
+func transparentListenControl(mss int, log logrus.FieldLogger) func(network, address string, raw syscall.RawConn) error {
+	clampMSS := mssControl(mss)
+	return func(network, address string, raw syscall.RawConn) error {
+		level, opt := unix.SOL_IP, unix.IP_TRANSPARENT
+		if network == "tcp6" {
+			level, opt = unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+		}
+		var sockErr error
+		err := raw.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), level, opt, 1)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			log.Warnf("could not set IP_TRANSPARENT, connections redirected by TPROXY won't be accepted (CAP_NET_ADMIN is required): %s", sockErr)
+		}
+		if clampMSS != nil {
+			return clampMSS(network, address, raw)
+		}
+		return nil
+	}
+}
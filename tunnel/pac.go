@@ -0,0 +1,414 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/robertkrimen/otto"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// how long FindProxyForURL may run before it is interrupted
+	pacTimeout = time.Second
+	// PAC scripts larger than this are refused
+	maxPACSize = 1 << 20
+)
+
+var errPACTimeout = errors.New("FindProxyForURL did not return in time")
+
+// pacFunctions are the helper functions of the PAC format that need no
+// access to the network.
+const pacFunctions = `
+function isPlainHostName(host) {
+	return host.indexOf(".") < 0;
+}
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length &&
+		host.substring(host.length - domain.length) === domain;
+}
+function localHostOrDomainIs(host, hostdom) {
+	return host === hostdom || hostdom.lastIndexOf(host + ".", 0) === 0;
+}
+function dnsDomainLevels(host) {
+	return host.split(".").length - 1;
+}
+function pacArgs(args) {
+	args = Array.prototype.slice.call(args);
+	var gmt = args[args.length - 1] === "GMT";
+	if (gmt) {
+		args.pop();
+	}
+	return {args: args, gmt: gmt, now: new Date()};
+}
+function pacInRange(value, from, to) {
+	return from <= to ? from <= value && value <= to : value >= from || value <= to;
+}
+function weekdayRange() {
+	var a = pacArgs(arguments), days = ["SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"];
+	var from = days.indexOf(a.args[0]), to = a.args.length > 1 ? days.indexOf(a.args[1]) : from;
+	if (from < 0 || to < 0) {
+		return false;
+	}
+	return pacInRange(a.gmt ? a.now.getUTCDay() : a.now.getDay(), from, to);
+}
+function dateRange() {
+	var a = pacArgs(arguments), months = ["JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"];
+	var now = {
+		day: a.gmt ? a.now.getUTCDate() : a.now.getDate(),
+		month: a.gmt ? a.now.getUTCMonth() : a.now.getMonth(),
+		year: a.gmt ? a.now.getUTCFullYear() : a.now.getFullYear()
+	};
+	// each bound is a day (1-31), a month name or a year, given in that order
+	function bound(values) {
+		var b = {};
+		for (var i = 0; i < values.length; i++) {
+			var month = months.indexOf(values[i]);
+			if (month >= 0) {
+				b.month = month;
+			} else if (values[i] > 31) {
+				b.year = values[i];
+			} else {
+				b.day = values[i];
+			}
+		}
+		return b;
+	}
+	// only the parts given in the bound are compared
+	function key(b, parts) {
+		return (parts.year === undefined ? 0 : b.year * 10000) +
+			(parts.month === undefined ? 0 : b.month * 100) +
+			(parts.day === undefined ? 0 : b.day);
+	}
+	var half = a.args.length === 1 ? 1 : a.args.length / 2;
+	var from = bound(a.args.slice(0, half)), to = a.args.length === 1 ? from : bound(a.args.slice(half));
+	return pacInRange(key(now, from), key(from, from), key(to, from));
+}
+function timeRange() {
+	var a = pacArgs(arguments), v = a.args;
+	var now = a.gmt ?
+		[a.now.getUTCHours(), a.now.getUTCMinutes(), a.now.getUTCSeconds()] :
+		[a.now.getHours(), a.now.getMinutes(), a.now.getSeconds()];
+	var seconds = function(h, m, s) { return h * 3600 + m * 60 + s; };
+	var t = seconds(now[0], now[1], now[2]);
+	switch (v.length) {
+	case 1:
+		return now[0] === v[0];
+	case 2:
+		return pacInRange(t, seconds(v[0], 0, 0), seconds(v[1], 0, 0) - 1);
+	case 4:
+		return pacInRange(t, seconds(v[0], v[1], 0), seconds(v[2], v[3], 0) - 1);
+	case 6:
+		return pacInRange(t, seconds(v[0], v[1], v[2]), seconds(v[3], v[4], v[5]));
+	}
+	return false;
+}
+`
+
+// loadPAC reads a PAC script from an http(s):// URL or a file.
+func loadPAC(source string, timeout time.Duration) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(strings.TrimPrefix(source, "file://"))
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", source, resp.Status)
+	}
+	script, err := io.ReadAll(io.LimitReader(resp.Body, maxPACSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(script) > maxPACSize {
+		return nil, fmt.Errorf("PAC script at %s is larger than %d bytes", source, maxPACSize)
+	}
+	return script, nil
+}
+
+// pacScript evaluates FindProxyForURL of a PAC script. The interpreter can
+// only run one call at a time.
+type pacScript struct {
+	mu sync.Mutex
+	vm *otto.Otto
+	// the interpreter right after loading the script, to start over from
+	// when a call had to be interrupted
+	pristine *otto.Otto
+}
+
+func newPACScript(script []byte, resolveTimeout time.Duration) (*pacScript, error) {
+	vm := otto.New()
+	resolve := func(host string) net.IP {
+		if ip := net.ParseIP(host); ip != nil {
+			return ip
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil || len(ips) == 0 {
+			return nil
+		}
+		return ips[0]
+	}
+	value := func(v interface{}) otto.Value {
+		converted, _ := vm.ToValue(v)
+		return converted
+	}
+	functions := map[string]func(otto.FunctionCall) otto.Value{
+		"dnsResolve": func(call otto.FunctionCall) otto.Value {
+			if ip := resolve(call.Argument(0).String()); ip != nil {
+				return value(ip.String())
+			}
+			return otto.NullValue()
+		},
+		"isResolvable": func(call otto.FunctionCall) otto.Value {
+			return value(resolve(call.Argument(0).String()) != nil)
+		},
+		"isInNet": func(call otto.FunctionCall) otto.Value {
+			ip := resolve(call.Argument(0).String())
+			pattern := net.ParseIP(call.Argument(1).String())
+			mask := net.ParseIP(call.Argument(2).String())
+			if ip == nil || pattern == nil || mask == nil || ip.To4() == nil || mask.To4() == nil {
+				return value(false)
+			}
+			ipMask := net.IPMask(mask.To4())
+			return value(ip.Mask(ipMask).Equal(pattern.Mask(ipMask)))
+		},
+		"myIpAddress": func(call otto.FunctionCall) otto.Value {
+			return value(localAddress())
+		},
+		"shExpMatch": func(call otto.FunctionCall) otto.Value {
+			return value(shExpMatch(call.Argument(0).String(), call.Argument(1).String()))
+		},
+	}
+	for name, fn := range functions {
+		if err := vm.Set(name, fn); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := vm.Run(pacFunctions); err != nil {
+		return nil, err
+	}
+	if _, err := vm.Run(string(script)); err != nil {
+		return nil, fmt.Errorf("invalid PAC script: %w", err)
+	}
+	if fn, err := vm.Get("FindProxyForURL"); err != nil || !fn.IsFunction() {
+		return nil, errors.New("invalid PAC script: FindProxyForURL is not defined")
+	}
+	return &pacScript{vm: vm, pristine: vm.Copy()}, nil
+}
+
+// findProxy calls FindProxyForURL(rawURL, host).
+func (s *pacScript) findProxy(rawURL, host string) (result string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	interrupt := make(chan func(), 1)
+	s.vm.Interrupt = interrupt
+	timer := time.AfterFunc(pacTimeout, func() {
+		interrupt <- func() { panic(errPACTimeout) }
+	})
+	defer timer.Stop()
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errPACTimeout {
+				panic(r)
+			}
+			// the interrupted call may have left anything behind
+			s.vm = s.pristine.Copy()
+			err = errPACTimeout
+		}
+	}()
+
+	v, err := s.vm.Call("FindProxyForURL", nil, rawURL, host)
+	if err != nil {
+		return "", err
+	}
+	if v.IsNull() || v.IsUndefined() {
+		return "", nil
+	}
+	return v.String(), nil
+}
+
+// localAddress returns the address this host reaches other networks from,
+// without sending anything.
+func localAddress() string {
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// shExpMatch matches str against a shell expression, where * matches any
+// string (slashes included) and ? any single character.
+func shExpMatch(str, shexp string) bool {
+	pattern := regexp.QuoteMeta(shexp)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	re, err := regexp.Compile("^" + pattern + "$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString(str)
+}
+
+// pacURL is the URL a PAC script is asked about for a connection to
+// host:port. Targets on the standard HTTP(S) ports look like web requests,
+// which is what most scripts expect.
+func pacURL(host, port string) string {
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: "/"}
+	switch port {
+	case "80":
+		u.Host = strings.TrimSuffix(u.Host, ":80")
+	case "443":
+		u.Scheme = "https"
+		u.Host = strings.TrimSuffix(u.Host, ":443")
+	}
+	return u.String()
+}
+
+// parsePACResult turns the result of FindProxyForURL, such as
+// "PROXY proxy:3128; SOCKS socks:1080; DIRECT", into proxy URLs in order of
+// preference. A nil URL stands for DIRECT, entries of an unsupported type
+// are left out.
+func parsePACResult(result string) ([]*url.URL, error) {
+	if strings.TrimSpace(result) == "" {
+		return []*url.URL{nil}, nil
+	}
+	schemes := map[string]string{
+		"PROXY":  "http",
+		"HTTP":   "http",
+		"HTTPS":  "https",
+		"SOCKS":  "socks5",
+		"SOCKS5": "socks5",
+	}
+	var urls []*url.URL
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" {
+			urls = append(urls, nil)
+			continue
+		}
+		scheme, ok := schemes[kind]
+		if !ok || len(fields) != 2 {
+			continue
+		}
+		urls = append(urls, &url.URL{Scheme: scheme, Host: fields[1]})
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no supported proxy in %q", result)
+	}
+	return urls, nil
+}
+
+// pacDialer dials through the proxies a PAC script picks for the target,
+// failing over in the order given like a failoverDialer does.
+type pacDialer struct {
+	script *pacScript
+	direct proxy.Dialer
+	// builds the dialer of a proxy named by the script
+	newProxy func(*url.URL, proxy.Dialer) (proxy.Dialer, error)
+	cooldown time.Duration
+	log      logrus.FieldLogger
+
+	mu sync.Mutex
+	// proxies are kept across dials so their health is remembered
+	proxies map[string]*failoverProxy
+}
+
+func (d *pacDialer) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	result, err := d.script.findProxy(pacURL(host, port), host)
+	if err != nil {
+		return nil, fmt.Errorf("could not evaluate PAC script: %w", err)
+	}
+	urls, err := parsePACResult(result)
+	if err != nil {
+		return nil, fmt.Errorf("PAC script returned %w", err)
+	}
+	d.log.Debugf("PAC script returned %q for %s", result, addr)
+
+	failover := &failoverDialer{cooldown: d.cooldown, log: d.log}
+	for _, u := range urls {
+		p, err := d.proxy(u)
+		if err != nil {
+			return nil, err
+		}
+		failover.proxies = append(failover.proxies, p)
+	}
+	if len(failover.proxies) == 1 {
+		p := failover.proxies[0]
+		conn, err := p.dialer.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return p.dialed(conn), nil
+	}
+	return failover.Dial(network, addr)
+}
+
+// proxy returns the proxy for u, DIRECT when u is nil.
+func (d *pacDialer) proxy(u *url.URL) (*failoverProxy, error) {
+	name := "DIRECT"
+	if u != nil {
+		name = u.String()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p, ok := d.proxies[name]; ok {
+		return p, nil
+	}
+	p := &failoverProxy{name: name, dialer: d.direct}
+	if u != nil {
+		dialer, err := d.newProxy(u, d.direct)
+		if err != nil {
+			return nil, fmt.Errorf("could not construct proxy %s: %w", name, err)
+		}
+		p.dialer = dialer
+	}
+	if d.proxies == nil {
+		d.proxies = make(map[string]*failoverProxy)
+	}
+	d.proxies[name] = p
+	return p, nil
+}
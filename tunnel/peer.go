@@ -0,0 +1,477 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+import (
+	"golang.org/x/crypto/hkdf"
+)
+
+// Peer handshake: the instance dialing a peer sends "TTPEER", a version
+// byte, the features it asks for and a random nonce. The listening peer
+// answers with a nonce of its own, the features both are going to use (those
+// asked for and those it insists on, but the compression asked for over its
+// own) and an HMAC-SHA256 over the features and both nonces, keyed with the
+// shared secret; the dialing side checks it and answers with its own HMAC
+// over them. Nothing is relayed before both have been verified, so whoever
+// doesn't know the secret can't reach the target.
+const (
+	peerMagic   = "TTPEER"
+	peerVersion = 3
+
+	peerNonceLen         = 32
+	peerHandshakeTimeout = 10 * time.Second
+)
+
+// what each side authenticates, so one's HMAC can't be replayed as the other's
+const (
+	peerRoleListen = "listen"
+	peerRoleDial   = "dial"
+)
+
+// peerFeatures are what paired instances agree on in the handshake.
+type peerFeatures byte
+
+const (
+	// the stream is sealed with AES-GCM under keys derived from the secret
+	peerEncrypt peerFeatures = 1 << iota
+	// the stream is compressed with one of these, then sealed
+	peerCompressZstd
+	peerCompressSnappy
+	// sealed frames are padded to fixed sizes and dummy ones sent in between
+	peerObfuscate
+
+	peerCompression = peerCompressZstd | peerCompressSnappy
+)
+
+// peerConfig is how the instance pairs with a peer.
+type peerConfig struct {
+	key []byte
+	// asked for when dialing, insisted on when listening
+	features peerFeatures
+	// mean time between dummy frames when obfuscating
+	chaff time.Duration
+}
+
+// peerConfig pairs with a peer knowing key as configured, nil when key is.
+func (c *client) peerConfig(key []byte) *peerConfig {
+	if key == nil {
+		return nil
+	}
+	p := &peerConfig{key: key, features: compressFeature(c.peerCompress), chaff: c.peerObfuscate}
+	if c.peerEncrypt {
+		p.features |= peerEncrypt
+	}
+	if c.peerObfuscate > 0 {
+		p.features |= peerObfuscate | peerEncrypt
+	} else {
+		// when the peer asks for it
+		p.chaff = defaultPeerChaff
+	}
+	return p
+}
+
+// readPeerKey reads the shared secret of paired instances from path.
+func readPeerKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s holds no secret", path)
+	}
+	return key, nil
+}
+
+func peerMAC(key []byte, role string, features peerFeatures, dialNonce, listenNonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(role))
+	mac.Write([]byte{byte(features)})
+	mac.Write(dialNonce)
+	mac.Write(listenNonce)
+	return mac.Sum(nil)
+}
+
+// peerDial authenticates conn, dialed to a peer, with the key of p, checks
+// that the peer knows it too and returns conn set up with the features
+// agreed on, those asked for among them.
+func peerDial(conn net.Conn, p *peerConfig) (net.Conn, error) {
+	key, want := p.key, p.features
+	_ = conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, 0, len(peerMagic)+2+peerNonceLen)
+	hello = append(append(hello, peerMagic...), peerVersion, byte(want))
+	dialNonce := make([]byte, peerNonceLen)
+	if _, err := rand.Read(dialNonce); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(hello, dialNonce...)); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, peerNonceLen+1+sha256.Size)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, fmt.Errorf("peer handshake: %w", err)
+	}
+	listenNonce := reply[:peerNonceLen]
+	features := peerFeatures(reply[peerNonceLen])
+	listenMAC := reply[peerNonceLen+1:]
+	if !hmac.Equal(listenMAC, peerMAC(key, peerRoleListen, features, dialNonce, listenNonce)) {
+		return nil, errors.New("peer handshake: the peer doesn't know the secret")
+	}
+	if features&want != want {
+		return nil, errors.New("peer handshake: the peer left out features asked for")
+	}
+	if _, err := conn.Write(peerMAC(key, peerRoleDial, features, dialNonce, listenNonce)); err != nil {
+		return nil, err
+	}
+	return newPeerConn(conn, p, features, dialNonce, listenNonce, true)
+}
+
+// peerAccept has the peer that dialed conn authenticate with the key of p
+// and returns conn set up with the features agreed on, those insisted on
+// among them.
+func peerAccept(conn net.Conn, p *peerConfig) (net.Conn, error) {
+	key, require := p.key, p.features
+	_ = conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, len(peerMagic)+2+peerNonceLen)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return nil, fmt.Errorf("peer handshake: %w", err)
+	}
+	if string(hello[:len(peerMagic)]) != peerMagic {
+		return nil, errors.New("peer handshake: not a tcptunnel peer")
+	}
+	if v := hello[len(peerMagic)]; v != peerVersion {
+		return nil, fmt.Errorf("peer handshake: unsupported version %d", v)
+	}
+	features := peerFeatures(hello[len(peerMagic)+1])
+	if features&peerCompression != 0 {
+		// the dialing side picks the compression when it asks for one
+		require &^= peerCompression
+	}
+	features |= require
+	if features&peerObfuscate != 0 {
+		// padding is only hidden in sealed frames
+		features |= peerEncrypt
+	}
+	dialNonce := hello[len(peerMagic)+2:]
+
+	listenNonce := make([]byte, peerNonceLen)
+	if _, err := rand.Read(listenNonce); err != nil {
+		return nil, err
+	}
+	reply := append(append(listenNonce, byte(features)), peerMAC(key, peerRoleListen, features, dialNonce, listenNonce)...)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+	dialMAC := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, dialMAC); err != nil {
+		return nil, fmt.Errorf("peer handshake: %w", err)
+	}
+	if !hmac.Equal(dialMAC, peerMAC(key, peerRoleDial, features, dialNonce, listenNonce)) {
+		return nil, errors.New("peer handshake: wrong secret")
+	}
+	return newPeerConn(conn, p, features, dialNonce, listenNonce, false)
+}
+
+// most bytes sealed in one frame
+const maxPeerFrame = 16 * 1024
+
+// Sealed frames start with their type. A rekey frame is the last one sealed
+// with the current key, the frames after it use the key derived from it; a
+// close frame tells the stream ended on purpose, so a connection cut short
+// reads as io.ErrUnexpectedEOF rather than a clean end.
+const (
+	peerFrameData byte = iota
+	peerFrameRekey
+	peerFrameClose
+)
+
+// how much is sealed with one key and for how long before a new one is derived
+const (
+	peerRekeyBytes    = 1 << 30
+	peerRekeyInterval = time.Hour
+)
+
+// sealedConn seals what is written to it and opens what is read, in frames of
+// a two byte length followed by the AES-GCM sealed data. Every session and
+// direction has its own key, so a counter makes a unique nonce; frames
+// replayed, dropped or reordered fail to authenticate.
+type sealedConn struct {
+	net.Conn
+	wmu  sync.Mutex
+	seal peerCipher
+	open peerCipher
+	// the length and as much of the frame being read as has arrived, kept
+	// across reads so one timing out midway can be retried
+	frame []byte
+	// opened, not yet read
+	pending []byte
+	// the peer sent a close frame
+	eof bool
+	// frames are padded and carry the length of their data first
+	padded bool
+	// closed along with the connection, stopping the dummy frames
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// peerCipher is one direction of a sealed stream.
+type peerCipher struct {
+	cipher.AEAD
+	key []byte
+	seq uint64
+	// sealed with key so far and since when, on the sealing side
+	sealed  int64
+	keyedAt time.Time
+}
+
+func newPeerCipher(key []byte) (peerCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return peerCipher{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return peerCipher{}, err
+	}
+	return peerCipher{AEAD: aead, key: key, keyedAt: time.Now()}, nil
+}
+
+// rekey switches to the key derived from the current one.
+func (pc *peerCipher) rekey() error {
+	key, err := peerKey(pc.key, nil, "tcptunnel peer rekey")
+	if err != nil {
+		return err
+	}
+	next, err := newPeerCipher(key)
+	if err != nil {
+		return err
+	}
+	*pc = next
+	return nil
+}
+
+func (pc *peerCipher) nonce() []byte {
+	nonce := make([]byte, pc.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], pc.seq)
+	return nonce
+}
+
+// newPeerConn returns conn as the features agreed on in the handshake have
+// it, conn itself when there is nothing to do.
+func newPeerConn(conn net.Conn, p *peerConfig, features peerFeatures, dialNonce, listenNonce []byte, dialing bool) (net.Conn, error) {
+	if features&peerObfuscate != 0 && features&peerEncrypt == 0 {
+		return nil, errors.New("peer handshake: obfuscating needs encryption")
+	}
+	if features&peerEncrypt != 0 {
+		sealed, err := newSealedConn(conn, p.key, dialNonce, listenNonce, dialing)
+		if err != nil {
+			return nil, err
+		}
+		if features&peerObfuscate != 0 {
+			sealed.obfuscate(p.chaff)
+		}
+		conn = sealed
+	}
+	return newCompressedConn(conn, features)
+}
+
+func newSealedConn(conn net.Conn, secret, dialNonce, listenNonce []byte, dialing bool) (*sealedConn, error) {
+	salt := append(append([]byte{}, dialNonce...), listenNonce...)
+	var ciphers [2]peerCipher
+	for i, info := range []string{"tcptunnel peer dial to listen", "tcptunnel peer listen to dial"} {
+		key, err := peerKey(secret, salt, info)
+		if err != nil {
+			return nil, err
+		}
+		if ciphers[i], err = newPeerCipher(key); err != nil {
+			return nil, err
+		}
+	}
+	p := &sealedConn{Conn: conn, seal: ciphers[0], open: ciphers[1], closed: make(chan struct{})}
+	if !dialing {
+		p.seal, p.open = ciphers[1], ciphers[0]
+	}
+	p.frame = make([]byte, 0, 2+maxPeerFrame+p.open.Overhead())
+	return p, nil
+}
+
+// peerKey derives a 32 byte key from secret.
+func peerKey(secret, salt []byte, info string) ([]byte, error) {
+	k := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (p *sealedConn) Write(b []byte) (int, error) {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > p.maxData() {
+			chunk = chunk[:p.maxData()]
+		}
+		if err := p.writeFrame(peerFrameData, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeFrame seals a frame of type typ with data and sends it, first
+// switching to a new key when the current one is used up; p.wmu is held.
+func (p *sealedConn) writeFrame(typ byte, data []byte) error {
+	if typ != peerFrameClose && (p.seal.sealed >= peerRekeyBytes || time.Since(p.seal.keyedAt) >= peerRekeyInterval) {
+		if err := p.sendFrame(peerFrameRekey, nil); err != nil {
+			return err
+		}
+		if err := p.seal.rekey(); err != nil {
+			return err
+		}
+	}
+	return p.sendFrame(typ, data)
+}
+
+// sendFrame seals a frame of type typ with data and sends it; p.wmu is held.
+func (p *sealedConn) sendFrame(typ byte, data []byte) error {
+	plain := append([]byte{typ}, data...)
+	if p.padded {
+		plain = padFrame(plain)
+	}
+	frame := make([]byte, 2, 2+len(plain)+p.seal.Overhead())
+	frame = p.seal.Seal(frame, p.seal.nonce(), plain, nil)
+	p.seal.seq++
+	p.seal.sealed += int64(len(plain))
+	binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+	_, err := p.Conn.Write(frame)
+	return err
+}
+
+// maxData is the most data sent in one frame, after its type.
+func (p *sealedConn) maxData() int {
+	if p.padded {
+		return maxPeerFrame - 3
+	}
+	return maxPeerFrame - 1
+}
+
+func (p *sealedConn) Read(b []byte) (int, error) {
+	for len(p.pending) == 0 {
+		if p.eof {
+			return 0, io.EOF
+		}
+		size := 2
+		if len(p.frame) >= 2 {
+			size += int(binary.BigEndian.Uint16(p.frame))
+			if size > cap(p.frame) {
+				return 0, errors.New("peer frame too large")
+			}
+		}
+		if len(p.frame) < size {
+			n, err := p.Conn.Read(p.frame[len(p.frame):size])
+			p.frame = p.frame[:len(p.frame)+n]
+			if err != nil {
+				// only a close frame ends the stream
+				return 0, noEOF(err)
+			}
+			continue
+		}
+		frame := p.frame[2:size]
+		p.frame = p.frame[:0]
+		data, err := p.open.Open(frame[:0], p.open.nonce(), frame, nil)
+		if err != nil {
+			return 0, errors.New("peer frame failed to authenticate")
+		}
+		p.open.seq++
+		if p.padded {
+			if data, err = unpadFrame(data); err != nil {
+				return 0, err
+			}
+		}
+		if len(data) == 0 {
+			return 0, errors.New("peer frame has no type")
+		}
+		switch data[0] {
+		case peerFrameData:
+			p.pending = data[1:]
+		case peerFrameRekey:
+			if err = p.open.rekey(); err != nil {
+				return 0, err
+			}
+		case peerFrameClose:
+			p.eof = true
+		default:
+			return 0, fmt.Errorf("unknown peer frame type %d", data[0])
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// how long Close waits to send the close frame, writes in progress failing after it
+const peerCloseTimeout = time.Second
+
+// Close sends a close frame and closes the connection.
+func (p *sealedConn) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		_ = p.Conn.SetWriteDeadline(time.Now().Add(peerCloseTimeout))
+		p.wmu.Lock()
+		_ = p.writeFrame(peerFrameClose, nil)
+		p.wmu.Unlock()
+	})
+	return p.Conn.Close()
+}
+
+// NetConn is the connection the frames are sent over.
+func (p *sealedConn) NetConn() net.Conn {
+	return p.Conn
+}
+
+// noEOF turns an EOF that didn't come after a close frame into
+// io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
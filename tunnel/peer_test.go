@@ -0,0 +1,313 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// captureConn records what is written to it.
+type captureConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+// tcpPair returns both ends of a loopback TCP connection, which unlike
+// net.Pipe buffers what is written.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dialed.Close(); accepted.Close() })
+	return dialed, accepted
+}
+
+func TestPeerHandshake(t *testing.T) {
+	tests := []struct {
+		name      string
+		dialKey   string
+		listenKey string
+		ok        bool
+	}{
+		{"same key", "s3cret", "s3cret", true},
+		{"other key", "s3cret", "other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialed, accepted := tcpPair(t)
+			done := make(chan error, 1)
+			go func() {
+				conn, err := peerAccept(accepted, &peerConfig{key: []byte(tt.listenKey)})
+				if err == nil {
+					_, err = conn.Write([]byte("pong"))
+				}
+				done <- err
+				accepted.Close()
+			}()
+			conn, err := peerDial(dialed, &peerConfig{key: []byte(tt.dialKey)})
+			if err == nil {
+				buf := make([]byte, 4)
+				_, err = conn.Read(buf)
+			} else {
+				// the listener waits for the MAC that isn't going to come
+				dialed.Close()
+			}
+			acceptErr := <-done
+			if tt.ok && (err != nil || acceptErr != nil) {
+				t.Fatalf("handshake failed: dial %v, accept %v", err, acceptErr)
+			}
+			if !tt.ok && acceptErr == nil {
+				t.Fatal("handshake with the wrong key succeeded")
+			}
+		})
+	}
+}
+
+func newSealedPair(t *testing.T, padded bool) (writer *sealedConn, written *captureConn, reader *sealedConn, raw net.Conn) {
+	t.Helper()
+	key := []byte("s3cret")
+	dialNonce, listenNonce := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)
+	written = &captureConn{}
+	writer, err := newSealedConn(written, key, dialNonce, listenNonce, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, conn := net.Pipe()
+	t.Cleanup(func() { raw.Close(); conn.Close() })
+	if reader, err = newSealedConn(conn, key, dialNonce, listenNonce, false); err != nil {
+		t.Fatal(err)
+	}
+	writer.padded, reader.padded = padded, padded
+	return writer, written, reader, raw
+}
+
+// A read timing out in the middle of a frame, as stallCopy lets happen and
+// then carries on, must not lose the part of the frame read already.
+func TestSealedConnResumesAfterTimeout(t *testing.T) {
+	for _, padded := range []bool{false, true} {
+		writer, written, reader, raw := newSealedPair(t, padded)
+		if _, err := writer.Write([]byte("hello, peer")); err != nil {
+			t.Fatal(err)
+		}
+		frame := written.written.Bytes()
+
+		// the length, one byte of the frame, then the rest
+		for _, cut := range []int{1, 3} {
+			part := frame[:cut]
+			go raw.Write(part)
+			frame = frame[cut:]
+			_ = reader.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			buf := make([]byte, 64)
+			if _, err := reader.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("read of a partial frame returned %v, expected a timeout", err)
+			}
+		}
+		go raw.Write(frame)
+		_ = reader.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 64)
+		n, err := reader.Read(buf)
+		if err != nil || string(buf[:n]) != "hello, peer" {
+			t.Fatalf("read %q, %v after resuming, expected \"hello, peer\"", buf[:n], err)
+		}
+	}
+}
+
+func TestCompressedConnResumesAfterTimeout(t *testing.T) {
+	for _, features := range []peerFeatures{peerCompressZstd, peerCompressSnappy} {
+		a, b := net.Pipe()
+		writer, err := newCompressedConn(a, features)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := newCompressedConn(b, features)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = reader.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		buf := make([]byte, 64)
+		if _, err = reader.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("idle read returned %v, expected a timeout", err)
+		}
+		go writer.Write([]byte("hello, peer"))
+		_ = reader.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := reader.Read(buf)
+		if err != nil || string(buf[:n]) != "hello, peer" {
+			t.Fatalf("read %q, %v after a timeout, expected \"hello, peer\"", buf[:n], err)
+		}
+		writer.Close()
+		reader.Close()
+	}
+}
+
+func TestCompressedConnSendsIncompressibleRaw(t *testing.T) {
+	random := make([]byte, 8192)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 100)
+	tests := []struct {
+		data []byte
+		kind byte
+	}{
+		{random, compressFrameRaw},
+		{text, compressFrameCompressed},
+		{[]byte("ls -la\n"), compressFrameCompressed},
+	}
+	for _, features := range []peerFeatures{peerCompressZstd, peerCompressSnappy} {
+		for _, test := range tests {
+			a, _ := net.Pipe()
+			capture := &captureConn{Conn: a}
+			conn, err := newCompressedConn(capture, features)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = conn.Write(test.data); err != nil {
+				t.Fatal(err)
+			}
+			if kind := capture.written.Bytes()[0]; kind != test.kind {
+				t.Errorf("sent %d bytes in a frame of type %d, expected %d", len(test.data), kind, test.kind)
+			}
+			conn.Close()
+		}
+	}
+}
+
+func TestCompressedConnMixesFrames(t *testing.T) {
+	random := make([]byte, 100000)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	writes := [][]byte{
+		[]byte("hello, peer"),
+		random[:5000],
+		bytes.Repeat([]byte("compressible "), 10000),
+		random,
+		[]byte("bye"),
+	}
+	for _, features := range []peerFeatures{peerCompressZstd, peerCompressSnappy} {
+		a, b := tcpPair(t)
+		writer, err := newCompressedConn(a, features)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := newCompressedConn(b, features)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for _, data := range writes {
+				_, _ = writer.Write(data)
+			}
+			writer.Close()
+		}()
+		read, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := bytes.Join(writes, nil); !bytes.Equal(read, expected) {
+			t.Fatalf("read %d bytes, expected the %d written", len(read), len(expected))
+		}
+		reader.Close()
+	}
+}
+
+func TestSealedConnRekeys(t *testing.T) {
+	writer, written, reader, raw := newSealedPair(t, false)
+	key := writer.seal.key
+	// the key is used up, the next frame goes out under a new one
+	writer.seal.sealed = peerRekeyBytes
+	for _, msg := range []string{"before", "after"} {
+		if _, err := writer.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Equal(writer.seal.key, key) {
+		t.Fatal("writer kept the used up key")
+	}
+	go raw.Write(written.written.Bytes())
+	buf := make([]byte, 64)
+	for _, msg := range []string{"before", "after"} {
+		n, err := reader.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("read %q, %v, expected %q", buf[:n], err, msg)
+		}
+	}
+	if !bytes.Equal(reader.open.key, writer.seal.key) {
+		t.Fatal("reader didn't switch to the writer's new key")
+	}
+}
+
+func TestSealedConnEndOfStream(t *testing.T) {
+	tests := []struct {
+		name string
+		// ends the stream after "bye" has been written
+		end  func(writer *sealedConn, raw net.Conn)
+		want error
+	}{
+		{"closed", func(writer *sealedConn, raw net.Conn) { writer.Close() }, io.EOF},
+		{"cut short", func(writer *sealedConn, raw net.Conn) { raw.Close() }, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialed, accepted := tcpPair(t)
+			dialNonce, listenNonce := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)
+			writer, err := newSealedConn(dialed, []byte("s3cret"), dialNonce, listenNonce, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader, err := newSealedConn(accepted, []byte("s3cret"), dialNonce, listenNonce, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = writer.Write([]byte("bye")); err != nil {
+				t.Fatal(err)
+			}
+			tt.end(writer, dialed)
+
+			got, err := io.ReadAll(reader)
+			if string(got) != "bye" {
+				t.Fatalf("read %q, expected \"bye\"", got)
+			}
+			if tt.want == io.EOF && err != nil {
+				t.Fatalf("stream ended with %v, expected a clean end", err)
+			}
+			if tt.want != io.EOF && !errors.Is(err, tt.want) {
+				t.Fatalf("stream ended with %v, expected %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// reportPort prints and/or writes the port the listener is actually bound to.
+// This is mostly useful with ephemeral ports (e.g. "127.0.0.1:0").
+func (c *client) reportPort(addr net.Addr) error {
+	if !c.printPort && c.portFile == "" {
+		return nil
+	}
+	var port string
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		port = strconv.Itoa(addr.Port)
+	case *net.UDPAddr:
+		port = strconv.Itoa(addr.Port)
+	default:
+		return fmt.Errorf("unexpected listener address type %T", addr)
+	}
+
+	if c.printPort {
+		fmt.Printf("LISTEN_PORT=%s\n", port)
+	}
+
+	if c.portFile != "" {
+		if err := writeFileAtomic(c.portFile, []byte(port+"\n")); err != nil {
+			return err
+		}
+		c.log.Debugf("wrote listening port %s to %s", port, c.portFile)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers never observe a partially written file and a crash
+// leaves either the old file or the new one.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PortMapping is a single listening address along with the target it forwards to.
+type PortMapping struct {
+	Listen string
+	Target string
+}
+
+// parsePortRange splits <host>:<first>-<last> (or a plain <host>:<port>) into its parts.
+func parsePortRange(addr string) (host string, first int, last int, err error) {
+	host, ports, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	from, to, isRange := strings.Cut(ports, "-")
+	if first, err = parsePort(from); err != nil {
+		return "", 0, 0, err
+	}
+	if !isRange {
+		return host, first, first, nil
+	}
+	if last, err = parsePort(to); err != nil {
+		return "", 0, 0, err
+	}
+	if first == 0 || first > last {
+		return "", 0, 0, fmt.Errorf("invalid port range %q", ports)
+	}
+	return host, first, last, nil
+}
+
+// isPortRange reports whether the port of addr is a range, leaving hyphens
+// in the host alone.
+func isPortRange(addr string) bool {
+	return strings.Contains(addr[strings.LastIndex(addr, ":")+1:], "-")
+}
+
+func parsePort(port string) (int, error) {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", port)
+	}
+	return int(p), nil
+}
+
+// ExpandPortMapping expands a listening port range into one mapping per port.
+// The target is either fixed, a port range of the same size (the n-th listening
+// port forwards to the n-th target port), or a template in which %port is
+// replaced by the listening port and %index by its offset within the range.
+func ExpandPortMapping(listen string, target string) ([]PortMapping, error) {
+	if !isPortRange(listen) {
+		return []PortMapping{{Listen: listen, Target: target}}, nil
+	}
+	host, first, last, err := parsePortRange(listen)
+	if err != nil {
+		return nil, err
+	}
+
+	template := strings.Contains(target, "%port") || strings.Contains(target, "%index")
+	targetHost, targetFirst, targetLast := "", 0, 0
+	if !template && isPortRange(target) {
+		if targetHost, targetFirst, targetLast, err = parsePortRange(target); err != nil {
+			return nil, fmt.Errorf("invalid target: %w", err)
+		}
+		if targetLast-targetFirst != last-first {
+			return nil, fmt.Errorf("target port range %d-%d doesn't match listening port range %d-%d",
+				targetFirst, targetLast, first, last)
+		}
+	}
+
+	mappings := make([]PortMapping, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		index := port - first
+		m := PortMapping{
+			Listen: net.JoinHostPort(host, strconv.Itoa(port)),
+			Target: target,
+		}
+		switch {
+		case template:
+			m.Target = strings.NewReplacer("%port", strconv.Itoa(port), "%index", strconv.Itoa(index)).Replace(target)
+		case targetFirst > 0:
+			m.Target = net.JoinHostPort(targetHost, strconv.Itoa(targetFirst+index))
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		addr        string
+		host        string
+		first, last int
+		ok          bool
+	}{
+		{"127.0.0.1:8000-8002", "127.0.0.1", 8000, 8002, true},
+		{":8000-8000", "", 8000, 8000, true},
+		{"[::1]:1-65535", "::1", 1, 65535, true},
+		{"my-host:80", "my-host", 80, 80, true},
+		{"localhost:0", "localhost", 0, 0, true},
+		{"localhost:8002-8000", "", 0, 0, false},
+		{"localhost:0-10", "", 0, 0, false},
+		{"localhost:8000-65536", "", 0, 0, false},
+		{"localhost:65536", "", 0, 0, false},
+		{"localhost:-1", "", 0, 0, false},
+		{"localhost:8000-", "", 0, 0, false},
+		{"localhost:8000-8001-8002", "", 0, 0, false},
+		{"localhost:+80", "", 0, 0, false},
+		{"localhost:http", "", 0, 0, false},
+		{"localhost", "", 0, 0, false},
+		{"::1:80-81", "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		host, first, last, err := parsePortRange(tt.addr)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("parsed %q as %q %d-%d, expected an error", tt.addr, host, first, last)
+			}
+			continue
+		}
+		if err != nil || host != tt.host || first != tt.first || last != tt.last {
+			t.Errorf("parsed %q as %q %d-%d, %v, expected %q %d-%d", tt.addr, host, first, last, err, tt.host, tt.first, tt.last)
+		}
+	}
+}
+
+func TestExpandPortMapping(t *testing.T) {
+	tests := []struct {
+		listen, target string
+		want           []PortMapping
+	}{
+		{"127.0.0.1:80", "example.com:80", []PortMapping{
+			{"127.0.0.1:80", "example.com:80"},
+		}},
+		{"my-host:80", "other-host:8080", []PortMapping{
+			{"my-host:80", "other-host:8080"},
+		}},
+		{":8000-8002", "example.com:9000-9002", []PortMapping{
+			{":8000", "example.com:9000"},
+			{":8001", "example.com:9001"},
+			{":8002", "example.com:9002"},
+		}},
+		{"[::1]:8000-8001", "example.com:443", []PortMapping{
+			{"[::1]:8000", "example.com:443"},
+			{"[::1]:8001", "example.com:443"},
+		}},
+		{":8000-8001", "backend-1:443", []PortMapping{
+			{":8000", "backend-1:443"},
+			{":8001", "backend-1:443"},
+		}},
+		{":8000-8001", "backend-%index:%port", []PortMapping{
+			{":8000", "backend-0:8000"},
+			{":8001", "backend-1:8001"},
+		}},
+		{":8000-8001", "", []PortMapping{
+			{":8000", ""},
+			{":8001", ""},
+		}},
+		{":8000-8002", "example.com:9000-9001", nil},
+		{":8000-8001", "example.com:9001-9000", nil},
+		{":8002-8000", "example.com:443", nil},
+		{":8000-99999", "example.com:443", nil},
+		{"8000-8001", "example.com:443", nil},
+	}
+	for _, tt := range tests {
+		got, err := ExpandPortMapping(tt.listen, tt.target)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("expanded %q to %q as %v, expected an error", tt.listen, tt.target, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expanded %q to %q as %v, %v, expected %v", tt.listen, tt.target, got, err, tt.want)
+		}
+	}
+}
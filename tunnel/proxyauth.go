@@ -0,0 +1,107 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Authentication schemes, in order of preference. Basic sends the password
+// in the clear, so it is only used when the proxy offers nothing else.
+const (
+	authNegotiate = "Negotiate"
+	authNTLM      = "NTLM"
+	authBasic     = "Basic"
+)
+
+// proxyAuthenticator runs the handshake of an authentication scheme with an
+// HTTP proxy.
+type proxyAuthenticator interface {
+	// step returns the token to send next, given the challenge of the
+	// proxy, which is nil in the first round.
+	step(challenge []byte) ([]byte, error)
+	close()
+}
+
+// pickProxyAuth returns the most preferred scheme offered in the
+// Proxy-Authenticate headers of resp, or "" when there is none.
+func pickProxyAuth(resp *http.Response) string {
+	offered := make(map[string]bool)
+	for _, header := range resp.Header.Values("Proxy-Authenticate") {
+		scheme, _, _ := strings.Cut(strings.TrimSpace(header), " ")
+		offered[strings.ToLower(scheme)] = true
+	}
+	for _, scheme := range []string{authNegotiate, authNTLM, authBasic} {
+		if offered[strings.ToLower(scheme)] {
+			return scheme
+		}
+	}
+	return ""
+}
+
+// basicAuthenticator sends the user and password of the proxy URL once.
+type basicAuthenticator struct {
+	credentials []byte
+}
+
+func newBasicAuthenticator(proxyURL *url.URL) (proxyAuthenticator, error) {
+	if proxyURL.User == nil {
+		return nil, errors.New("Basic authentication needs the user and password in the proxy URL")
+	}
+	password, _ := proxyURL.User.Password()
+	return &basicAuthenticator{credentials: []byte(proxyURL.User.Username() + ":" + password)}, nil
+}
+
+func (a *basicAuthenticator) step(challenge []byte) ([]byte, error) {
+	if challenge != nil {
+		return nil, errors.New("unexpected Basic challenge")
+	}
+	return a.credentials, nil
+}
+
+func (a *basicAuthenticator) close() {}
+
+// proxyChallenge returns the token the proxy sent along with scheme.
+func proxyChallenge(resp *http.Response, scheme string) []byte {
+	for _, header := range resp.Header.Values("Proxy-Authenticate") {
+		name, token, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if !strings.EqualFold(name, scheme) {
+			continue
+		}
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+		if err == nil && len(challenge) > 0 {
+			return challenge
+		}
+	}
+	return nil
+}
+
+// proxyCredentials splits the user of the proxy URL into domain and user name
+// (DOMAIN\user); a user principal name (user@domain) is left whole.
+func proxyCredentials(user *url.Userinfo) (domain, username, password string) {
+	if user == nil {
+		return "", "", ""
+	}
+	password, _ = user.Password()
+	username = user.Username()
+	if d, u, ok := strings.Cut(username, `\`); ok {
+		return d, u, password
+	}
+	return "", username, password
+}
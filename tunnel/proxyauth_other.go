@@ -0,0 +1,54 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package tunnel
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+import "github.com/Azure/go-ntlmssp"
+
+// newProxyAuthenticator starts a handshake for scheme with the proxy at
+// proxyURL. Without SSPI, Kerberos isn't available: Negotiate is answered
+// with NTLM tokens, which proxies accept in its place.
+func newProxyAuthenticator(scheme string, proxyURL *url.URL) (proxyAuthenticator, error) {
+	domain, username, password := proxyCredentials(proxyURL.User)
+	if username == "" {
+		return nil, errors.New(scheme + " authentication needs the user and password in the proxy URL")
+	}
+	return &ntlmAuthenticator{domain: domain, username: username, password: password}, nil
+}
+
+// ntlmAuthenticator answers NTLM challenges with the given credentials.
+type ntlmAuthenticator struct {
+	domain   string
+	username string
+	password string
+}
+
+func (a *ntlmAuthenticator) step(challenge []byte) ([]byte, error) {
+	if challenge == nil {
+		return ntlmssp.NewNegotiateMessage(a.domain, "")
+	}
+	// the domain of a user principal name is part of it already
+	domainNeeded := !strings.Contains(a.username, "@")
+	return ntlmssp.ProcessChallenge(challenge, a.username, a.password, domainNeeded)
+}
+
+func (a *ntlmAuthenticator) close() {}
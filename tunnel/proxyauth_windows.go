@@ -0,0 +1,111 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"net/url"
+)
+
+import (
+	"github.com/alexbrainman/sspi"
+	"github.com/alexbrainman/sspi/negotiate"
+	"github.com/alexbrainman/sspi/ntlm"
+)
+
+// newProxyAuthenticator starts a handshake for scheme with the proxy at
+// proxyURL through SSPI, with the credentials in the URL or else those of
+// the current user.
+func newProxyAuthenticator(scheme string, proxyURL *url.URL) (proxyAuthenticator, error) {
+	domain, username, password := proxyCredentials(proxyURL.User)
+	var cred *sspi.Credentials
+	var err error
+	switch {
+	case scheme == authNegotiate && username != "":
+		cred, err = negotiate.AcquireUserCredentials(domain, username, password)
+	case scheme == authNegotiate:
+		cred, err = negotiate.AcquireCurrentUserCredentials()
+	case username != "":
+		cred, err = ntlm.AcquireUserCredentials(domain, username, password)
+	default:
+		cred, err = ntlm.AcquireCurrentUserCredentials()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if scheme == authNegotiate {
+		return &negotiateAuthenticator{cred: cred, target: "HTTP/" + proxyURL.Hostname()}, nil
+	}
+	return &sspiNTLMAuthenticator{cred: cred}, nil
+}
+
+// negotiateAuthenticator answers Negotiate (Kerberos, or NTLM where Kerberos
+// isn't possible) challenges.
+type negotiateAuthenticator struct {
+	cred    *sspi.Credentials
+	target  string
+	context *negotiate.ClientContext
+}
+
+func (a *negotiateAuthenticator) step(challenge []byte) ([]byte, error) {
+	if a.context == nil {
+		context, token, err := negotiate.NewClientContext(a.cred, a.target)
+		if err != nil {
+			return nil, err
+		}
+		a.context = context
+		return token, nil
+	}
+	if challenge == nil {
+		return nil, errors.New("proxy sent no Negotiate challenge")
+	}
+	_, token, err := a.context.Update(challenge)
+	return token, err
+}
+
+func (a *negotiateAuthenticator) close() {
+	if a.context != nil {
+		a.context.Release()
+	}
+	a.cred.Release()
+}
+
+// sspiNTLMAuthenticator answers NTLM challenges.
+type sspiNTLMAuthenticator struct {
+	cred    *sspi.Credentials
+	context *ntlm.ClientContext
+}
+
+func (a *sspiNTLMAuthenticator) step(challenge []byte) ([]byte, error) {
+	if a.context == nil {
+		context, token, err := ntlm.NewClientContext(a.cred)
+		if err != nil {
+			return nil, err
+		}
+		a.context = context
+		return token, nil
+	}
+	if challenge == nil {
+		return nil, errors.New("proxy sent no NTLM challenge")
+	}
+	return a.context.Update(challenge)
+}
+
+func (a *sspiNTLMAuthenticator) close() {
+	if a.context != nil {
+		a.context.Release()
+	}
+	a.cred.Release()
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// readProxyCredentials reads "user:password" from the first line of path.
+func readProxyCredentials(path string) (*url.Userinfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	user, password, ok := strings.Cut(strings.TrimSpace(line), ":")
+	if user == "" {
+		return nil, fmt.Errorf("no user in %s", path)
+	}
+	if !ok {
+		return url.User(user), nil
+	}
+	return url.UserPassword(user, password), nil
+}
+
+// loadProxyCredentials returns the credentials given for proxies without
+// their own, from the credentials file or else those set by option.
+func (c *client) loadProxyCredentials() (*url.Userinfo, error) {
+	if c.proxyCredFile != "" {
+		return readProxyCredentials(c.proxyCredFile)
+	}
+	if c.proxyUser == "" {
+		if c.proxyPassword != "" {
+			return nil, errors.New("a proxy password needs a user")
+		}
+		return nil, nil
+	}
+	return url.UserPassword(c.proxyUser, c.proxyPassword), nil
+}
+
+// withProxyCredentials returns proxyURL with the configured credentials,
+// unless it names a user itself.
+func (c *client) withProxyCredentials(proxyURL *url.URL) *url.URL {
+	if c.proxyCredentials == nil || proxyURL.User != nil {
+		return proxyURL
+	}
+	withUser := *proxyURL
+	withUser.User = c.proxyCredentials
+	return &withUser
+}
@@ -0,0 +1,291 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Versions of the PROXY protocol (https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt).
+const (
+	// human readable header line
+	ProxyProtocolV1 = "v1"
+	// binary header
+	ProxyProtocolV2 = "v2"
+)
+
+// how long a client may take to send its PROXY protocol header
+const proxyProtocolTimeout = 10 * time.Second
+
+// the longest version 1 header line, CRLF included
+const proxyProtocolV1MaxLength = 107
+
+// proxyProtocolV2Signature starts every version 2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtocolV2Local = 0x20
+	proxyProtocolV2Proxy = 0x21
+
+	proxyProtocolV2Unspec = 0x00
+	proxyProtocolV2TCP4   = 0x11
+	proxyProtocolV2TCP6   = 0x21
+)
+
+func validProxyProtocol(version string) error {
+	switch version {
+	case ProxyProtocolV1, ProxyProtocolV2:
+		return nil
+	}
+	return fmt.Errorf("unknown PROXY protocol version %q", version)
+}
+
+// proxyHeader builds the PROXY protocol header announcing a connection from
+// src to dst. Connections between IPv4 and IPv6 addresses are announced as
+// TCP6, and connections not between TCP addresses without addresses.
+func proxyHeader(version string, src, dst net.Addr) []byte {
+	srcTCP, _ := src.(*net.TCPAddr)
+	dstTCP, _ := dst.(*net.TCPAddr)
+	var srcIP, dstIP net.IP
+	family := ""
+	if srcTCP != nil && dstTCP != nil {
+		if srcIP, dstIP = srcTCP.IP.To4(), dstTCP.IP.To4(); srcIP != nil && dstIP != nil {
+			family = "TCP4"
+		} else if srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16(); srcIP != nil && dstIP != nil {
+			family = "TCP6"
+		}
+	}
+
+	if version == ProxyProtocolV1 {
+		if family == "" {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family,
+			proxyHeaderIP(srcIP, family), proxyHeaderIP(dstIP, family), srcTCP.Port, dstTCP.Port))
+	}
+
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	switch family {
+	case "TCP4":
+		header = append(header, proxyProtocolV2Proxy, proxyProtocolV2TCP4)
+	case "TCP6":
+		header = append(header, proxyProtocolV2Proxy, proxyProtocolV2TCP6)
+	default:
+		return append(header, proxyProtocolV2Local, proxyProtocolV2Unspec, 0, 0)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(srcTCP.Port))
+	return binary.BigEndian.AppendUint16(header, uint16(dstTCP.Port))
+}
+
+// proxyHeaderIP formats ip for a version 1 header, writing IPv4 addresses
+// announced as TCP6 in their IPv4-mapped form.
+func proxyHeaderIP(ip net.IP, family string) string {
+	if family == "TCP6" && ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
+
+// sendProxyHeader announces the client of s to the target over dialed.
+func (c *client) sendProxyHeader(dialed net.Conn, s *Session) error {
+	_, err := dialed.Write(proxyHeader(c.proxyProtocolOut, s.clientAddr, s.localAddr))
+	if err != nil {
+		return fmt.Errorf("could not send PROXY protocol header: %w", err)
+	}
+	return nil
+}
+
+// proxiedConn is a connection accepted with a PROXY protocol header, which
+// reports the addresses from the header.
+type proxiedConn struct {
+	bufferedConn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (p *proxiedConn) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+func (p *proxiedConn) LocalAddr() net.Addr {
+	return p.local
+}
+
+// readProxyHeader reads the PROXY protocol header, of either version, from
+// r and returns the addresses it announces. Both are nil when the header
+// doesn't name the client (UNKNOWN or LOCAL).
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	start, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(start, proxyProtocolV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, nil, errors.New("no PROXY protocol header")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, nil, errors.New("PROXY protocol header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol header %q", strings.TrimSpace(string(line)))
+	}
+	v4 := fields[1] == "TCP4"
+	src, err := parseProxyAddr(fields[2], fields[4], v4)
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5], v4)
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// parseProxyAddr parses an address of a version 1 header, which has to be
+// of the family the header names.
+func parseProxyAddr(ip, port string, v4 bool) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil || strings.Contains(ip, ":") == v4 {
+		return nil, fmt.Errorf("invalid address %q in PROXY protocol header", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in PROXY protocol header", port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	command, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	if command&0xf0 != 0x20 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", command>>4)
+	}
+	switch command {
+	case proxyProtocolV2Local:
+		return nil, nil, nil
+	case proxyProtocolV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol command %#x", command&0x0f)
+	}
+
+	// the addresses are followed by TLVs, which are left alone
+	ipLength := 0
+	switch family {
+	case proxyProtocolV2TCP4:
+		ipLength = net.IPv4len
+	case proxyProtocolV2TCP6:
+		ipLength = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLength+4 {
+		return nil, nil, errors.New("PROXY protocol header too short")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLength]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLength:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLength : 2*ipLength]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLength+2:])),
+	}
+	return src, dst, nil
+}
+
+// trustedProxyHeader tells whether accepted comes from a load balancer
+// trusted to name the client, closing it when not.
+func (c *client) trustedProxyHeader(accepted net.Conn) bool {
+	ip := addrIP(accepted.RemoteAddr())
+	for _, n := range c.proxyProtocolNets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	c.log.Warnf("connection from %s denied (not a trusted load balancer)", accepted.RemoteAddr())
+	c.failed(accepted.RemoteAddr())
+	closeConn(accepted, c.closing.deny == CloseRST)
+	return false
+}
+
+// acceptProxyHeader reads the PROXY protocol header from accepted and
+// makes the session, and the connection returned, report the client it
+// names. The connection is closed when there is no valid header.
+func (c *client) acceptProxyHeader(accepted net.Conn, s *Session) (net.Conn, bool) {
+	timeout := c.dialTimeout
+	if timeout <= 0 {
+		timeout = proxyProtocolTimeout
+	}
+	reader := bufio.NewReader(accepted)
+	_ = accepted.SetReadDeadline(time.Now().Add(timeout))
+	src, dst, err := readProxyHeader(reader)
+	_ = accepted.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.log.Warnf("could not read PROXY protocol header from %s: %s", accepted.RemoteAddr(), err)
+		accepted.Close()
+		return nil, false
+	}
+
+	conn := &proxiedConn{
+		bufferedConn: bufferedConn{Conn: accepted, reader: reader},
+		remote:       accepted.RemoteAddr(),
+		local:        accepted.LocalAddr(),
+	}
+	if src != nil {
+		c.log.Infof("connection from %s is from %s to %s", accepted.RemoteAddr(), src, dst)
+		conn.remote, conn.local = src, dst
+		s.clientAddr, s.localAddr = src, dst
+	}
+	return conn, true
+}
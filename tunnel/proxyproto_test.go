@@ -0,0 +1,220 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tcp := func(addr string) net.Addr {
+		a, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	tests := []struct {
+		src, dst net.Addr
+		// the addresses aren't announced
+		unknown bool
+	}{
+		{tcp("192.0.2.1:1234"), tcp("198.51.100.2:443"), false},
+		{tcp("[2001:db8::1]:65535"), tcp("[2001:db8::2]:0"), false},
+		{tcp("192.0.2.1:1234"), tcp("[2001:db8::2]:443"), false},
+		{tcp("192.0.2.1:1234"), &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 53}, true},
+		{&net.UnixAddr{Name: "/run/a.sock", Net: "unix"}, tcp("198.51.100.2:443"), true},
+	}
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		for _, tt := range tests {
+			header := proxyHeader(version, tt.src, tt.dst)
+			r := bufio.NewReader(strings.NewReader(string(header) + "rest"))
+			src, dst, err := readProxyHeader(r)
+			if err != nil {
+				t.Errorf("%s: read %q: %v", version, header, err)
+				continue
+			}
+			if rest, _ := r.ReadString(0); rest != "rest" {
+				t.Errorf("%s: read %q, left %q, expected %q", version, header, rest, "rest")
+			}
+			if tt.unknown {
+				if src != nil || dst != nil {
+					t.Errorf("%s: read %q as %v -> %v, expected no addresses", version, header, src, dst)
+				}
+				continue
+			}
+			mixed := strings.Contains(tt.src.String(), "[") != strings.Contains(tt.dst.String(), "[")
+			if mixed {
+				// announced as TCP6, with the IPv4 address mapped
+				if src == nil || src.(*net.TCPAddr).Port != tt.src.(*net.TCPAddr).Port ||
+					!src.(*net.TCPAddr).IP.Equal(tt.src.(*net.TCPAddr).IP) {
+					t.Errorf("%s: read %q as %v, expected %v", version, header, src, tt.src)
+				}
+				continue
+			}
+			if src == nil || dst == nil || src.String() != tt.src.String() || dst.String() != tt.dst.String() {
+				t.Errorf("%s: read %q as %v -> %v, expected %v -> %v", version, header, src, dst, tt.src, tt.dst)
+			}
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, payload ...byte) string {
+		header := append([]byte{}, proxyProtocolV2Signature...)
+		header = append(header, command, family, byte(len(payload)>>8), byte(len(payload)))
+		return string(append(header, payload...))
+	}
+	v4Payload := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0x04, 0xd2, 0x01, 0xbb}
+	tests := []struct {
+		header string
+		// source address, or "" when none is announced
+		src string
+		ok  bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 1234 443\r\n", "192.0.2.1:1234", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n", "[2001:db8::1]:1234", true},
+		{"PROXY TCP6 ::ffff:192.0.2.1 ::ffff:198.51.100.2 1234 443\r\n", "192.0.2.1:1234", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY UNKNOWN 192.0.2.1 198.51.100.2 1234 443\r\n", "", true},
+		{"PROXY UNKNOWN " + strings.Repeat("x", proxyProtocolV1MaxLength-len("PROXY UNKNOWN \r\n")) + "\r\n", "", true},
+		{"PROXY UNKNOWN " + strings.Repeat("x", proxyProtocolV1MaxLength) + "\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 1234 443", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 1234\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 1234 443 80\r\n", "", false},
+		{"PROXY UDP4 192.0.2.1 198.51.100.2 1234 443\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 65536 443\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 -1 443\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 1234 http\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 +80 443\r\n", "", false},
+		{"PROXY TCP4 192.0.2 198.51.100.2 1234 443\r\n", "", false},
+		{"PROXY TCP4 2001:db8::1 198.51.100.2 1234 443\r\n", "", false},
+		{"PROXY TCP6 192.0.2.1 2001:db8::2 1234 443\r\n", "", false},
+		{"PROXY ", "", false},
+		{"GET / HTTP/1.1\r\n\r\n", "", false},
+		{"", "", false},
+		{v2(proxyProtocolV2Proxy, proxyProtocolV2TCP4, v4Payload...), "192.0.2.1:1234", true},
+		{v2(proxyProtocolV2Proxy, proxyProtocolV2TCP4, append(v4Payload, 0x04, 0, 1, 0)...), "192.0.2.1:1234", true},
+		{v2(proxyProtocolV2Local, proxyProtocolV2Unspec), "", true},
+		{v2(proxyProtocolV2Local, proxyProtocolV2TCP4, v4Payload...), "", true},
+		{v2(proxyProtocolV2Proxy, proxyProtocolV2Unspec), "", true},
+		{v2(proxyProtocolV2Proxy, 0x12, v4Payload...), "", true},
+		{v2(0x22, proxyProtocolV2TCP4, v4Payload...), "", false},
+		{v2(0x2f, proxyProtocolV2TCP4, v4Payload...), "", false},
+		{v2(0x11, proxyProtocolV2TCP4, v4Payload...), "", false},
+		{v2(proxyProtocolV2Proxy, proxyProtocolV2TCP4, v4Payload[:11]...), "", false},
+		{v2(proxyProtocolV2Proxy, proxyProtocolV2TCP6, v4Payload...), "", false},
+		{v2(proxyProtocolV2Proxy, proxyProtocolV2TCP4, v4Payload...)[:20], "", false},
+		{v2(proxyProtocolV2Proxy, proxyProtocolV2TCP4)[:14], "", false},
+	}
+	for _, tt := range tests {
+		src, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(tt.header)))
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("read %q as %v, expected an error", tt.header, src)
+			}
+			continue
+		}
+		got := ""
+		if src != nil {
+			got = src.String()
+		}
+		if err != nil || got != tt.src {
+			t.Errorf("read %q as %q, %v, expected %q", tt.header, got, err, tt.src)
+		}
+	}
+}
+
+// remoteConn is a connection from remote.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestProxyHeaderAdmission(t *testing.T) {
+	tests := []struct {
+		// load balancers trusted, and the access list applied to clients
+		trusted, deny string
+		remote        string
+		header        string
+		// untrusted, bad header, denied or admitted
+		outcome string
+		// client address of the session once admitted
+		client string
+	}{
+		{"10.0.0.0/8", "", "10.0.0.1:5000", "PROXY TCP4 192.0.2.1 198.51.100.2 1234 443\r\n", "admitted", "192.0.2.1:1234"},
+		{"10.0.0.0/8", "", "192.0.2.9:5000", "PROXY TCP4 192.0.2.1 198.51.100.2 1234 443\r\n", "untrusted", ""},
+		{"10.0.0.1, 2001:db8::/32", "", "[2001:db8::5]:5000", "PROXY TCP4 192.0.2.1 198.51.100.2 1234 443\r\n", "admitted", "192.0.2.1:1234"},
+		{"10.0.0.1", "", "10.0.0.2:5000", "PROXY TCP4 192.0.2.1 198.51.100.2 1234 443\r\n", "untrusted", ""},
+		// health checks of the load balancer itself name no client
+		{"10.0.0.0/8", "", "10.0.0.1:5000", "PROXY UNKNOWN\r\n", "admitted", "10.0.0.1:5000"},
+		{"10.0.0.0/8", "", "10.0.0.1:5000", "GET / HTTP/1.1\r\n\r\n", "bad header", ""},
+		{"10.0.0.0/8", "", "10.0.0.1:5000", "PROXY TCP4 192.0.2.1 198.51.100.2 1234", "bad header", ""},
+		// the access list applies to the client named, not the load balancer
+		{"10.0.0.0/8", "192.0.2.0/24", "10.0.0.1:5000", "PROXY TCP4 192.0.2.1 198.51.100.2 1234 443\r\n", "denied", ""},
+		{"10.0.0.0/8", "10.0.0.0/8", "10.0.0.1:5000", "PROXY TCP4 192.0.2.1 198.51.100.2 1234 443\r\n", "admitted", "192.0.2.1:1234"},
+		{"", "", "10.0.0.1:5000", "PROXY TCP4 192.0.2.1 198.51.100.2 1234 443\r\n", "untrusted", ""},
+	}
+	for _, tt := range tests {
+		c := newClient(clientConfig{}, make(chan struct{}), make(chan struct{}), make(chan struct{}))
+		var err error
+		if c.proxyProtocolNets, err = parseCIDRs(tt.trusted); err != nil {
+			t.Fatal(err)
+		}
+		if tt.deny != "" {
+			if c.access, err = newAccessList("", tt.deny); err != nil {
+				t.Fatal(err)
+			}
+		}
+		remote, err := net.ResolveTCPAddr("tcp", tt.remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, peer := net.Pipe()
+		go func(header string) {
+			_, _ = peer.Write([]byte(header))
+			peer.Close()
+		}(tt.header)
+		var accepted net.Conn = &remoteConn{Conn: conn, remote: remote}
+		s := newSession(accepted, "")
+
+		outcome := "untrusted"
+		if c.trustedProxyHeader(accepted) {
+			outcome = "bad header"
+			if accepted, ok := c.acceptProxyHeader(accepted, s); ok {
+				outcome = "denied"
+				if c.admit(accepted, s.clientAddr) {
+					outcome = "admitted"
+				}
+				if accepted.RemoteAddr().String() != s.clientAddr.String() {
+					t.Errorf("%q from %s: connection from %s, session from %s",
+						tt.header, tt.remote, accepted.RemoteAddr(), s.clientAddr)
+				}
+			}
+		}
+		if outcome != tt.outcome {
+			t.Errorf("%q from %s: %s, expected %s", tt.header, tt.remote, outcome, tt.outcome)
+		} else if outcome == "admitted" && s.clientAddr.String() != tt.client {
+			t.Errorf("%q from %s: client %s, expected %s", tt.header, tt.remote, s.clientAddr, tt.client)
+		}
+		conn.Close()
+	}
+}
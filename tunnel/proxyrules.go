@@ -0,0 +1,117 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+import "golang.org/x/net/proxy"
+
+// proxyRule sends the targets it matches through a proxy, or directly.
+type proxyRule struct {
+	// matches addresses in it, nil for a host name rule
+	network *net.IPNet
+	// matches this host name, or its subdomains when it starts with "*."
+	host string
+	// nil for dialing directly
+	proxy *url.URL
+}
+
+// parseProxyRules parses a comma separated list of <match>=<proxy> rules.
+// <match> is a CIDR, an address, a host name or *.<domain>, and <proxy> a
+// proxy URL or "direct".
+func parseProxyRules(list string) ([]proxyRule, error) {
+	var rules []proxyRule
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		match, target, ok := strings.Cut(item, "=")
+		match, target = strings.TrimSpace(match), strings.TrimSpace(target)
+		if !ok || match == "" || target == "" {
+			return nil, fmt.Errorf("invalid proxy rule %q, expected <match>=<proxy>", item)
+		}
+
+		var rule proxyRule
+		if strings.Contains(match, "/") || net.ParseIP(match) != nil {
+			nets, err := parseCIDRs(match)
+			if err != nil {
+				return nil, err
+			}
+			rule.network = nets[0]
+		} else {
+			rule.host = strings.ToLower(strings.TrimSuffix(match, "."))
+		}
+		if !strings.EqualFold(target, "direct") {
+			u, err := url.Parse(target)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("invalid proxy in rule for %s", match)
+			}
+			rule.proxy = u
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// matches tells whether the rule applies to the target host.
+func (r *proxyRule) matches(host string) bool {
+	if r.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.network.Contains(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(r.host, "*.") {
+		return strings.HasSuffix(host, r.host[1:])
+	}
+	return host == r.host
+}
+
+// ruleDialer dials each target through the proxy of the first rule
+// matching its host, or with fallback when none does.
+type ruleDialer struct {
+	rules []proxyRule
+	// the dialer of each rule
+	dialers  []proxy.Dialer
+	fallback proxy.Dialer
+}
+
+func (d *ruleDialer) Dial(network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	for i := range d.rules {
+		if !d.rules[i].matches(host) {
+			continue
+		}
+		conn, err := d.dialers[i].Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// tells the access log which way it went, the fallback proxy not included
+		name := ""
+		if d.rules[i].proxy != nil {
+			name = redactedURL(d.rules[i].proxy)
+		}
+		return &viaProxyConn{Conn: conn, proxy: name}, nil
+	}
+	return d.fallback.Dial(network, addr)
+}
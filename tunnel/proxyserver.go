@@ -0,0 +1,148 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Protocols the listener can speak as a proxy, taking the target from each client.
+const (
+	// SOCKS5 with the CONNECT command (RFC 1928)
+	ProxyServerSOCKS5 = "socks5"
+	// HTTP, with CONNECT for anything but plain http:// requests
+	ProxyServerHTTP = "http"
+)
+
+// how long a client may take to name its target
+const proxyServerTimeout = 10 * time.Second
+
+var errTargetNotAllowed = errors.New("target not allowed")
+
+func validProxyServer(protocol string) error {
+	switch protocol {
+	case ProxyServerSOCKS5, ProxyServerHTTP:
+		return nil
+	}
+	return fmt.Errorf("unknown proxy server protocol %q", protocol)
+}
+
+// proxyUsers are the user names and passwords clients of the proxy server
+// have to log in with.
+type proxyUsers map[string]string
+
+// loadProxyUsers reads one user:password per line from path, skipping empty
+// lines and those starting with #.
+func loadProxyUsers(path string) (proxyUsers, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(proxyUsers)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:password", path, n)
+		}
+		users[user] = password
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no users in %s", path)
+	}
+	return users, nil
+}
+
+// valid reports whether user may log in with password.
+func (u proxyUsers) valid(user, password string) bool {
+	expected, ok := u[user]
+	if !ok {
+		// compare anyway, so unknown users take as long as wrong passwords
+		expected = password + "x"
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && ok
+}
+
+// routeProxyRequest takes the target of accepted from the proxy protocol it
+// speaks and sets the session target to it. The connection is closed when
+// that fails.
+func (c *client) routeProxyRequest(accepted net.Conn, s *Session) (net.Conn, bool) {
+	timeout := c.dialTimeout
+	if timeout <= 0 {
+		timeout = proxyServerTimeout
+	}
+	_ = accepted.SetDeadline(time.Now().Add(timeout))
+	var target string
+	var err error
+	switch c.proxyServer {
+	case ProxyServerHTTP:
+		var client *httpProxyConn
+		if client, target, err = c.httpServe(accepted, s); err == nil {
+			accepted = client
+		}
+	default:
+		target, err = c.socks5Serve(accepted, s)
+	}
+	_ = accepted.SetDeadline(time.Time{})
+	if err == nil {
+		err = plainHostPort(target)
+	}
+	if err != nil {
+		c.log.Warnf("could not read proxy request from %s: %s", accepted.RemoteAddr(), err)
+		c.failed(s.clientAddr)
+		accepted.Close()
+		return nil, false
+	}
+	if c.proxyServerTargets != nil && !c.proxyServerTargets.MatchString(strings.ToLower(target)) {
+		c.log.Warnf("target %q requested by %s is not allowed", target, accepted.RemoteAddr())
+		_ = c.replyProxyRequest(accepted, nil, errTargetNotAllowed)
+		c.failed(s.clientAddr)
+		closeConn(accepted, c.closing.deny == CloseRST)
+		return nil, false
+	}
+
+	c.log.Debugf("routing %s to requested target %s", accepted.RemoteAddr(), target)
+	s.target = target
+	s.routed = true
+	return accepted, true
+}
+
+// replyProxyRequest tells the client of the proxy server whether its target
+// was dialed (err is nil) or not.
+func (c *client) replyProxyRequest(accepted, dialed net.Conn, err error) error {
+	if client, ok := accepted.(*httpProxyConn); ok {
+		return httpReply(client, dialed, err)
+	}
+	if err != nil {
+		return socks5Reply(accepted, socks5ReplyCode(err), nil)
+	}
+	return socks5Reply(accepted, socks5ReplySucceeded, dialed.LocalAddr())
+}
@@ -0,0 +1,377 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+// Relay protocol: a peer opens a TCP connection to the relay and sends a single
+// line, "TCPTUNNEL ACCEPT <token>" when it offers to accept a connection or
+// "TCPTUNNEL CONNECT <token>" when it wants to reach the accepting side. Once
+// the relay has paired an ACCEPT with a CONNECT carrying the same token, it
+// answers "OK" to both and shuttles bytes between them. Failures are answered
+// with "ERR <reason>".
+const (
+	relayMagic       = "TCPTUNNEL"
+	relayRoleAccept  = "ACCEPT"
+	relayRoleConnect = "CONNECT"
+	relayReplyOK     = "OK"
+	relayReplyErr    = "ERR"
+
+	relayMaxLineLen       = 512
+	relayHandshakeTimeout = 10 * time.Second
+	relayMaxRetryBackoff  = 30 * time.Second
+)
+
+// DefaultRelayWaitTimeout is how long a relay keeps a peer waiting to be paired by default.
+const DefaultRelayWaitTimeout = 60 * time.Second
+
+// readRelayLine reads a single line without buffering beyond it, so nothing
+// sent by the peer after the handshake gets lost.
+func readRelayLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < relayMaxLineLen {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("relay handshake line too long")
+}
+
+func writeRelayLine(conn net.Conn, format string, args ...interface{}) error {
+	_, err := fmt.Fprintf(conn, format+"\n", args...)
+	return err
+}
+
+// parseRelayURL splits relay://<host>:<port>/<token> into its relay address and token.
+func parseRelayURL(rawURL string) (string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	token := strings.Trim(u.Path, "/")
+	if u.Scheme != "relay" || u.Host == "" || token == "" || strings.ContainsAny(token, " \r\n") {
+		return "", "", fmt.Errorf("invalid relay address %q, expected relay://<host>:<port>/<token>", rawURL)
+	}
+	return u.Host, token, nil
+}
+
+// IsRelayURL tells whether addr is a relay://<host>:<port>/<token> address.
+func IsRelayURL(addr string) bool {
+	return strings.HasPrefix(addr, "relay://")
+}
+
+// relayHandshake sends our role and token and waits until the relay reports a pairing.
+func relayHandshake(conn net.Conn, role, token string) error {
+	if err := writeRelayLine(conn, "%s %s %s", relayMagic, role, token); err != nil {
+		return err
+	}
+	reply, err := readRelayLine(conn)
+	if err != nil {
+		return err
+	}
+	if reply != relayReplyOK {
+		return fmt.Errorf("relay refused: %s", strings.TrimPrefix(reply, relayReplyErr+" "))
+	}
+	return nil
+}
+
+// relayDialer reaches the target by asking a relay to pair us with a peer
+// accepting connections under the same token.
+type relayDialer struct {
+	dialer proxy.Dialer
+	token  string
+}
+
+func (d *relayDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = relayHandshake(conn, relayRoleConnect, d.token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+type relayAddr string
+
+func (a relayAddr) Network() string { return "relay" }
+func (a relayAddr) String() string  { return "relay://" + string(a) }
+
+// relayListener accepts connections by registering at a relay and waiting
+// until a connecting peer is paired with us.
+type relayListener struct {
+	addr    string
+	token   string
+	dial    func(network, addr string) (net.Conn, error)
+	done    chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	pending net.Conn
+	log     logrus.FieldLogger
+}
+
+func newRelayListener(rawURL string, dial func(network, addr string) (net.Conn, error), log logrus.FieldLogger) (*relayListener, error) {
+	addr, token, err := parseRelayURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &relayListener{
+		addr:  addr,
+		token: token,
+		dial:  dial,
+		done:  make(chan struct{}),
+		log:   log,
+	}, nil
+}
+
+func (l *relayListener) Accept() (net.Conn, error) {
+	backoff := time.Second
+	for {
+		conn, err := l.register()
+		if err == nil {
+			return conn, nil
+		}
+
+		select {
+		case <-l.done:
+			return nil, net.ErrClosed
+		default:
+		}
+		if err == io.EOF {
+			// the relay stopped waiting for a peer on our behalf, register again
+			backoff = time.Second
+			continue
+		}
+
+		l.log.Warnf("could not register at relay %s: %s", l.addr, err)
+		select {
+		case <-l.done:
+			return nil, net.ErrClosed
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > relayMaxRetryBackoff {
+			backoff = relayMaxRetryBackoff
+		}
+	}
+}
+
+func (l *relayListener) register() (net.Conn, error) {
+	conn, err := l.dial("tcp", l.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	select {
+	case <-l.done:
+		l.mu.Unlock()
+		conn.Close()
+		return nil, net.ErrClosed
+	default:
+	}
+	l.pending = conn
+	l.mu.Unlock()
+
+	err = relayHandshake(conn, relayRoleAccept, l.token)
+
+	l.mu.Lock()
+	l.pending = nil
+	l.mu.Unlock()
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (l *relayListener) Close() error {
+	l.once.Do(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		close(l.done)
+		if l.pending != nil {
+			l.pending.Close()
+		}
+	})
+	return nil
+}
+
+func (l *relayListener) Addr() net.Addr {
+	return relayAddr(l.addr)
+}
+
+// relayPeer is a registered connection waiting for its counterpart.
+type relayPeer struct {
+	conn   net.Conn
+	paired chan struct{}
+}
+
+// RelayServer pairs the instances meeting at it with the same token.
+type RelayServer struct {
+	waitTimeout time.Duration
+	mu          sync.Mutex
+	// waiting peers, keyed by role and token
+	waiting map[string][]*relayPeer
+}
+
+// NewRelayServer returns a relay keeping peers waiting to be paired for at
+// most waitTimeout.
+func NewRelayServer(waitTimeout time.Duration) *RelayServer {
+	return &RelayServer{
+		waitTimeout: waitTimeout,
+		waiting:     make(map[string][]*relayPeer),
+	}
+}
+
+// Serve handles the connections accepted by listener until accepting fails.
+func (r *RelayServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go r.handleConn(conn)
+	}
+}
+
+func (r *RelayServer) handleConn(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(relayHandshakeTimeout))
+	line, err := readRelayLine(conn)
+	if err != nil {
+		log.Debugf("failed to read relay handshake from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != relayMagic || (fields[1] != relayRoleAccept && fields[1] != relayRoleConnect) {
+		log.Debugf("invalid relay handshake from %s", conn.RemoteAddr())
+		_ = writeRelayLine(conn, "%s invalid handshake", relayReplyErr)
+		conn.Close()
+		return
+	}
+	role, token := fields[1], fields[2]
+	opposite := relayRoleAccept
+	if role == relayRoleAccept {
+		opposite = relayRoleConnect
+	}
+
+	self := &relayPeer{conn: conn, paired: make(chan struct{})}
+	r.mu.Lock()
+	if peer := r.pop(opposite + " " + token); peer != nil {
+		r.mu.Unlock()
+		close(peer.paired)
+		r.bridge(self, peer)
+		return
+	}
+	r.waiting[role+" "+token] = append(r.waiting[role+" "+token], self)
+	r.mu.Unlock()
+
+	log.Debugf("%s from %s is waiting for a peer", role, conn.RemoteAddr())
+	select {
+	case <-self.paired:
+		// the peer's goroutine owns the pairing now
+		return
+	case <-time.After(r.waitTimeout):
+	}
+
+	r.mu.Lock()
+	removed := r.remove(role+" "+token, self)
+	r.mu.Unlock()
+	if !removed {
+		// got paired in the meantime
+		return
+	}
+	if role == relayRoleConnect {
+		_ = writeRelayLine(conn, "%s no peer available", relayReplyErr)
+	}
+	conn.Close()
+}
+
+// pop removes and returns the longest waiting peer under key. r.mu must be held.
+func (r *RelayServer) pop(key string) *relayPeer {
+	queue := r.waiting[key]
+	if len(queue) == 0 {
+		return nil
+	}
+	peer := queue[0]
+	if len(queue) == 1 {
+		delete(r.waiting, key)
+	} else {
+		r.waiting[key] = queue[1:]
+	}
+	return peer
+}
+
+// remove drops peer from the queue under key. r.mu must be held.
+func (r *RelayServer) remove(key string, peer *relayPeer) bool {
+	queue := r.waiting[key]
+	for i, p := range queue {
+		if p == peer {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			if len(queue) == 0 {
+				delete(r.waiting, key)
+			} else {
+				r.waiting[key] = queue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RelayServer) bridge(a, b *relayPeer) {
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	if writeRelayLine(a.conn, relayReplyOK) != nil || writeRelayLine(b.conn, relayReplyOK) != nil {
+		return
+	}
+	log.Infof("relaying between %s and %s", a.conn.RemoteAddr(), b.conn.RemoteAddr())
+
+	copyDone := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(a.conn, b.conn)
+		copyDone <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(b.conn, a.conn)
+		copyDone <- struct{}{}
+	}()
+	<-copyDone
+}
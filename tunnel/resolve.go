@@ -0,0 +1,379 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/proxy"
+)
+
+// Where the targets of proxied connections are resolved.
+const (
+	// by the proxy, the way it is reached without a hostname otherwise
+	ProxyResolveRemote = "remote"
+	// by the tunnel, which only hands the proxy addresses
+	ProxyResolveLocal = "local"
+)
+
+func validProxyResolve(where string) error {
+	switch where {
+	case ProxyResolveRemote, ProxyResolveLocal:
+		return nil
+	}
+	return fmt.Errorf("unknown proxy resolution %q", where)
+}
+
+const (
+	// resolvConf lists the nameservers lookups with a TTL are sent to
+	resolvConf = "/etc/resolv.conf"
+	// how long names the nameservers don't know (say from /etc/hosts) are
+	// cached for, as the system resolver doesn't tell their TTL
+	systemLookupTTL = 30 * time.Second
+	// how long a lookup may take
+	lookupTimeout = 5 * time.Second
+)
+
+// resolver looks names up through its nameservers and/or the system
+// resolver, caching their addresses for as long as their TTL says or,
+// resolving once, for good.
+type resolver struct {
+	nameservers []nameserver
+	// names the nameservers don't know (or all of them without any) are
+	// looked up by the system resolver
+	system bool
+	cache  bool
+	once   bool
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// newResolver returns a resolver using the -dns nameservers if there are
+// any, else the system ones when the TTL is needed for caching.
+func newResolver(dns string, cache, once bool) (*resolver, error) {
+	r := &resolver{
+		cache:   cache || once,
+		once:    once,
+		entries: make(map[string]dnsEntry),
+	}
+	if dns == "" {
+		r.system = true
+		if r.cache {
+			for _, address := range readNameservers(resolvConf) {
+				r.nameservers = append(r.nameservers, &plainNameserver{address: address})
+			}
+		}
+		return r, nil
+	}
+	for _, server := range strings.Split(dns, ",") {
+		ns, err := parseNameserver(strings.TrimSpace(server))
+		if err != nil {
+			return nil, err
+		}
+		r.nameservers = append(r.nameservers, ns)
+	}
+	return r, nil
+}
+
+// readNameservers returns the nameservers of a resolv.conf, none when it
+// can't be read.
+func readNameservers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var nameservers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			nameservers = append(nameservers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return nameservers
+}
+
+// resolve returns the addresses of host, IPv6 ones first.
+func (r *resolver) resolve(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if r.cache {
+		r.mu.Lock()
+		entry, ok := r.entries[host]
+		r.mu.Unlock()
+		if ok && (r.once || time.Now().Before(entry.expires)) {
+			return entry.ips, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	ips, ttl, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if r.cache {
+		r.mu.Lock()
+		r.entries[host] = dnsEntry{ips: ips, expires: time.Now().Add(ttl)}
+		r.mu.Unlock()
+	}
+	return ips, nil
+}
+
+// lookup asks the nameservers for the addresses of host and their TTL,
+// falling back to the system resolver for names they don't know.
+func (r *resolver) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	ips, ttl, err := lookupTTL(ctx, r.nameservers, host)
+	if err == nil || !r.system {
+		return ips, ttl, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	// IPv6 first, as lookupTTL orders them
+	ips = make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ips = append(ips, addr.IP)
+		}
+	}
+	return ips, systemLookupTTL, nil
+}
+
+// lookupTTL asks the first nameserver answering for the AAAA and A records of
+// host, returning the addresses with the lowest TTL among the records.
+func lookupTTL(ctx context.Context, nameservers []nameserver, host string) ([]net.IP, time.Duration, error) {
+	if len(nameservers) == 0 {
+		return nil, 0, errors.New("no nameservers")
+	}
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	var ips []net.IP
+	var ttl uint32
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA} {
+		var answers []net.IP
+		var answersTTL uint32
+		for _, nameserver := range nameservers {
+			if answers, answersTTL, err = queryNameserver(ctx, nameserver, name, qtype); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(answers) > 0 && (len(ips) == 0 || answersTTL < ttl) {
+			ttl = answersTTL
+		}
+		ips = append(ips, answers...)
+	}
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("no addresses for %s", host)
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// queryNameserver asks ns for the records of name of type qtype.
+func queryNameserver(ctx context.Context, ns nameserver, name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, uint32, error) {
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	response, err := ns.exchange(ctx, packed)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSAnswers(response, query.ID, qtype)
+}
+
+// parseDNSAnswers returns the addresses in the response to query id and the
+// lowest TTL among the records leading to them.
+func parseDNSAnswers(response []byte, id uint16, qtype dnsmessage.Type) (ips []net.IP, ttl uint32, err error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(response)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.ID != id || !header.Response {
+		return nil, 0, errors.New("mismatched DNS response")
+	}
+	if header.Truncated {
+		return nil, 0, errors.New("truncated DNS response")
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("DNS error %s", header.RCode)
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	for records := 0; ; records++ {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if records == 0 || h.TTL < ttl {
+			ttl = h.TTL
+		}
+		switch {
+		case h.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case h.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		default:
+			if err = p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	return ips, ttl, nil
+}
+
+// resolvingDialer resolves names through the resolver before dialing, racing
+// the address families like net.Dialer does (RFC 6555).
+type resolvingDialer struct {
+	resolver      *resolver
+	dialer        proxy.Dialer
+	fallbackDelay time.Duration
+}
+
+func (d *resolvingDialer) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || network == "unix" || net.ParseIP(host) != nil {
+		return d.dialer.Dial(network, addr)
+	}
+	ips, err := d.resolver.resolve(host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	var primaries, fallbacks []net.IP
+	for _, ip := range ips {
+		if (ip.To4() == nil) == (ips[0].To4() == nil) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	if len(fallbacks) == 0 || d.fallbackDelay < 0 {
+		return d.dialSerial(network, append(primaries, fallbacks...), port)
+	}
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan dialResult, 2)
+	race := func(ips []net.IP, primary bool) {
+		conn, err := d.dialSerial(network, ips, port)
+		results <- dialResult{conn, err, primary}
+	}
+	go race(primaries, true)
+	fallbackTimer := time.NewTimer(d.fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	started, pending := 1, 1
+	var firstErr error
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if started == 1 {
+				started, pending = 2, pending+1
+				go race(fallbacks, false)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the loser is closed whenever it connects
+				if pending > 0 {
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			if firstErr == nil || r.primary {
+				firstErr = r.err
+			}
+			if started == 1 {
+				// the primaries failed before their head start ran out
+				fallbackTimer.Stop()
+				started, pending = 2, pending+1
+				go race(fallbacks, false)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// dialSerial dials the addresses one after another until one connects.
+func (d *resolvingDialer) dialSerial(network string, ips []net.IP, port string) (net.Conn, error) {
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := d.dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
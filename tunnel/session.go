@@ -0,0 +1,202 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session describes a single tunneled connection.
+type Session struct {
+	clientAddr net.Addr
+	localAddr  net.Addr
+	target     string
+	// the target has been picked by the client (or the FTP server) rather than configured
+	routed bool
+	// the user or certificate name the client authenticated as, empty when it didn't
+	identity string
+	// the target picked from a list, nil for a single target
+	backend *backend
+	// proxy the target has been dialed through, empty when dialed directly
+	proxy string
+	// where the SOCKS proxy waits for the target to connect with SOCKS BIND
+	bindAddr string
+	// error the target broke off the connection with
+	targetErr error
+	// when the connection was accepted
+	start time.Time
+	// when the connection to the target was established
+	established time.Time
+	// bytes sent from the client to the target
+	bytesIn atomic.Int64
+	// bytes sent from the target to the client
+	bytesOut atomic.Int64
+	// running copy goroutines
+	copies sync.WaitGroup
+	// last time data has been copied in either direction (UnixNano)
+	lastActivity atomic.Int64
+	// why the connection has been closed, the first reason given wins
+	closeReason string
+	closeOnce   sync.Once
+}
+
+func newSession(accepted net.Conn, target string) *Session {
+	return &Session{
+		clientAddr: accepted.RemoteAddr(),
+		localAddr:  accepted.LocalAddr(),
+		target:     target,
+		start:      time.Now(),
+	}
+}
+
+// ClientAddr is the address of the client the connection has been accepted from.
+func (s *Session) ClientAddr() net.Addr {
+	return s.clientAddr
+}
+
+// LocalAddr is the address the connection has been accepted on.
+func (s *Session) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+// Target is the address the connection is tunneled to.
+func (s *Session) Target() string {
+	return s.target
+}
+
+// Identity is the user of the proxy server or the name in the client
+// certificate the client authenticated with, empty when it didn't.
+func (s *Session) Identity() string {
+	return s.identity
+}
+
+// Proxy is the proxy the target has been dialed through, empty when it has
+// been dialed directly.
+func (s *Session) Proxy() string {
+	return s.proxy
+}
+
+// BindAddr is the address the SOCKS proxy accepts the connection of the
+// target on with SOCKS BIND, for the target to be told where to connect.
+// It is empty without SOCKS BIND.
+func (s *Session) BindAddr() string {
+	return s.bindAddr
+}
+
+// Start is when the connection has been accepted.
+func (s *Session) Start() time.Time {
+	return s.start
+}
+
+// Established is when the connection to the target has been established,
+// zero if it hasn't (yet).
+func (s *Session) Established() time.Time {
+	return s.established
+}
+
+// BytesIn is the number of bytes sent from the client to the target so far.
+func (s *Session) BytesIn() int64 {
+	return s.bytesIn.Load()
+}
+
+// BytesOut is the number of bytes sent from the target to the client so far.
+func (s *Session) BytesOut() int64 {
+	return s.bytesOut.Load()
+}
+
+// Duration is how long the connection has been open.
+func (s *Session) Duration() time.Duration {
+	return time.Since(s.start)
+}
+
+// DialDuration is how long it took to establish the connection to the target.
+func (s *Session) DialDuration() time.Duration {
+	if s.established.IsZero() {
+		return 0
+	}
+	return s.established.Sub(s.start)
+}
+
+// CloseReason tells why the connection has been closed, as in "client
+// closed", "target closed", "shutdown" or "dial failed". It is final once
+// OnClose or OnDialError is called.
+func (s *Session) CloseReason() string {
+	return s.closeReason
+}
+
+// setCloseReason records why the connection is being closed, unless a
+// reason has been given already.
+func (s *Session) setCloseReason(reason string) {
+	if reason == "" {
+		return
+	}
+	s.closeOnce.Do(func() { s.closeReason = reason })
+}
+
+func (c *client) track(s *Session) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	c.sessions[s] = struct{}{}
+}
+
+func (c *client) untrack(s *Session) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	delete(c.sessions, s)
+}
+
+// activeSessions returns the connections being tunneled, oldest first.
+func (c *client) activeSessions() []*Session {
+	c.sessionsMu.Lock()
+	sessions := make([]*Session, 0, len(c.sessions))
+	for s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	c.sessionsMu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].start.Before(sessions[j].start)
+	})
+	return sessions
+}
+
+// countingWriter adds the bytes written through it to written.
+type countingWriter struct {
+	io.Writer
+	written *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.written.Add(int64(n))
+	return n, err
+}
+
+// touch records progress of the copy loops.
+func (s *Session) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idleSince returns when data has last been copied in either direction.
+func (s *Session) idleSince() time.Time {
+	if last := s.lastActivity.Load(); last != 0 {
+		return time.Unix(0, last)
+	}
+	return s.established
+}
@@ -0,0 +1,269 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tlsHandshakeClientHello    = 0x01
+	tlsExtensionServerName     = 0x0000
+	tlsServerNameTypeHostName  = 0x00
+	tlsMaxClientHelloLen       = 64 * 1024
+	sniDefaultHandshakeTimeout = 10 * time.Second
+)
+
+var errNoSNI = errors.New("no server name in ClientHello")
+
+// sniRouter derives the target of a connection from the server name its
+// ClientHello asks for.
+type sniRouter struct {
+	// the server name has to match this completely
+	allow *regexp.Regexp
+	// %sni is replaced by the server name, %1 to %9 by the groups captured by allow
+	template string
+}
+
+func newSNIRouter(allow string, template string) (*sniRouter, error) {
+	if allow == "" {
+		return nil, errors.New("deriving the target from SNI requires an allowlist pattern")
+	}
+	re, err := regexp.Compile("^(?:" + allow + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid SNI allowlist pattern: %w", err)
+	}
+	return &sniRouter{allow: re, template: template}, nil
+}
+
+// target returns the target for serverName, or false if it isn't allowed.
+func (r *sniRouter) target(serverName string) (string, bool) {
+	m := r.allow.FindStringSubmatch(strings.ToLower(serverName))
+	if m == nil {
+		return "", false
+	}
+	replacements := []string{"%sni", m[0]}
+	// higher groups first, so %1 doesn't eat the start of %12
+	for i := len(m) - 1; i >= 1; i-- {
+		replacements = append(replacements, "%"+strconv.Itoa(i), m[i])
+	}
+	return strings.NewReplacer(replacements...).Replace(r.template), true
+}
+
+// routeSNI reads the ClientHello from accepted and sets the session target
+// from its server name. The returned connection replays what has been read.
+func (c *client) routeSNI(accepted net.Conn, s *Session) (net.Conn, bool) {
+	timeout := c.dialTimeout
+	if timeout <= 0 {
+		timeout = sniDefaultHandshakeTimeout
+	}
+	_ = accepted.SetReadDeadline(time.Now().Add(timeout))
+	hello, err := readClientHello(accepted)
+	_ = accepted.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.log.Warnf("could not read ClientHello from %s: %s", accepted.RemoteAddr(), err)
+		c.failed(s.clientAddr)
+		accepted.Close()
+		return nil, false
+	}
+
+	serverName, err := parseSNI(hello)
+	if err != nil {
+		c.log.Warnf("could not route connection from %s: %s", accepted.RemoteAddr(), err)
+		c.failed(s.clientAddr)
+		accepted.Close()
+		return nil, false
+	}
+	target, ok := c.sniRouter.target(serverName)
+	if ok && plainHostPort(target) != nil {
+		// the server name is the client's to pick, schemes and paths included
+		ok = false
+	}
+	if !ok {
+		c.log.Warnf("server name %q requested by %s is not allowed", serverName, accepted.RemoteAddr())
+		c.failed(s.clientAddr)
+		closeConn(accepted, c.closing.deny == CloseRST)
+		return nil, false
+	}
+
+	c.log.Debugf("routing %s with server name %q to %s", accepted.RemoteAddr(), serverName, target)
+	s.target = target
+	s.routed = true
+	return &prefixConn{Conn: accepted, prefix: hello}, true
+}
+
+// readClientHello reads the TLS records carrying the ClientHello handshake
+// message and returns them as read.
+func readClientHello(r io.Reader) ([]byte, error) {
+	var raw, handshake []byte
+	header := make([]byte, tlsRecordHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		if header[0] != tlsRecordTypeHandshake {
+			return nil, errors.New("not a TLS handshake")
+		}
+		length := int(binary.BigEndian.Uint16(header[3:]))
+		if len(raw)+tlsRecordHeaderLen+length > tlsMaxClientHelloLen {
+			return nil, errors.New("ClientHello too large")
+		}
+		record := make([]byte, length)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return nil, err
+		}
+		raw = append(append(raw, header...), record...)
+		handshake = append(handshake, record...)
+
+		// the message may be fragmented over several records
+		if len(handshake) >= 4 {
+			if handshake[0] != tlsHandshakeClientHello {
+				return nil, errors.New("not a ClientHello")
+			}
+			msgLen := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if len(handshake) >= 4+msgLen {
+				return raw, nil
+			}
+		}
+	}
+}
+
+// parseSNI extracts the host name from the server_name extension of a
+// ClientHello, as returned by readClientHello.
+func parseSNI(raw []byte) (string, error) {
+	// strip the record headers
+	var msg []byte
+	for len(raw) >= tlsRecordHeaderLen {
+		length := int(binary.BigEndian.Uint16(raw[3:]))
+		raw = raw[tlsRecordHeaderLen:]
+		if length > len(raw) {
+			return "", errors.New("truncated TLS record")
+		}
+		msg = append(msg, raw[:length]...)
+		raw = raw[length:]
+	}
+
+	p := &byteParser{b: msg}
+	p.skip(4)  // handshake type and length
+	p.skip(2)  // client version
+	p.skip(32) // random
+	p.skip(int(p.uint8()))
+	p.skip(int(p.uint16()))
+	p.skip(int(p.uint8()))
+	if p.err != nil {
+		return "", p.err
+	}
+	if len(p.b) == 0 {
+		return "", errNoSNI
+	}
+
+	extensions := &byteParser{b: p.bytes(int(p.uint16()))}
+	for p.err == nil && extensions.err == nil && len(extensions.b) > 0 {
+		extType := extensions.uint16()
+		data := extensions.bytes(int(extensions.uint16()))
+		if extType != tlsExtensionServerName {
+			continue
+		}
+		ext := &byteParser{b: data}
+		names := &byteParser{b: ext.bytes(int(ext.uint16()))}
+		for ext.err == nil && names.err == nil && len(names.b) > 0 {
+			nameType := names.uint8()
+			name := names.bytes(int(names.uint16()))
+			if nameType == tlsServerNameTypeHostName && names.err == nil {
+				return string(name), nil
+			}
+		}
+		if ext.err != nil {
+			return "", ext.err
+		}
+		if names.err != nil {
+			return "", names.err
+		}
+		return "", errNoSNI
+	}
+	if p.err != nil {
+		return "", p.err
+	}
+	if extensions.err != nil {
+		return "", extensions.err
+	}
+	return "", errNoSNI
+}
+
+var errTruncated = errors.New("truncated ClientHello")
+
+// byteParser reads big endian values off a byte slice, remembering the first error.
+type byteParser struct {
+	b   []byte
+	err error
+}
+
+func (p *byteParser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n > len(p.b) {
+		p.err = errTruncated
+		return nil
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *byteParser) skip(n int) {
+	p.bytes(n)
+}
+
+func (p *byteParser) uint8() uint8 {
+	if b := p.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *byteParser) uint16() uint16 {
+	if b := p.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// prefixConn returns prefix from Read before reading from the connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (p *prefixConn) NetConn() net.Conn {
+	return p.Conn
+}
+
+func (p *prefixConn) Read(b []byte) (int, error) {
+	if len(p.prefix) > 0 {
+		n := copy(b, p.prefix)
+		p.prefix = p.prefix[n:]
+		return n, nil
+	}
+	return p.Conn.Read(b)
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+)
+
+// clientHello builds a ClientHello handshake message with the given extensions.
+func clientHello(extensions ...[]byte) []byte {
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0)          // session id
+	body = append(body, 0, 2, 0, 1) // cipher suites
+	body = append(body, 1, 0)       // compression methods
+	if extensions != nil {
+		all := bytes.Join(extensions, nil)
+		body = append(body, byte(len(all)>>8), byte(len(all)))
+		body = append(body, all...)
+	}
+	msg := []byte{tlsHandshakeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...)
+}
+
+func extension(typ uint16, data []byte) []byte {
+	return append([]byte{byte(typ >> 8), byte(typ), byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+func serverNameExtension(names ...string) []byte {
+	var list []byte
+	for _, name := range names {
+		list = append(list, tlsServerNameTypeHostName, byte(len(name)>>8), byte(len(name)))
+		list = append(list, name...)
+	}
+	return extension(tlsExtensionServerName, append([]byte{byte(len(list) >> 8), byte(len(list))}, list...))
+}
+
+// records splits msg over handshake records of at most size bytes.
+func records(msg []byte, size int) []byte {
+	var raw []byte
+	for len(msg) > 0 {
+		n := size
+		if n > len(msg) {
+			n = len(msg)
+		}
+		raw = append(raw, tlsRecordTypeHandshake, 0x03, 0x01, byte(n>>8), byte(n))
+		raw = append(raw, msg[:n]...)
+		msg = msg[n:]
+	}
+	return raw
+}
+
+func TestParseSNI(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+		err  error
+	}{
+		{"sni", records(clientHello(serverNameExtension("example.com")), 1<<14), "example.com", nil},
+		{"fragmented", records(clientHello(extension(0x000a, []byte{0, 2, 0, 0x1d}), serverNameExtension("example.com")), 7), "example.com", nil},
+		{"after other extensions", records(clientHello(extension(0x000a, []byte{0, 2, 0, 0x1d}), serverNameExtension("example.com")), 1<<14), "example.com", nil},
+		{"other name types first", records(clientHello(extension(tlsExtensionServerName, []byte{0, 4, 0x01, 0, 1, 'x'})), 1<<14), "", errNoSNI},
+		{"no extensions", records(clientHello(), 1<<14), "", errNoSNI},
+		{"no server name", records(clientHello(extension(0x000a, []byte{0, 2, 0, 0x1d})), 1<<14), "", errNoSNI},
+		{"empty name list", records(clientHello(serverNameExtension()), 1<<14), "", errNoSNI},
+		{"name past extension", records(clientHello(extension(tlsExtensionServerName, []byte{0, 14, 0, 0, 11, 'e'})), 1<<14), "", errTruncated},
+		{"extension past message", records(clientHello(serverNameExtension("example.com"))[:60], 1<<14), "", errTruncated},
+		{"truncated record", records(clientHello(serverNameExtension("example.com")), 1<<14)[:30], "", nil},
+		{"empty", nil, "", errTruncated},
+	}
+	for _, tt := range tests {
+		got, err := parseSNI(tt.raw)
+		switch {
+		case tt.want != "":
+			if err != nil || got != tt.want {
+				t.Errorf("%s: parsed %q, %v, expected %q", tt.name, got, err, tt.want)
+			}
+		case tt.err != nil:
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: parsed %q, %v, expected %v", tt.name, got, err, tt.err)
+			}
+		case err == nil:
+			t.Errorf("%s: parsed %q, expected an error", tt.name, got)
+		}
+	}
+}
+
+func TestReadClientHello(t *testing.T) {
+	msg := clientHello(serverNameExtension("example.com"))
+	tests := []struct {
+		name string
+		raw  []byte
+		ok   bool
+	}{
+		{"single record", records(msg, 1<<14), true},
+		{"fragmented", records(msg, 7), true},
+		{"truncated header", records(msg, 1<<14)[:3], false},
+		{"truncated record", records(msg, 1<<14)[:30], false},
+		{"truncated message", records(msg, 7)[:48], false},
+		{"not a handshake", append([]byte{0x17}, records(msg, 1<<14)[1:]...), false},
+		{"not a ClientHello", records(append([]byte{0x02}, msg[1:]...), 1<<14), false},
+		{"too large", records(append([]byte{tlsHandshakeClientHello, 0x01, 0, 0}, make([]byte, tlsMaxClientHelloLen)...), 1<<14), false},
+		{"plain text", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), false},
+	}
+	for _, tt := range tests {
+		raw, err := readClientHello(bytes.NewReader(append(tt.raw, "rest"...)))
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: read %d bytes, expected an error", tt.name, len(raw))
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(raw, tt.raw) {
+			t.Errorf("%s: read %d bytes, %v, expected %d", tt.name, len(raw), err, len(tt.raw))
+		}
+	}
+}
+
+func TestReadClientHelloFromTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "Example.COM", InsecureSkipVerify: true}).Handshake()
+	}()
+	defer client.Close()
+
+	raw, err := readClientHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := parseSNI(raw); err != nil || got != "Example.COM" {
+		t.Errorf("parsed %q, %v, expected %q", got, err, "Example.COM")
+	}
+}
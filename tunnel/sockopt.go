@@ -0,0 +1,74 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+import "golang.org/x/net/proxy"
+
+// keepAliveConfig fine-tunes TCP keep-alive probes beyond the single period
+// the standard library sets. Zero values leave the respective setting alone.
+type keepAliveConfig struct {
+	// idle time before the first probe (TCP_KEEPIDLE)
+	idle time.Duration
+	// time between probes (TCP_KEEPINTVL)
+	interval time.Duration
+	// unanswered probes before the connection is dropped (TCP_KEEPCNT)
+	count int
+}
+
+func (k keepAliveConfig) isSet() bool {
+	return k.idle > 0 || k.interval > 0 || k.count > 0
+}
+
+// tuneConn applies the configured socket options to a tunneled connection,
+// either accepted or dialed.
+func (c *client) tuneConn(conn net.Conn) error {
+	tcpConn, ok := underlyingConn(conn).(*net.TCPConn)
+	if !ok || !c.keepAlive.isSet() {
+		return nil
+	}
+	if err := setKeepAlive(tcpConn, c.keepAlive); err != nil {
+		return fmt.Errorf("could not set keep-alive options: %w", err)
+	}
+	return nil
+}
+
+// listenConfig returns the configuration for opening tunneled listening sockets.
+func (c *client) listenConfig() *net.ListenConfig {
+	return &net.ListenConfig{Control: mssControl(c.mss)}
+}
+
+// tunedDialer applies the socket options to the connections it dials.
+type tunedDialer struct {
+	c      *client
+	dialer proxy.Dialer
+}
+
+func (d *tunedDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.c.tuneConn(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
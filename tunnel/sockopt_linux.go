@@ -0,0 +1,84 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+import "golang.org/x/sys/unix"
+
+func checkSocketOptions(k keepAliveConfig, mss int) error {
+	return nil
+}
+
+// mssControl returns a Control function for net.Dialer and net.ListenConfig
+// setting TCP_MAXSEG before connecting or listening, so the clamped MSS is
+// advertised in the SYN (or inherited by accepted connections for the SYN-ACK).
+func mssControl(mss int) func(network, address string, raw syscall.RawConn) error {
+	if mss <= 0 {
+		return nil
+	}
+	return func(network, address string, raw syscall.RawConn) error {
+		var sockErr error
+		err := raw.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG, mss)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("could not set MSS: %w", sockErr)
+		}
+		return nil
+	}
+}
+
+func setKeepAlive(conn *net.TCPConn, k keepAliveConfig) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// the kernel takes whole seconds
+		seconds := func(d time.Duration) int {
+			s := int((d + time.Second - 1) / time.Second)
+			if s < 1 {
+				s = 1
+			}
+			return s
+		}
+		if sockErr == nil && k.idle > 0 {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, seconds(k.idle))
+		}
+		if sockErr == nil && k.interval > 0 {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, seconds(k.interval))
+		}
+		if sockErr == nil && k.count > 0 {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT, k.count)
+		}
+		if sockErr == nil {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
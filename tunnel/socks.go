@@ -0,0 +1,285 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5 protocol constants (RFC 1928 and RFC 1929)
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5PasswordVersion = 0x01
+
+	socks5CmdConnect = 0x01
+	socks5CmdBind    = 0x02
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded = 0x00
+)
+
+var socks5ReplyErrors = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Handshake negotiates the authentication method with a SOCKS5 server,
+// using the credentials from the proxy URL if there are any.
+func socks5Handshake(conn net.Conn, user *url.Userinfo) error {
+	methods := []byte{socks5AuthNone}
+	if user != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	req := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if user == nil {
+			return errors.New("SOCKS server requires authentication")
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("SOCKS username or password too long")
+		}
+		req = []byte{socks5PasswordVersion, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS authentication failed")
+		}
+		return nil
+	default:
+		return errors.New("no acceptable SOCKS authentication method")
+	}
+}
+
+// socks5Request sends a command for addr. The reply has to be read with readSocks5Reply.
+func socks5Request(conn net.Conn, cmd byte, addr string) error {
+	req := []byte{socks5Version, cmd, 0}
+	req, err := appendSocks5Addr(req, addr)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(req)
+	return err
+}
+
+// readSocks5Reply reads a command reply and returns the address it carries.
+func readSocks5Reply(conn net.Conn) (string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version %d", header[0])
+	}
+	if header[1] != socks5ReplySucceeded {
+		if msg, ok := socks5ReplyErrors[header[1]]; ok {
+			return "", errors.New(msg)
+		}
+		return "", fmt.Errorf("unknown SOCKS error %d", header[1])
+	}
+	return readSocks5Addr(conn)
+}
+
+func appendSocks5Addr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AddrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AddrIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+func readSocks5Addr(r io.Reader) (string, error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch addrType[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if addrType[0] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unknown SOCKS address type %d", addrType[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// handleBind asks the SOCKS5 proxy to accept a connection from the target on
+// our behalf and tunnels it to the accepted local connection, calling
+// releaseSlot once done.
+func (c *client) handleBind(accepted net.Conn, s *Session, releaseSlot func()) {
+	defer c.wg.Done()
+	defer c.conns.Done()
+	defer releaseSlot()
+	defer c.recoverPanic(s, accepted)
+
+	releaseIPSlot, ok := c.acquireIPSlot(accepted, s.clientAddr)
+	if !ok {
+		return
+	}
+	defer releaseIPSlot()
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: c.dialTimeout, FallbackDelay: netnsFallbackDelay(c.dialNetns, c.fallbackDelay)}
+	err := inNetns(c.dialNetns, func() (err error) {
+		conn, err = dialer.Dial("tcp", c.proxyURL.Host)
+		return err
+	})
+	if err != nil {
+		c.log.Errorf("error dialing SOCKS proxy: %s", err)
+		c.dialFailed(s, err)
+		accepted.Close()
+		return
+	}
+
+	// unblock the handshake when stopping
+	bindDone := make(chan struct{})
+	go func() {
+		select {
+		case <-c.done:
+			conn.Close()
+		case <-bindDone:
+		}
+	}()
+
+	bound, err := c.requestBind(conn, s.target)
+	if err == nil {
+		c.log.Infof("SOCKS proxy accepting inbound connection for %s on %s", accepted.RemoteAddr(), bound)
+		s.bindAddr = bound
+		c.events.bind(s)
+		c.runHook(hookBind, s)
+		var peer string
+		if peer, err = readSocks5Reply(conn); err == nil {
+			c.log.Infof("inbound connection from %s accepted by SOCKS proxy", peer)
+		}
+	}
+	close(bindDone)
+	if err != nil {
+		c.log.Errorf("SOCKS BIND failed: %s", err)
+		c.dialFailed(s, err)
+		conn.Close()
+		accepted.Close()
+		return
+	}
+
+	c.wg.Add(1)
+	c.handleConn(accepted, conn, s)
+}
+
+// requestBind asks the proxy on conn to accept a connection from target,
+// returning the address it accepts it on.
+func (c *client) requestBind(conn net.Conn, target string) (string, error) {
+	if err := socks5Handshake(conn, c.proxyURL.User); err != nil {
+		return "", err
+	}
+	if err := socks5Request(conn, socks5CmdBind, target); err != nil {
+		return "", err
+	}
+	bound, err := readSocks5Reply(conn)
+	if err != nil {
+		return "", err
+	}
+	// servers answering 0.0.0.0 listen on the address they were reached at
+	if host, port, err := net.SplitHostPort(bound); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			bound = net.JoinHostPort(c.proxyURL.Hostname(), port)
+		}
+	}
+	return bound, nil
+}
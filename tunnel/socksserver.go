@@ -0,0 +1,159 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+const (
+	socks5ReplyFailure        = 0x01
+	socks5ReplyNotAllowed     = 0x02
+	socks5ReplyNetUnreachable = 0x03
+	socks5ReplyHostUnreach    = 0x04
+	socks5ReplyRefused        = 0x05
+	socks5ReplyBadCommand     = 0x07
+)
+
+// socks5Serve runs the server side of the SOCKS5 handshake on conn up to
+// the CONNECT request and returns the requested address. Other commands are
+// refused.
+func (c *client) socks5Serve(conn net.Conn, s *Session) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socks5AuthNone)
+	if c.proxyServerUsers != nil {
+		method = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return "", errors.New("no acceptable SOCKS authentication method offered")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5AuthPassword {
+		if err := c.socks5Login(conn, s); err != nil {
+			return "", err
+		}
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version %d", request[0])
+	}
+	addr, err := readSocks5Addr(conn)
+	if err != nil {
+		_ = socks5Reply(conn, socks5ReplyFailure, nil)
+		return "", err
+	}
+	if request[1] != socks5CmdConnect {
+		_ = socks5Reply(conn, socks5ReplyBadCommand, nil)
+		return "", fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+	return addr, nil
+}
+
+// socks5Login checks the user name and password sent by the client (RFC 1929),
+// taking the user as the identity of s.
+func (c *client) socks5Login(conn net.Conn, s *Session) error {
+	readField := func() (string, error) {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		field := make([]byte, length[0])
+		_, err := io.ReadFull(conn, field)
+		return string(field), err
+	}
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return err
+	}
+	if version[0] != socks5PasswordVersion {
+		return fmt.Errorf("unexpected SOCKS authentication version %d", version[0])
+	}
+	user, err := readField()
+	if err != nil {
+		return err
+	}
+	password, err := readField()
+	if err != nil {
+		return err
+	}
+	if !c.proxyServerUsers.valid(user, password) {
+		_, _ = conn.Write([]byte{socks5PasswordVersion, 1})
+		return fmt.Errorf("SOCKS authentication failed for user %q", user)
+	}
+	s.identity = user
+	_, err = conn.Write([]byte{socks5PasswordVersion, 0})
+	return err
+}
+
+// socks5Reply answers the CONNECT request with code and the local address
+// of the connection to the target, if there is one.
+func socks5Reply(conn net.Conn, code byte, bound net.Addr) error {
+	addr := "0.0.0.0:0"
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		addr = tcpAddr.String()
+	}
+	reply, err := appendSocks5Addr([]byte{socks5Version, code, 0}, addr)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(reply)
+	return err
+}
+
+// socks5ReplyCode tells the client why the target could not be dialed.
+func socks5ReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, errIdentityLimit), errors.Is(err, errTargetNotAllowed):
+		return socks5ReplyNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ReplyRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5ReplyNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5ReplyHostUnreach
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5ReplyHostUnreach
+	}
+	return socks5ReplyFailure
+}
@@ -0,0 +1,238 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// how often a quiet SSH connection is checked to be alive
+	sshKeepAliveInterval = 30 * time.Second
+	// pause before reconnecting to an SSH server that could not be reached
+	sshRedialDelay = time.Second
+)
+
+// sshConfig tells how to authenticate to ssh:// proxies and verify them.
+type sshConfig struct {
+	// private key file, tried along with the keys of a running ssh-agent
+	keyFile string
+	// known_hosts file the server keys are verified with, ~/.ssh/known_hosts by default
+	knownHosts string
+}
+
+// newSSHClientConfig builds the client configuration for logging in to the
+// SSH server of proxyURL: with the password in the URL, the key file, or the
+// keys of the ssh-agent listening on $SSH_AUTH_SOCK.
+func newSSHClientConfig(proxyURL *url.URL, cfg sshConfig, timeout time.Duration) (*ssh.ClientConfig, error) {
+	if proxyURL.User == nil || proxyURL.User.Username() == "" {
+		return nil, errors.New("ssh:// proxies need a user name")
+	}
+
+	knownHostsFile := cfg.knownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("no known_hosts file to verify the SSH server with: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load known hosts: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if password, ok := proxyURL.User.Password(); ok {
+		auth = append(auth, ssh.Password(password))
+	}
+	var signers []ssh.Signer
+	if cfg.keyFile != "" {
+		pem, err := os.ReadFile(cfg.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse SSH key %s: %w", cfg.keyFile, err)
+		}
+		signers = append(signers, signer)
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		// the agent is asked on every login, so it may be started later on
+		auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				return signers, nil
+			}
+			defer conn.Close()
+			agentSigners, err := agent.NewClient(conn).Signers()
+			if err != nil {
+				return signers, nil
+			}
+			return append(signers, agentSigners...), nil
+		}))
+	} else if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("no SSH authentication method: set a password in the URL, a key file or run ssh-agent")
+	}
+
+	return &ssh.ClientConfig{
+		User:            proxyURL.User.Username(),
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	}, nil
+}
+
+// sshDialer dials targets through a single SSH connection, reconnecting when
+// it drops.
+type sshDialer struct {
+	addr    string
+	config  *ssh.ClientConfig
+	forward proxy.Dialer
+	log     logrus.FieldLogger
+	mu      sync.Mutex
+	client  *ssh.Client
+	// closed once client is gone
+	closed chan struct{}
+	failed time.Time
+}
+
+func newSSHDialer(proxyURL *url.URL, forward proxy.Dialer, cfg sshConfig, timeout time.Duration, log logrus.FieldLogger) (*sshDialer, error) {
+	config, err := newSSHClientConfig(proxyURL, cfg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	addr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		addr = net.JoinHostPort(proxyURL.Hostname(), "22")
+	}
+	return &sshDialer{addr: addr, config: config, forward: forward, log: log}, nil
+}
+
+// connection returns the SSH connection along with a channel closed once it
+// drops, logging in again if there is none or the previous one dropped.
+func (d *sshDialer) connection() (*ssh.Client, chan struct{}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		select {
+		case <-d.closed:
+		default:
+			return d.client, d.closed, nil
+		}
+	}
+	if wait := sshRedialDelay - time.Since(d.failed); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	conn, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		d.failed = time.Now()
+		return nil, nil, err
+	}
+	if d.config.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(d.config.Timeout))
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, d.addr, d.config)
+	if err != nil {
+		conn.Close()
+		d.failed = time.Now()
+		return nil, nil, fmt.Errorf("could not log in to %s: %w", d.addr, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(sshConn, chans, reqs)
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+	go sshKeepAlive(client, closed)
+	d.client, d.closed = client, closed
+	d.log.Infof("logged in to SSH server %s as %s", d.addr, d.config.User)
+	return client, closed, nil
+}
+
+// sshKeepAlive closes client once it stops answering, so a dropped
+// connection gets noticed before the next dial.
+func sshKeepAlive(client *ssh.Client, closed chan struct{}) {
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case <-reply:
+			// servers refusing the request are alive all the same
+		case <-time.After(sshKeepAliveInterval):
+			client.Close()
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (d *sshDialer) Dial(network, addr string) (net.Conn, error) {
+	client, closed, err := d.connection()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial(network, addr)
+	if err != nil {
+		select {
+		case <-closed:
+			// the connection dropped since it has been handed out, log in again
+			d.log.Warnf("SSH connection to %s dropped, reconnecting", d.addr)
+			if client, _, err = d.connection(); err != nil {
+				return nil, err
+			}
+			conn, err = client.Dial(network, addr)
+		default:
+		}
+	}
+	// the server refusing to open the channel is about the target
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		return nil, &targetError{err: err}
+	}
+	return conn, err
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stallConfig bounds how long the copy loops wait for progress. Zero values
+// disable the respective deadline.
+type stallConfig struct {
+	// no data has been copied in either direction for this long
+	read time.Duration
+	// a write hasn't been able to complete for this long
+	write time.Duration
+}
+
+func (st stallConfig) isSet() bool {
+	return st.read > 0 || st.write > 0
+}
+
+// stallCopy copies from src to dst like io.Copy, refreshing the deadlines on
+// progress so a peer vanishing without FIN or RST gets the connection torn
+// down instead of leaking it.
+func (c *client) stallCopy(dst, src net.Conn, s *Session, written *atomic.Int64) error {
+	buf := make([]byte, 32*1024)
+	for {
+		if c.stall.read > 0 {
+			_ = src.SetReadDeadline(s.idleSince().Add(c.stall.read))
+		}
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			if c.stall.write > 0 {
+				_ = dst.SetWriteDeadline(time.Now().Add(c.stall.write))
+			}
+			nw, werr := dst.Write(buf[:nr])
+			written.Add(int64(nw))
+			s.touch()
+			if werr != nil {
+				if errors.Is(werr, os.ErrDeadlineExceeded) {
+					c.log.Warnf("connection from %s to %s stalled: no write progress for %s",
+						s.clientAddr, s.target, c.stall.write)
+					s.setCloseReason("stalled")
+					return nil
+				}
+				return werr
+			}
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// the other direction might have made progress in the meantime
+			if time.Since(s.idleSince()) < c.stall.read {
+				continue
+			}
+			c.log.Warnf("connection from %s to %s stalled: no data for %s",
+				s.clientAddr, s.target, c.stall.read)
+			s.setCloseReason("stalled")
+			return nil
+		}
+		if errors.Is(err, errDataCap) {
+			return err
+		}
+		if err != nil {
+			// EOF and read errors end the copy silently, like io.Copy
+			return nil
+		}
+	}
+}
+
+// chanDeadline is the read deadline of a connection whose reads wait on
+// channels rather than on a socket, so the stall deadlines work for it too.
+type chanDeadline struct {
+	mu sync.Mutex
+	t  time.Time
+	// closed when t changes, waking a read waiting for data
+	changed chan struct{}
+}
+
+func (d *chanDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+	}
+	d.changed = make(chan struct{})
+}
+
+// wait returns what a read selects on besides its data: a channel firing
+// at the deadline and one closed when it changes, along with the func
+// releasing the timer. It returns os.ErrDeadlineExceeded if the deadline
+// has passed already.
+func (d *chanDeadline) wait() (<-chan time.Time, <-chan struct{}, func() bool, error) {
+	d.mu.Lock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	deadline, changed := d.t, d.changed
+	d.mu.Unlock()
+
+	if deadline.IsZero() {
+		return nil, changed, func() bool { return false }, nil
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return nil, nil, nil, os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(wait)
+	return timer.C, changed, timer.Stop, nil
+}
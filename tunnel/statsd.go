@@ -0,0 +1,136 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+import (
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	DefaultStatsDInterval = 10 * time.Second
+
+	// keeps datagrams within the MTU of most paths
+	statsDMaxPacket = 1432
+)
+
+// SendStatsD emits the counters and gauges of m to the StatsD server at addr
+// every interval until ctx is done, counters as the increments since the
+// previous emission. The labels go along as DogStatsD tags, so Datadog's
+// agent and others understanding them keep the tunnels and targets apart.
+func (m *Metrics) SendStatsD(ctx context.Context, addr string, interval time.Duration) error {
+	if interval <= 0 {
+		interval = DefaultStatsDInterval
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	last := make(map[string]float64)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		lines, err := m.statsDLines(last)
+		if err != nil {
+			log.Warnf("could not gather metrics for StatsD: %s", err)
+			continue
+		}
+		for _, packet := range statsDPackets(lines) {
+			// a server that isn't listening (yet) shows up as an error on the next write
+			if _, err = conn.Write(packet); err != nil {
+				log.Debugf("could not send metrics to StatsD at %s: %s", addr, err)
+			}
+		}
+	}
+}
+
+// statsDLines renders the tunnel metrics as StatsD lines, remembering the
+// counter values in last to send the increments from.
+func (m *Metrics) statsDLines(last map[string]float64) ([]string, error) {
+	families, err := m.registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "tcptunnel_") {
+			continue
+		}
+		name := "tcptunnel." + strings.TrimSuffix(strings.TrimPrefix(family.GetName(), "tcptunnel_"), "_total")
+		for _, metric := range family.GetMetric() {
+			tags := statsDTags(metric.GetLabel())
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				key := name + tags
+				value := metric.GetCounter().GetValue()
+				delta := value - last[key]
+				last[key] = value
+				if delta > 0 {
+					lines = append(lines, fmt.Sprintf("%s:%g|c%s", name, delta, tags))
+				}
+			case dto.MetricType_GAUGE:
+				lines = append(lines, fmt.Sprintf("%s:%g|g%s", name, metric.GetGauge().GetValue(), tags))
+			}
+		}
+	}
+	return lines, nil
+}
+
+func statsDTags(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(labels))
+	for _, label := range labels {
+		// ':' and ',' delimit the tags, '|' the fields
+		value := strings.NewReplacer(",", "_", "|", "_").Replace(label.GetValue())
+		tags = append(tags, label.GetName()+":"+value)
+	}
+	return "|#" + strings.Join(tags, ",")
+}
+
+// statsDPackets packs lines into as few datagrams as fit them.
+func statsDPackets(lines []string) [][]byte {
+	var packets [][]byte
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsDMaxPacket {
+			packets = append(packets, append([]byte(nil), packet.Bytes()...))
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		packets = append(packets, packet.Bytes())
+	}
+	return packets
+}
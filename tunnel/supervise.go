@@ -0,0 +1,73 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"net"
+	"runtime/debug"
+	"time"
+)
+
+// how long a panicked accept loop waits before it is restarted
+const serveRestartDelay = time.Second
+
+// recoverPanic recovers a panic of a connection goroutine and logs it with
+// the session, so a single bad connection only takes itself down. It has
+// to be deferred directly.
+func (c *client) recoverPanic(s *Session, conns ...net.Conn) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	c.panics.Add(1)
+	c.log.WithField("stack", string(debug.Stack())).Errorf(
+		"recovered from panic in connection from %s to %s: %v", s.clientAddr, s.target, r)
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// superviseServe runs the accept loop of listener, restarting it when it
+// panics instead of bringing every tunnel of the process down.
+func (c *client) superviseServe(listener net.Listener, target string) {
+	accept := listener.Accept
+	if c.acceptQueue > 0 {
+		accept = c.queueAccepts(listener)
+	}
+	for c.serveRecovered(listener, accept, target) {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(serveRestartDelay):
+			c.log.Warnf("restarting accept loop on %s", listener.Addr())
+		}
+	}
+}
+
+// serveRecovered runs the accept loop and reports whether it panicked.
+func (c *client) serveRecovered(listener net.Listener, accept func() (net.Conn, error), target string) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.panics.Add(1)
+			c.log.WithField("stack", string(debug.Stack())).Errorf(
+				"recovered from panic in accept loop on %s: %v", listener.Addr(), r)
+			panicked = true
+		}
+	}()
+	_ = c.serve(accept, target)
+	return false
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"net"
+	"time"
+)
+
+import (
+	"golang.org/x/time/rate"
+)
+
+// most bytes read before waiting for the bandwidth limit, the copy buffer size
+const maxThrottleBurst = 32 * 1024
+
+// newBandwidthLimiter holds a copy direction to bytesPerSec, nil when zero.
+func newBandwidthLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := maxThrottleBurst
+	if bytesPerSec < int64(burst) {
+		burst = int(bytesPerSec)
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// throttledConn is a net.Conn whose reads are held to the rate of all its
+// limiters.
+type throttledConn struct {
+	net.Conn
+	limiters []*rate.Limiter
+	// give up waiting, the connection is being torn down
+	stop, done <-chan struct{}
+}
+
+// throttle wraps conn in a throttledConn for whichever of limiters are set,
+// returning conn itself when none is.
+func (c *client) throttle(conn net.Conn, stop <-chan struct{}, limiters ...*rate.Limiter) net.Conn {
+	t := &throttledConn{Conn: conn, stop: stop, done: c.done}
+	for _, l := range limiters {
+		if l != nil {
+			t.limiters = append(t.limiters, l)
+		}
+	}
+	if len(t.limiters) == 0 {
+		return conn
+	}
+	return t
+}
+
+func (t *throttledConn) Read(p []byte) (int, error) {
+	for _, l := range t.limiters {
+		if len(p) > l.Burst() {
+			p = p[:l.Burst()]
+		}
+	}
+	n, err := t.Conn.Read(p)
+	if n > 0 {
+		t.wait(n)
+	}
+	return n, err
+}
+
+// wait takes n tokens from every limiter, sleeping until the slowest of
+// them has them.
+func (t *throttledConn) wait(n int) {
+	now := time.Now()
+	var delay time.Duration
+	for _, l := range t.limiters {
+		if d := l.ReserveN(now, n).DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-t.stop:
+	case <-t.done:
+	}
+}
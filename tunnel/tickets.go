@@ -0,0 +1,151 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+import "github.com/sirupsen/logrus"
+
+// ticketKeys replaces the session ticket keys of the TLS listeners. Without
+// a file, a new key is generated on every rotation and only the one before
+// it is kept to decrypt tickets issued earlier, so a leaked key exposes two
+// intervals of sessions at most. With a file, the keys are taken from it,
+// letting instances behind the same load balancer resume each other's
+// sessions; whatever writes the file rotates them.
+type ticketKeys struct {
+	config *tls.Config
+	// hex encoded 32 byte keys, one per line and the first one encrypting; generated when empty
+	file string
+	log  logrus.FieldLogger
+
+	mu sync.Mutex
+	// the generated key in use, zero before the first rotation
+	current [32]byte
+	// of file when it was last read
+	modTime time.Time
+}
+
+func newTicketKeys(config *tls.Config, file string, log logrus.FieldLogger) (*ticketKeys, error) {
+	k := &ticketKeys{config: config, file: file, log: log}
+	if file != "" {
+		return k, k.load(true)
+	}
+	return k, k.rotate()
+}
+
+// rotate makes a new key the one encrypting, keeping the one before.
+func (k *ticketKeys) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := [][32]byte{key}
+	if k.current != [32]byte{} {
+		keys = append(keys, k.current)
+	}
+	k.current = key
+	k.config.SetSessionTicketKeys(keys)
+	return nil
+}
+
+// load reads the keys in the file if force is set or it changed since it was
+// last read, keeping the keys read before when it can't be.
+func (k *ticketKeys) load(force bool) error {
+	info, err := os.Stat(k.file)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !force && info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(k.file)
+	if err != nil {
+		return err
+	}
+	keys, err := parseTicketKeys(data)
+	if err != nil {
+		return fmt.Errorf("invalid session ticket keys in %s: %w", k.file, err)
+	}
+	reloaded := !k.modTime.IsZero()
+	k.config.SetSessionTicketKeys(keys)
+	k.modTime = info.ModTime()
+	if reloaded {
+		k.log.Infof("reloaded %d session ticket keys from %s", len(keys), k.file)
+	}
+	return nil
+}
+
+// parseTicketKeys parses hex encoded 32 byte keys, one per line. Blank lines
+// and lines starting with # are skipped.
+func parseTicketKeys(data []byte) ([][32]byte, error) {
+	var keys [][32]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(text)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("line %d: not 64 hex digits", line)
+		}
+		var key [32]byte
+		copy(key[:], raw)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	return keys, nil
+}
+
+// run rotates the keys, or checks the file for changes, every interval until
+// done is closed.
+func (k *ticketKeys) run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var err error
+			if k.file != "" {
+				err = k.load(false)
+			} else {
+				err = k.rotate()
+			}
+			if err != nil {
+				k.log.Warnf("could not rotate session ticket keys, keeping the ones in use: %s", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
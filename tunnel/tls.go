@@ -0,0 +1,272 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// how long a client gets to complete the TLS handshake of a terminated connection
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsVersions maps the names of the supported minimum TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsServerConfig tells how TLS is terminated on the listening side.
+type tlsServerConfig struct {
+	certFile   string
+	keyFile    string
+	minVersion string
+	// CA certificates client certificates are required to be signed by,
+	// client certificates aren't asked for when empty
+	clientCA string
+	// how often the files are checked for changes, never when zero
+	reload time.Duration
+	// how often the session ticket keys are replaced, or the file holding
+	// them checked for changes; left to crypto/tls when both are empty
+	ticketRotate time.Duration
+	ticketKeys   string
+}
+
+func (t tlsServerConfig) enabled() bool {
+	return t.certFile != "" || t.keyFile != ""
+}
+
+// tlsClientConfig tells how connections to the target are wrapped in TLS.
+type tlsClientConfig struct {
+	enabled bool
+	// CA certificates to verify the target with instead of the system ones
+	ca string
+	// client certificate and key presented to the target, if any
+	certFile string
+	keyFile  string
+	// server name sent and verified instead of the target's host
+	serverName string
+	// skip verifying the target's certificate
+	insecure bool
+}
+
+// loadCertPool reads the PEM encoded certificates in file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// newTLSServerConfig builds the configuration terminating TLS on the listeners.
+func (c *client) newTLSServerConfig() (*tls.Config, error) {
+	if c.tlsServer.certFile == "" || c.tlsServer.keyFile == "" {
+		return nil, configError(errors.New("TLS termination needs both a certificate and a key"))
+	}
+	minVersion, ok := tlsVersions[c.tlsServer.minVersion]
+	if !ok {
+		return nil, configError(fmt.Errorf("unknown TLS version %q (1.0, 1.1, 1.2 or 1.3)", c.tlsServer.minVersion))
+	}
+	config := &tls.Config{
+		MinVersion:   minVersion,
+		KeyLogWriter: c.keyLog,
+	}
+	certs, err := newCertReloader(c.tlsServer, config, c.log)
+	if err != nil {
+		return nil, preflightError(err)
+	}
+	c.certs.Store(certs)
+	if c.tlsServer.ticketRotate > 0 || c.tlsServer.ticketKeys != "" {
+		tickets, err := newTicketKeys(config, c.tlsServer.ticketKeys, c.log)
+		if err != nil {
+			return nil, preflightError(fmt.Errorf("could not set session ticket keys: %w", err))
+		}
+		c.tickets.Store(tickets)
+	}
+	return config, nil
+}
+
+// reloadTLS reads the certificate, key, client CA and session ticket keys of
+// the TLS listeners again.
+func (c *client) reloadTLS() error {
+	if certs := c.certs.Load(); certs != nil {
+		if err := certs.load(true); err != nil {
+			return err
+		}
+	}
+	if tickets := c.tickets.Load(); tickets != nil && tickets.file != "" {
+		return tickets.load(true)
+	}
+	return nil
+}
+
+// handshakeTLS completes the handshake of a terminated connection, so clients
+// failing it don't get the target dialed for them.
+func (c *client) handshakeTLS(conn *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	return conn.HandshakeContext(ctx)
+}
+
+// handshakingListener completes the TLS handshakes of the connections it
+// accepts before handing them on, for the HTTP server of wss:// listeners,
+// which would only log a failed one. Clients failing it count towards a
+// ban like on any TLS listener, and banned ones don't get to try.
+type handshakingListener struct {
+	net.Listener
+	c        *client
+	config   *tls.Config
+	accepted chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	err      error
+}
+
+func newHandshakingListener(c *client, listener net.Listener, config *tls.Config) *handshakingListener {
+	l := &handshakingListener{
+		Listener: listener,
+		c:        c,
+		config:   config,
+		accepted: make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *handshakingListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			l.Close()
+			return
+		}
+		if l.c.banned(conn.RemoteAddr()) {
+			closeConn(conn, l.c.closing.deny == CloseRST)
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *handshakingListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+	if err := l.c.handshakeTLS(tlsConn); err != nil {
+		l.c.log.Warnf("TLS handshake with %s failed: %s", conn.RemoteAddr(), err)
+		l.c.failed(conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	select {
+	case l.accepted <- tlsConn:
+	case <-l.done:
+		tlsConn.Close()
+	}
+}
+
+func (l *handshakingListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.err != nil && !errors.Is(l.err, net.ErrClosed) {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *handshakingListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.Listener.Close()
+	})
+	return nil
+}
+
+// newTLSClientConfig builds the configuration wrapping connections to the
+// target in TLS.
+func (c *client) newTLSClientConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.tlsClient.serverName,
+		InsecureSkipVerify: c.tlsClient.insecure,
+		KeyLogWriter:       c.keyLog,
+	}
+	if c.tlsClient.ca != "" {
+		pool, err := loadCertPool(c.tlsClient.ca)
+		if err != nil {
+			return nil, preflightError(fmt.Errorf("could not load target CA: %w", err))
+		}
+		config.RootCAs = pool
+	}
+	if c.tlsClient.certFile != "" || c.tlsClient.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.tlsClient.certFile, c.tlsClient.keyFile)
+		if err != nil {
+			return nil, preflightError(fmt.Errorf("could not load client certificate: %w", err))
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if config.InsecureSkipVerify {
+		c.log.Warnf("not verifying the certificate of the target")
+	}
+	return config, nil
+}
+
+// originateTLS wraps conn, dialed to target, in TLS. The server name defaults
+// to the host of target.
+func (c *client) originateTLS(conn net.Conn, target string) (net.Conn, error) {
+	config := c.targetTLS.Clone()
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(target); err == nil {
+			config.ServerName = host
+		}
+	}
+	if c.tlsFingerprint != "" {
+		tlsConn, err := mimicTLS(conn, config, c.tlsFingerprint)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %s failed: %w", target, err)
+		}
+		return tlsConn, nil
+	}
+	tlsConn := tls.Client(conn, config)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", target, err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+)
+
+// dialTransparent dials the target from the client's own address instead of
+// one of the tunnel host, so the target sees the true client. This needs
+// IP_TRANSPARENT and routing sending the replies back to the tunnel host.
+func (c *client) dialTransparent(s *Session) (net.Conn, error) {
+	clientAddr, ok := s.clientAddr.(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("no client IP address to dial from")
+	}
+	dialer := &net.Dialer{
+		Timeout:   c.dialTimeout,
+		KeepAlive: c.keepAlivePeriod,
+		LocalAddr: &net.TCPAddr{IP: clientAddr.IP, Zone: clientAddr.Zone},
+		Control:   transparentControl(c.mss),
+	}
+	var conn net.Conn
+	err := inNetns(c.dialNetns, func() (err error) {
+		conn, err = dialer.Dial("tcp", s.target)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = c.tuneConn(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
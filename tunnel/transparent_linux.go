@@ -0,0 +1,52 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"fmt"
+	"syscall"
+)
+
+import "golang.org/x/sys/unix"
+
+func checkTransparent() error {
+	return nil
+}
+
+// transparentControl returns a Control function for net.Dialer allowing the
+// socket to bind to a non-local address, also clamping the MSS if asked to.
+func transparentControl(mss int) func(network, address string, raw syscall.RawConn) error {
+	clampMSS := mssControl(mss)
+	return func(network, address string, raw syscall.RawConn) error {
+		level, opt := unix.SOL_IP, unix.IP_TRANSPARENT
+		if network == "tcp6" {
+			level, opt = unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+		}
+		var sockErr error
+		err := raw.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), level, opt, 1)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("could not set IP_TRANSPARENT (CAP_NET_ADMIN is required): %w", sockErr)
+		}
+		if clampMSS != nil {
+			return clampMSS(network, address, raw)
+		}
+		return nil
+	}
+}
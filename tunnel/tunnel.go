@@ -0,0 +1,182 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tunnel forwards TCP connections accepted on a local address to a
+// target, directly or through a chain of proxies. It is the engine behind the
+// tcptunnel command and can be embedded in other programs:
+//
+//	t := tunnel.New("127.0.0.1:8080", "example.com:80",
+//		tunnel.WithProxy("socks5://127.0.0.1:1080"))
+//	go t.Run(ctx)
+//	...
+//	t.Close()
+package tunnel
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import "github.com/sirupsen/logrus"
+
+// log receives the messages of relay servers and of tunnels without a logger
+// of their own.
+var log logrus.FieldLogger = logrus.StandardLogger()
+
+// SetLogger replaces the default logger of the package, the logrus standard
+// logger unless set. Tunnels started afterwards without WithLogger use it.
+func SetLogger(l logrus.FieldLogger) {
+	log = l
+}
+
+// Tunnel listens on one address (or port range) and forwards the accepted
+// connections to its target.
+type Tunnel struct {
+	cfg       clientConfig
+	stop      chan struct{}
+	closeOnce sync.Once
+	drain     chan struct{}
+	// closed once the listeners are, or right away by a Run coming too late
+	unbound chan struct{}
+	// guards running against Drain, so it knows whether there is a Run to wait for
+	mu      sync.Mutex
+	running bool
+	drained bool
+	// set once Run has been called
+	client atomic.Pointer[client]
+}
+
+// New returns a tunnel from listen to target, configured by opts. It does not
+// open any socket until Run is called.
+func New(listen, target string, opts ...Option) *Tunnel {
+	cfg := clientConfig{
+		listenAddress:   listen,
+		targetAddress:   target,
+		balance:         BalanceRoundRobin,
+		proxyResolve:    ProxyResolveRemote,
+		dialTimeout:     10 * time.Second,
+		fallbackDelay:   300 * time.Millisecond,
+		keepAlivePeriod: 30 * time.Second,
+		proxyCooldown:   30 * time.Second,
+		udpTimeout:      DefaultUDPTimeout,
+		tlsServer:       tlsServerConfig{minVersion: "1.2"},
+		ejectAfter:      3,
+		ejectFor:        30 * time.Second,
+		healthCheck:     healthCheckConfig{timeout: 2 * time.Second, threshold: 2},
+		ban:             banConfig{window: 10 * time.Minute, duration: time.Hour},
+		acceptBurst:     1,
+		hooks: hookConfig{
+			concurrency: 4,
+			timeout:     10 * time.Second,
+		},
+		usage: usageConfig{
+			format:   UsageJSON,
+			interval: time.Minute,
+		},
+		closing: closePolicy{
+			shutdown: CloseFIN,
+			limit:    CloseFIN,
+			deny:     CloseFIN,
+		},
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &Tunnel{cfg: cfg, stop: make(chan struct{}), drain: make(chan struct{}), unbound: make(chan struct{})}
+}
+
+// Run opens the listeners and forwards connections until ctx is done or Close
+// is called, then waits for the active connections to drain. It returns nil
+// after a clean stop; otherwise the error is an *Error telling what failed.
+// A tunnel can only be run once, and one drained before doesn't start.
+func (t *Tunnel) Run(ctx context.Context) error {
+	t.mu.Lock()
+	t.running = true
+	drained := t.drained
+	t.mu.Unlock()
+	if drained {
+		close(t.unbound)
+		return nil
+	}
+
+	// stops watching ctx when run fails without Close being called
+	returned := make(chan struct{})
+	defer close(returned)
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.Close()
+		case <-t.stop:
+		case <-returned:
+		}
+	}()
+	c := newClient(t.cfg, t.stop, t.drain, t.unbound)
+	t.client.Store(c)
+	return c.run()
+}
+
+// Started returns when Run has been called, zero if it hasn't (yet).
+func (t *Tunnel) Started() time.Time {
+	if c := t.client.Load(); c != nil {
+		return c.started
+	}
+	return time.Time{}
+}
+
+// Sessions returns the connections being tunneled right now, oldest first.
+func (t *Tunnel) Sessions() []*Session {
+	if c := t.client.Load(); c != nil {
+		return c.activeSessions()
+	}
+	return nil
+}
+
+// ReloadCertificates reads the certificate, key, client CA and session ticket
+// key file of the TLS listeners again, keeping the ones loaded before when it
+// fails. Established connections are left alone.
+func (t *Tunnel) ReloadCertificates() error {
+	if c := t.client.Load(); c != nil {
+		return c.reloadTLS()
+	}
+	return nil
+}
+
+// Drain has a running tunnel stop accepting connections and Run return once
+// those being tunneled have finished, instead of cutting them off like Close
+// does. It returns once the listeners are closed, so another tunnel can
+// listen on the same addresses. Connections carried by the listening socket
+// itself, those of udp:// and mux:// listeners, end along with it. Close
+// still stops the tunnel right away.
+func (t *Tunnel) Drain() {
+	t.mu.Lock()
+	if !t.drained {
+		t.drained = true
+		close(t.drain)
+	}
+	running := t.running
+	t.mu.Unlock()
+	if running {
+		<-t.unbound
+	}
+}
+
+// Close asks a running tunnel to stop. Run returns once it has.
+func (t *Tunnel) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.stop)
+	})
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestDrainBeforeRun(t *testing.T) {
+	tun := New(freeAddr(t), "127.0.0.1:9")
+	drained := make(chan struct{})
+	go func() {
+		tun.Drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("Drain of a tunnel not run waited")
+	}
+	if err := tun.Run(context.Background()); err != nil {
+		t.Fatalf("Run of a drained tunnel returned %v, expected nil", err)
+	}
+	// again, now that Run has been called
+	tun.Drain()
+}
+
+func TestDrainFreesListenAddress(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		addr := freeAddr(t)
+		tun := New(addr, "127.0.0.1:9")
+		done := make(chan error, 1)
+		go func() { done <- tun.Run(context.Background()) }()
+		tun.Drain()
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("could not listen on %s after Drain returned: %v", addr, err)
+		}
+		err = <-done
+		listener.Close()
+		if err != nil {
+			t.Fatalf("drained tunnel returned %v, expected nil", err)
+		}
+	}
+}
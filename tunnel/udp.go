@@ -0,0 +1,380 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+import "github.com/sirupsen/logrus"
+
+// UDP over TCP: a udp:// listener turns the datagrams of each client address
+// into a stream, which is tunneled like any accepted connection to a peer
+// instance. The peer, having a udp:// target, sends every datagram it gets
+// from the stream to the target and frames the replies back. Each datagram is
+// framed as a 2 byte big-endian length followed by the payload.
+const (
+	udpScheme = "udp://"
+
+	udpMaxDatagram = 65535
+	// datagrams waiting to be read by a client session before dropping them
+	udpSessionQueue = 64
+	// new client sessions waiting to be accepted before dropping their datagrams
+	udpAcceptQueue = 16
+	// how long the datagrams of a client whose session has been refused are
+	// dropped, rather than each starting (and being refused) a session anew
+	udpRefusedHold = 10 * time.Second
+
+	// DefaultUDPTimeout is how long a UDP client session is kept without traffic by default.
+	DefaultUDPTimeout = time.Minute
+)
+
+func isUDPURL(addr string) bool {
+	return strings.HasPrefix(addr, udpScheme)
+}
+
+// appendFrame appends payload to dst as a single frame.
+func appendFrame(dst, payload []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(payload)))
+	return append(dst, payload...)
+}
+
+// frameWriter takes a stream of frames in arbitrary chunks and passes every
+// complete payload to send.
+type frameWriter struct {
+	buf  []byte
+	send func(payload []byte) error
+}
+
+func (w *frameWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for len(w.buf) >= 2 {
+		size := int(binary.BigEndian.Uint16(w.buf))
+		if len(w.buf) < 2+size {
+			break
+		}
+		if err := w.send(w.buf[2 : 2+size]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[2+size:]
+	}
+	// don't keep growing the buffer behind consumed frames
+	if len(w.buf) == 0 {
+		w.buf = w.buf[:0:0]
+	}
+	return len(b), nil
+}
+
+// udpListener accepts a stream connection for every client address sending
+// datagrams to it.
+type udpListener struct {
+	conn     net.PacketConn
+	timeout  time.Duration
+	accepted chan *udpSessionConn
+	done     chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	sessions map[string]*udpSessionConn
+	err      error
+	log      logrus.FieldLogger
+}
+
+func newUDPListener(conn net.PacketConn, timeout time.Duration, log logrus.FieldLogger) *udpListener {
+	l := &udpListener{
+		conn:     conn,
+		timeout:  timeout,
+		log:      log,
+		accepted: make(chan *udpSessionConn, udpAcceptQueue),
+		done:     make(chan struct{}),
+		sessions: make(map[string]*udpSessionConn),
+	}
+	go l.receive()
+	return l
+}
+
+// receive dispatches the incoming datagrams to the sessions of their senders.
+func (l *udpListener) receive() {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			l.Close()
+			return
+		}
+		payload := make([]byte, n)
+		copy(payload, buf[:n])
+
+		l.mu.Lock()
+		s, ok := l.sessions[addr.String()]
+		if !ok {
+			s = newUDPSessionConn(l, addr)
+			select {
+			case l.accepted <- s:
+				l.sessions[addr.String()] = s
+			default:
+				// too many sessions waiting to be accepted
+				l.log.Debugf("dropping datagram from %s: accept queue is full", addr)
+				l.mu.Unlock()
+				continue
+			}
+		}
+		l.mu.Unlock()
+		s.deliver(payload)
+	}
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.accepted:
+		return s, nil
+	case <-l.done:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *udpListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+	return nil
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *udpListener) remove(s *udpSessionConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sessions[s.addr.String()] == s {
+		delete(l.sessions, s.addr.String())
+	}
+}
+
+// udpSessionConn is the stream of the datagrams exchanged with a single
+// client address. It's closed once no datagram has passed it for the timeout
+// of the listener.
+type udpSessionConn struct {
+	l       *udpListener
+	addr    net.Addr
+	in      chan []byte
+	pending []byte
+	writer  frameWriter
+	idle    *time.Timer
+	closed  chan struct{}
+	once    sync.Once
+	// set by the first Read; a session closed before has been refused
+	read          atomic.Bool
+	readDeadline  chanDeadline
+	writeDeadline atomic.Pointer[time.Time]
+}
+
+func newUDPSessionConn(l *udpListener, addr net.Addr) *udpSessionConn {
+	s := &udpSessionConn{
+		l:      l,
+		addr:   addr,
+		in:     make(chan []byte, udpSessionQueue),
+		closed: make(chan struct{}),
+	}
+	s.writer.send = func(payload []byte) error {
+		s.idle.Reset(l.timeout)
+		_, err := l.conn.WriteTo(payload, addr)
+		return err
+	}
+	s.idle = time.AfterFunc(l.timeout, func() { s.Close() })
+	return s
+}
+
+func (s *udpSessionConn) deliver(payload []byte) {
+	select {
+	case <-s.closed:
+		// refused, held to drop what its client sends
+		return
+	default:
+	}
+	s.idle.Reset(s.l.timeout)
+	select {
+	case s.in <- payload:
+	case <-s.closed:
+	default:
+		s.l.log.Debugf("dropping datagram from %s: session is not keeping up", s.addr)
+	}
+}
+
+func (s *udpSessionConn) Read(b []byte) (int, error) {
+	s.read.Store(true)
+	for len(s.pending) == 0 {
+		timeout, deadlineSet, stop, err := s.readDeadline.wait()
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case payload := <-s.in:
+			stop()
+			s.pending = appendFrame(s.pending[:0], payload)
+		case <-s.closed:
+			stop()
+			return 0, net.ErrClosed
+		case <-s.l.done:
+			stop()
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-deadlineSet:
+			stop()
+		}
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *udpSessionConn) Write(b []byte) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	// sending a datagram doesn't wait, only a deadline gone by fails it
+	if t := s.writeDeadline.Load(); t != nil && !t.IsZero() && !time.Now().Before(*t) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return s.writer.Write(b)
+}
+
+// Close ends the session. One refused before it has been read from stays
+// with the listener for udpRefusedHold, swallowing the datagrams of its
+// client, so a client being refused doesn't get a session (and a log entry)
+// for every datagram it sends.
+func (s *udpSessionConn) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+		if s.read.Load() {
+			s.idle.Stop()
+			s.l.remove(s)
+			return
+		}
+		s.idle.Stop()
+		time.AfterFunc(udpRefusedHold, func() { s.l.remove(s) })
+	})
+	return nil
+}
+
+func (s *udpSessionConn) LocalAddr() net.Addr  { return s.l.conn.LocalAddr() }
+func (s *udpSessionConn) RemoteAddr() net.Addr { return s.addr }
+
+func (s *udpSessionConn) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *udpSessionConn) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+func (s *udpSessionConn) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.Store(&t)
+	return nil
+}
+
+// datagramConn frames the datagrams received on a connected UDP socket into
+// a stream, and sends the frames written to it as datagrams.
+type datagramConn struct {
+	net.Conn
+	buf     []byte
+	pending []byte
+	writer  frameWriter
+}
+
+func newDatagramConn(conn net.Conn) *datagramConn {
+	d := &datagramConn{Conn: conn, buf: make([]byte, udpMaxDatagram)}
+	d.writer.send = func(payload []byte) error {
+		_, err := conn.Write(payload)
+		return err
+	}
+	return d
+}
+
+func (d *datagramConn) Read(b []byte) (int, error) {
+	for len(d.pending) == 0 {
+		n, err := d.Conn.Read(d.buf)
+		if err != nil {
+			// a datagram refused by the target doesn't end the stream
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			return 0, err
+		}
+		d.pending = appendFrame(d.pending[:0], d.buf[:n])
+	}
+	n := copy(b, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *datagramConn) Write(b []byte) (int, error) {
+	return d.writer.Write(b)
+}
+
+// NetConn returns the UDP socket d is built on.
+func (d *datagramConn) NetConn() net.Conn {
+	return d.Conn
+}
+
+// listenUDP opens a udp:// listener.
+func (c *client) listenUDP(addr string) (net.Listener, error) {
+	var conn net.PacketConn
+	err := inNetns(c.listenNetns, func() (err error) {
+		conn, err = net.ListenPacket("udp", strings.TrimPrefix(addr, udpScheme))
+		return err
+	})
+	if err != nil {
+		return nil, bindError(fmt.Errorf("could not start listening: %w", err))
+	}
+	return newUDPListener(conn, c.udpTimeout, c.log), nil
+}
+
+// dialUDP connects a UDP socket to a udp:// target.
+func (c *client) dialUDP(target string) (net.Conn, error) {
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: c.dialTimeout, FallbackDelay: netnsFallbackDelay(c.dialNetns, c.fallbackDelay)}
+	err := inNetns(c.dialNetns, func() (err error) {
+		conn, err = dialer.Dial("udp", strings.TrimPrefix(target, udpScheme))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newDatagramConn(conn), nil
+}
@@ -0,0 +1,303 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/sirupsen/logrus"
+
+// udpPair returns a UDP listener on loopback and a socket sending to it.
+func udpPair(t *testing.T) (*udpListener, net.Conn) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newUDPListener(conn, time.Minute, logrus.New())
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		l.Close()
+	})
+	return l, client
+}
+
+// acceptWithin accepts the next session, nil if none comes within wait.
+func acceptWithin(l *udpListener, wait time.Duration) net.Conn {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		return conn
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+func TestUDPSessionReadDeadline(t *testing.T) {
+	l, client := udpPair(t)
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	session := acceptWithin(l, time.Second)
+	if session == nil {
+		t.Fatal("no session accepted")
+	}
+	buf := make([]byte, 64)
+	if n, err := session.Read(buf); err != nil || string(buf[2:n]) != "ping" {
+		t.Fatalf("read %q, %v, expected a frame of \"ping\"", buf[:n], err)
+	}
+
+	_ = session.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := session.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("idle read returned %v, expected a timeout", err)
+	}
+	// a datagram arriving after the deadline is moved is read
+	_ = session.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := session.Read(buf); err != nil || string(buf[2:n]) != "pong" {
+		t.Fatalf("read %q, %v after a timeout, expected a frame of \"pong\"", buf[:n], err)
+	}
+
+	_ = session.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := session.Write([]byte{0, 1, 'x'}); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write past the deadline returned %v, expected a timeout", err)
+	}
+}
+
+func TestUDPRefusedSessionHeld(t *testing.T) {
+	l, client := udpPair(t)
+	if _, err := client.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	session := acceptWithin(l, time.Second)
+	if session == nil {
+		t.Fatal("no session accepted")
+	}
+	// refused, like admit does
+	session.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := client.Write([]byte("again")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conn := acceptWithin(l, 200*time.Millisecond); conn != nil {
+		t.Fatal("refused client got a new session right away")
+	}
+	l.mu.Lock()
+	held := l.sessions[client.LocalAddr().String()] == session
+	l.mu.Unlock()
+	if !held {
+		t.Fatal("refused session isn't held by the listener")
+	}
+}
+
+func TestFrameWriter(t *testing.T) {
+	frame := func(payload string) string {
+		return string(appendFrame(nil, []byte(payload)))
+	}
+	tests := []struct {
+		// written in turn
+		chunks []string
+		sent   []string
+	}{
+		{[]string{frame("ping")}, []string{"ping"}},
+		{[]string{frame("ping") + frame("") + frame("pong")}, []string{"ping", "", "pong"}},
+		{[]string{frame("ping")[:1], frame("ping")[1:3], frame("ping")[3:]}, []string{"ping"}},
+		{[]string{frame("ping") + frame("pong")[:3], frame("pong")[3:]}, []string{"ping", "pong"}},
+		{[]string{frame("ping")[:5]}, nil},
+	}
+	for _, tt := range tests {
+		var sent []string
+		w := &frameWriter{send: func(payload []byte) error {
+			sent = append(sent, string(payload))
+			return nil
+		}}
+		for _, chunk := range tt.chunks {
+			if n, err := w.Write([]byte(chunk)); n != len(chunk) || err != nil {
+				t.Errorf("%q: wrote %d of %q, %v", tt.chunks, n, chunk, err)
+			}
+		}
+		if strings.Join(sent, "|") != strings.Join(tt.sent, "|") || len(sent) != len(tt.sent) {
+			t.Errorf("%q: sent %q, expected %q", tt.chunks, sent, tt.sent)
+		}
+	}
+}
+
+func TestUDPSessionTable(t *testing.T) {
+	tests := []struct {
+		name string
+		// datagrams sent by each client, in turn
+		sent [][]string
+	}{
+		{"one client", [][]string{{"a", "b", "c"}}},
+		{"clients apart", [][]string{{"a1", "a2"}, {"b1"}, {"c1", "c2", "c3"}}},
+		{"empty datagram", [][]string{{"", "x"}}},
+	}
+	for _, tt := range tests {
+		l, first := udpPair(t)
+		clients := []net.Conn{first}
+		for len(clients) < len(tt.sent) {
+			client, err := net.Dial("udp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			clients = append(clients, client)
+		}
+
+		for i, client := range clients {
+			for _, payload := range tt.sent[i] {
+				if _, err := client.Write([]byte(payload)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			session := acceptWithin(l, time.Second)
+			if session == nil {
+				t.Fatalf("%s: no session for client %d", tt.name, i)
+			}
+			if session.RemoteAddr().String() != client.LocalAddr().String() {
+				t.Errorf("%s: session of %s, expected %s", tt.name, session.RemoteAddr(), client.LocalAddr())
+			}
+			_ = session.SetReadDeadline(time.Now().Add(time.Second))
+			var expected []byte
+			for _, payload := range tt.sent[i] {
+				expected = appendFrame(expected, []byte(payload))
+			}
+			read := make([]byte, len(expected))
+			if _, err := io.ReadFull(session, read); err != nil || string(read) != string(expected) {
+				t.Errorf("%s: client %d read as %q, %v, expected %q", tt.name, i, read, err, expected)
+			}
+
+			// the reply goes back to the client alone
+			if _, err := session.Write(appendFrame(nil, []byte("reply"))); err != nil {
+				t.Fatal(err)
+			}
+			_ = client.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 64)
+			if n, err := client.Read(buf); err != nil || string(buf[:n]) != "reply" {
+				t.Errorf("%s: client %d got %q, %v, expected \"reply\"", tt.name, i, buf[:n], err)
+			}
+		}
+		if conn := acceptWithin(l, 50*time.Millisecond); conn != nil {
+			t.Errorf("%s: extra session from %s", tt.name, conn.RemoteAddr())
+		}
+		l.mu.Lock()
+		sessions := len(l.sessions)
+		l.mu.Unlock()
+		if sessions != len(clients) {
+			t.Errorf("%s: %d sessions, expected %d", tt.name, sessions, len(clients))
+		}
+	}
+}
+
+func TestUDPSessionIdle(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newUDPListener(conn, 100*time.Millisecond, logrus.New())
+	defer l.Close()
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	session := acceptWithin(l, time.Second)
+	if session == nil {
+		t.Fatal("no session accepted")
+	}
+	buf := make([]byte, 64)
+	if _, err = session.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	// nothing passes, the session ends and leaves the table
+	if _, err = session.Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("idle session read returned %v, expected it closed", err)
+	}
+	l.mu.Lock()
+	left := len(l.sessions)
+	l.mu.Unlock()
+	if left != 0 {
+		t.Fatalf("%d sessions left after the idle timeout", left)
+	}
+
+	// the client coming back gets a new one
+	if _, err = client.Write([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	renewed := acceptWithin(l, time.Second)
+	if renewed == nil || renewed == session {
+		t.Fatal("no new session for a client coming back")
+	}
+	renewed.Close()
+}
+
+func TestUDPAcceptQueueFull(t *testing.T) {
+	l, _ := udpPair(t)
+	for i := 0; i < udpAcceptQueue+4; i++ {
+		client, err := net.Dial("udp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if _, err = client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the datagrams of clients coming once the queue is full are dropped
+	deadline := time.Now().Add(time.Second)
+	for {
+		l.mu.Lock()
+		sessions := len(l.sessions)
+		l.mu.Unlock()
+		if sessions == udpAcceptQueue {
+			break
+		}
+		if sessions > udpAcceptQueue || time.Now().After(deadline) {
+			t.Fatalf("%d sessions waiting to be accepted, expected %d", sessions, udpAcceptQueue)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	l.mu.Lock()
+	sessions := len(l.sessions)
+	l.mu.Unlock()
+	if sessions != udpAcceptQueue {
+		t.Fatalf("%d sessions waiting to be accepted, expected %d", sessions, udpAcceptQueue)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const unixScheme = "unix://"
+
+func isUnixURL(addr string) bool {
+	return strings.HasPrefix(addr, unixScheme)
+}
+
+// unixPath returns the socket path of a unix:// address.
+func unixPath(addr string) string {
+	return strings.TrimPrefix(addr, unixScheme)
+}
+
+// removeStaleSocket removes a socket file left behind at path by a previous
+// instance. Anything else than a socket is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	// a socket somebody is still listening on must not be taken over
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// listenUnix opens a unix:// listener. The socket file is removed again when
+// the listener is closed.
+func (c *client) listenUnix(addr string) (net.Listener, error) {
+	if c.backlog > 0 || c.bpfProgram != nil || c.acceptFilter != "" {
+		return nil, configError(errors.New("backlog, BPF and accept filters are only supported on TCP listeners"))
+	}
+	var mode uint64
+	if c.unixMode != "" {
+		var err error
+		if mode, err = strconv.ParseUint(c.unixMode, 8, 32); err != nil || mode > 0777 {
+			return nil, configError(fmt.Errorf("invalid socket permissions %q", c.unixMode))
+		}
+	}
+	path := unixPath(addr)
+	if err := removeStaleSocket(path); err != nil {
+		return nil, bindError(fmt.Errorf("could not start listening: %w", err))
+	}
+	var listener net.Listener
+	err := inNetns(c.listenNetns, func() (err error) {
+		listener, err = c.listenConfig().Listen(context.Background(), "unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, bindError(fmt.Errorf("could not start listening: %w", err))
+	}
+	if c.unixMode != "" {
+		if err = os.Chmod(path, os.FileMode(mode)); err != nil {
+			listener.Close()
+			return nil, bindError(fmt.Errorf("could not set socket permissions: %w", err))
+		}
+	}
+	return listener, nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	UsageJSON = "json"
+	UsageCSV  = "csv"
+
+	usagePostTimeout = 30 * time.Second
+)
+
+var usageCSVHeader = []string{"client", "connections", "bytes_in", "bytes_out"}
+
+// usageConfig tells where per-client usage reports go.
+type usageConfig struct {
+	// report file, rewritten on every interval; totals are resumed from it
+	path   string
+	format string
+	// the report is also POSTed here when set
+	post     string
+	interval time.Duration
+	// HMAC-SHA256 key file signing the reports, unsigned when empty
+	keyFile string
+}
+
+func (u usageConfig) enabled() bool {
+	return u.path != "" || u.post != ""
+}
+
+// usageTotals are the transfer totals of a single client.
+type usageTotals struct {
+	Client      string `json:"client"`
+	Connections int64  `json:"connections"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+}
+
+type usageReport struct {
+	Generated time.Time      `json:"generated"`
+	Clients   []*usageTotals `json:"clients"`
+}
+
+// usageLedger accumulates the totals of closed connections by client IP.
+type usageLedger struct {
+	config  usageConfig
+	key     []byte
+	mu      sync.Mutex
+	clients map[string]*usageTotals
+}
+
+func newUsageLedger(config usageConfig) (*usageLedger, error) {
+	switch config.format {
+	case UsageJSON, UsageCSV:
+	default:
+		return nil, fmt.Errorf("unknown usage report format %q (json or csv)", config.format)
+	}
+	if config.interval <= 0 {
+		return nil, errors.New("the usage report interval has to be positive")
+	}
+	l := &usageLedger{config: config, clients: make(map[string]*usageTotals)}
+	if config.keyFile != "" {
+		key, err := os.ReadFile(config.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if l.key = bytes.TrimSpace(key); len(l.key) == 0 {
+			return nil, errors.New("empty usage report key")
+		}
+	}
+	if config.path != "" {
+		if err := l.resume(); err != nil {
+			return nil, fmt.Errorf("could not resume usage totals from %s: %w", config.path, err)
+		}
+	}
+	return l, nil
+}
+
+// resume loads the totals of a previous run from the report file.
+func (l *usageLedger) resume() error {
+	f, err := os.Open(l.config.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var clients []*usageTotals
+	if l.config.format == UsageJSON {
+		var report usageReport
+		if err = json.NewDecoder(f).Decode(&report); err != nil {
+			return err
+		}
+		clients = report.Clients
+	} else if clients, err = readUsageCSV(f); err != nil {
+		return err
+	}
+	for _, totals := range clients {
+		l.clients[totals.Client] = totals
+	}
+	return nil
+}
+
+func readUsageCSV(r io.Reader) ([]*usageTotals, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var clients []*usageTotals
+	for i, record := range records {
+		if i == 0 || len(record) != len(usageCSVHeader) {
+			continue
+		}
+		var values [3]int64
+		for j := range values {
+			if values[j], err = strconv.ParseInt(record[j+1], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+		}
+		clients = append(clients, &usageTotals{
+			Client:      record[0],
+			Connections: values[0],
+			BytesIn:     values[1],
+			BytesOut:    values[2],
+		})
+	}
+	return clients, nil
+}
+
+func (l *usageLedger) record(s *Session) {
+	client := s.clientAddr.String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	totals, ok := l.clients[client]
+	if !ok {
+		totals = &usageTotals{Client: client}
+		l.clients[client] = totals
+	}
+	totals.Connections++
+	totals.BytesIn += s.bytesIn.Load()
+	totals.BytesOut += s.bytesOut.Load()
+}
+
+// encode renders the current totals in the configured format.
+func (l *usageLedger) encode() ([]byte, error) {
+	l.mu.Lock()
+	report := usageReport{Generated: time.Now().UTC()}
+	for _, totals := range l.clients {
+		copied := *totals
+		report.Clients = append(report.Clients, &copied)
+	}
+	l.mu.Unlock()
+	sort.Slice(report.Clients, func(i, j int) bool {
+		return report.Clients[i].Client < report.Clients[j].Client
+	})
+
+	var buf bytes.Buffer
+	if l.config.format == UsageJSON {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(report)
+		return buf.Bytes(), err
+	}
+	w := csv.NewWriter(&buf)
+	_ = w.Write(usageCSVHeader)
+	for _, totals := range report.Clients {
+		_ = w.Write([]string{
+			totals.Client,
+			strconv.FormatInt(totals.Connections, 10),
+			strconv.FormatInt(totals.BytesIn, 10),
+			strconv.FormatInt(totals.BytesOut, 10),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func (l *usageLedger) sign(data []byte) string {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// report writes the totals to the report file, with the signature next to
+// it in <file>.sig, and POSTs them to the billing endpoint.
+func (l *usageLedger) report() error {
+	data, err := l.encode()
+	if err != nil {
+		return err
+	}
+	var signature string
+	if l.key != nil {
+		signature = l.sign(data)
+	}
+
+	if l.config.path != "" {
+		if err = writeFileAtomic(l.config.path, data); err != nil {
+			return err
+		}
+		if signature != "" {
+			if err = writeFileAtomic(l.config.path+".sig", []byte(signature+"\n")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if l.config.post != "" {
+		req, err := http.NewRequest(http.MethodPost, l.config.post, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if l.config.format == UsageCSV {
+			req.Header.Set("Content-Type", "text/csv")
+		}
+		if signature != "" {
+			req.Header.Set("X-Signature", "sha256="+signature)
+		}
+		client := &http.Client{Timeout: usagePostTimeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("usage report rejected: %s", resp.Status)
+		}
+	}
+	return nil
+}
+
+// reportUsage writes a report on every interval until stopping, the final
+// one is written by Run once the connections are drained.
+func (c *client) reportUsage() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.usage.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+		if err := c.usageLedger.report(); err != nil {
+			c.log.Errorf("could not write usage report: %s", err)
+		}
+	}
+}
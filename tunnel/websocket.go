@@ -0,0 +1,205 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+import "golang.org/x/net/websocket"
+
+// how long a client gets to send the HTTP request upgrading to WebSocket
+const webSocketHandshakeTimeout = 10 * time.Second
+
+func isWebSocketURL(addr string) bool {
+	return strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://")
+}
+
+// parseWebSocketURL returns the parsed ws:// or wss:// URL along with the
+// host:port to connect to or listen on.
+func parseWebSocketURL(rawURL string) (*url.URL, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Host == "" {
+		return nil, "", fmt.Errorf("missing host in %s", rawURL)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, addr, nil
+}
+
+// dialWebSocket connects to a ws:// or wss:// target and upgrades the
+// connection, which then carries the tunneled stream in binary messages.
+func (c *client) dialWebSocket(target string) (net.Conn, error) {
+	u, addr, err := parseWebSocketURL(target)
+	if err != nil {
+		return nil, err
+	}
+	// fronted, the CDN is connected to and named in TLS, the real host only
+	// showing up in the Host header inside
+	if c.frontDomain != "" {
+		_, port, _ := net.SplitHostPort(addr)
+		addr = net.JoinHostPort(c.frontDomain, port)
+	}
+	conn, err := c.dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = c.wrapDialed(conn, addr); err != nil {
+		return nil, err
+	}
+	origin := "http://" + u.Host + "/"
+	config, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(webSocketHandshakeTimeout))
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake with %s failed: %w", u, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// webSocketListener accepts the WebSocket connections upgraded on a path of
+// an HTTP server running on listener.
+type webSocketListener struct {
+	listener net.Listener
+	server   *http.Server
+	accepted chan *webSocketConn
+	done     chan struct{}
+	once     sync.Once
+	err      error
+}
+
+func newWebSocketListener(listener net.Listener, path string) *webSocketListener {
+	l := &webSocketListener{
+		listener: listener,
+		accepted: make(chan *webSocketConn),
+		done:     make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{
+		Handler: l.handle,
+		// clients of a tunnel aren't browsers, any origin (or none) is fine
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+	})
+	l.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: webSocketHandshakeTimeout,
+	}
+	go func() {
+		l.err = l.server.Serve(listener)
+		l.Close()
+	}()
+	return l
+}
+
+// handle passes an upgraded connection to Accept and keeps it open until it's
+// closed, as returning closes it.
+func (l *webSocketListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &webSocketConn{Conn: ws, closed: make(chan struct{})}
+	req := ws.Request()
+	if addrPort, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+		conn.remoteAddr = net.TCPAddrFromAddrPort(addrPort)
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.localAddr = addr
+	}
+	select {
+	case l.accepted <- conn:
+	case <-l.done:
+		return
+	}
+	<-conn.closed
+}
+
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		if l.err != nil && !errors.Is(l.err, http.ErrServerClosed) {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *webSocketListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.server.Close()
+	})
+	return nil
+}
+
+func (l *webSocketListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// webSocketConn is a connection accepted by a webSocketListener, reporting
+// the addresses of the underlying connection instead of URLs.
+type webSocketConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	closed     chan struct{}
+	once       sync.Once
+}
+
+func (w *webSocketConn) Close() error {
+	err := w.Conn.Close()
+	w.once.Do(func() { close(w.closed) })
+	return err
+}
+
+func (w *webSocketConn) RemoteAddr() net.Addr {
+	if w.remoteAddr != nil {
+		return w.remoteAddr
+	}
+	return w.Conn.RemoteAddr()
+}
+
+func (w *webSocketConn) LocalAddr() net.Addr {
+	if w.localAddr != nil {
+		return w.localAddr
+	}
+	return w.Conn.LocalAddr()
+}
@@ -0,0 +1,174 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import "tcptunnel/tunnel"
+
+// rateValue is a flag taking a number of events per second, or per
+// some other period as in 50/s, 3000/m or 100/10s.
+type rateValue float64
+
+func (r *rateValue) String() string {
+	return strconv.FormatFloat(float64(*r), 'g', -1, 64)
+}
+
+func (r *rateValue) Set(s string) error {
+	count, per, found := strings.Cut(s, "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+		return fmt.Errorf("invalid rate %q", s)
+	}
+	if !found {
+		*r = rateValue(n)
+		return nil
+	}
+	// a bare unit means one of it
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid rate %q: bad period %q", s, per)
+	}
+	*r = rateValue(n / d.Seconds())
+	return nil
+}
+
+// bandwidthValue is a flag taking bytes per second, as a plain number or
+// with a unit as in 10mbit, 500kbit, 2MB or 64KB (powers of 1000).
+type bandwidthValue int64
+
+func (b *bandwidthValue) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *bandwidthValue) Set(s string) error {
+	v := strings.TrimSuffix(strings.ToLower(s), "/s")
+	bits := strings.HasSuffix(v, "bit")
+	n, err := parseSize(strings.TrimSuffix(v, "bit"))
+	if err != nil {
+		return fmt.Errorf("invalid bandwidth %q", s)
+	}
+	if bits {
+		n /= 8
+	}
+	*b = bandwidthValue(n)
+	return nil
+}
+
+// sizeValue is a flag taking a number of bytes, as a plain number or with
+// a unit as in 5G, 100MB or 64k (powers of 1000).
+type sizeValue int64
+
+func (z *sizeValue) String() string {
+	return strconv.FormatInt(int64(*z), 10)
+}
+
+func (z *sizeValue) Set(s string) error {
+	n, err := parseSize(strings.ToLower(s))
+	if err != nil {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*z = sizeValue(n)
+	return nil
+}
+
+// parseSize parses a lower case number with an optional k, m, g or t
+// prefix and b suffix.
+func parseSize(v string) (float64, error) {
+	v = strings.TrimSuffix(v, "b")
+	scale := 1.0
+	if v != "" {
+		switch v[len(v)-1] {
+		case 'k':
+			scale = 1e3
+		case 'm':
+			scale = 1e6
+		case 'g':
+			scale = 1e9
+		case 't':
+			scale = 1e12
+		}
+		if scale > 1 {
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative size %q", v)
+	}
+	// NaN fails every comparison, so check for what fits instead
+	if !(n*scale < math.MaxInt64) {
+		return 0, fmt.Errorf("size %q out of range", v)
+	}
+	return n * scale, nil
+}
+
+// identityLimitsValue is a flag taking comma separated limits of single
+// identities as <identity>=<sessions>[@<rate>], as in alice=10@5/s. Either
+// may be 0 for unlimited.
+type identityLimitsValue map[string]tunnel.IdentityLimit
+
+func (v *identityLimitsValue) String() string {
+	if v == nil || len(*v) == 0 {
+		return ""
+	}
+	limits := make([]string, 0, len(*v))
+	for identity, limit := range *v {
+		limits = append(limits, fmt.Sprintf("%s=%d@%s", identity, limit.MaxConns, strconv.FormatFloat(limit.Rate, 'g', -1, 64)))
+	}
+	sort.Strings(limits)
+	return strings.Join(limits, ",")
+}
+
+func (v *identityLimitsValue) Set(s string) error {
+	limits := make(map[string]tunnel.IdentityLimit)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		identity, limit, ok := strings.Cut(item, "=")
+		if !ok || identity == "" {
+			return fmt.Errorf("invalid identity limit %q, expected <identity>=<sessions>[@<rate>]", item)
+		}
+		sessions, perSecond, hasRate := strings.Cut(limit, "@")
+		n, err := strconv.Atoi(sessions)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number of sessions in %q", item)
+		}
+		var r rateValue
+		if hasRate {
+			if err = r.Set(perSecond); err != nil {
+				return err
+			}
+		}
+		limits[identity] = tunnel.IdentityLimit{MaxConns: n, Rate: float64(r)}
+	}
+	*v = limits
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 Mohammad Hadi Hosseinpour
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import "testing"
+
+func TestRateValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"50", 50, true},
+		{"0.5", 0.5, true},
+		{"0", 0, true},
+		{"50/s", 50, true},
+		{"3000/m", 50, true},
+		{"100/10s", 10, true},
+		{"7200/h", 2, true},
+		{"1/500ms", 2, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"-1/s", 0, false},
+		{"fast", 0, false},
+		{"nan", 0, false},
+		{"inf/s", 0, false},
+		{"1e400", 0, false},
+		{"50/", 0, false},
+		{"50/0s", 0, false},
+		{"50/-1s", 0, false},
+		{"50/fortnight", 0, false},
+		{"/s", 0, false},
+	}
+	for _, tt := range tests {
+		var r rateValue
+		err := r.Set(tt.in)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("set %q as %v, expected an error", tt.in, float64(r))
+			}
+			continue
+		}
+		if err != nil || float64(r) != tt.want {
+			t.Errorf("set %q as %v, %v, expected %v", tt.in, float64(r), err, tt.want)
+		}
+	}
+}
+
+func TestBandwidthValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"1000", 1000, true},
+		{"10mbit", 1250000, true},
+		{"500kbit/s", 62500, true},
+		{"2MB", 2000000, true},
+		{"64KB/s", 64000, true},
+		{"1Gbit", 125000000, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"/s", 0, false},
+		{"-1mbit", 0, false},
+		{"10mib", 0, false},
+		{"fast", 0, false},
+		{"nanbit", 0, false},
+		{"infMB", 0, false},
+		{"1e30", 0, false},
+	}
+	for _, tt := range tests {
+		var b bandwidthValue
+		err := b.Set(tt.in)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("set %q as %d, expected an error", tt.in, int64(b))
+			}
+			continue
+		}
+		if err != nil || int64(b) != tt.want {
+			t.Errorf("set %q as %d, %v, expected %d", tt.in, int64(b), err, tt.want)
+		}
+	}
+}
+
+func TestSizeValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"1024", 1024, true},
+		{"64k", 64000, true},
+		{"100MB", 100000000, true},
+		{"5G", 5000000000, true},
+		{"1.5t", 1500000000000, true},
+		{"2b", 2, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"k", 0, false},
+		{"-5G", 0, false},
+		{"5GiB", 0, false},
+		{"5x", 0, false},
+		{"nan", 0, false},
+		{"inf", 0, false},
+		{"1e400", 0, false},
+		{"10000000t", 0, false},
+	}
+	for _, tt := range tests {
+		var z sizeValue
+		err := z.Set(tt.in)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("set %q as %d, expected an error", tt.in, int64(z))
+			}
+			continue
+		}
+		if err != nil || int64(z) != tt.want {
+			t.Errorf("set %q as %d, %v, expected %d", tt.in, int64(z), err, tt.want)
+		}
+	}
+}